@@ -0,0 +1,73 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/index"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
+
+	"github.com/spf13/cobra"
+)
+
+// indexCmd represents the index command
+var indexCmd = &cobra.Command{
+	Use:   "index",
+	Short: "Parse all MRF files listed in a table of contents (index) file. Output is a parquet fileset per file.",
+	Long: `Parse all MRF files listed in a table of contents (index) file. Output is a parquet fileset per file.
+
+- Input is a table of contents JSON file. Can be located at a local, HTTP, S3, or GCS path. 
+  Supports GZIPed files.
+- A plans table, plans.zstd.parquet, is written to the output path. It relates each plan to its files.
+- Each unique in-network (and optionally, allowed-amount) file is parsed to output/<file_id>.
+
+Plan fields are populated from the index file for files reported for a single plan.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		inputPath, err := cmd.Flags().GetString("input")
+		utils.ExitOnError(err)
+
+		outputPath, err := cmd.Flags().GetString("output")
+		utils.ExitOnError(err)
+
+		serviceFile, err := cmd.Flags().GetString("services")
+		utils.ExitOnError(err)
+
+		allowedAmounts, err := cmd.Flags().GetBool("allowed-amounts")
+		utils.ExitOnError(err)
+
+		fn := func() { err = index.Crawl(cmd.Context(), inputPath, outputPath, serviceFile, allowedAmounts) }
+
+		elapsed := utils.Timed(fn)
+		utils.ExitOnError(err)
+
+		log.Infof("Completed in %d seconds", elapsed)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(indexCmd)
+
+	indexCmd.Flags().StringP("input", "i", "", "Input path to table of contents JSON file. Can be a local, HTTP, S3, or GCS path. Supports GZIPed files.")
+	err := indexCmd.MarkFlagRequired("input")
+	utils.ExitOnError(err)
+
+	indexCmd.Flags().StringP("output", "o", "", "Output path for the plans table and parsed MRF filesets in parquet format")
+	err = indexCmd.MarkFlagRequired("output")
+	utils.ExitOnError(err)
+
+	indexCmd.Flags().StringVarP(&servicesFile, "services", "s", "", "Path to a CSV file containing a list of service billing codes to filter on")
+
+	indexCmd.Flags().Bool("allowed-amounts", true, "Also parse allowed-amount files")
+}
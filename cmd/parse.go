@@ -44,9 +44,16 @@ parseMrf outputs a parquet fileset. See README for schema.`,
 		planID, err := cmd.Flags().GetInt64("planid")
 		utils.ExitOnError(err)
 
-		fn := func() { mrf.Parse(inputPath, outputPath, planID, serviceFile) }
+		opts, err := parserOptions(cmd)
+		utils.ExitOnError(err)
+
+		fn := func() {
+			err = mrf.Parse(cmd.Context(), inputPath, outputPath, planFromID(planID), serviceFile, opts...)
+		}
 
 		elapsed := utils.Timed(fn)
+		utils.ExitOnError(err)
+
 		log.Infof("Completed in %d seconds", elapsed)
 	},
 }
@@ -62,9 +69,37 @@ func init() {
 	err = parseCmd.MarkFlagRequired("output")
 	utils.ExitOnError(err)
 
-	parseCmd.Flags().StringVarP(&servicesFile, "services", "s", "", "path to a CSV file containing a list of CPT/HCPCS service codes to filter on")
+	parseCmd.Flags().StringVarP(&servicesFile, "services", "s", "", "path to a CSV file containing a list of service billing codes to filter on")
 
 	parseCmd.Flags().Int64P("planid", "p", -1, "the planid acquired from the index file")
 	err = parseCmd.MarkFlagRequired("planid")
 	utils.ExitOnError(err)
+
+	parseCmd.Flags().Bool("rate-facts", false, "Output a rate_fact row per billing code, price and provider NPI in place of the in_network and provider records")
+	parseCmd.Flags().Bool("resume", false, "Resume a failed parse from the checkpoint in the output path")
+}
+
+// parserOptions returns the parser options set by cmd's flags
+func parserOptions(cmd *cobra.Command) ([]mrf.ParserOption, error) {
+	var opts []mrf.ParserOption
+
+	rateFacts, err := cmd.Flags().GetBool("rate-facts")
+	if err != nil {
+		return nil, err
+	}
+
+	if rateFacts {
+		opts = append(opts, mrf.WithRateFacts())
+	}
+
+	resume, err := cmd.Flags().GetBool("resume")
+	if err != nil {
+		return nil, err
+	}
+
+	if resume {
+		opts = append(opts, mrf.WithResume())
+	}
+
+	return opts, nil
 }
@@ -20,6 +20,7 @@ import (
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // pipelineCmd represents the pipeline command
@@ -34,7 +35,10 @@ var pipelineCmd = &cobra.Command{
 
 Requires a services file containing a list of CPT/HCPCS service codes to filter on. Typically, we'd use the CMS 500 Shoppable Services list.
 
-Plan ID is acquired from the carrier's Index file.`,
+Plan ID is acquired from the carrier's Index file.
+
+With --stream, the file is parsed in a single pass as it is downloaded, rather than being downloaded and split
+into temporary files first. This requires far less disk space for very large files.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		inputPath, err := cmd.Flags().GetString("input")
 		utils.ExitOnError(err)
@@ -48,8 +52,22 @@ Plan ID is acquired from the carrier's Index file.`,
 		planID, err := cmd.Flags().GetInt64("planid")
 		utils.ExitOnError(err)
 
-		p := pipeline.NewParsePipeline(inputPath, outputPath, serviceFile, planID)
-		p.Run()
+		stream, err := cmd.Flags().GetBool("stream")
+		utils.ExitOnError(err)
+
+		opts, err := parserOptions(cmd)
+		utils.ExitOnError(err)
+
+		var p *pipeline.Pipeline
+		if stream {
+			p = pipeline.NewStreamParsePipeline(inputPath, outputPath, serviceFile, planFromID(planID), opts...)
+		} else {
+			p, err = pipeline.NewParsePipeline(inputPath, outputPath, serviceFile, planFromID(planID), opts...)
+			utils.ExitOnError(err)
+		}
+
+		err = p.Run(cmd.Context())
+		utils.ExitOnError(err)
 	},
 }
 
@@ -64,9 +82,17 @@ func init() {
 	err = pipelineCmd.MarkFlagRequired("output")
 	utils.ExitOnError(err)
 
-	pipelineCmd.Flags().StringVarP(&servicesFile, "services", "s", "", "Path to a CSV file containing a list of CPT/HCPCS service codes to filter on")
+	pipelineCmd.Flags().StringVarP(&servicesFile, "services", "s", "", "Path to a CSV file containing a list of service billing codes to filter on")
 
 	pipelineCmd.Flags().Int64P("planid", "p", -1, "The planid acquired from the index file")
 	err = pipelineCmd.MarkFlagRequired("planid")
 	utils.ExitOnError(err)
+
+	pipelineCmd.Flags().Bool("stream", false, "Parse the MRF file in a single pass without downloading and splitting it first")
+	pipelineCmd.Flags().Bool("rate-facts", false, "Output a rate_fact row per billing code, price and provider NPI in place of the in_network and provider records. Not supported with --stream")
+	pipelineCmd.Flags().Bool("resume", false, "Resume a failed parse from the checkpoint in the output path. The file is split again. Not supported with --stream")
+	pipelineCmd.Flags().Int("download-segments", 1, "Download the MRF file with this many concurrent Range requests. Not supported with --stream")
+
+	err = viper.BindPFlag("pipeline.download_segments", pipelineCmd.Flags().Lookup("download-segments"))
+	utils.ExitOnError(err)
 }
@@ -16,10 +16,15 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
 	"os"
+	"os/signal"
 	"runtime/pprof"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -72,20 +77,71 @@ Input and Output paths can be local filesytem paths or AWS S3 and Google Cloud S
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+//
+// The commands' context is cancelled on SIGINT or SIGTERM, so that a run stops gracefully and
+// closes the parquet file being written. A second signal terminates immediately.
 func Execute() {
-	err := rootCmd.Execute()
+	err := rootCmd.ExecuteContext(signalContext())
 
 	if err != nil {
 		os.Exit(1)
 	}
 }
 
+// signalContext returns a context that is cancelled when SIGINT or SIGTERM is received. The default
+// signal behaviour is restored once the context is cancelled.
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		s := <-sig
+		signal.Stop(sig)
+
+		utils.GetLogger().Warnf("Received %s. Shutting down, send again to terminate immediately.", s)
+		cancel()
+	}()
+
+	return ctx
+}
+
 func init() {
 	cobra.OnInitialize(initConfig)
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default config.yaml)")
 	rootCmd.PersistentFlags().StringVar(&memProfileFile, "memprofile", "", "Write memory profile to this file")
 	rootCmd.PersistentFlags().StringVar(&cpuProfileFile, "cpuprofile", "", "Write CPU profile to this file")
+	rootCmd.PersistentFlags().String("format", "parquet",
+		"Output format: parquet, gzip compressed csv or ndjson, neo4j for neo4j-admin import CSVs, a sqlite database, or postgres")
+
+	rootCmd.PersistentFlags().String("layout", "wide",
+		"Output layout: wide, a single table, or normalized, a table per record type")
+
+	rootCmd.PersistentFlags().String("schema", "string",
+		"Parquet column schema: string, dates and amounts as found in the MRF, or typed, dates as DATE and amounts as DECIMAL(18,4)")
+
+	rootCmd.PersistentFlags().StringSlice("partition-by", nil,
+		"Columns to partition the parquet output on, written to key=value directories (e.g. reporting_entity_name,record_type)")
+
+	rootCmd.PersistentFlags().String("table-format", "",
+		"Commit the parquet output to a table format once written: delta, or empty for a bare parquet fileset")
+
+	err := viper.BindPFlag("writer.format", rootCmd.PersistentFlags().Lookup("format"))
+	utils.ExitOnError(err)
+
+	err = viper.BindPFlag("writer.layout", rootCmd.PersistentFlags().Lookup("layout"))
+	utils.ExitOnError(err)
+
+	err = viper.BindPFlag("writer.schema", rootCmd.PersistentFlags().Lookup("schema"))
+	utils.ExitOnError(err)
+
+	err = viper.BindPFlag("writer.table_format", rootCmd.PersistentFlags().Lookup("table-format"))
+	utils.ExitOnError(err)
+
+	err = viper.BindPFlag("writer.partition_by", rootCmd.PersistentFlags().Lookup("partition-by"))
+	utils.ExitOnError(err)
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -111,3 +167,12 @@ func initConfig() {
 	// Initialize or update logger with level from ENV or config
 	log = utils.GetLogger()
 }
+
+// planFromID returns a plan that overrides the plan_id of the root record, or nil if planID is -1.
+func planFromID(planID int64) *models.Plan {
+	if planID == -1 {
+		return nil
+	}
+
+	return &models.Plan{PlanID: strconv.FormatInt(planID, 10)}
+}
@@ -39,9 +39,11 @@ The input JSON file can be gzipped and may be located on the local filesystem or
 		overwrite, err := cmd.Flags().GetBool("overwrite")
 		utils.ExitOnError(err)
 
-		fn := func() { split.File(inputPath, outputPath, overwrite) }
+		fn := func() { err = split.File(cmd.Context(), inputPath, outputPath, overwrite) }
 
 		elapsed := utils.Timed(fn)
+		utils.ExitOnError(err)
+
 		log.Infof("Completed in %d seconds", elapsed)
 	},
 }
@@ -16,6 +16,7 @@ limitations under the License.
 package cloud
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
@@ -24,15 +25,22 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"cloud.google.com/go/storage"
 	"gocloud.dev/blob"
 	_ "gocloud.dev/blob/fileblob" // required by CDK as blob driver
 	_ "gocloud.dev/blob/gcsblob"  // required by CDK as blob driver
 	_ "gocloud.dev/blob/s3blob"   // required by CDK as blob driver
+	"gocloud.dev/gcerrors"
 )
 
 var log = utils.GetLogger()
 
+// writeSettleTime is how long WriteIfNotExist waits before reading back an object written without a
+// conditional write, so that a concurrent writer that checked for the object at the same time has written it
+var writeSettleTime = 2 * time.Second
+
 // OpenBucket opens a blob storage bucket at the URI. Context can be used to cancel any operations.
 // Google CDK is used to support both AWS S3 and Google Cloud Storage. Use the correct URI scheme to
 // specify the storage provider (gs:// or s3://).
@@ -140,12 +148,12 @@ func Glob(ctx context.Context, uri, pattern string) ([]string, error) {
 		return nil, err
 	}
 
-	b, err := OpenBucket(context.Background(), uri)
+	b, err := OpenBucket(ctx, uri)
 	if err != nil {
 		return nil, err
 	}
 
-	iter := b.List(&blob.ListOptions{Prefix: u.Path})
+	iter := b.List(&blob.ListOptions{Prefix: strings.TrimLeft(u.Path, "/")})
 
 	for {
 		obj, err := iter.Next(ctx)
@@ -161,7 +169,7 @@ func Glob(ctx context.Context, uri, pattern string) ([]string, error) {
 		log.Debugf("Key is %s", k)
 
 		if matched, _ := filepath.Match(pattern, k); matched {
-			matches = append(matches, u.Scheme+u.Host+"/"+obj.Key)
+			matches = append(matches, u.Scheme+"://"+u.Host+"/"+obj.Key)
 		}
 	}
 	log.Debugf("Found %d matches for %s", len(matches), pattern)
@@ -169,6 +177,280 @@ func Glob(ctx context.Context, uri, pattern string) ([]string, error) {
 	return matches, nil
 }
 
+// FileAttributes are the attributes of a file or cloud storage object
+type FileAttributes struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Attributes returns the size and modification time of the file or object at uri.
+// Google Cloud Storage, AWS S3, and local filesystem URIs are supported.
+func Attributes(ctx context.Context, uri string) (*FileAttributes, error) {
+	if !IsCloudURI(uri) {
+		fi, err := os.Stat(uri)
+		if err != nil {
+			return nil, err
+		}
+
+		return &FileAttributes{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+	}
+
+	_, _, k, err := ParseBlobURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := OpenBucket(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	defer b.Close()
+
+	attrs, err := b.Attributes(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileAttributes{Size: attrs.Size, ModTime: attrs.ModTime}, nil
+}
+
+// Exists reports whether the file or object at uri exists.
+// Google Cloud Storage, AWS S3, and local filesystem URIs are supported.
+func Exists(ctx context.Context, uri string) (bool, error) {
+	if !IsCloudURI(uri) {
+		_, err := os.Stat(uri)
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return err == nil, err
+	}
+
+	_, _, k, err := ParseBlobURI(uri)
+	if err != nil {
+		return false, err
+	}
+
+	b, err := OpenBucket(ctx, uri)
+	if err != nil {
+		return false, err
+	}
+
+	defer b.Close()
+
+	return b.Exists(ctx, k)
+}
+
+// WriteIfNotExist writes data to uri, returning an error wrapping os.ErrExist if the file or object already
+// exists. On the local filesystem, the file is written to a temporary file and then linked to uri, so that
+// the check and the write are atomic. On Google Cloud Storage, the object is written on condition that it
+// doesn't exist, which is also atomic.
+//
+// Conditional writes to S3 aren't supported by the driver used here, so other cloud URIs are checked for
+// before they're written, and read back once written. Should a concurrent writer have replaced the object,
+// an error wrapping os.ErrExist is returned, as it would be had the writer written it first. A concurrent
+// write after the object is read back isn't detected, so concurrent writers should still be avoided.
+func WriteIfNotExist(ctx context.Context, uri string, data []byte) error {
+	if !IsCloudURI(uri) {
+		return writeLocalIfNotExist(uri, data)
+	}
+
+	scheme, _, k, err := ParseBlobURI(uri)
+	if err != nil {
+		return err
+	}
+
+	b, err := OpenBucket(ctx, uri)
+	if err != nil {
+		return err
+	}
+
+	defer b.Close()
+
+	return writeBucketIfNotExist(ctx, b, uri, scheme == "gs", k, data)
+}
+
+// writeBucketIfNotExist writes data to key of bucket b, at uri, as WriteIfNotExist does. conditional is set if
+// b supports Google Cloud Storage's conditional writes.
+func writeBucketIfNotExist(ctx context.Context, b *blob.Bucket, uri string, conditional bool, k string, data []byte) error {
+	exists := &os.PathError{Op: "write", Path: uri, Err: os.ErrExist}
+
+	if conditional {
+		err := b.WriteAll(ctx, k, data, &blob.WriterOptions{BeforeWrite: ifNotExist})
+		if gcerrors.Code(err) == gcerrors.FailedPrecondition {
+			return exists
+		}
+
+		return err
+	}
+
+	ok, err := b.Exists(ctx, k)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		return exists
+	}
+
+	err = b.WriteAll(ctx, k, data, nil)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(writeSettleTime):
+	}
+
+	written, err := b.ReadAll(ctx, k)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(written, data) {
+		log.Warnf("%s was written by a concurrent writer", uri)
+		return exists
+	}
+
+	return nil
+}
+
+// ifNotExist is a blob.WriterOptions.BeforeWrite setting the precondition that a Google Cloud Storage object
+// doesn't exist
+func ifNotExist(as func(any) bool) error {
+	var obj **storage.ObjectHandle
+
+	if as(&obj) {
+		*obj = (*obj).If(storage.Conditions{DoesNotExist: true})
+	}
+
+	return nil
+}
+
+func writeLocalIfNotExist(path string, data []byte) error {
+	dir := filepath.Dir(path)
+
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := os.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Unable to remove %s: %s", f.Name(), err.Error())
+		}
+	}()
+
+	_, err = f.Write(data)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	// Link fails if path exists
+	return os.Link(f.Name(), path)
+}
+
+// WriteFile writes data to uri, replacing any existing file or object. On the local filesystem, the file is
+// written to a temporary file and then renamed to uri, so that readers never see a partially written file.
+// Cloud storage objects are only visible once fully written.
+func WriteFile(ctx context.Context, uri string, data []byte) error {
+	if !IsCloudURI(uri) {
+		return writeLocalFile(uri, data)
+	}
+
+	_, _, k, err := ParseBlobURI(uri)
+	if err != nil {
+		return err
+	}
+
+	b, err := OpenBucket(ctx, uri)
+	if err != nil {
+		return err
+	}
+
+	defer b.Close()
+
+	return b.WriteAll(ctx, k, data, nil)
+}
+
+func writeLocalFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Close()
+	} else {
+		_ = f.Close()
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+// Remove removes the file or object at uri. It is not an error if uri doesn't exist.
+// Google Cloud Storage, AWS S3, and local filesystem URIs are supported.
+func Remove(ctx context.Context, uri string) error {
+	if !IsCloudURI(uri) {
+		err := os.Remove(uri)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	_, _, k, err := ParseBlobURI(uri)
+	if err != nil {
+		return err
+	}
+
+	b, err := OpenBucket(ctx, uri)
+	if err != nil {
+		return err
+	}
+
+	defer b.Close()
+
+	err = b.Delete(ctx, k)
+	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		return err
+	}
+
+	return nil
+}
+
 // ParseBlobURI parses a URI into its scheme, bucket, and key components.
 func ParseBlobURI(uri string) (scheme, bucket, key string, err error) {
 	u, err := url.Parse(uri)
@@ -31,9 +31,14 @@ limitations under the License.
 package cloud
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob/memblob"
 )
 
 func TestIsCloudURITrue(t *testing.T) {
@@ -77,3 +82,90 @@ func TestParseBlobUriFS(t *testing.T) {
 	require.Equal(t, expectedBucket, actualBucket)
 	require.Equal(t, expectedKey, actualKey)
 }
+
+func TestWriteIfNotExist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log", "00000000000000000000.json")
+
+	err := WriteIfNotExist(context.Background(), path, []byte("first"))
+	require.NoError(t, err)
+
+	err = WriteIfNotExist(context.Background(), path, []byte("second"))
+	require.ErrorIs(t, err, os.ErrExist)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "first", string(data))
+
+	// the temporary file is removed
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	attrs, err := Attributes(context.Background(), path)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), attrs.Size)
+}
+
+// objects written without a conditional write are read back, so that an object replaced by a concurrent
+// writer is detected
+func TestWriteBucketIfNotExist(t *testing.T) {
+	defer func(d time.Duration) { writeSettleTime = d }(writeSettleTime)
+
+	var (
+		ctx = context.Background()
+		b   = memblob.OpenBucket(nil)
+		key = "log/00000000000000000000.json"
+	)
+
+	defer b.Close()
+
+	writeSettleTime = 0
+
+	err := writeBucketIfNotExist(ctx, b, "s3://bucket/"+key, false, key, []byte("first"))
+	require.NoError(t, err)
+
+	err = writeBucketIfNotExist(ctx, b, "s3://bucket/"+key, false, key, []byte("second"))
+	require.ErrorIs(t, err, os.ErrExist)
+
+	// a concurrent writer replaces the object before it is read back
+	require.NoError(t, b.Delete(ctx, key))
+
+	writeSettleTime = 500 * time.Millisecond
+
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		_ = b.WriteAll(ctx, key, []byte("concurrent"), nil)
+	}()
+
+	err = writeBucketIfNotExist(ctx, b, "s3://bucket/"+key, false, key, []byte("third"))
+	require.ErrorIs(t, err, os.ErrExist)
+
+	data, err := b.ReadAll(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, "concurrent", string(data))
+}
+
+func TestWriteFileExistsRemove(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a", "checkpoint.json")
+
+	require.NoError(t, WriteFile(context.Background(), path, []byte("a longer first write")))
+	require.NoError(t, WriteFile(context.Background(), path, []byte("second")))
+
+	// the file is replaced rather than overwritten in place
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "second", string(data))
+
+	ok, err := Exists(context.Background(), path)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	require.NoError(t, Remove(context.Background(), path))
+	require.NoError(t, Remove(context.Background(), path))
+	require.NoFileExists(t, path)
+
+	ok, err = Exists(context.Background(), path)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
@@ -0,0 +1,275 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package delta commits parquet files to Delta Lake tables by writing their _delta_log. Files only become
+// visible to Delta readers once a commit adding them has been written, so readers never see files from
+// incomplete or failed writes.
+package delta
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
+
+	"github.com/segmentio/parquet-go"
+)
+
+// LogDir is the directory of a table's log, relative to the table's root
+const LogDir = "_delta_log"
+
+// maxCommitAttempts is the number of versions tried before giving up on a commit, should concurrent
+// writers commit the same versions
+const maxCommitAttempts = 10
+
+var (
+	log = utils.GetLogger()
+
+	commitFile = regexp.MustCompile(`^(\d{20})\.json$`)
+)
+
+// Table is a Delta table whose root is at URI, with the schema of its parquet files
+type Table struct {
+	URI              string
+	Schema           *parquet.Schema
+	PartitionColumns []string
+}
+
+// DataFile is a parquet file to be added to a table
+type DataFile struct {
+	// Path is the path of the file relative to the table's root, using / as a separator
+	Path string
+	// PartitionValues are the values of the table's partition columns. Missing columns are null.
+	PartitionValues  map[string]string
+	Size             int64
+	ModificationTime time.Time
+	NumRecords       int64
+}
+
+// Commit adds files to table in a new version of its log, creating the table if need be, and returns the
+// version committed. If another writer commits the same version first, Commit retries with the next version.
+func Commit(ctx context.Context, table Table, files []DataFile) (int64, error) {
+	logURI := cloud.JoinURI(table.URI, LogDir)
+
+	for attempt := 0; attempt < maxCommitAttempts; attempt++ {
+		current, err := latestVersion(ctx, logURI)
+		if err != nil {
+			return 0, err
+		}
+
+		version := current + 1
+
+		data, err := commitActions(table, files, version == 0, time.Now())
+		if err != nil {
+			return 0, err
+		}
+
+		err = cloud.WriteIfNotExist(ctx, cloud.JoinURI(logURI, fmt.Sprintf("%020d.json", version)), data)
+		if errors.Is(err, os.ErrExist) {
+			log.Warnf("Version %d of %s was committed by another writer. Retrying.", version, table.URI)
+			continue
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		log.Infof("Committed version %d of %s, adding %d files", version, table.URI, len(files))
+
+		return version, nil
+	}
+
+	return 0, fmt.Errorf("unable to commit to %s after %d attempts", table.URI, maxCommitAttempts)
+}
+
+// latestVersion returns the latest version in the log at logURI, or -1 if the table has no log
+func latestVersion(ctx context.Context, logURI string) (int64, error) {
+	var latest int64 = -1
+
+	files, err := cloud.Glob(ctx, logURI, "*.json")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, f := range files {
+		m := commitFile.FindStringSubmatch(filepath.Base(f))
+		if m == nil {
+			continue
+		}
+
+		v, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		if v > latest {
+			latest = v
+		}
+	}
+
+	return latest, nil
+}
+
+type action struct {
+	CommitInfo *commitInfo `json:"commitInfo,omitempty"`
+	Protocol   *protocol   `json:"protocol,omitempty"`
+	MetaData   *metaData   `json:"metaData,omitempty"`
+	Add        *add        `json:"add,omitempty"`
+}
+
+type commitInfo struct {
+	Timestamp           int64             `json:"timestamp"`
+	Operation           string            `json:"operation"`
+	OperationParameters map[string]string `json:"operationParameters"`
+	IsBlindAppend       bool              `json:"isBlindAppend"`
+	EngineInfo          string            `json:"engineInfo"`
+}
+
+type protocol struct {
+	MinReaderVersion int `json:"minReaderVersion"`
+	MinWriterVersion int `json:"minWriterVersion"`
+}
+
+type fileFormat struct {
+	Provider string            `json:"provider"`
+	Options  map[string]string `json:"options"`
+}
+
+type metaData struct {
+	ID               string            `json:"id"`
+	Format           fileFormat        `json:"format"`
+	SchemaString     string            `json:"schemaString"`
+	PartitionColumns []string          `json:"partitionColumns"`
+	Configuration    map[string]string `json:"configuration"`
+	CreatedTime      int64             `json:"createdTime"`
+}
+
+type add struct {
+	Path             string             `json:"path"`
+	PartitionValues  map[string]*string `json:"partitionValues"`
+	Size             int64              `json:"size"`
+	ModificationTime int64              `json:"modificationTime"`
+	DataChange       bool               `json:"dataChange"`
+	Stats            string             `json:"stats"`
+}
+
+// commitActions returns the newline delimited actions of a commit adding files to table. The first commit
+// of a table also holds the protocol and the table's metadata.
+func commitActions(table Table, files []DataFile, create bool, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+
+	partitionBy, err := json.Marshal(table.PartitionColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	actions := []action{{CommitInfo: &commitInfo{
+		Timestamp:           now.UnixMilli(),
+		Operation:           "WRITE",
+		OperationParameters: map[string]string{"mode": "Append", "partitionBy": string(partitionBy)},
+		IsBlindAppend:       true,
+		EngineInfo:          "mrfparse",
+	}}}
+
+	if create {
+		schema, err := schemaString(table.Schema, table.PartitionColumns)
+		if err != nil {
+			return nil, err
+		}
+
+		partitionColumns := table.PartitionColumns
+		if partitionColumns == nil {
+			partitionColumns = []string{}
+		}
+
+		actions = append(actions,
+			action{Protocol: &protocol{MinReaderVersion: 1, MinWriterVersion: 2}},
+			action{MetaData: &metaData{
+				ID:               utils.GetUniqueID(),
+				Format:           fileFormat{Provider: "parquet", Options: map[string]string{}},
+				SchemaString:     schema,
+				PartitionColumns: partitionColumns,
+				Configuration:    map[string]string{},
+				CreatedTime:      now.UnixMilli(),
+			}})
+	}
+
+	for i := range files {
+		a, err := addAction(table, &files[i])
+		if err != nil {
+			return nil, err
+		}
+
+		actions = append(actions, action{Add: a})
+	}
+
+	for i := range actions {
+		if err := enc.Encode(actions[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func addAction(table Table, f *DataFile) (*add, error) {
+	values := make(map[string]*string, len(table.PartitionColumns))
+
+	for _, c := range table.PartitionColumns {
+		if v, ok := f.PartitionValues[c]; ok {
+			v := v
+			values[c] = &v
+		} else {
+			values[c] = nil
+		}
+	}
+
+	stats, err := json.Marshal(map[string]int64{"numRecords": f.NumRecords})
+	if err != nil {
+		return nil, err
+	}
+
+	return &add{
+		Path:             escapePath(f.Path),
+		PartitionValues:  values,
+		Size:             f.Size,
+		ModificationTime: f.ModificationTime.UnixMilli(),
+		DataChange:       true,
+		Stats:            string(stats),
+	}, nil
+}
+
+// escapePath returns path as a relative URI, as the paths of add actions are URIs
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+
+	return strings.Join(segments, "/")
+}
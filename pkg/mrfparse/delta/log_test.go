@@ -0,0 +1,126 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/segmentio/parquet-go"
+	"github.com/stretchr/testify/assert"
+)
+
+type testRow struct {
+	Name   string   `parquet:"name,plain"`
+	Rate   float64  `parquet:"rate,plain"`
+	NPI    int64    `parquet:"npi,plain"`
+	Codes  []string `parquet:"codes,list,plain"`
+	Ignore string   `parquet:"-"`
+}
+
+// readCommit returns the actions of the commit file name in the log of the table at dir
+func readCommit(t *testing.T, dir, name string) []action {
+	var actions []action
+
+	data, err := os.ReadFile(filepath.Join(dir, LogDir, name))
+	assert.NoError(t, err)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var a action
+
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &a))
+		actions = append(actions, a)
+	}
+
+	return actions
+}
+
+func TestCommit(t *testing.T) {
+	dir := t.TempDir()
+
+	table := Table{URI: dir, Schema: parquet.SchemaOf(new(testRow)), PartitionColumns: []string{"plan", "record_type"}}
+	files := []DataFile{{
+		Path:             "plan=a%2Fb/record_type=__HIVE_DEFAULT_PARTITION__/mrf_0000.zstd.parquet",
+		PartitionValues:  map[string]string{"plan": "a/b"},
+		Size:             100,
+		ModificationTime: time.UnixMilli(1000),
+		NumRecords:       10,
+	}}
+
+	version, err := Commit(context.Background(), table, files)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), version)
+
+	actions := readCommit(t, dir, "00000000000000000000.json")
+	assert.Len(t, actions, 4)
+
+	assert.Equal(t, "WRITE", actions[0].CommitInfo.Operation)
+	assert.Equal(t, 1, actions[1].Protocol.MinReaderVersion)
+	assert.Equal(t, []string{"plan", "record_type"}, actions[2].MetaData.PartitionColumns)
+
+	add := actions[3].Add
+	assert.Equal(t, "plan=a%252Fb/record_type=__HIVE_DEFAULT_PARTITION__/mrf_0000.zstd.parquet", add.Path)
+	assert.Equal(t, "a/b", *add.PartitionValues["plan"])
+	assert.Nil(t, add.PartitionValues["record_type"])
+	assert.Equal(t, int64(100), add.Size)
+	assert.Equal(t, int64(1000), add.ModificationTime)
+	assert.Equal(t, `{"numRecords":10}`, add.Stats)
+
+	// later commits only add files
+	version, err = Commit(context.Background(), table, files)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), version)
+
+	actions = readCommit(t, dir, "00000000000000000001.json")
+	assert.Len(t, actions, 2)
+	assert.NotNil(t, actions[1].Add)
+}
+
+// Dates and decimals are written with their Delta types
+func TestSchemaStringTyped(t *testing.T) {
+	type typedRow struct {
+		Date int32 `parquet:"date,date,optional"`
+		Rate int64 `parquet:"rate,decimal(4:18)"`
+	}
+
+	s, err := schemaString(parquet.SchemaOf(new(typedRow)), nil)
+	assert.NoError(t, err)
+
+	assert.JSONEq(t, `{"type": "struct", "fields": [
+		{"name": "date", "type": "date", "nullable": true, "metadata": {}},
+		{"name": "rate", "type": "decimal(18,4)", "nullable": true, "metadata": {}}
+	]}`, s)
+}
+
+func TestSchemaString(t *testing.T) {
+	s, err := schemaString(parquet.SchemaOf(new(testRow)), []string{"name", "record_type"})
+	assert.NoError(t, err)
+
+	assert.JSONEq(t, `{"type": "struct", "fields": [
+		{"name": "name", "type": "string", "nullable": true, "metadata": {}},
+		{"name": "rate", "type": "double", "nullable": true, "metadata": {}},
+		{"name": "npi", "type": "long", "nullable": true, "metadata": {}},
+		{"name": "codes", "type": {"type": "array", "elementType": "string", "containsNull": false}, "nullable": true, "metadata": {}},
+		{"name": "record_type", "type": "string", "nullable": true, "metadata": {}}
+	]}`, s)
+}
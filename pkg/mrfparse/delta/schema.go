@@ -0,0 +1,135 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package delta
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/segmentio/parquet-go"
+	"github.com/segmentio/parquet-go/format"
+)
+
+// structType is a Delta struct type, in the JSON format of the schemaString of a table's metaData
+type structType struct {
+	Type   string        `json:"type"`
+	Fields []structField `json:"fields"`
+}
+
+type structField struct {
+	Name     string            `json:"name"`
+	Type     any               `json:"type"`
+	Nullable bool              `json:"nullable"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+type arrayType struct {
+	Type         string `json:"type"`
+	ElementType  any    `json:"elementType"`
+	ContainsNull bool   `json:"containsNull"`
+}
+
+// schemaString returns the Delta schema of a parquet schema, with any partition columns not in the parquet
+// schema added as string columns. Partition values are held in the log rather than in the data files.
+func schemaString(schema *parquet.Schema, partitionColumns []string) (string, error) {
+	st := structOf(schema)
+
+	for _, c := range partitionColumns {
+		if !hasField(st, c) {
+			st.Fields = append(st.Fields, structField{Name: c, Type: "string", Nullable: true, Metadata: map[string]string{}})
+		}
+	}
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func hasField(st structType, name string) bool {
+	for _, f := range st.Fields {
+		if f.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func structOf(node parquet.Node) structType {
+	st := structType{Type: "struct", Fields: []structField{}}
+
+	for _, f := range node.Fields() {
+		st.Fields = append(st.Fields, structField{Name: f.Name(), Type: typeOf(f), Nullable: true, Metadata: map[string]string{}})
+	}
+
+	return st
+}
+
+// typeOf returns the Delta type of a parquet node
+func typeOf(node parquet.Node) any {
+	if !node.Leaf() {
+		// A LIST is a group holding a repeated list group of elements
+		if fields := node.Fields(); len(fields) == 1 && fields[0].Repeated() && len(fields[0].Fields()) == 1 {
+			elem := fields[0].Fields()[0]
+			return arrayType{Type: "array", ElementType: typeOf(elem), ContainsNull: elem.Optional()}
+		}
+
+		return structOf(node)
+	}
+
+	if node.Repeated() {
+		return arrayType{Type: "array", ElementType: leafType(node.Type()), ContainsNull: false}
+	}
+
+	return leafType(node.Type())
+}
+
+func leafType(t parquet.Type) string {
+	if lt := t.LogicalType(); lt != nil {
+		switch {
+		case lt.Date != nil:
+			return "date"
+		case lt.Decimal != nil:
+			return fmt.Sprintf("decimal(%d,%d)", lt.Decimal.Precision, lt.Decimal.Scale)
+		}
+	}
+
+	switch t.Kind() {
+	case parquet.Boolean:
+		return "boolean"
+	case parquet.Int32:
+		return "integer"
+	case parquet.Int64:
+		return "long"
+	case parquet.Float:
+		return "float"
+	case parquet.Double:
+		return "double"
+	default:
+		if isString(t.LogicalType()) {
+			return "string"
+		}
+
+		return "binary"
+	}
+}
+
+func isString(lt *format.LogicalType) bool {
+	return lt != nil && (lt.UTF8 != nil || lt.Enum != nil || lt.Json != nil)
+}
@@ -0,0 +1,425 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package http
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/avast/retry-go/v4"
+	"github.com/spf13/viper"
+)
+
+// PartialSuffix is appended to the path of a file being downloaded by DownloadFile to name the file recording
+// the version of the file being downloaded. It's removed once the download completes.
+const PartialSuffix = ".download"
+
+// partial identifies the version of a file being downloaded by its ETag and Last-Modified headers. If it's
+// downloaded in segments, Size is the size of the file and Segments the progress of each segment.
+type partial struct {
+	URL          string     `json:"url"`
+	ETag         string     `json:"etag,omitempty"`
+	LastModified string     `json:"last_modified,omitempty"`
+	Size         int64      `json:"size,omitempty"`
+	Segments     []*segment `json:"segments,omitempty"`
+}
+
+// newPartial returns the version of the file at url in the response r
+func newPartial(url string, r *http.Response) *partial {
+	return &partial{URL: url, ETag: r.Header.Get("ETag"), LastModified: r.Header.Get("Last-Modified")}
+}
+
+// validator returns the If-Range header that a Range request resuming the download must be sent with, or ""
+// if the download can't be resumed. Weak ETags may not be used with If-Range.
+func (p *partial) validator() string {
+	if p == nil {
+		return ""
+	}
+
+	if p.ETag != "" && !strings.HasPrefix(p.ETag, "W/") {
+		return p.ETag
+	}
+
+	return p.LastModified
+}
+
+// download is a DownloadFile in progress. offset bytes of the file have been written to f. If sum is set and
+// the file is being written as a single stream from the first byte, hash is the sha256 of the bytes written.
+type download struct {
+	client    *http.Client
+	url       string
+	f         *os.File
+	statePath string
+	state     *partial
+	offset    int64
+	sum       bool
+	hash      hash.Hash
+}
+
+// DownloadFile downloads a file from the given URL to the local path, returning its size. A download that
+// fails part way is resumed from the last byte written using a Range request, retrying with RetryAfterDelay
+// backoff. If a download of the URL to path was interrupted, for example by a crash, it's also resumed.
+//
+// If pipeline.download_segments is more than one, the file is downloaded with that many concurrent Range
+// requests, each written to its segment of the file. Servers that don't support Range requests are
+// downloaded from as a single stream.
+//
+// A download is only resumed if the server identified the file with an ETag or Last-Modified header, and
+// it's unchanged according to the If-Range header. Otherwise, the download starts again from the first byte.
+func DownloadFile(ctx context.Context, fileURL, path string) (int64, error) {
+	d, err := downloadFile(ctx, fileURL, path, false)
+	if err != nil {
+		return 0, err
+	}
+
+	return d.offset, nil
+}
+
+// DownloadFileSum downloads a file from the given URL to the local path as DownloadFile does, returning its
+// size and sha256. The file is hashed as it's written if it's downloaded as a single stream from the first
+// byte. A download that was resumed or downloaded in segments is read once downloaded.
+func DownloadFileSum(ctx context.Context, fileURL, path string) (int64, []byte, error) {
+	d, err := downloadFile(ctx, fileURL, path, true)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if d.hash != nil {
+		return d.offset, d.hash.Sum(nil), nil
+	}
+
+	log.Infof("Reading %s to checksum it, as it was resumed or downloaded in segments", path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return d.offset, h.Sum(nil), nil
+}
+
+// downloadFile downloads a file from the given URL to the local path, returning the completed download. If
+// sum is set, the file is hashed as it's written where it can be.
+func downloadFile(ctx context.Context, fileURL, path string, sum bool) (*download, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &download{
+		client:    newClient(),
+		url:       fileURL,
+		f:         f,
+		statePath: path + PartialSuffix,
+		sum:       sum,
+	}
+
+	err = d.loadPartial()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	err = d.run(ctx, viper.GetInt("pipeline.download_segments"))
+	if err != nil {
+		_ = f.Close()
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, fmt.Errorf("unable to download file from %s: %w", fileURL, err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Remove(d.statePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// run downloads the file in segments, if the download was started in segments or segments is more than one
+// and the server supports Range requests, and otherwise as a single stream. A download in segments of a file
+// that changes is started again, once.
+func (d *download) run(ctx context.Context, segments int) error {
+	if !d.state.segmented() && (d.offset > 0 || segments < 2) {
+		return d.getStream(ctx)
+	}
+
+	for restarted := false; ; restarted = true {
+		if !d.state.segmented() {
+			ok, err := d.planSegments(ctx, segments)
+			if err != nil {
+				return err
+			}
+
+			if !ok {
+				return d.getStream(ctx)
+			}
+		}
+
+		// Segments are written out of order, so the file can only be hashed once downloaded
+		d.hash = nil
+
+		err := d.getSegments(ctx)
+		if restarted || !errors.Is(err, errChanged) {
+			return err
+		}
+
+		log.Warnf("%s has changed. Downloading it again.", d.url)
+
+		d.state = nil
+
+		err = d.reset()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// getStream downloads the file from the offset as a single stream, resuming it from the last byte written
+// should it fail part way
+func (d *download) getStream(ctx context.Context) error {
+	return retry.Do(func() error {
+		return d.get(ctx)
+	}, retryOptions(ctx)...)
+}
+
+// loadPartial reads the version of an interrupted download of the URL to the file, resuming from the end of
+// the file. If there's no such download, the file is truncated.
+func (d *download) loadPartial() error {
+	doc, err := os.ReadFile(d.statePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err == nil {
+		var state partial
+
+		err = json.Unmarshal(doc, &state)
+		if err == nil && state.URL == d.url && state.validator() != "" {
+			st, err := d.f.Stat()
+			if err != nil {
+				return err
+			}
+
+			switch {
+			case !state.segmented():
+				d.state = &state
+				d.offset = st.Size()
+
+				log.Infof("Found a partial download of %s of %d bytes", d.url, d.offset)
+
+				return nil
+			case st.Size() == state.Size:
+				d.state = &state
+
+				log.Infof("Found a partial download of %s of %d of %d bytes", d.url, state.written(), state.Size)
+
+				return nil
+			}
+		}
+	}
+
+	return d.reset()
+}
+
+// reset truncates the file, so that the download starts again from the first byte
+func (d *download) reset() error {
+	d.offset = 0
+
+	d.hash = nil
+	if d.sum {
+		d.hash = sha256.New()
+	}
+
+	return d.f.Truncate(0)
+}
+
+// get requests the file from the offset, and writes the response to the file. Errors that may succeed if
+// retried are returned as is, others as retry.Unrecoverable.
+func (d *download) get(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, http.NoBody)
+	if err != nil {
+		return retry.Unrecoverable(err)
+	}
+
+	if d.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.offset))
+		req.Header.Set("If-Range", d.state.validator())
+	}
+
+	r, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	switch {
+	case r.StatusCode == http.StatusPartialContent && d.offset > 0:
+		start, _, err := parseContentRange(r.Header.Get("Content-Range"))
+		if err != nil || start != d.offset {
+			_ = d.reset()
+			return fmt.Errorf("unexpected Content-Range %q resuming download of %s", r.Header.Get("Content-Range"), d.url)
+		}
+
+		log.Infof("Resuming download of %s from byte %d", d.url, d.offset)
+	case r.StatusCode == http.StatusRequestedRangeNotSatisfiable && d.offset > 0:
+		// The range starts at the end of a file that has been downloaded in full
+		_, size, err := parseContentRange(r.Header.Get("Content-Range"))
+		if err == nil && size == d.offset {
+			return nil
+		}
+
+		_ = d.reset()
+
+		return fmt.Errorf("unable to resume download of %s from byte %d: %s", d.url, d.offset, r.Status)
+	case r.StatusCode == http.StatusOK:
+		if d.offset > 0 {
+			log.Warnf("%s has changed or doesn't support Range requests. Downloading it again.", d.url)
+		}
+
+		err = d.start(r)
+		if err != nil {
+			return retry.Unrecoverable(err)
+		}
+	default:
+		err = checkStatus(d.url, r)
+		if err == nil {
+			err = retry.Unrecoverable(fmt.Errorf("unexpected status downloading %s: %s", d.url, r.Status))
+		}
+
+		return err
+	}
+
+	_, err = d.f.Seek(d.offset, io.SeekStart)
+	if err != nil {
+		return retry.Unrecoverable(err)
+	}
+
+	var w io.Writer = d.f
+	if d.hash != nil {
+		w = io.MultiWriter(d.f, d.hash)
+	}
+
+	n, err := io.Copy(w, r.Body)
+	d.offset += n
+
+	if err != nil {
+		log.Warnf("Download of %s failed after %d bytes: %s", d.url, d.offset, err)
+
+		// The hash may not be of the bytes written, and the download is resumed
+		d.hash = nil
+
+		if d.state.validator() == "" {
+			log.Warnf("%s can't be resumed. Downloading it again.", d.url)
+			_ = d.reset()
+		}
+	}
+
+	return err
+}
+
+// start starts the download from the first byte, recording the version of the file in the response r so that
+// the download may be resumed
+func (d *download) start(r *http.Response) error {
+	err := d.reset()
+	if err != nil {
+		return err
+	}
+
+	d.state = newPartial(d.url, r)
+
+	return d.saveState()
+}
+
+// saveState writes the version of the file, and the progress of each segment, so that the download may be
+// resumed. If the download can't be resumed, any earlier state is removed.
+func (d *download) saveState() error {
+	if d.state.validator() == "" {
+		err := os.Remove(d.statePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		return nil
+	}
+
+	doc, err := json.Marshal(d.state)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(d.statePath, doc, 0o644)
+}
+
+// parseContentRange parses a Content-Range header of the form "bytes start-end/size" or "bytes */size",
+// returning start and size. Either is -1 if unknown.
+func parseContentRange(header string) (start, size int64, err error) {
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+
+	rng, total, ok := strings.Cut(strings.TrimPrefix(header, "bytes "), "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+
+	start, size = -1, -1
+
+	if rng != "*" {
+		first, _, _ := strings.Cut(rng, "-")
+
+		start, err = strconv.ParseInt(first, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+		}
+	}
+
+	if total != "*" {
+		size, err = strconv.ParseInt(total, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+		}
+	}
+
+	return start, size, nil
+}
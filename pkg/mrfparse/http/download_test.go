@@ -0,0 +1,284 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fileServer serves content with ServeContent, recording the Range header of each request. If etag is set,
+// it's the ETag of content. If fail is set, the first response to a request with the Range header failRange
+// is cut off after fail bytes.
+type fileServer struct {
+	content   []byte
+	etag      string
+	fail      int
+	failRange string
+	mu        sync.Mutex
+	ranges    []string
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	fail := 0
+	if r.Header.Get("Range") == s.failRange {
+		fail, s.fail = s.fail, 0
+	}
+	s.mu.Unlock()
+
+	if s.etag != "" {
+		w.Header().Set("ETag", s.etag)
+	}
+
+	if fail > 0 {
+		w = &cutoffWriter{ResponseWriter: w, n: fail}
+	}
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.content))
+}
+
+// requests returns the Range headers of the requests, sorted
+func (s *fileServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ranges := append([]string(nil), s.ranges...)
+	sort.Strings(ranges)
+
+	return ranges
+}
+
+// cutoffWriter aborts the response after n bytes of the body have been written
+type cutoffWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (w *cutoffWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		p = p[:w.n]
+	}
+
+	n, _ := w.ResponseWriter.Write(p)
+	w.n -= n
+
+	if w.n == 0 {
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+
+	return n, nil
+}
+
+func testContent() []byte {
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	return content
+}
+
+// writePartial writes content to path as a partial download of url, of the version etag
+func writePartial(t *testing.T, path, url, etag string, content []byte) {
+	err := os.WriteFile(path, content, 0o644)
+	assert.NoError(t, err)
+
+	doc, err := json.Marshal(partial{URL: url, ETag: etag})
+	assert.NoError(t, err)
+
+	err = os.WriteFile(path+PartialSuffix, doc, 0o644)
+	assert.NoError(t, err)
+}
+
+func assertDownloaded(t *testing.T, path string, content []byte) {
+	got, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+	assert.NoFileExists(t, path+PartialSuffix)
+}
+
+// A partial download of an unchanged file is resumed from its last byte
+func TestDownloadFileResume(t *testing.T) {
+	content := testContent()
+	s := &fileServer{content: content, etag: `"v1"`}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "in-network.json")
+	writePartial(t, path, ts.URL, `"v1"`, content[:400])
+
+	n, err := DownloadFile(context.Background(), ts.URL, path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), n)
+	assert.Equal(t, []string{"bytes=400-"}, s.ranges)
+	assertDownloaded(t, path, content)
+}
+
+// A partial download of a file that has changed starts again
+func TestDownloadFileChanged(t *testing.T) {
+	content := testContent()
+	s := &fileServer{content: content, etag: `"v2"`}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "in-network.json")
+	writePartial(t, path, ts.URL, `"v1"`, bytes.Repeat([]byte{0xff}, 1200))
+
+	n, err := DownloadFile(context.Background(), ts.URL, path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), n)
+	assertDownloaded(t, path, content)
+}
+
+// A partial download of a whole file is complete
+func TestDownloadFileComplete(t *testing.T) {
+	content := testContent()
+	s := &fileServer{content: content, etag: `"v1"`}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "in-network.json")
+	writePartial(t, path, ts.URL, `"v1"`, content)
+
+	n, err := DownloadFile(context.Background(), ts.URL, path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), n)
+	assertDownloaded(t, path, content)
+}
+
+// A download that fails part way is resumed, or started again if the file has no validator
+func TestDownloadFileInterrupted(t *testing.T) {
+	for _, etag := range []string{`"v1"`, ""} {
+		content := testContent()
+		s := &fileServer{content: content, etag: etag, fail: 400, failRange: ""}
+		ts := httptest.NewServer(s)
+
+		path := filepath.Join(t.TempDir(), "in-network.json")
+
+		n, err := DownloadFile(context.Background(), ts.URL, path)
+		ts.Close()
+
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1000), n)
+		assertDownloaded(t, path, content)
+
+		if etag != "" {
+			assert.Equal(t, []string{"", "bytes=400-"}, s.ranges)
+		} else {
+			assert.Equal(t, []string{"", ""}, s.ranges)
+		}
+	}
+}
+
+// The sha256 of a download is hashed as it's written if it's a single stream from the first byte, and read
+// once downloaded otherwise
+func TestDownloadFileSum(t *testing.T) {
+	content := testContent()
+	want := sha256.Sum256(content)
+
+	cases := []struct {
+		name     string
+		partial  bool
+		fail     int
+		segments int
+		streamed bool
+	}{
+		{name: "stream", streamed: true},
+		{name: "resumed", partial: true},
+		{name: "interrupted", fail: 400},
+		{name: "segments", segments: 4},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.segments > 0 {
+				setSegments(t, tc.segments)
+			}
+
+			s := &fileServer{content: content, etag: `"v1"`, fail: tc.fail}
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+
+			path := filepath.Join(t.TempDir(), "in-network.json")
+			if tc.partial {
+				writePartial(t, path, ts.URL, `"v1"`, content[:400])
+			}
+
+			d, err := downloadFile(context.Background(), ts.URL, path, true)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.streamed, d.hash != nil)
+
+			if tc.streamed {
+				assert.Equal(t, want[:], d.hash.Sum(nil))
+			}
+
+			// A download that wasn't hashed as it was written is read
+			s.fail = tc.fail
+			path = filepath.Join(t.TempDir(), "in-network.json")
+			if tc.partial {
+				writePartial(t, path, ts.URL, `"v1"`, content[:400])
+			}
+
+			n, sum, err := DownloadFileSum(context.Background(), ts.URL, path)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1000), n)
+			assert.Equal(t, want[:], sum)
+		})
+	}
+}
+
+func TestDownloadFileBadStatus(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	_, err := DownloadFile(context.Background(), ts.URL, filepath.Join(t.TempDir(), "in-network.json"))
+	assert.ErrorContains(t, err, "404")
+}
+
+func TestParseContentRange(t *testing.T) {
+	cases := []struct {
+		header      string
+		start, size int64
+		wantErr     bool
+	}{
+		{"bytes 400-999/1000", 400, 1000, false},
+		{"bytes 400-999/*", 400, -1, false},
+		{"bytes */1000", -1, 1000, false},
+		{"400-999/1000", 0, 0, true},
+		{"bytes x-999/1000", 0, 0, true},
+	}
+	for _, c := range cases {
+		start, size, err := parseContentRange(c.header)
+		assert.Equal(t, c.wantErr, err != nil, c.header)
+		assert.Equal(t, c.start, start, c.header)
+		assert.Equal(t, c.size, size, c.header)
+	}
+}
@@ -16,7 +16,7 @@ limitations under the License.
 package http
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -30,45 +30,146 @@ import (
 
 const MaxRetryAttempts = 10
 
+// DefaultMaxRetryTime is the longest time waited between the attempts of a request in total, unless set by
+// pipeline.max_retry_time in minutes
+const DefaultMaxRetryTime = 30 * time.Minute
+
 var log = utils.GetLogger()
 
 // DownloadFileReader downloads a file from the given URL and returns an io.ReadCloser.
 // The caller is responsible for closing the returned io.ReadCloser.
-// DownloadFilereader attempts to retry the download if it receives a RetryAfterDelay error.
-func DownloadReader(fileURL string) (io.ReadCloser, error) {
+// DownloadFilereader retries the download on transport errors and 429, 502, 503 and 504 responses,
+// waiting for any delay given by the Retry-After header. Other unsuccessful responses are not retried.
+// Cancelling ctx stops any retries and aborts reads of the response body.
+func DownloadReader(ctx context.Context, fileURL string) (io.ReadCloser, error) {
 	var (
-		err         error
-		r           *http.Response
-		HTTPTimeOut time.Duration
+		err        error
+		r          *http.Response
+		httpClient = newClient()
 	)
 
-	HTTPTimeOut = time.Duration(viper.GetInt("pipeline.download_timeout")) * time.Minute
-
-	var httpClient = &http.Client{
-		Timeout: HTTPTimeOut,
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, http.NoBody)
+	if err != nil {
+		return nil, err
 	}
 
 	err = retry.Do(func() error {
-		r, err = httpClient.Get(fileURL) //nolint:bodyclose // Embedded in retry confusing linter
+		r, err = httpClient.Do(req) //nolint:bodyclose // Embedded in retry confusing linter
+		if err != nil {
+			return err
+		}
+
+		err = checkStatus(fileURL, r)
 		if err != nil {
+			r.Body.Close()
 			return err
 		}
+
 		return nil
-	}, retry.DelayType(RetryAfterDelay),
-		retry.Attempts(MaxRetryAttempts),
-	)
+	}, retryOptions(ctx)...)
 	if err != nil {
-		r.Body.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 
-		return nil, fmt.Errorf("unable to download file from %s: %s", fileURL, errors.Unwrap(err))
+		return nil, fmt.Errorf("unable to download file from %s: %w", fileURL, err)
 	}
 
-	if r.StatusCode != http.StatusOK {
-		errorText := fmt.Errorf("bad status downloading %s: %s", fileURL, r.Status)
-		log.Error(errorText)
+	return r.Body, nil
+}
 
-		return nil, errorText
+// newClient returns a http.Client that times out after pipeline.download_timeout minutes
+func newClient() *http.Client {
+	return &http.Client{
+		Timeout: time.Duration(viper.GetInt("pipeline.download_timeout")) * time.Minute,
 	}
+}
 
-	return r.Body, nil
+// checkStatus returns nil if the response r to a request for fileURL is successful. 429, 502, 503 and 504
+// responses are returned as a RetryAfterError, so that the request is retried after any delay given by the
+// Retry-After header. Other responses are returned as retry.Unrecoverable.
+func checkStatus(fileURL string, r *http.Response) error {
+	if retryableStatus(r.StatusCode) {
+		return RetryAfterError{response: *r}
+	}
+
+	if r.StatusCode >= 200 && r.StatusCode < 300 {
+		return nil
+	}
+
+	errorText := fmt.Errorf("bad status downloading %s: %s", fileURL, r.Status)
+	log.Error(errorText)
+
+	return retry.Unrecoverable(errorText)
+}
+
+// retryableStatus returns true if a request may succeed if retried after a response with the status code
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// maxRetryTime returns the longest time waited between the attempts of a request in total, set by
+// pipeline.max_retry_time in minutes
+func maxRetryTime() time.Duration {
+	if viper.IsSet("pipeline.max_retry_time") {
+		return time.Duration(viper.GetInt("pipeline.max_retry_time")) * time.Minute
+	}
+
+	return DefaultMaxRetryTime
+}
+
+// retryOptions returns the options of a retry of a request with RetryAfterDelay backoff. Errors that are
+// recoverable are retried until MaxRetryAttempts attempts have been made, or the time waited between attempts
+// reaches maxRetryTime. Only the last error is returned.
+func retryOptions(ctx context.Context) []retry.Option {
+	w := &retryWait{max: maxRetryTime()}
+
+	return []retry.Option{
+		retry.DelayType(w.delay),
+		retry.RetryIf(w.retryIf),
+		retry.Attempts(MaxRetryAttempts),
+		retry.Context(ctx),
+		retry.LastErrorOnly(true),
+	}
+}
+
+// retryWait caps the time waited between the attempts of a request at max in total
+type retryWait struct {
+	max    time.Duration
+	waited time.Duration
+}
+
+func (w *retryWait) retryIf(err error) bool {
+	if !retry.IsRecoverable(err) {
+		return false
+	}
+
+	if w.waited >= w.max {
+		log.Warnf("Giving up after waiting %s to retry: %s", w.waited, err)
+		return false
+	}
+
+	return true
+}
+
+// delay returns the RetryAfterDelay, shortened to the time left to wait
+func (w *retryWait) delay(n uint, err error, config *retry.Config) time.Duration {
+	d := RetryAfterDelay(n, err, config)
+
+	if d < 0 {
+		d = 0
+	}
+
+	if d > w.max-w.waited {
+		d = w.max - w.waited
+	}
+
+	w.waited += d
+
+	return d
 }
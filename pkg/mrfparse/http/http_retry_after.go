@@ -65,6 +65,8 @@ func RetryAfterDelay(n uint, err error, config *retry.Config) time.Duration {
 	return delay
 }
 
+// RetryAfterError is a response that may succeed if the request is retried, after any delay given by its
+// Retry-After header
 type RetryAfterError struct {
 	response http.Response
 }
@@ -72,7 +74,7 @@ type RetryAfterError struct {
 func (err RetryAfterError) Error() string {
 	return fmt.Sprintf(
 		"Request to %s fail %s (%d)",
-		err.response.Request.RequestURI,
+		err.response.Request.URL,
 		err.response.Status,
 		err.response.StatusCode,
 	)
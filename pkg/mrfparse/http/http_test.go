@@ -0,0 +1,154 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package http
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// statusServer responds to each request with the next of statuses, with the Retry-After header of the same
+// index if any, and then with next
+type statusServer struct {
+	statuses   []int
+	retryAfter []string
+	next       http.Handler
+	mu         sync.Mutex
+	requests   int
+}
+
+func (s *statusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	i := s.requests
+	s.requests++
+	s.mu.Unlock()
+
+	if i >= len(s.statuses) {
+		s.next.ServeHTTP(w, r)
+		return
+	}
+
+	if i < len(s.retryAfter) && s.retryAfter[i] != "" {
+		w.Header().Set("Retry-After", s.retryAfter[i])
+	}
+
+	w.WriteHeader(s.statuses[i])
+}
+
+func okHandler(w http.ResponseWriter, _ *http.Request) {
+	_, _ = w.Write([]byte("ok"))
+}
+
+// 429, 502, 503 and 504 responses are retried, after the delay in any Retry-After header
+func TestDownloadReaderRetryAfter(t *testing.T) {
+	s := &statusServer{
+		statuses:   []int{http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusGatewayTimeout},
+		retryAfter: []string{"1", "0", "0", "0"},
+		next:       http.HandlerFunc(okHandler),
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	start := time.Now()
+
+	r, err := DownloadReader(context.Background(), ts.URL)
+	assert.NoError(t, err)
+
+	defer r.Close()
+
+	body, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, 5, s.requests)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+}
+
+// Other unsuccessful responses aren't retried
+func TestDownloadReaderFatalStatus(t *testing.T) {
+	s := &statusServer{statuses: []int{http.StatusForbidden}, next: http.HandlerFunc(okHandler)}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	_, err := DownloadReader(context.Background(), ts.URL)
+	assert.ErrorContains(t, err, "403")
+	assert.Equal(t, 1, s.requests)
+}
+
+// Requests aren't retried once the time waited reaches pipeline.max_retry_time
+func TestDownloadReaderMaxRetryTime(t *testing.T) {
+	viper.Set("pipeline.max_retry_time", 0)
+	t.Cleanup(func() { viper.Set("pipeline.max_retry_time", 30) })
+
+	s := &statusServer{
+		statuses:   []int{http.StatusTooManyRequests, http.StatusTooManyRequests},
+		retryAfter: []string{"3600", "3600"},
+		next:       http.HandlerFunc(okHandler),
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	_, err := DownloadReader(context.Background(), ts.URL)
+	assert.True(t, errors.As(err, &RetryAfterError{}))
+	assert.ErrorContains(t, err, "429")
+	assert.Equal(t, 1, s.requests)
+}
+
+// The delays between attempts are shortened to the time left to wait
+func TestRetryWait(t *testing.T) {
+	w := &retryWait{max: 2 * time.Second}
+
+	err := RetryAfterError{response: http.Response{
+		Header:  http.Header{"Retry-After": []string{"3600"}},
+		Request: httptest.NewRequest(http.MethodGet, "http://example.com/in-network.json", http.NoBody),
+	}}
+
+	assert.True(t, w.retryIf(err))
+	assert.Equal(t, 2*time.Second, w.delay(1, err, &retry.Config{}))
+	assert.False(t, w.retryIf(err))
+	assert.False(t, (&retryWait{max: time.Minute}).retryIf(retry.Unrecoverable(err)))
+}
+
+// A download to a file in segments is retried on 429 responses
+func TestDownloadFileRetryAfter(t *testing.T) {
+	setSegments(t, 2)
+
+	content := testContent()
+	s := &statusServer{
+		statuses:   []int{http.StatusTooManyRequests, http.StatusTooManyRequests},
+		retryAfter: []string{"0", "0"},
+		next:       &fileServer{content: content, etag: `"v1"`},
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "in-network.json")
+
+	n, err := DownloadFile(context.Background(), ts.URL, path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), n)
+	assertDownloaded(t, path, content)
+}
@@ -0,0 +1,304 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+)
+
+var (
+	// minSegmentSize is the smallest segment a file downloaded in segments is split into
+	minSegmentSize int64 = 16 << 20
+	// progressInterval is the interval between reports of the progress of a download in segments
+	progressInterval = 30 * time.Second
+	// errChanged is returned when a file changes while it's being downloaded in segments
+	errChanged = errors.New("file has changed")
+)
+
+// segment is the range of bytes [Start, End) of a file downloaded in segments. Offset is the next byte to
+// write, and is updated atomically.
+type segment struct {
+	Start  int64 `json:"start"`
+	End    int64 `json:"end"`
+	Offset int64 `json:"offset"`
+}
+
+// MarshalJSON marshals the segment, loading Offset atomically so that progress may be saved while the
+// segment is downloaded
+func (s *segment) MarshalJSON() ([]byte, error) {
+	type plain segment
+
+	return json.Marshal(plain{Start: s.Start, End: s.End, Offset: atomic.LoadInt64(&s.Offset)})
+}
+
+// segmentWriter writes to its segment of the download's file, advancing the segment's Offset
+type segmentWriter struct {
+	d *download
+	s *segment
+}
+
+func (w segmentWriter) Write(p []byte) (int, error) {
+	n, err := w.d.f.WriteAt(p, atomic.LoadInt64(&w.s.Offset))
+	atomic.AddInt64(&w.s.Offset, int64(n))
+
+	return n, err
+}
+
+// segmented returns true if the file is being downloaded in segments
+func (p *partial) segmented() bool {
+	return p != nil && len(p.Segments) > 0
+}
+
+// written returns the number of bytes of a file downloaded in segments that have been written
+func (p *partial) written() int64 {
+	var n int64
+
+	for _, s := range p.Segments {
+		n += atomic.LoadInt64(&s.Offset) - s.Start
+	}
+
+	return n
+}
+
+// planSegments requests the first byte of the file to find its size and whether the server supports Range
+// requests. If so, the file is split into up to n segments and preallocated, and true is returned.
+func (d *download) planSegments(ctx context.Context, n int) (bool, error) {
+	var r *http.Response
+
+	err := retry.Do(func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, http.NoBody)
+		if err != nil {
+			return retry.Unrecoverable(err)
+		}
+
+		req.Header.Set("Range", "bytes=0-0")
+
+		r, err = d.client.Do(req) //nolint:bodyclose // Embedded in retry confusing linter
+		if err != nil {
+			return err
+		}
+
+		// Other unsuccessful responses are left to the download as a single stream
+		if retryableStatus(r.StatusCode) {
+			r.Body.Close()
+			return RetryAfterError{response: *r}
+		}
+
+		return nil
+	}, retryOptions(ctx)...)
+	if err != nil {
+		return false, err
+	}
+
+	// A server ignoring the Range header answers with the whole file, which is downloaded as a single stream
+	// rather than read here
+	if r.StatusCode == http.StatusPartialContent {
+		_, _ = io.Copy(io.Discard, r.Body)
+	}
+
+	r.Body.Close()
+
+	_, size, err := parseContentRange(r.Header.Get("Content-Range"))
+	if r.StatusCode != http.StatusPartialContent || err != nil || size <= 0 {
+		log.Infof("%s doesn't support Range requests. Downloading it as a single stream.", d.url)
+		return false, nil
+	}
+
+	state := newPartial(d.url, r)
+	if state.validator() == "" {
+		log.Infof("%s has no ETag or Last-Modified header. Downloading it as a single stream.", d.url)
+		return false, nil
+	}
+
+	if limit := (size + minSegmentSize - 1) / minSegmentSize; int64(n) > limit {
+		n = int(limit)
+	}
+
+	if n < 2 {
+		return false, nil
+	}
+
+	state.Size = size
+
+	for i := 0; i < n; i++ {
+		start := size * int64(i) / int64(n)
+		state.Segments = append(state.Segments, &segment{Start: start, End: size * int64(i+1) / int64(n), Offset: start})
+	}
+
+	err = d.f.Truncate(size)
+	if err != nil {
+		return false, err
+	}
+
+	d.state = state
+
+	log.Infof("Downloading %d bytes from %s in %d segments", size, d.url, n)
+
+	return true, d.saveState()
+}
+
+// getSegments downloads the segments of the file that are incomplete concurrently, retrying each should it
+// fail part way. Progress is reported and saved every progressInterval, and once the segments are done.
+func (d *download) getSegments(ctx context.Context) error {
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		done     = make(chan struct{})
+		reported = make(chan struct{})
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		defer close(reported)
+		d.reportProgress(done)
+	}()
+
+	for _, s := range d.state.Segments {
+		if atomic.LoadInt64(&s.Offset) >= s.End {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(s *segment) {
+			defer wg.Done()
+
+			err := retry.Do(func() error {
+				return d.getSegment(ctx, s)
+			}, retryOptions(ctx)...)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(s)
+	}
+
+	wg.Wait()
+	close(done)
+	<-reported
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	d.offset = d.state.Size
+
+	return nil
+}
+
+// reportProgress logs and saves the progress of the segments every progressInterval until done is closed,
+// and saves it once more when it is
+func (d *download) reportProgress(done <-chan struct{}) {
+	var (
+		started = time.Now()
+		from    = d.state.written()
+		ticker  = time.NewTicker(progressInterval)
+	)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			written := d.state.written()
+			rate := float64(written-from) / time.Since(started).Seconds() / (1 << 20)
+
+			log.Infof("Downloaded %d of %d bytes (%.1f%%) from %s at %.1f MiB/s",
+				written, d.state.Size, float64(written)*100/float64(d.state.Size), d.url, rate)
+
+			d.saveProgress()
+		case <-done:
+			d.saveProgress()
+			return
+		}
+	}
+}
+
+// saveProgress saves the progress of the segments. Failing to do so only means a download that's interrupted
+// resumes from an earlier byte, so errors are logged.
+func (d *download) saveProgress() {
+	err := d.saveState()
+	if err != nil {
+		log.Errorf("Unable to save the progress of the download of %s: %s", d.url, err)
+	}
+}
+
+// getSegment requests the segment from its offset, and writes the response to its range of the file. Errors
+// that may succeed if retried are returned as is, others as retry.Unrecoverable.
+func (d *download) getSegment(ctx context.Context, s *segment) error {
+	offset := atomic.LoadInt64(&s.Offset)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, http.NoBody)
+	if err != nil {
+		return retry.Unrecoverable(err)
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, s.End-1))
+	req.Header.Set("If-Range", d.state.validator())
+
+	r, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The file no longer matches If-Range
+		return retry.Unrecoverable(errChanged)
+	default:
+		err = checkStatus(d.url, r)
+		if err == nil {
+			err = retry.Unrecoverable(fmt.Errorf("unexpected status downloading %s: %s", d.url, r.Status))
+		}
+
+		return err
+	}
+
+	start, _, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil || start != offset {
+		return retry.Unrecoverable(fmt.Errorf("unexpected Content-Range %q downloading bytes %d-%d of %s",
+			r.Header.Get("Content-Range"), offset, s.End-1, d.url))
+	}
+
+	_, err = io.Copy(segmentWriter{d: d, s: s}, io.LimitReader(r.Body, s.End-offset))
+	if err == nil && atomic.LoadInt64(&s.Offset) < s.End {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		log.Warnf("Download of bytes %d-%d of %s failed at byte %d: %s", s.Start, s.End-1, d.url, atomic.LoadInt64(&s.Offset), err)
+	}
+
+	return err
+}
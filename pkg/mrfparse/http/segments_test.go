@@ -0,0 +1,198 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// setSegments downloads files of 1000 bytes in segments of at least 100 bytes
+func setSegments(t *testing.T, segments int) {
+	viper.Set("pipeline.download_segments", segments)
+	minSegmentSize = 100
+
+	t.Cleanup(func() {
+		viper.Set("pipeline.download_segments", 1)
+		minSegmentSize = 16 << 20
+	})
+}
+
+// A segment that fails part way is retried from its last byte
+func TestDownloadFileSegments(t *testing.T) {
+	setSegments(t, 4)
+
+	content := testContent()
+	s := &fileServer{content: content, etag: `"v1"`, fail: 100, failRange: "bytes=500-749"}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "in-network.json")
+
+	n, err := DownloadFile(context.Background(), ts.URL, path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), n)
+	assertDownloaded(t, path, content)
+
+	assert.Equal(t, []string{"bytes=0-0", "bytes=0-249", "bytes=250-499", "bytes=500-749", "bytes=600-749", "bytes=750-999"}, s.requests())
+}
+
+// The number of segments is limited by the size of the file
+func TestDownloadFileSegmentsLimited(t *testing.T) {
+	setSegments(t, 100)
+
+	content := testContent()
+	s := &fileServer{content: content[:250], etag: `"v1"`}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "in-network.json")
+
+	_, err := DownloadFile(context.Background(), ts.URL, path)
+	assert.NoError(t, err)
+	assertDownloaded(t, path, content[:250])
+
+	assert.Equal(t, []string{"bytes=0-0", "bytes=0-82", "bytes=166-249", "bytes=83-165"}, s.requests())
+}
+
+// Servers that don't support Range requests, or don't identify the file, are downloaded from as a single stream
+func TestDownloadFileSegmentsUnsupported(t *testing.T) {
+	setSegments(t, 4)
+
+	content := testContent()
+
+	noRanges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}))
+	defer noRanges.Close()
+
+	noValidator := httptest.NewServer(&fileServer{content: content})
+	defer noValidator.Close()
+
+	for _, url := range []string{noRanges.URL, noValidator.URL} {
+		path := filepath.Join(t.TempDir(), "in-network.json")
+
+		n, err := DownloadFile(context.Background(), url, path)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1000), n)
+		assertDownloaded(t, path, content)
+	}
+}
+
+// The response to the first byte of a file from a server ignoring Range requests isn't read
+func TestDownloadFileSegmentsProbe(t *testing.T) {
+	setSegments(t, 4)
+
+	var (
+		content = testContent()
+		chunk   = make([]byte, 1<<20)
+		limit   = int64(1 << 30)
+		written int64
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "" {
+			_, _ = w.Write(content)
+			return
+		}
+
+		// the whole of a large file, until the client stops reading
+		for written < limit {
+			n, err := w.Write(chunk)
+			written += int64(n)
+
+			if err != nil {
+				return
+			}
+		}
+	}))
+
+	path := filepath.Join(t.TempDir(), "in-network.json")
+
+	n, err := DownloadFile(context.Background(), ts.URL, path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), n)
+	assertDownloaded(t, path, content)
+
+	// waits for the handlers to return
+	ts.Close()
+	assert.Less(t, written, limit)
+}
+
+// writeSegments writes a partial download in segments of url, of the version etag, to path. The bytes of
+// each segment before its offset are those of content.
+func writeSegments(t *testing.T, path, url, etag string, content []byte, segments []*segment) {
+	data := bytes.Repeat([]byte{0xff}, len(content))
+	for _, s := range segments {
+		copy(data[s.Start:s.Offset], content[s.Start:s.Offset])
+	}
+
+	err := os.WriteFile(path, data, 0o644)
+	assert.NoError(t, err)
+
+	doc, err := json.Marshal(partial{URL: url, ETag: etag, Size: int64(len(content)), Segments: segments})
+	assert.NoError(t, err)
+
+	err = os.WriteFile(path+PartialSuffix, doc, 0o644)
+	assert.NoError(t, err)
+}
+
+// An interrupted download in segments resumes each segment from its last byte
+func TestDownloadFileSegmentsResume(t *testing.T) {
+	setSegments(t, 1)
+
+	content := testContent()
+	s := &fileServer{content: content, etag: `"v1"`}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "in-network.json")
+	writeSegments(t, path, ts.URL, `"v1"`, content, []*segment{{Start: 0, End: 500, Offset: 500}, {Start: 500, End: 1000, Offset: 600}})
+
+	n, err := DownloadFile(context.Background(), ts.URL, path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), n)
+	assertDownloaded(t, path, content)
+
+	assert.Equal(t, []string{"bytes=600-999"}, s.requests())
+}
+
+// An interrupted download in segments of a file that has since changed starts again
+func TestDownloadFileSegmentsChanged(t *testing.T) {
+	setSegments(t, 2)
+
+	content := testContent()
+	s := &fileServer{content: content, etag: `"v2"`}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "in-network.json")
+	writeSegments(t, path, ts.URL, `"v1"`, content, []*segment{{Start: 0, End: 500, Offset: 200}, {Start: 500, End: 1000, Offset: 600}})
+
+	n, err := DownloadFile(context.Background(), ts.URL, path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), n)
+	assertDownloaded(t, path, content)
+}
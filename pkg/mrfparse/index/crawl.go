@@ -0,0 +1,84 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package index
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/parquet"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/pipeline"
+)
+
+const PlansFilename = "plans.zstd.parquet"
+
+// Crawl downloads the table of contents file at indexURI, writes a plans table to outputURI, and
+// then runs a parse pipeline for each unique file referenced by the table of contents. Each file's
+// parquet fileset is written to outputURI/<file_id>. Allowed-amount files are only parsed if
+// allowedAmounts is true. Crawl stops at the first file that fails to parse, or when ctx is cancelled.
+func Crawl(ctx context.Context, indexURI, outputURI, serviceFile string, allowedAmounts bool) error {
+	toc, err := Load(ctx, indexURI)
+	if err != nil {
+		return err
+	}
+
+	files := toc.Files()
+	log.Infof("Found %d files for %d reporting structures in %s", len(files), len(toc.ReportingStructure), indexURI)
+
+	if !cloud.IsCloudURI(outputURI) {
+		err = os.MkdirAll(outputURI, os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = parquet.WriteFile(ctx, cloud.JoinURI(outputURI, PlansFilename), toc.PlanFiles())
+	if err != nil {
+		return err
+	}
+
+	for i, f := range files {
+		var p *pipeline.Pipeline
+
+		out := cloud.JoinURI(outputURI, f.ID)
+
+		switch f.Type {
+		case InNetworkFileType:
+			p, err = pipeline.NewParsePipeline(f.Location, out, serviceFile, f.Plan())
+		case AllowedAmountsFileType:
+			if !allowedAmounts {
+				continue
+			}
+
+			p, err = pipeline.NewParseAllowedPipeline(f.Location, out, serviceFile, f.Plan())
+		}
+
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Parsing file %d of %d: %s", i+1, len(files), f.Location)
+
+		err = p.Run(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to parse %s: %w", f.Location, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/http"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
+)
+
+const (
+	InNetworkFileType      = "in_network"
+	AllowedAmountsFileType = "allowed_amounts"
+)
+
+var log = utils.GetLogger()
+
+// TableOfContents is a payer's table of contents (index) file. It lists the in-network and
+// allowed-amount files reported for each of the payer's plans.
+type TableOfContents struct {
+	ReportingEntityName string               `json:"reporting_entity_name"`
+	ReportingEntityType string               `json:"reporting_entity_type"`
+	ReportingStructure  []ReportingStructure `json:"reporting_structure"`
+}
+
+type ReportingStructure struct {
+	ReportingPlans    []models.Plan  `json:"reporting_plans"`
+	InNetworkFiles    []FileLocation `json:"in_network_files"`
+	AllowedAmountFile *FileLocation  `json:"allowed_amount_file"`
+}
+
+type FileLocation struct {
+	Description string `json:"description"`
+	Location    string `json:"location"`
+}
+
+// File is a unique MRF file referenced by a table of contents, along with all plans that reference it.
+type File struct {
+	ID          string
+	Type        string
+	Location    string
+	Description string
+	Plans       []models.Plan
+}
+
+// Plan returns the plan to record in the root of the file's parquet fileset. This is only
+// possible when the file is reported for a single plan. Otherwise, nil is returned and files are
+// related to their plans by the plans table.
+func (f *File) Plan() *models.Plan {
+	if len(f.Plans) != 1 {
+		return nil
+	}
+
+	return &f.Plans[0]
+}
+
+// FileID returns the ID of a file location. The ID is used as the name of the file's output directory.
+func FileID(location string) string {
+	return utils.Sha256Sum(location)
+}
+
+// Load downloads and parses the table of contents file at uri. HTTP(S), S3, GCS and local paths
+// are supported, and the file may be gzip compressed.
+func Load(ctx context.Context, uri string) (*TableOfContents, error) {
+	var (
+		f   io.ReadCloser
+		err error
+	)
+
+	if strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://") {
+		f, err = http.DownloadReader(ctx, uri)
+	} else {
+		f, err = cloud.NewReader(ctx, uri)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(f io.ReadCloser) {
+		err := f.Close()
+		if err != nil {
+			log.Errorf("Unable to close index file: %s", err.Error())
+		}
+	}(f)
+
+	r, err := utils.NewDecompressReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(r)
+}
+
+// Parse parses a table of contents document
+func Parse(r io.Reader) (*TableOfContents, error) {
+	var toc TableOfContents
+
+	err := json.NewDecoder(r).Decode(&toc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &toc, nil
+}
+
+// Files returns the unique files referenced by the table of contents, in the order in which
+// they first appear. Each file lists every plan that references it.
+func (toc *TableOfContents) Files() []*File {
+	var (
+		files []*File
+		seen  = make(map[string]*File)
+	)
+
+	add := func(fileType string, fl *FileLocation, plans []models.Plan) {
+		if fl == nil || fl.Location == "" {
+			return
+		}
+
+		f, ok := seen[fl.Location]
+		if !ok {
+			f = &File{ID: FileID(fl.Location), Type: fileType, Location: fl.Location, Description: fl.Description}
+			seen[fl.Location] = f
+			files = append(files, f)
+		}
+
+		f.Plans = append(f.Plans, plans...)
+	}
+
+	for i := range toc.ReportingStructure {
+		rs := &toc.ReportingStructure[i]
+
+		for j := range rs.InNetworkFiles {
+			add(InNetworkFileType, &rs.InNetworkFiles[j], rs.ReportingPlans)
+		}
+
+		add(AllowedAmountsFileType, rs.AllowedAmountFile, rs.ReportingPlans)
+	}
+
+	return files
+}
+
+// PlanFiles returns a plans table row for every (plan, file) pair in the table of contents.
+func (toc *TableOfContents) PlanFiles() []*models.PlanFile {
+	var rows []*models.PlanFile
+
+	for _, f := range toc.Files() {
+		for _, p := range f.Plans {
+			rows = append(rows, &models.PlanFile{
+				ReportingEntityName: toc.ReportingEntityName,
+				ReportingEntityType: toc.ReportingEntityType,
+				Plan:                p,
+				FileType:            f.Type,
+				FileID:              f.ID,
+				FileLocation:        f.Location,
+				FileDescription:     f.Description,
+			})
+		}
+	}
+
+	return rows
+}
@@ -0,0 +1,108 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package index
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const tocJSON = `{
+	"reporting_entity_name": "Acme Health",
+	"reporting_entity_type": "health insurance issuer",
+	"reporting_structure": [
+	  {
+		"reporting_plans": [
+		  { "plan_name": "Plan A", "plan_id_type": "ein", "plan_id": "11-1111111", "plan_market_type": "group" },
+		  { "plan_name": "Plan B", "plan_id_type": "ein", "plan_id": "22-2222222", "plan_market_type": "group" }
+		],
+		"in_network_files": [
+		  { "description": "in-network file", "location": "https://example.com/in_network_1.json.gz" },
+		  { "description": "in-network file", "location": "https://example.com/in_network_2.json.gz" }
+		],
+		"allowed_amount_file": { "description": "allowed amounts", "location": "https://example.com/allowed.json.gz" }
+	  },
+	  {
+		"reporting_plans": [
+		  { "plan_name": "Plan C", "plan_id_type": "hios", "plan_id": "12345", "plan_market_type": "individual" }
+		],
+		"in_network_files": [
+		  { "description": "in-network file", "location": "https://example.com/in_network_1.json.gz" },
+		  { "description": "in-network file", "location": "https://example.com/in_network_3.json.gz" }
+		]
+	  }
+	]
+}`
+
+func TestParse(t *testing.T) {
+	toc, err := Parse(strings.NewReader(tocJSON))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "Acme Health", toc.ReportingEntityName)
+	assert.Equal(t, "health insurance issuer", toc.ReportingEntityType)
+	assert.Equal(t, 2, len(toc.ReportingStructure))
+	assert.Equal(t, "Plan B", toc.ReportingStructure[0].ReportingPlans[1].PlanName)
+	assert.Equal(t, "https://example.com/allowed.json.gz", toc.ReportingStructure[0].AllowedAmountFile.Location)
+	assert.Nil(t, toc.ReportingStructure[1].AllowedAmountFile)
+}
+
+func TestFiles(t *testing.T) {
+	toc, err := Parse(strings.NewReader(tocJSON))
+	assert.NoError(t, err)
+
+	files := toc.Files()
+	assert.Equal(t, 4, len(files))
+
+	// in_network_1 is shared by all three plans
+	assert.Equal(t, "https://example.com/in_network_1.json.gz", files[0].Location)
+	assert.Equal(t, InNetworkFileType, files[0].Type)
+	assert.Equal(t, 3, len(files[0].Plans))
+	assert.Nil(t, files[0].Plan())
+	assert.Equal(t, FileID(files[0].Location), files[0].ID)
+
+	assert.Equal(t, "https://example.com/allowed.json.gz", files[2].Location)
+	assert.Equal(t, AllowedAmountsFileType, files[2].Type)
+
+	// in_network_3 is only reported for Plan C, so its plan can be recorded in the root
+	assert.Equal(t, "https://example.com/in_network_3.json.gz", files[3].Location)
+	assert.Equal(t, &models.Plan{PlanName: "Plan C", PlanIDType: "hios", PlanID: "12345", PlanMarketType: "individual"},
+		files[3].Plan())
+}
+
+func TestPlanFiles(t *testing.T) {
+	toc, err := Parse(strings.NewReader(tocJSON))
+	assert.NoError(t, err)
+
+	rows := toc.PlanFiles()
+	// in_network_1: 3 plans, in_network_2: 2 plans, allowed: 2 plans, in_network_3: 1 plan
+	assert.Equal(t, 8, len(rows))
+
+	assert.Equal(t, "Acme Health", rows[0].ReportingEntityName)
+	assert.Equal(t, "11-1111111", rows[0].PlanID)
+	assert.Equal(t, InNetworkFileType, rows[0].FileType)
+	assert.Equal(t, FileID("https://example.com/in_network_1.json.gz"), rows[0].FileID)
+	assert.Equal(t, "12345", rows[2].PlanID)
+	assert.Equal(t, rows[0].FileID, rows[2].FileID)
+}
+
+func TestFileIDStable(t *testing.T) {
+	assert.Equal(t, FileID("https://example.com/a.json"), FileID("https://example.com/a.json"))
+	assert.NotEqual(t, FileID("https://example.com/a.json"), FileID("https://example.com/b.json"))
+}
@@ -0,0 +1,28 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package models
+
+// PlanFile relates a plan reported in a table of contents (index) file to one of its MRF files.
+// FileID is the name of the output directory the file's parquet fileset is written to.
+type PlanFile struct {
+	ReportingEntityName string `parquet:"reporting_entity_name,plain"`
+	ReportingEntityType string `parquet:"reporting_entity_type,plain"`
+	Plan
+	FileType        string `parquet:"file_type,enum,plain"`
+	FileID          string `parquet:"file_id,plain"`
+	FileLocation    string `parquet:"file_location,plain"`
+	FileDescription string `parquet:"file_description,plain"`
+}
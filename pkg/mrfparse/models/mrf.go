@@ -26,6 +26,7 @@ type Mrf struct {
 	InNetwork
 
 	BundledCodes
+	CoveredServices
 	Tin
 	ProviderGroup
 	UUID       string `parquet:"uuid,plain"`
@@ -37,6 +38,14 @@ type Mrf struct {
 	NegotiatedRate
 
 	NegotiatedPrices
+	DrugPrices
+
+	OutOfNetwork
+	AllowedAmounts
+	Payments
+	PaymentProviders
+
+	RateFact
 }
 
 type MrfRoot struct {
@@ -44,10 +53,16 @@ type MrfRoot struct {
 	ReportingEntityType string `json:"reporting_entity_type" parquet:"reporting_entity_type,plain"`
 	LastUpdatedOn       string `json:"last_updated_on" parquet:"last_updated_on,plain"`
 	Version             string `json:"version" parquet:"version,plain"`
-	PlanMarketType      string `json:"plan_market_type,omitempty" parquet:"plan_market_type,enum,plain"`
-	PlanName            string `json:"plan_name,omitempty" parquet:"plan_name,plain"`
-	PlanIDType          string `json:"plan_id_type,omitempty" parquet:"plan_id_type,plain"`
-	PlanID              string `json:"plan_id,omitempty" parquet:"plan_id,plain"`
+	Plan
+}
+
+// Plan identifies a plan. Plan fields are optional in MRF root documents, and are also found
+// in the reporting_plans of a table of contents (index) file.
+type Plan struct {
+	PlanMarketType string `json:"plan_market_type,omitempty" parquet:"plan_market_type,enum,plain"`
+	PlanName       string `json:"plan_name,omitempty" parquet:"plan_name,plain"`
+	PlanIDType     string `json:"plan_id_type,omitempty" parquet:"plan_id_type,plain"`
+	PlanID         string `json:"plan_id,omitempty" parquet:"plan_id,plain"`
 }
 
 type ProviderGroup struct {
@@ -80,6 +95,13 @@ type BundledCodes struct {
 	NCBillingCodeTypeVersion string `parquet:"in_bc_billing_code_type_version,plain"`
 }
 
+type CoveredServices struct {
+	CSDescription            string `parquet:"in_cs_description,plain"`
+	CSBillingCodeType        string `parquet:"in_cs_billing_code_type,enum,plain"`
+	CSBillingCode            string `parquet:"in_cs_billing_code,plain"`
+	CSBillingCodeTypeVersion string `parquet:"in_cs_billing_code_type_version,plain"`
+}
+
 type NegotiatedPrices struct {
 	NegotiatedType        string               `parquet:"in_np_negotiated_type,enum,plain"`
 	BillingClass          string               `parquet:"in_np_billing_class,plain"`
@@ -90,6 +112,64 @@ type NegotiatedPrices struct {
 	NegotiatedRateValue   float64              `parquet:"in_np_negotiated_rate,plain"`
 }
 
+// DrugPrices are the prices of a prescription drug (NDC) negotiated rate
+type DrugPrices struct {
+	DPNegotiatedType        string       `parquet:"in_dp_negotiated_type,enum,plain"`
+	DPExpirationDate        string       `parquet:"in_dp_expiration_date,plain"`
+	DPPharmacyType          string       `parquet:"in_dp_pharmacy_type,enum,plain"`
+	DPDosage                string       `parquet:"in_dp_dosage,plain"`
+	DPAdditionalInformation string       `parquet:"in_dp_additional_information,plain"`
+	DPServiceCodes          ServiceCodes `parquet:"in_dp_service_codes,list,plain"`
+	DPNegotiatedRateValue   float64      `parquet:"in_dp_negotiated_rate,plain"`
+	DPNadac                 float64      `parquet:"in_dp_nadac,plain"`
+}
+
 type NegotiatedRate struct {
 	PRList ProviderReferences `parquet:"in_nr_provider_references,list,plain"`
 }
+
+type OutOfNetwork struct {
+	OONName                   string `parquet:"oon_name,plain"`
+	OONDescription            string `parquet:"oon_description,plain"`
+	OONBillingCodeType        string `parquet:"oon_billing_code_type,enum,plain"`
+	OONBillingCode            string `parquet:"oon_billing_code,plain"`
+	OONBillingCodeTypeVersion string `parquet:"oon_billing_code_type_version,plain"`
+}
+
+type AllowedAmounts struct {
+	AATinType      string       `parquet:"oon_aa_tin_type,enum,plain"`
+	AATinValue     string       `parquet:"oon_aa_tin_value,plain"`
+	AAServiceCodes ServiceCodes `parquet:"oon_aa_service_codes,list,plain"`
+	AABillingClass string       `parquet:"oon_aa_billing_class,plain"`
+}
+
+type Payments struct {
+	AllowedAmount               float64              `parquet:"oon_payment_allowed_amount,plain"`
+	PaymentBillingCodeModifiers BillingCodeModifiers `parquet:"oon_payment_billing_code_modifiers,list,plain"`
+}
+
+type PaymentProviders struct {
+	BilledCharge float64 `parquet:"oon_provider_billed_charge,plain"`
+	PPNpiList    NpiList `parquet:"oon_provider_npi_list,list,plain"`
+}
+
+// RateFact is a negotiated price for a service, denormalized with one of the providers it applies to, so that
+// a price lookup doesn't require joining through the in_network, negotiated_rate and provider records.
+type RateFact struct {
+	RFBillingCodeType        string               `parquet:"rf_billing_code_type,enum,plain"`
+	RFBillingCode            string               `parquet:"rf_billing_code,plain"`
+	RFBillingCodeTypeVersion string               `parquet:"rf_billing_code_type_version,plain"`
+	RFName                   string               `parquet:"rf_name,plain"`
+	RFNegotiationArrangement string               `parquet:"rf_negotiation_arrangement,enum,plain"`
+	RFNegotiatedType         string               `parquet:"rf_negotiated_type,enum,plain"`
+	RFNegotiatedRate         float64              `parquet:"rf_negotiated_rate,plain"`
+	RFExpirationDate         string               `parquet:"rf_expiration_date,plain"`
+	RFBillingClass           string               `parquet:"rf_billing_class,plain"`
+	RFServiceCodes           ServiceCodes         `parquet:"rf_service_codes,list,plain"`
+	RFBillingCodeModifiers   BillingCodeModifiers `parquet:"rf_billing_code_modifiers,list,plain"`
+	RFAdditionalInformation  string               `parquet:"rf_additional_information,plain"`
+	RFProviderGroupID        string               `parquet:"rf_provider_group_id,plain"`
+	RFTinType                string               `parquet:"rf_tin_type,enum,plain"`
+	RFTinValue               string               `parquet:"rf_tin_value,plain"`
+	RFNpi                    int64                `parquet:"rf_npi,plain"`
+}
@@ -0,0 +1,212 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package models
+
+// Rows of the normalized output, where each record type is written to its own table containing only
+// the columns relevant to it. Tables are joined on uuid and parent_uuid, as with the wide Mrf table.
+
+type RootRow struct {
+	UUID string `parquet:"uuid,plain"`
+	MrfRoot
+}
+
+type InNetworkRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	InNetwork
+}
+
+type BundledCodesRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	BundledCodes
+}
+
+type CoveredServiceRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	CoveredServices
+}
+
+type NegotiatedRateRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	NegotiatedRate
+}
+
+type NegotiatedPricesRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	NegotiatedPrices
+}
+
+type DrugPriceRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	DrugPrices
+}
+
+type ProviderGroupRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	ProviderGroup
+}
+
+type ProviderRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	Provider
+}
+
+type TinRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	Tin
+}
+
+type OutOfNetworkRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	OutOfNetwork
+}
+
+type AllowedAmountRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	AllowedAmounts
+}
+
+type PaymentRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	Payments
+}
+
+type PaymentProviderRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	PaymentProviders
+}
+
+type RateFactRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	RateFact
+}
+
+func (m *Mrf) RootRow() RootRow {
+	return RootRow{UUID: m.UUID, MrfRoot: m.MrfRoot}
+}
+
+func (m *Mrf) InNetworkRow() InNetworkRow {
+	return InNetworkRow{UUID: m.UUID, ParentUUID: m.ParentUUID, InNetwork: m.InNetwork}
+}
+
+func (m *Mrf) BundledCodesRow() BundledCodesRow {
+	return BundledCodesRow{UUID: m.UUID, ParentUUID: m.ParentUUID, BundledCodes: m.BundledCodes}
+}
+
+func (m *Mrf) CoveredServiceRow() CoveredServiceRow {
+	return CoveredServiceRow{UUID: m.UUID, ParentUUID: m.ParentUUID, CoveredServices: m.CoveredServices}
+}
+
+func (m *Mrf) NegotiatedRateRow() NegotiatedRateRow {
+	return NegotiatedRateRow{UUID: m.UUID, ParentUUID: m.ParentUUID, NegotiatedRate: m.NegotiatedRate}
+}
+
+func (m *Mrf) NegotiatedPricesRow() NegotiatedPricesRow {
+	return NegotiatedPricesRow{UUID: m.UUID, ParentUUID: m.ParentUUID, NegotiatedPrices: m.NegotiatedPrices}
+}
+
+func (m *Mrf) DrugPriceRow() DrugPriceRow {
+	return DrugPriceRow{UUID: m.UUID, ParentUUID: m.ParentUUID, DrugPrices: m.DrugPrices}
+}
+
+func (m *Mrf) ProviderGroupRow() ProviderGroupRow {
+	return ProviderGroupRow{UUID: m.UUID, ParentUUID: m.ParentUUID, ProviderGroup: m.ProviderGroup}
+}
+
+func (m *Mrf) ProviderRow() ProviderRow {
+	return ProviderRow{UUID: m.UUID, ParentUUID: m.ParentUUID, Provider: m.Provider}
+}
+
+func (m *Mrf) TinRow() TinRow {
+	return TinRow{UUID: m.UUID, ParentUUID: m.ParentUUID, Tin: m.Tin}
+}
+
+func (m *Mrf) OutOfNetworkRow() OutOfNetworkRow {
+	return OutOfNetworkRow{UUID: m.UUID, ParentUUID: m.ParentUUID, OutOfNetwork: m.OutOfNetwork}
+}
+
+func (m *Mrf) AllowedAmountRow() AllowedAmountRow {
+	return AllowedAmountRow{UUID: m.UUID, ParentUUID: m.ParentUUID, AllowedAmounts: m.AllowedAmounts}
+}
+
+func (m *Mrf) PaymentRow() PaymentRow {
+	return PaymentRow{UUID: m.UUID, ParentUUID: m.ParentUUID, Payments: m.Payments}
+}
+
+func (m *Mrf) PaymentProviderRow() PaymentProviderRow {
+	return PaymentProviderRow{UUID: m.UUID, ParentUUID: m.ParentUUID, PaymentProviders: m.PaymentProviders}
+}
+
+func (m *Mrf) RateFactRow() RateFactRow {
+	return RateFactRow{UUID: m.UUID, ParentUUID: m.ParentUUID, RateFact: m.RateFact}
+}
+
+// RecordTypes are the record types with a table in the normalized output
+var RecordTypes = []string{"root", "in_network", "bundled_codes", "covered_service", "negotiated_rate",
+	"negotiated_prices", "drug_price", "provider_group", "provider", "tin", "out_of_network", "allowed_amount",
+	"payment", "payment_provider", "rate_fact"}
+
+// TableRow returns m's row in the table of its record type in the normalized output, or nil if the
+// record type has no table
+func (m *Mrf) TableRow() any {
+	switch m.RecordType {
+	case "root":
+		return m.RootRow()
+	case "in_network":
+		return m.InNetworkRow()
+	case "bundled_codes":
+		return m.BundledCodesRow()
+	case "covered_service":
+		return m.CoveredServiceRow()
+	case "negotiated_rate":
+		return m.NegotiatedRateRow()
+	case "negotiated_prices":
+		return m.NegotiatedPricesRow()
+	case "drug_price":
+		return m.DrugPriceRow()
+	case "provider_group":
+		return m.ProviderGroupRow()
+	case "provider":
+		return m.ProviderRow()
+	case "tin":
+		return m.TinRow()
+	case "out_of_network":
+		return m.OutOfNetworkRow()
+	case "allowed_amount":
+		return m.AllowedAmountRow()
+	case "payment":
+		return m.PaymentRow()
+	case "payment_provider":
+		return m.PaymentProviderRow()
+	case "rate_fact":
+		return m.RateFactRow()
+	default:
+		return nil
+	}
+}
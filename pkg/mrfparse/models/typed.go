@@ -0,0 +1,341 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package models
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Rows of the typed schema, set by writer.schema. Dates are written with the DATE logical type and
+// amounts as DECIMAL(18,4), in place of the strings and doubles of the MRF. Only the record types with
+// dates or amounts have typed rows. Other record types are written with the same rows as the string schema.
+//
+// Dates are stored as days since the Unix epoch, and amounts scaled by 10^DecimalScale. Dates are
+// pointers so that empty dates may be written as null and 1970-01-01, day 0, as a date. parquet-go's
+// date tag doesn't support pointers, so the writer sets the DATE logical type of the DateColumns.
+
+// DecimalScale is the number of decimal places of the typed schema's amounts
+const DecimalScale = 4
+
+// DateColumns are the date columns of the typed schema
+var DateColumns = []string{"last_updated_on", "in_np_expiration_date", "in_dp_expiration_date", "rf_expiration_date"}
+
+// decimalFactor scales an amount to a DECIMAL(18,4) unscaled value
+const decimalFactor = 10_000
+
+// dateLayouts are the date formats found in payers' MRFs, tried in order
+var dateLayouts = []string{
+	"2006-1-2",
+	"2006/1/2",
+	"20060102",
+	"1/2/2006",
+	"1-2-2006",
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+// ParseDate parses a MRF date in any of the formats used by payers, returning the number of days
+// since the Unix epoch. An empty date is returned as 0.
+func ParseDate(s string) (int32, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	for _, layout := range dateLayouts {
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			continue
+		}
+
+		y, m, d := t.Date()
+
+		return int32(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86_400), nil
+	}
+
+	return 0, fmt.Errorf("unrecognized date %q", s)
+}
+
+// Decimal returns the DECIMAL(18,4) unscaled value of amount, rounded to 4 decimal places
+func Decimal(amount float64) int64 {
+	return int64(math.Round(amount * decimalFactor))
+}
+
+// date returns the typed value of s, or null if s is empty or isn't a valid date
+func date(s string) *int32 {
+	if s == "" {
+		return nil
+	}
+
+	d, err := ParseDate(s)
+	if err != nil {
+		return nil
+	}
+
+	return &d
+}
+
+// ValidateDates returns an error naming the first date column of m that isn't a valid date, so
+// that the record may be rejected rather than written to the typed schema with a null date
+func (m *Mrf) ValidateDates() error {
+	values := []string{m.LastUpdatedOn, m.ExpirationDate, m.DPExpirationDate, m.RFExpirationDate}
+
+	for i, value := range values {
+		if _, err := ParseDate(value); err != nil {
+			return fmt.Errorf("%s: %w", DateColumns[i], err)
+		}
+	}
+
+	return nil
+}
+
+// TypedMrf is the wide Mrf table with the typed schema
+type TypedMrf struct {
+	TypedMrfRoot
+	InNetwork
+
+	BundledCodes
+	CoveredServices
+	Tin
+	ProviderGroup
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	RecordType string `parquet:"record_type,enum,plain"`
+
+	Provider
+
+	NegotiatedRate
+
+	TypedNegotiatedPrices
+	TypedDrugPrices
+
+	OutOfNetwork
+	AllowedAmounts
+	TypedPayments
+	TypedPaymentProviders
+
+	TypedRateFact
+}
+
+type TypedMrfRoot struct {
+	ReportingEntityName string `parquet:"reporting_entity_name,plain"`
+	ReportingEntityType string `parquet:"reporting_entity_type,plain"`
+	LastUpdatedOn       *int32 `parquet:"last_updated_on,plain"`
+	Version             string `parquet:"version,plain"`
+	Plan
+}
+
+type TypedNegotiatedPrices struct {
+	NegotiatedType        string               `parquet:"in_np_negotiated_type,enum,plain"`
+	BillingClass          string               `parquet:"in_np_billing_class,plain"`
+	ExpirationDate        *int32               `parquet:"in_np_expiration_date,plain"`
+	AdditionalInformation string               `parquet:"in_np_additional_information,plain"`
+	ServiceCodes          ServiceCodes         `parquet:"in_np_service_codes,list,plain"`
+	BillingCodeModifiers  BillingCodeModifiers `parquet:"in_np_billing_code_modifiers,list,plain"`
+	NegotiatedRateValue   int64                `parquet:"in_np_negotiated_rate,decimal(4:18),plain"`
+}
+
+type TypedDrugPrices struct {
+	DPNegotiatedType        string       `parquet:"in_dp_negotiated_type,enum,plain"`
+	DPExpirationDate        *int32       `parquet:"in_dp_expiration_date,plain"`
+	DPPharmacyType          string       `parquet:"in_dp_pharmacy_type,enum,plain"`
+	DPDosage                string       `parquet:"in_dp_dosage,plain"`
+	DPAdditionalInformation string       `parquet:"in_dp_additional_information,plain"`
+	DPServiceCodes          ServiceCodes `parquet:"in_dp_service_codes,list,plain"`
+	DPNegotiatedRateValue   int64        `parquet:"in_dp_negotiated_rate,decimal(4:18),plain"`
+	DPNadac                 int64        `parquet:"in_dp_nadac,decimal(4:18),plain"`
+}
+
+type TypedPayments struct {
+	AllowedAmount               int64                `parquet:"oon_payment_allowed_amount,decimal(4:18),plain"`
+	PaymentBillingCodeModifiers BillingCodeModifiers `parquet:"oon_payment_billing_code_modifiers,list,plain"`
+}
+
+type TypedPaymentProviders struct {
+	BilledCharge int64   `parquet:"oon_provider_billed_charge,decimal(4:18),plain"`
+	PPNpiList    NpiList `parquet:"oon_provider_npi_list,list,plain"`
+}
+
+type TypedRateFact struct {
+	RFBillingCodeType        string               `parquet:"rf_billing_code_type,enum,plain"`
+	RFBillingCode            string               `parquet:"rf_billing_code,plain"`
+	RFBillingCodeTypeVersion string               `parquet:"rf_billing_code_type_version,plain"`
+	RFName                   string               `parquet:"rf_name,plain"`
+	RFNegotiationArrangement string               `parquet:"rf_negotiation_arrangement,enum,plain"`
+	RFNegotiatedType         string               `parquet:"rf_negotiated_type,enum,plain"`
+	RFNegotiatedRate         int64                `parquet:"rf_negotiated_rate,decimal(4:18),plain"`
+	RFExpirationDate         *int32               `parquet:"rf_expiration_date,plain"`
+	RFBillingClass           string               `parquet:"rf_billing_class,plain"`
+	RFServiceCodes           ServiceCodes         `parquet:"rf_service_codes,list,plain"`
+	RFBillingCodeModifiers   BillingCodeModifiers `parquet:"rf_billing_code_modifiers,list,plain"`
+	RFAdditionalInformation  string               `parquet:"rf_additional_information,plain"`
+	RFProviderGroupID        string               `parquet:"rf_provider_group_id,plain"`
+	RFTinType                string               `parquet:"rf_tin_type,enum,plain"`
+	RFTinValue               string               `parquet:"rf_tin_value,plain"`
+	RFNpi                    int64                `parquet:"rf_npi,plain"`
+}
+
+func (r *MrfRoot) typed() TypedMrfRoot {
+	return TypedMrfRoot{
+		ReportingEntityName: r.ReportingEntityName,
+		ReportingEntityType: r.ReportingEntityType,
+		LastUpdatedOn:       date(r.LastUpdatedOn),
+		Version:             r.Version,
+		Plan:                r.Plan,
+	}
+}
+
+func (p *NegotiatedPrices) typed() TypedNegotiatedPrices {
+	return TypedNegotiatedPrices{
+		NegotiatedType:        p.NegotiatedType,
+		BillingClass:          p.BillingClass,
+		ExpirationDate:        date(p.ExpirationDate),
+		AdditionalInformation: p.AdditionalInformation,
+		ServiceCodes:          p.ServiceCodes,
+		BillingCodeModifiers:  p.BillingCodeModifiers,
+		NegotiatedRateValue:   Decimal(p.NegotiatedRateValue),
+	}
+}
+
+func (p *DrugPrices) typed() TypedDrugPrices {
+	return TypedDrugPrices{
+		DPNegotiatedType:        p.DPNegotiatedType,
+		DPExpirationDate:        date(p.DPExpirationDate),
+		DPPharmacyType:          p.DPPharmacyType,
+		DPDosage:                p.DPDosage,
+		DPAdditionalInformation: p.DPAdditionalInformation,
+		DPServiceCodes:          p.DPServiceCodes,
+		DPNegotiatedRateValue:   Decimal(p.DPNegotiatedRateValue),
+		DPNadac:                 Decimal(p.DPNadac),
+	}
+}
+
+func (p *Payments) typed() TypedPayments {
+	return TypedPayments{
+		AllowedAmount:               Decimal(p.AllowedAmount),
+		PaymentBillingCodeModifiers: p.PaymentBillingCodeModifiers,
+	}
+}
+
+func (p *PaymentProviders) typed() TypedPaymentProviders {
+	return TypedPaymentProviders{BilledCharge: Decimal(p.BilledCharge), PPNpiList: p.PPNpiList}
+}
+
+func (f *RateFact) typed() TypedRateFact {
+	return TypedRateFact{
+		RFBillingCodeType:        f.RFBillingCodeType,
+		RFBillingCode:            f.RFBillingCode,
+		RFBillingCodeTypeVersion: f.RFBillingCodeTypeVersion,
+		RFName:                   f.RFName,
+		RFNegotiationArrangement: f.RFNegotiationArrangement,
+		RFNegotiatedType:         f.RFNegotiatedType,
+		RFNegotiatedRate:         Decimal(f.RFNegotiatedRate),
+		RFExpirationDate:         date(f.RFExpirationDate),
+		RFBillingClass:           f.RFBillingClass,
+		RFServiceCodes:           f.RFServiceCodes,
+		RFBillingCodeModifiers:   f.RFBillingCodeModifiers,
+		RFAdditionalInformation:  f.RFAdditionalInformation,
+		RFProviderGroupID:        f.RFProviderGroupID,
+		RFTinType:                f.RFTinType,
+		RFTinValue:               f.RFTinValue,
+		RFNpi:                    f.RFNpi,
+	}
+}
+
+// TypedRow returns m's row in the wide table with the typed schema. Dates that aren't valid are null.
+func (m *Mrf) TypedRow() TypedMrf {
+	return TypedMrf{
+		TypedMrfRoot:          m.MrfRoot.typed(),
+		InNetwork:             m.InNetwork,
+		BundledCodes:          m.BundledCodes,
+		CoveredServices:       m.CoveredServices,
+		Tin:                   m.Tin,
+		ProviderGroup:         m.ProviderGroup,
+		UUID:                  m.UUID,
+		ParentUUID:            m.ParentUUID,
+		RecordType:            m.RecordType,
+		Provider:              m.Provider,
+		NegotiatedRate:        m.NegotiatedRate,
+		TypedNegotiatedPrices: m.NegotiatedPrices.typed(),
+		TypedDrugPrices:       m.DrugPrices.typed(),
+		OutOfNetwork:          m.OutOfNetwork,
+		AllowedAmounts:        m.AllowedAmounts,
+		TypedPayments:         m.Payments.typed(),
+		TypedPaymentProviders: m.PaymentProviders.typed(),
+		TypedRateFact:         m.RateFact.typed(),
+	}
+}
+
+type TypedRootRow struct {
+	UUID string `parquet:"uuid,plain"`
+	TypedMrfRoot
+}
+
+type TypedNegotiatedPricesRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	TypedNegotiatedPrices
+}
+
+type TypedDrugPriceRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	TypedDrugPrices
+}
+
+type TypedPaymentRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	TypedPayments
+}
+
+type TypedPaymentProviderRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	TypedPaymentProviders
+}
+
+type TypedRateFactRow struct {
+	UUID       string `parquet:"uuid,plain"`
+	ParentUUID string `parquet:"parent_uuid,plain"`
+	TypedRateFact
+}
+
+func (m *Mrf) TypedRootRow() TypedRootRow {
+	return TypedRootRow{UUID: m.UUID, TypedMrfRoot: m.MrfRoot.typed()}
+}
+
+func (m *Mrf) TypedNegotiatedPricesRow() TypedNegotiatedPricesRow {
+	return TypedNegotiatedPricesRow{UUID: m.UUID, ParentUUID: m.ParentUUID, TypedNegotiatedPrices: m.NegotiatedPrices.typed()}
+}
+
+func (m *Mrf) TypedDrugPriceRow() TypedDrugPriceRow {
+	return TypedDrugPriceRow{UUID: m.UUID, ParentUUID: m.ParentUUID, TypedDrugPrices: m.DrugPrices.typed()}
+}
+
+func (m *Mrf) TypedPaymentRow() TypedPaymentRow {
+	return TypedPaymentRow{UUID: m.UUID, ParentUUID: m.ParentUUID, TypedPayments: m.Payments.typed()}
+}
+
+func (m *Mrf) TypedPaymentProviderRow() TypedPaymentProviderRow {
+	return TypedPaymentProviderRow{UUID: m.UUID, ParentUUID: m.ParentUUID, TypedPaymentProviders: m.PaymentProviders.typed()}
+}
+
+func (m *Mrf) TypedRateFactRow() TypedRateFactRow {
+	return TypedRateFactRow{UUID: m.UUID, ParentUUID: m.ParentUUID, TypedRateFact: m.RateFact.typed()}
+}
@@ -0,0 +1,349 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
+
+	"github.com/minio/simdjson-go"
+)
+
+// parseAllowedAmountsFileset parses the out_of_network files of an allowed-amounts fileset.
+func (run *parseRun) parseAllowedAmountsFileset(filesList []string, rootUUID string) error {
+	start := time.Now()
+
+	for i := range filesList {
+		f := filepath.Base(filesList[i])
+		if strings.HasPrefix(f, "out_of_network_") {
+			log.Info("Found out_of_network file", f)
+
+			err := run.parseOutOfNetwork(filesList[i], rootUUID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Wait for all out_of_network threads to finish
+	log.Debug("Waiting for out_of_network threads to finish.")
+
+	err := run.oonGroup.Wait()
+	if err != nil {
+		return err
+	}
+
+	run.timed("out_of_network", start)
+
+	return nil
+}
+
+// parseOutOfNetwork parses out_of_network_*.json files. It stops reading if a parse task fails.
+func (run *parseRun) parseOutOfNetwork(filename, rootUUID string) error {
+	log.Info("Parsing out_of_network: ", filename)
+
+	err := run.scanFile(filename, run.parser.oonBatchSize, run.oonGroup, func(lines *string) error {
+		return run.parseOONLines(lines, rootUUID)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("Completed reading out_of_network: ", filename)
+
+	return nil
+}
+
+// parseOONLines parses out_of_network lines, each of which is a json object.
+func (run *parseRun) parseOONLines(lines *string, rootUUID string) error {
+	parsed, err := utils.ParseJSON(lines, nil)
+	if err != nil {
+		return err
+	}
+
+	var (
+		iter    = parsed.Iter()
+		tmpIter *simdjson.Iter
+		mrfList []*models.Mrf
+	)
+
+	for {
+		typ := iter.Advance()
+
+		if typ == simdjson.TypeRoot {
+			_, tmpIter, err = iter.Root(nil)
+			if err != nil {
+				return err
+			}
+
+			mrfList, err = parseOONObject(tmpIter, rootUUID, run.serviceList)
+			// if we get a NotInListError, skip this record as it's not in the serviceList
+			if e, ok := err.(*NotInListError); ok {
+				log.Tracef("Skipping out_of_network record. %s", e.Error())
+				run.skippedOON.Add(1)
+
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			err = run.writeRecords(mrfList)
+			if err != nil {
+				return err
+			}
+		} else if typ == simdjson.TypeNone {
+			break
+		}
+	}
+
+	return nil
+}
+
+// parseOONObject parses an out_of_network object, returning the out_of_network record and its
+// allowed_amounts, payments and providers records.
+func parseOONObject(iter *simdjson.Iter, rootUUID string, serviceList *ServiceList) ([]*models.Mrf, error) {
+	var (
+		err                 error
+		mrf                 *models.Mrf
+		mrfList, mrfListTmp []*models.Mrf
+	)
+
+	mrf, err = parseOONRoot(iter, rootUUID, serviceList)
+	if err != nil {
+		return nil, err
+	}
+
+	mrfList = append(mrfList, mrf)
+
+	mrfListTmp, err = parseAllowedAmounts(iter, mrf.UUID)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("Got allowed_amounts: ", len(mrfListTmp), " records")
+
+	mrfList = append(mrfList, mrfListTmp...)
+
+	return mrfList, nil
+}
+
+// parseOONRoot parses the root of an out_of_network object, returning an Mrf record.
+// If the service is not in the serviceList, it returns a NotInListError
+func parseOONRoot(iter *simdjson.Iter, rootUUID string, serviceList *ServiceList) (*models.Mrf, error) {
+	var uuid = utils.GetUniqueID()
+
+	bct, bc, ok, err := isServiceInList(iter, serviceList)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, &NotInListError{bc}
+	}
+
+	log.Tracef("Found service %s %s", bct, bc)
+
+	name, err := utils.GetElementValue[string]("name", iter)
+	if err != nil {
+		return nil, err
+	}
+
+	bcv, err := utils.GetElementValue[string]("billing_code_type_version", iter)
+	if err != nil {
+		return nil, err
+	}
+
+	path := "description"
+	desc, err := utils.GetElementValue[string](path, iter)
+	if utils.TestElementNotPresent(err, path) {
+		desc = ""
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &models.Mrf{UUID: uuid, ParentUUID: rootUUID, RecordType: "out_of_network",
+		OutOfNetwork: models.OutOfNetwork{OONName: name, OONDescription: desc, OONBillingCodeType: bct,
+			OONBillingCode: bc, OONBillingCodeTypeVersion: bcv}}, nil
+}
+
+// parseAllowedAmounts parses the allowed_amounts array of an out_of_network object
+func parseAllowedAmounts(iter *simdjson.Iter, oonUUID string) ([]*models.Mrf, error) {
+	var (
+		err                error
+		mrfList, pmMrfList []*models.Mrf
+		scs                []string
+		uuid, path         string
+	)
+
+	aa, err := utils.GetArrayForElement("allowed_amounts", iter)
+	if err != nil {
+		return nil, err
+	}
+
+	aaIter := aa.Iter()
+
+	for {
+		typ := aaIter.Advance()
+
+		if typ == simdjson.TypeObject {
+			uuid = utils.GetUniqueID()
+
+			tin, err := aaIter.FindElement(nil, "tin")
+			if err != nil {
+				return nil, err
+			}
+
+			tt, err := utils.GetElementValue[string]("type", &tin.Iter)
+			if err != nil {
+				return nil, err
+			}
+
+			tv, err := utils.GetElementValue[string]("value", &tin.Iter)
+			if err != nil {
+				return nil, err
+			}
+
+			bc, err := utils.GetElementValue[string]("billing_class", &aaIter)
+			if err != nil {
+				return nil, err
+			}
+
+			path = "service_code"
+			scs, err = utils.GetArrayElementAsSlice[string](path, &aaIter)
+			if utils.TestElementNotPresent(err, path) {
+				scs = []string{}
+			} else if err != nil {
+				return nil, err
+			}
+
+			mrfList = append(mrfList, &models.Mrf{UUID: uuid, ParentUUID: oonUUID, RecordType: "allowed_amount",
+				AllowedAmounts: models.AllowedAmounts{AATinType: tt, AATinValue: tv, AAServiceCodes: scs,
+					AABillingClass: bc}})
+
+			pmMrfList, err = parsePayments(&aaIter, uuid)
+			if err != nil {
+				return nil, err
+			}
+
+			mrfList = append(mrfList, pmMrfList...)
+		} else if typ == simdjson.TypeNone {
+			break
+		}
+	}
+
+	return mrfList, nil
+}
+
+// parsePayments parses the payments array of an allowed_amounts object
+func parsePayments(iter *simdjson.Iter, aaUUID string) ([]*models.Mrf, error) {
+	var (
+		err                error
+		mrfList, ppMrfList []*models.Mrf
+		bcms               []string
+		uuid, path         string
+	)
+
+	pm, err := utils.GetArrayForElement("payments", iter)
+	if err != nil {
+		return nil, err
+	}
+
+	pmIter := pm.Iter()
+
+	for {
+		typ := pmIter.Advance()
+
+		if typ == simdjson.TypeObject {
+			uuid = utils.GetUniqueID()
+
+			aa, err := utils.GetElementValue[float64]("allowed_amount", &pmIter)
+			if err != nil {
+				return nil, err
+			}
+
+			path = "billing_code_modifier"
+			bcms, err = utils.GetArrayElementAsSlice[string](path, &pmIter)
+			if utils.TestElementNotPresent(err, path) {
+				bcms = []string{}
+			} else if err != nil {
+				return nil, err
+			}
+
+			mrfList = append(mrfList, &models.Mrf{UUID: uuid, ParentUUID: aaUUID, RecordType: "payment",
+				Payments: models.Payments{AllowedAmount: aa, PaymentBillingCodeModifiers: bcms}})
+
+			ppMrfList, err = parsePaymentProviders(&pmIter, uuid)
+			if err != nil {
+				return nil, err
+			}
+
+			mrfList = append(mrfList, ppMrfList...)
+		} else if typ == simdjson.TypeNone {
+			break
+		}
+	}
+
+	return mrfList, nil
+}
+
+// parsePaymentProviders parses the providers array of a payments object. providers is optional
+// as payers may omit it when there are fewer than 11 claims for the service.
+func parsePaymentProviders(iter *simdjson.Iter, pmUUID string) ([]*models.Mrf, error) {
+	var (
+		mrfList []*models.Mrf
+		npi     []int64
+	)
+
+	path := "providers"
+	pp, err := utils.GetArrayForElement(path, iter)
+	if utils.TestElementNotPresent(err, path) {
+		return mrfList, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ppIter := pp.Iter()
+
+	for {
+		typ := ppIter.Advance()
+
+		if typ == simdjson.TypeObject {
+			bc, err := utils.GetElementValue[float64]("billed_charge", &ppIter)
+			if err != nil {
+				return nil, err
+			}
+
+			npi, err = utils.GetArrayElementAsSlice[int64]("npi", &ppIter)
+			if err != nil {
+				return nil, err
+			}
+
+			mrfList = append(mrfList, &models.Mrf{UUID: utils.GetUniqueID(), ParentUUID: pmUUID,
+				RecordType:       "payment_provider",
+				PaymentProviders: models.PaymentProviders{BilledCharge: bc, PPNpiList: npi}})
+		} else if typ == simdjson.TypeNone {
+			break
+		}
+	}
+
+	return mrfList, nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"testing"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var oonJSON = []byte(`{
+	"name": "Office visit, established patient",
+	"billing_code_type": "CPT",
+	"billing_code_type_version": "2022",
+	"billing_code": "99213",
+	"description": "Office or other outpatient visit",
+	"allowed_amounts": [
+	  {
+		"tin": { "type": "ein", "value": "123456789" },
+		"service_code": ["11"],
+		"billing_class": "professional",
+		"payments": [
+		  {
+			"allowed_amount": 85.5,
+			"billing_code_modifier": ["25"],
+			"providers": [
+			  { "billed_charge": 120.0, "npi": [1234567890, 1234567891] },
+			  { "billed_charge": 150.0, "npi": [1234567892] }
+			]
+		  },
+		  {
+			"allowed_amount": 70.0
+		  }
+		]
+	  },
+	  {
+		"tin": { "type": "npi", "value": "1234567893" },
+		"billing_class": "institutional",
+		"payments": [
+		  {
+			"allowed_amount": 200.0,
+			"providers": [
+			  { "billed_charge": 300.0, "npi": [1234567893] }
+			]
+		  }
+		]
+	  }
+	]
+}`)
+
+func TestParseOONObject(t *testing.T) {
+	jp, err := utils.ParseJSON(&oonJSON, nil)
+	assert.NoError(t, err)
+
+	iter := jp.Iter()
+
+	mrfList, err := parseOONObject(&iter, "rootUUID", NewServiceList("99213"))
+	assert.NoError(t, err)
+
+	oon := mrfList[0]
+	assert.Equal(t, "out_of_network", oon.RecordType)
+	assert.Equal(t, "rootUUID", oon.ParentUUID)
+	assert.Equal(t, "Office visit, established patient", oon.OONName)
+	assert.Equal(t, "CPT", oon.OONBillingCodeType)
+	assert.Equal(t, "99213", oon.OONBillingCode)
+	assert.Equal(t, "2022", oon.OONBillingCodeTypeVersion)
+	assert.Equal(t, "Office or other outpatient visit", oon.OONDescription)
+
+	aaMrf := utils.Filter(mrfList, func(mrf *models.Mrf) bool {
+		return mrf.RecordType == "allowed_amount"
+	})
+
+	assert.Equal(t, 2, len(aaMrf))
+	assert.Equal(t, oon.UUID, aaMrf[0].ParentUUID)
+	assert.Equal(t, "ein", aaMrf[0].AATinType)
+	assert.Equal(t, "123456789", aaMrf[0].AATinValue)
+	assert.Equal(t, models.ServiceCodes{"11"}, aaMrf[0].AAServiceCodes)
+	assert.Equal(t, "professional", aaMrf[0].AABillingClass)
+	assert.Equal(t, models.ServiceCodes{}, aaMrf[1].AAServiceCodes)
+
+	pmMrf := utils.Filter(mrfList, func(mrf *models.Mrf) bool {
+		return mrf.RecordType == "payment"
+	})
+
+	assert.Equal(t, 3, len(pmMrf))
+	assert.Equal(t, aaMrf[0].UUID, pmMrf[0].ParentUUID)
+	assert.Equal(t, 85.5, pmMrf[0].AllowedAmount)
+	assert.Equal(t, models.BillingCodeModifiers{"25"}, pmMrf[0].PaymentBillingCodeModifiers)
+	assert.Equal(t, 70.0, pmMrf[1].AllowedAmount)
+	assert.Equal(t, aaMrf[1].UUID, pmMrf[2].ParentUUID)
+
+	ppMrf := utils.Filter(mrfList, func(mrf *models.Mrf) bool {
+		return mrf.RecordType == "payment_provider"
+	})
+
+	assert.Equal(t, 3, len(ppMrf))
+	assert.Equal(t, pmMrf[0].UUID, ppMrf[0].ParentUUID)
+	assert.Equal(t, 120.0, ppMrf[0].BilledCharge)
+	assert.Equal(t, models.NpiList{1234567890, 1234567891}, ppMrf[0].PPNpiList)
+	assert.Equal(t, pmMrf[2].UUID, ppMrf[2].ParentUUID)
+}
+
+func TestParseOONObjectNotInServiceList(t *testing.T) {
+	jp, err := utils.ParseJSON(&oonJSON, nil)
+	assert.NoError(t, err)
+
+	iter := jp.Iter()
+
+	_, err = parseOONObject(&iter, "rootUUID", NewServiceList("99214"))
+	_, ok := err.(*NotInListError)
+	assert.Equal(t, true, ok)
+}
+
+func TestParsePaymentProvidersMissing(t *testing.T) {
+	var j = []byte(`{"allowed_amount": 70.0}`)
+
+	jp, err := utils.ParseJSON(&j, nil)
+	assert.NoError(t, err)
+
+	iter := jp.Iter()
+
+	mrfList, err := parsePaymentProviders(&iter, "pmUUID")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(mrfList))
+}
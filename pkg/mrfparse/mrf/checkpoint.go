@@ -0,0 +1,454 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
+
+	"github.com/spf13/viper"
+	"gocloud.dev/gcerrors"
+)
+
+// CheckpointFile is the name of the checkpoint written to the output of a parse of a split fileset, from which
+// the parse may be resumed should it fail. It is removed once the parse completes.
+const CheckpointFile = "_checkpoint.json"
+
+// DefaultCheckpointInterval is the interval between checkpoints, unless set by checkpoint.interval in minutes
+const DefaultCheckpointInterval = 15 * time.Minute
+
+// ErrResumeUnsupported is returned when resuming a parse that can't be checkpointed
+var ErrResumeUnsupported = errors.New("only parses of split in-network-rates and allowed-amounts filesets to the parquet format may be resumed")
+
+// checkpointState is a checkpoint of a parse of a split fileset. Every record parsed from the lines in Files
+// had been written to a closed file when the checkpoint was taken.
+type checkpointState struct {
+	Source   string `json:"source"`
+	RootUUID string `json:"root_uuid"`
+	// Files is the progress of each split file, by its base name
+	Files map[string]*fileProgress `json:"files"`
+	// Providers is the providers set used to filter provider_references
+	Providers []string        `json:"providers"`
+	Stats     checkpointStats `json:"stats"`
+	// Sink is the state of the RecordSink
+	Sink json.RawMessage `json:"sink"`
+}
+
+// checkpointStats are the counts recorded in the Manifest at a checkpoint
+type checkpointStats struct {
+	Records          map[string]int64 `json:"records"`
+	Services         []string         `json:"services"`
+	SkippedIn        int64            `json:"skipped_in_network"`
+	SkippedOON       int64            `json:"skipped_out_of_network"`
+	TotalProviders   int32            `json:"total_providers"`
+	MatchedProviders int32            `json:"matched_providers"`
+}
+
+// fileProgress is the progress of parsing a split file
+type fileProgress struct {
+	// Done are the sorted, disjoint ranges of lines [start, end) that have been parsed
+	Done [][2]int `json:"done"`
+	// Lines is the number of lines in the file, once it has been read to the end
+	Lines int `json:"lines,omitempty"`
+}
+
+// add records the lines [start, end) as parsed, merging adjacent ranges
+func (f *fileProgress) add(start, end int) {
+	i := sort.Search(len(f.Done), func(i int) bool { return f.Done[i][0] > start })
+
+	f.Done = append(f.Done, [2]int{})
+	copy(f.Done[i+1:], f.Done[i:])
+	f.Done[i] = [2]int{start, end}
+
+	merged := f.Done[:1]
+
+	for _, r := range f.Done[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] <= last[1] {
+			if r[1] > last[1] {
+				last[1] = r[1]
+			}
+
+			continue
+		}
+
+		merged = append(merged, r)
+	}
+
+	f.Done = merged
+}
+
+// done returns true if line has been parsed. A nil fileProgress has parsed no lines.
+func (f *fileProgress) done(line int) bool {
+	if f == nil {
+		return false
+	}
+
+	i := sort.Search(len(f.Done), func(i int) bool { return f.Done[i][1] > line })
+
+	return i < len(f.Done) && f.Done[i][0] <= line
+}
+
+// complete returns true if every line of the file has been parsed
+func (f *fileProgress) complete() bool {
+	return f != nil && f.Lines > 0 && len(f.Done) == 1 && f.Done[0] == [2]int{0, f.Lines}
+}
+
+func (f *fileProgress) clone() *fileProgress {
+	return &fileProgress{Done: append([][2]int(nil), f.Done...), Lines: f.Lines}
+}
+
+// checkpointer records the progress of a parse of a split fileset, and periodically checkpoints it. Batches of
+// lines are parsed holding mu for reading, while checkpoints are taken holding it for writing, so that each
+// batch's records have either all been written to the RecordWriter when a checkpoint is taken, or none.
+//
+// A nil checkpointer records nothing, as is the case for parses that aren't checkpointed.
+type checkpointer struct {
+	mu       sync.RWMutex
+	writer   checkpointWriter
+	uri      string
+	interval time.Duration
+	rootUUID string
+	// resumed is the progress of each file at the checkpoint resumed from
+	resumed map[string]*fileProgress
+	// filesMu guards files, as batches are recorded concurrently
+	filesMu sync.Mutex
+	files   map[string]*fileProgress
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// progress returns the progress of the file name at the checkpoint resumed from, or nil
+func (c *checkpointer) progress(name string) *fileProgress {
+	if c == nil {
+		return nil
+	}
+
+	return c.resumed[name]
+}
+
+// parseBatch parses the lines [start, end) of the file name with parse, recording them once parsed
+func (c *checkpointer) parseBatch(name string, start, end int, parse func() error) error {
+	if c == nil {
+		return parse()
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	err := parse()
+	if err != nil {
+		return err
+	}
+
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+
+	c.file(name).add(start, end)
+
+	return nil
+}
+
+// setLines records the number of lines in the file name, once it has been read to the end
+func (c *checkpointer) setLines(name string, lines int) {
+	if c == nil {
+		return
+	}
+
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+
+	c.file(name).Lines = lines
+}
+
+// file returns the progress of the file name, creating it if need be. filesMu must be held.
+func (c *checkpointer) file(name string) *fileProgress {
+	f, ok := c.files[name]
+	if !ok {
+		f = &fileProgress{}
+		c.files[name] = f
+	}
+
+	return f
+}
+
+// checkpointWriter is implemented by RecordWriters whose output may be checkpointed and resumed
+type checkpointWriter interface {
+	RecordWriter
+	// checkpoints returns true if the output supports checkpoints
+	checkpoints() bool
+	// checkpoint closes any open files and returns the state of the output
+	checkpoint() ([]byte, error)
+	// resume restores the state returned by checkpoint, before any records are written
+	resume(state []byte) error
+}
+
+// checkpointInterval returns the interval between checkpoints, set by checkpoint.interval in minutes
+func checkpointInterval() time.Duration {
+	if viper.IsSet("checkpoint.interval") {
+		return time.Duration(viper.GetInt("checkpoint.interval")) * time.Minute
+	}
+
+	return DefaultCheckpointInterval
+}
+
+// initCheckpoints sets up the checkpointing of a parse of a split fileset, if it's enabled and supported by the
+// run's writer. If the parse is resumed from a checkpoint, the writer, providers set and counts are restored, and
+// the root UUID of the checkpoint is returned. Otherwise, the root UUID is empty and the root should be written.
+func (run *parseRun) initCheckpoints() (string, error) {
+	p := run.parser
+
+	if p.rateFacts || (p.checkpointInterval <= 0 && !p.resume) {
+		if p.resume {
+			return "", ErrResumeUnsupported
+		}
+
+		return "", nil
+	}
+
+	w, ok := run.writer.(checkpointWriter)
+	if !ok || !w.checkpoints() {
+		if p.resume {
+			return "", ErrResumeUnsupported
+		}
+
+		log.Debug("The writer doesn't support checkpoints. Parsing without them.")
+
+		return "", nil
+	}
+
+	run.checkpoints = &checkpointer{
+		writer:   w,
+		uri:      cloud.JoinURI(run.outputPath, CheckpointFile),
+		interval: p.checkpointInterval,
+		resumed:  make(map[string]*fileProgress),
+		files:    make(map[string]*fileProgress),
+	}
+
+	if !p.resume {
+		return "", nil
+	}
+
+	state, err := loadCheckpoint(run.ctx, run.checkpoints.uri)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Info("No checkpoint found at ", run.checkpoints.uri, ". Parsing from the start.")
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if state.Source != run.source.URI {
+		return "", fmt.Errorf("checkpoint at %s is of a parse of %s, not %s", run.checkpoints.uri, state.Source, run.source.URI)
+	}
+
+	err = run.restore(state)
+	if err != nil {
+		return "", err
+	}
+
+	log.Info("Resuming from checkpoint ", run.checkpoints.uri)
+
+	return state.RootUUID, nil
+}
+
+// restore restores the writer, providers set, counts and progress of the run from state
+func (run *parseRun) restore(state *checkpointState) error {
+	c := run.checkpoints
+
+	if len(state.Sink) == 0 {
+		return fmt.Errorf("checkpoint at %s has no writer state", c.uri)
+	}
+
+	err := c.writer.resume(state.Sink)
+	if err != nil {
+		return err
+	}
+
+	c.rootUUID = state.RootUUID
+
+	for name, f := range state.Files {
+		c.resumed[name] = f
+		c.files[name] = f.clone()
+	}
+
+	run.providers.Add(state.Providers...)
+
+	stats := state.Stats
+	for recordType, n := range stats.Records {
+		run.stats.records[recordType] = n
+	}
+
+	for _, service := range stats.Services {
+		run.stats.services.Add(service)
+	}
+
+	run.skippedIn.Store(stats.SkippedIn)
+	run.skippedOON.Store(stats.SkippedOON)
+	run.totalProviders.Store(stats.TotalProviders)
+	run.matchedProviders.Store(stats.MatchedProviders)
+
+	return nil
+}
+
+// loadCheckpoint reads the checkpoint at uri, returning an error wrapping os.ErrNotExist if there is none
+func loadCheckpoint(ctx context.Context, uri string) (*checkpointState, error) {
+	r, err := cloud.NewReader(ctx, uri)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, fmt.Errorf("%s: %w", uri, os.ErrNotExist)
+		}
+
+		return nil, err
+	}
+
+	defer r.Close()
+
+	doc, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var state checkpointState
+
+	err = json.Unmarshal(doc, &state)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read checkpoint %s: %w", uri, err)
+	}
+
+	return &state, nil
+}
+
+// startCheckpoints starts checkpointing the run every interval, once the root has been written with rootUUID
+func (run *parseRun) startCheckpoints(rootUUID string) {
+	c := run.checkpoints
+	if c == nil {
+		return
+	}
+
+	c.rootUUID = rootUUID
+
+	if c.interval <= 0 {
+		return
+	}
+
+	c.stop = make(chan struct{})
+	c.stopped = make(chan struct{})
+
+	go func() {
+		defer close(c.stopped)
+
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				run.checkpoint()
+			case <-c.stop:
+				return
+			case <-run.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stopCheckpoints stops checkpointing the run, waiting for any checkpoint being taken
+func (run *parseRun) stopCheckpoints() {
+	c := run.checkpoints
+	if c == nil || c.stop == nil {
+		return
+	}
+
+	close(c.stop)
+	<-c.stopped
+
+	c.stop = nil
+}
+
+// checkpoint waits for the batches being parsed to be written, checkpoints the writer, and writes the
+// checkpoint. Failing to checkpoint doesn't fail the parse, so errors are logged. A writer that fails to
+// checkpoint stops, failing the parse.
+func (run *parseRun) checkpoint() {
+	c := run.checkpoints
+	if c == nil || c.interval <= 0 {
+		return
+	}
+
+	err := func() error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		sinkState, err := c.writer.checkpoint()
+		if err != nil {
+			return err
+		}
+
+		state := checkpointState{
+			Source:    run.source.URI,
+			RootUUID:  c.rootUUID,
+			Files:     make(map[string]*fileProgress, len(c.files)),
+			Providers: run.providers.Slice(),
+			Stats:     run.stats.checkpoint(),
+			Sink:      sinkState,
+		}
+
+		state.Stats.SkippedIn = run.skippedIn.Load()
+		state.Stats.SkippedOON = run.skippedOON.Load()
+		state.Stats.TotalProviders = run.totalProviders.Load()
+		state.Stats.MatchedProviders = run.matchedProviders.Load()
+
+		c.filesMu.Lock()
+		for name, f := range c.files {
+			state.Files[name] = f.clone()
+		}
+		c.filesMu.Unlock()
+
+		doc, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+
+		// The checkpoint is written with a context that is never cancelled, as the output's files are
+		return cloud.WriteFile(context.Background(), c.uri, doc)
+	}()
+	if err != nil {
+		log.Errorf("Unable to checkpoint to %s: %s", c.uri, err.Error())
+		return
+	}
+
+	log.Info("Checkpointed to ", c.uri)
+}
+
+// removeCheckpoint removes the checkpoint of a completed parse
+func (run *parseRun) removeCheckpoint() error {
+	if run.checkpoints == nil {
+		return nil
+	}
+
+	return cloud.Remove(context.Background(), run.checkpoints.uri)
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileProgress(t *testing.T) {
+	var f fileProgress
+
+	f.add(4, 6)
+	f.add(0, 2)
+	assert.Equal(t, [][2]int{{0, 2}, {4, 6}}, f.Done)
+
+	assert.True(t, f.done(1))
+	assert.False(t, f.done(2))
+	assert.True(t, f.done(5))
+	assert.False(t, f.done(6))
+
+	f.Lines = 6
+	assert.False(t, f.complete())
+
+	f.add(2, 4)
+	assert.Equal(t, [][2]int{{0, 6}}, f.Done)
+	assert.True(t, f.complete())
+
+	var none *fileProgress
+	assert.False(t, none.done(0))
+	assert.False(t, none.complete())
+}
+
+// A parse that fails after a checkpoint is resumed from it, without writing the checkpointed records again
+func TestParseResume(t *testing.T) {
+	input := inNetworkFileset(t, 1)
+	output := t.TempDir()
+	pr := filepath.Join(input, "provider_references_0.json")
+
+	valid, err := os.ReadFile(pr)
+	assert.NoError(t, err)
+
+	// The in_network phase is checkpointed before provider_references fail to parse
+	err = os.WriteFile(pr, []byte(`{"provider_group_id": 1, "provider_groups": [`), 0o644)
+	assert.NoError(t, err)
+
+	p := NewParser(WithServiceFile("../../../data/test_typed_services.csv"))
+	err = p.Parse(context.Background(), input, output)
+	p.Close()
+
+	assert.Error(t, err)
+	assert.FileExists(t, filepath.Join(output, CheckpointFile))
+
+	err = os.WriteFile(pr, valid, 0o644)
+	assert.NoError(t, err)
+
+	p = NewParser(WithServiceFile("../../../data/test_typed_services.csv"), WithResume())
+	defer p.Close()
+
+	err = p.Parse(context.Background(), input, output)
+	assert.NoError(t, err)
+
+	// root, in_network, negotiated_rate, negotiated_prices, provider_group, provider and tin
+	assert.Equal(t, int64(7), countRows(t, output))
+	assert.NoFileExists(t, filepath.Join(output, CheckpointFile))
+
+	m := readManifest(t, output)
+	assert.Equal(t, map[string]int64{
+		"root": 1, "in_network": 1, "negotiated_rate": 1, "negotiated_prices": 1, "provider_group": 1, "provider": 1, "tin": 1,
+	}, m.Records)
+}
+
+// Resuming without a checkpoint parses from the start
+func TestParseResumeNoCheckpoint(t *testing.T) {
+	p := NewParser(WithServiceFile("../../../data/test_typed_services.csv"), WithResume())
+	defer p.Close()
+
+	output := t.TempDir()
+
+	err := p.Parse(context.Background(), inNetworkFileset(t, 1), output)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), countRows(t, output))
+}
+
+func TestParseResumeUnsupported(t *testing.T) {
+	p := NewParser(WithServiceList(NewServiceList("99213")), WithResume(), WithWriter(func(context.Context, string) (RecordWriter, error) {
+		return &sliceWriter{}, nil
+	}))
+	defer p.Close()
+
+	err := p.Parse(context.Background(), inNetworkFileset(t, 1), "")
+	assert.ErrorIs(t, err, ErrResumeUnsupported)
+
+	err = p.ParseStream(context.Background(), "in-network.json", "")
+	assert.ErrorIs(t, err, ErrResumeUnsupported)
+}
@@ -16,90 +16,39 @@ limitations under the License.
 package mrf
 
 import (
-	"bufio"
-	"context"
 	"fmt"
-	"io"
-	"strings"
 
-	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
 
 	"github.com/minio/simdjson-go"
 )
 
-func parseInNetworkRates(filename, rootUUUID string, serviceList StringSet) {
-	const LinesAtATime int = 100
-
-	var line string
-	var lineCount = 0
-	var totalLineCount = 0
-
-	var strBuilder strings.Builder
-
+// parseInNetworkRates reads the in_network NDJSON file at filename, submitting batches of lines to the
+// in_network pool group for parsing. The records parsed are passed to handle. It stops reading if a
+// parse task fails.
+func (run *parseRun) parseInNetworkRates(filename, rootUUID string, handle recordHandler) error {
 	log.Info("Parsing in_network_rates: ", filename)
 
-	f, err := cloud.NewReader(context.TODO(), filename)
-	utils.ExitOnError(err)
-
-	defer func(f io.ReadCloser) {
-		err := f.Close()
-		if err != nil {
-			utils.ExitOnError(err)
-		}
-	}(f)
-
-	scanner := bufio.NewScanner(f)
-
-	buf := make([]byte, LineBuffer)
-	scanner.Buffer(buf, MaxLineBuffer)
-
-	for scanner.Scan() {
-		line = scanner.Text()
-		strBuilder.WriteString(line)
-		strBuilder.WriteString("\n")
-
-		if lineCount == LinesAtATime {
-			lines := strBuilder.String()
-
-			inPoolGroup.Submit(func() {
-				parseInLines(&lines, rootUUUID, serviceList)
-			})
-
-			lineCount = 0
-
-			strBuilder.Reset()
-		} else {
-			lineCount++
-		}
-
-		if totalLineCount%200 == 0 {
-			log.Debug("Read ", totalLineCount, " lines")
-		}
-
-		totalLineCount++
-	}
-
-	if err := scanner.Err(); err != nil {
-		utils.ExitOnError(err)
-	}
-
-	if lineCount > 0 {
-		log.Debug("Read ", totalLineCount, " lines")
-		lines := strBuilder.String()
-
-		inPoolGroup.Submit(func() {
-			parseInLines(&lines, rootUUUID, serviceList)
-		})
+	err := run.scanFile(filename, run.parser.inBatchSize, run.inGroup, func(lines *string) error {
+		return run.parseInLines(lines, rootUUID, handle)
+	})
+	if err != nil {
+		return err
 	}
 
 	log.Info("Completed reading negotiated_rates: ", filename)
+
+	return nil
 }
 
-func parseInLines(lines *string, rootUUID string, serviceList StringSet) {
+// parseInLines parses in_network lines, each of which is a json object, passing the records of those
+// in the serviceList to handle.
+func (run *parseRun) parseInLines(lines *string, rootUUID string, handle recordHandler) error {
 	parsed, err := utils.ParseJSON(lines, nil)
-	utils.ExitOnError(err)
+	if err != nil {
+		return err
+	}
 
 	var iter = parsed.Iter()
 	var tmpIter *simdjson.Iter
@@ -111,34 +60,40 @@ func parseInLines(lines *string, rootUUID string, serviceList StringSet) {
 
 		if typ == simdjson.TypeRoot {
 			_, tmpIter, err = iter.Root(nil)
-			utils.ExitOnError(err)
-
-			_, err := tmpIter.FindElement(nil, "covered_services")
-			if err == nil {
-				// This is a covered_services record. We don't yet support these.
-				utils.ExitOnError(fmt.Errorf("covered_services records are not supported"))
+			if err != nil {
+				return err
 			}
 
 			// Parse in_network_rates object
-			mrfList, err = parseInObject(tmpIter, rootUUID, serviceList)
+			mrfList, err = parseInObject(tmpIter, rootUUID, run.serviceList, run.providers)
 			// if we get a NotInListError, skip this record as it's not in the serviceList
 			if e, ok := err.(*NotInListError); ok {
 				log.Tracef("Skipping in_network_rates record. %s", e.Error())
+				run.skippedIn.Add(1)
+
 				continue
 			}
 
-			// if it's another error, exit
-			utils.ExitOnError(err)
+			// if it's another error, return it
+			if err != nil {
+				return err
+			}
 
-			err = WriteRecords(mrfList)
-			utils.ExitOnError(err)
+			err = handle(mrfList)
+			if err != nil {
+				return err
+			}
 		} else if typ == simdjson.TypeNone {
 			break
 		}
 	}
+
+	return nil
 }
 
-func parseInObject(iter *simdjson.Iter, rootUUID string, serviceList StringSet) ([]*models.Mrf, error) {
+// parseInObject parses an in_network object, returning the in_network record and its child records.
+// The provider_references of its negotiated_rates are added to providers.
+func parseInObject(iter *simdjson.Iter, rootUUID string, serviceList *ServiceList, providers *ProviderList) ([]*models.Mrf, error) {
 	var (
 		err                 error
 		mrf                 *models.Mrf
@@ -165,8 +120,17 @@ func parseInObject(iter *simdjson.Iter, rootUUID string, serviceList StringSet)
 
 	mrfList = append(mrfList, mrfListTmp...)
 
+	// Parse covered_services, if present
+	mrfListTmp, err = parseCoveredServices(iter, inUUID, serviceList)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("Got covered_services: ", len(mrfListTmp), " records")
+
+	mrfList = append(mrfList, mrfListTmp...)
+
 	// Parse negotiated_rates
-	mrfListTmp, err = parseNegotiatedRates(iter, inUUID)
+	mrfListTmp, err = parseNegotiatedRates(iter, inUUID, providers)
 	if err != nil {
 		return nil, err
 	}
@@ -188,6 +152,8 @@ func parseBundledCodes(iter *simdjson.Iter, inUUID string) ([]*models.Mrf, error
 	// bundled_codes is optional
 	if utils.TestElementNotPresent(err, path) {
 		return mrfList, nil
+	} else if err != nil {
+		return nil, err
 	}
 
 	bcIter := bc.Iter
@@ -216,9 +182,10 @@ func parseBundledCodes(iter *simdjson.Iter, inUUID string) ([]*models.Mrf, error
 			path = "description"
 			bcDescription, err := utils.GetElementValue[string]("description", &bcIter)
 
-			r := utils.TestElementNotPresent(err, path)
-			if r {
+			if utils.TestElementNotPresent(err, path) {
 				bcDescription = ""
+			} else if err != nil {
+				return nil, err
 			}
 
 			mrfList = append(mrfList,
@@ -233,7 +200,108 @@ func parseBundledCodes(iter *simdjson.Iter, inUUID string) ([]*models.Mrf, error
 	return mrfList, nil
 }
 
-func parseNegotiatedRates(iter *simdjson.Iter, inUUID string) ([]*models.Mrf, error) {
+// parseCoveredServices parses the covered_services array, which is present for capitation arrangements.
+// Only covered services in the serviceList are returned.
+func parseCoveredServices(iter *simdjson.Iter, inUUID string, serviceList *ServiceList) ([]*models.Mrf, error) {
+	var mrfList []*models.Mrf
+
+	path := "covered_services"
+	cs, err := iter.FindElement(nil, path)
+
+	// covered_services is optional
+	if utils.TestElementNotPresent(err, path) {
+		return mrfList, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	csIter := cs.Iter
+
+	for {
+		typ := csIter.Advance()
+
+		if typ == simdjson.TypeObject {
+			csType, err := utils.GetElementValue[string]("billing_code_type", &csIter)
+			if err != nil {
+				return nil, err
+			}
+
+			csCode, err := utils.GetElementValue[string]("billing_code", &csIter)
+			if err != nil {
+				return nil, err
+			}
+
+			if !serviceInList(csType, csCode, serviceList) {
+				log.Tracef("Skipping covered_service %s %s", csType, csCode)
+				continue
+			}
+
+			csTypeVersion, err := utils.GetElementValue[string]("billing_code_type_version", &csIter)
+			if err != nil {
+				return nil, err
+			}
+
+			path = "description"
+			csDescription, err := utils.GetElementValue[string](path, &csIter)
+			if utils.TestElementNotPresent(err, path) {
+				csDescription = ""
+			} else if err != nil {
+				return nil, err
+			}
+
+			mrfList = append(mrfList,
+				&models.Mrf{UUID: utils.GetUniqueID(), ParentUUID: inUUID, RecordType: "covered_service",
+					CoveredServices: models.CoveredServices{CSBillingCodeType: csType, CSBillingCode: csCode,
+						CSBillingCodeTypeVersion: csTypeVersion, CSDescription: csDescription}})
+		} else if typ == simdjson.TypeNone {
+			break
+		}
+	}
+
+	return mrfList, nil
+}
+
+// hasCoveredServiceInList returns true if any of the in_network record's covered_services
+// are in the serviceList.
+func hasCoveredServiceInList(iter *simdjson.Iter, serviceList *ServiceList) (bool, error) {
+	path := "covered_services"
+	cs, err := iter.FindElement(nil, path)
+
+	if utils.TestElementNotPresent(err, path) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	csIter := cs.Iter
+
+	for {
+		typ := csIter.Advance()
+
+		if typ == simdjson.TypeObject {
+			csType, err := utils.GetElementValue[string]("billing_code_type", &csIter)
+			if err != nil {
+				return false, err
+			}
+
+			csCode, err := utils.GetElementValue[string]("billing_code", &csIter)
+			if err != nil {
+				return false, err
+			}
+
+			if serviceInList(csType, csCode, serviceList) {
+				return true, nil
+			}
+		} else if typ == simdjson.TypeNone {
+			break
+		}
+	}
+
+	return false, nil
+}
+
+// parseNegotiatedRates parses the negotiated_rates array, adding any provider_references to providers.
+func parseNegotiatedRates(iter *simdjson.Iter, inUUID string, providers *ProviderList) ([]*models.Mrf, error) {
 	const prParent = "negotiated_rates"
 
 	var (
@@ -258,8 +326,14 @@ func parseNegotiatedRates(iter *simdjson.Iter, inUUID string) ([]*models.Mrf, er
 		if typ == simdjson.TypeObject {
 			uuid = utils.GetUniqueID()
 
-			// Parse negotiated_prices
-			npMrfList, err = parseNegotiatedPrices(&neIter, uuid)
+			// Parse negotiated_prices, or prices for prescription drug (NDC) rates
+			_, err = neIter.FindElement(nil, "prices")
+			if utils.TestElementNotPresent(err, "prices") {
+				npMrfList, err = parseNegotiatedPrices(&neIter, uuid)
+			} else if err == nil {
+				npMrfList, err = parseDrugPrices(&neIter, uuid)
+			}
+
 			if err != nil {
 				return nil, err
 			}
@@ -272,7 +346,7 @@ func parseNegotiatedRates(iter *simdjson.Iter, inUUID string) ([]*models.Mrf, er
 			if utils.TestElementNotPresent(err, "provider_references") {
 				log.Trace("provider_references not present, parsing provider_groups")
 				// Add a record to capture the NR / parent relationship
-				mrfList = append(mrfList, &models.Mrf{UUID: uuid, ParentUUID: inUUID})
+				mrfList = append(mrfList, &models.Mrf{UUID: uuid, ParentUUID: inUUID, RecordType: "negotiated_rate"})
 
 				prMrfList, err = parseProviderGroups(&neIter, uuid, prParent)
 				if err != nil {
@@ -280,9 +354,11 @@ func parseNegotiatedRates(iter *simdjson.Iter, inUUID string) ([]*models.Mrf, er
 				}
 
 				mrfList = append(mrfList, prMrfList...)
+			} else if err != nil {
+				return nil, err
 			} else {
-				// if provider_references not missing, add to providersFilter and write record
-				providersFilter.Add(pr...)
+				// if provider_references not missing, add to providers and write record
+				providers.Add(pr...)
 
 				mrfList = append(mrfList, &models.Mrf{UUID: uuid, ParentUUID: inUUID, RecordType: "negotiated_rate",
 					NegotiatedRate: models.NegotiatedRate{PRList: pr}})
@@ -372,6 +448,97 @@ func parseNegotiatedPrices(iter *simdjson.Iter, nrUUID string) ([]*models.Mrf, e
 	return mrfList, nil
 }
 
+// parseDrugPrices parses the prices array of a prescription drug (NDC) negotiated rate, and returns a list of MRFs.
+func parseDrugPrices(iter *simdjson.Iter, nrUUID string) ([]*models.Mrf, error) {
+	var (
+		err        error
+		dp         *simdjson.Array
+		mrfList    []*models.Mrf
+		scs        []string
+		ai, pt, d  string
+		nadac      float64
+		uuid, path string
+	)
+
+	dp, err = utils.GetArrayForElement("prices", iter)
+	if err != nil {
+		return nil, err
+	}
+
+	dpIter := dp.Iter()
+
+	for {
+		typ := dpIter.Advance()
+		if typ == simdjson.TypeObject {
+			uuid = utils.GetUniqueID()
+
+			t, err := utils.GetElementValue[string]("negotiated_type", &dpIter)
+			if err != nil {
+				return nil, err
+			}
+
+			ed, err := utils.GetElementValue[string]("expiration_date", &dpIter)
+			if err != nil {
+				return nil, err
+			}
+
+			nr, err := utils.GetElementValue[float64]("negotiated_rate", &dpIter)
+			if err != nil {
+				return nil, err
+			}
+
+			path = "pharmacy_type"
+			pt, err = utils.GetElementValue[string](path, &dpIter)
+			if utils.TestElementNotPresent(err, path) {
+				pt = ""
+			} else if err != nil {
+				return nil, err
+			}
+
+			path = "dosage"
+			d, err = utils.GetElementValue[string](path, &dpIter)
+			if utils.TestElementNotPresent(err, path) {
+				d = ""
+			} else if err != nil {
+				return nil, err
+			}
+
+			path = "nadac"
+			nadac, err = utils.GetElementValue[float64](path, &dpIter)
+			if utils.TestElementNotPresent(err, path) {
+				nadac = 0
+			} else if err != nil {
+				return nil, err
+			}
+
+			path = "additional_information"
+			ai, err = utils.GetElementValue[string](path, &dpIter)
+			if utils.TestElementNotPresent(err, path) {
+				ai = ""
+			} else if err != nil {
+				return nil, err
+			}
+
+			path = "service_code"
+			scs, err = utils.GetArrayElementAsSlice[string](path, &dpIter)
+			if utils.TestElementNotPresent(err, path) {
+				scs = []string{}
+			} else if err != nil {
+				return nil, err
+			}
+
+			mrfList = append(mrfList, &models.Mrf{UUID: uuid, ParentUUID: nrUUID, RecordType: "drug_price",
+				DrugPrices: models.DrugPrices{DPNegotiatedType: t, DPExpirationDate: ed, DPNegotiatedRateValue: nr,
+					DPPharmacyType: pt, DPDosage: d, DPNadac: nadac, DPAdditionalInformation: ai,
+					DPServiceCodes: scs}})
+		} else if typ == simdjson.TypeNone {
+			break
+		}
+	}
+
+	return mrfList, nil
+}
+
 // parseNPServiceCodes parses Negotiated Prices service_codes, which should be present if billing_class is professional
 // Returns an empty slice if billing_class is not professional
 func parseNPServiceCodes(iter *simdjson.Iter, billingClass string) ([]string, error) {
@@ -390,30 +557,47 @@ func parseNPServiceCodes(iter *simdjson.Iter, billingClass string) ([]string, er
 }
 
 // isServiceInList gets the billing_code_type and code and determines if the service is in serviceList
-func isServiceInList(tmpIter *simdjson.Iter, serviceList StringSet) (billingCodeType, billingCode string, ok bool) {
+func isServiceInList(tmpIter *simdjson.Iter, serviceList *ServiceList) (billingCodeType, billingCode string, ok bool, err error) {
 	bct, err := utils.GetElementValue[string]("billing_code_type", tmpIter)
 	if err != nil {
-		utils.ExitOnError(err)
+		return "", "", false, err
 	}
 
 	bc, err := utils.GetElementValue[string]("billing_code", tmpIter)
 	if err != nil {
-		utils.ExitOnError(err)
+		return "", "", false, err
 	}
 
-	return bct, bc, ((bct == "HCPCS" || bct == "CPT") && serviceList.Contains(bc))
+	return bct, bc, serviceInList(bct, bc, serviceList), nil
+}
+
+// serviceInList returns true if the service is in serviceList
+func serviceInList(billingCodeType, billingCode string, serviceList *ServiceList) bool {
+	return serviceList.Contains(billingCodeType, billingCode)
 }
 
 // parseInRoot parses the root of the in_network file, returning an Mrf record.
-// If the service is not in the serviceList, it returns a NotInServiceListError
-func parseInRoot(iter *simdjson.Iter, rootUUID string, serviceList StringSet) (*models.Mrf, error) {
+// If the service is not in the serviceList, it returns a NotInServiceListError. Capitation
+// records are matched on their covered_services rather than the in_network billing code.
+func parseInRoot(iter *simdjson.Iter, rootUUID string, serviceList *ServiceList) (*models.Mrf, error) {
 	var uuid = utils.GetUniqueID()
 
 	// Get the billing_code_type and code and determine if in serviceList
-	inBillingCodeType, inBillingCode, ok := isServiceInList(iter, serviceList)
+	inBillingCodeType, inBillingCode, ok, err := isServiceInList(iter, serviceList)
+	if err != nil {
+		return nil, err
+	}
+
 	if !ok {
-		// This is not a service we care about. Skip it.
-		return nil, &NotInListError{inBillingCode}
+		csOk, err := hasCoveredServiceInList(iter, serviceList)
+		if err != nil {
+			return nil, err
+		}
+
+		if !csOk {
+			// This is not a service we care about. Skip it.
+			return nil, &NotInListError{inBillingCode}
+		}
 	}
 
 	log.Tracef("Found service %s %s", inBillingCodeType, inBillingCode)
@@ -435,10 +619,11 @@ func parseInRoot(iter *simdjson.Iter, rootUUID string, serviceList StringSet) (*
 
 	path := "description"
 	desc, err := utils.GetElementValue[string](path, iter)
-	r := utils.TestElementNotPresent(err, path)
 	// some carriers don't have a description, despite it being a required field
-	if r {
+	if utils.TestElementNotPresent(err, path) {
 		desc = ""
+	} else if err != nil {
+		return nil, err
 	}
 
 	return &models.Mrf{UUID: uuid, ParentUUID: rootUUID, RecordType: "in_network",
@@ -21,7 +21,6 @@ import (
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
 
-	mapset "github.com/deckarep/golang-set/v2"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -65,9 +64,9 @@ func TestParseInObject(t *testing.T) {
 
 	iter := jp.Iter()
 
-	serviceList := mapset.NewSet("Q5116")
+	serviceList := NewServiceList("Q5116")
 
-	mrfList, err := parseInObject(&iter, "rootUUID", serviceList)
+	mrfList, err := parseInObject(&iter, "rootUUID", serviceList, NewProviderList())
 	assert.NoError(t, err)
 
 	mrf := mrfList[0]
@@ -122,16 +121,18 @@ func TestIsServiceInListCPT(t *testing.T) {
 
 	iter := jp.Iter()
 
-	serviceList := mapset.NewSet("2025", "2021", "53")
+	serviceList := NewServiceList("2025", "2021", "53")
 
-	bt, bc, ok := isServiceInList(&iter, serviceList)
+	bt, bc, ok, err := isServiceInList(&iter, serviceList)
+	assert.NoError(t, err)
 	assert.Equal(t, true, ok)
 	assert.Equal(t, "CPT", bt)
 	assert.Equal(t, "2021", bc)
 
-	serviceList = mapset.NewSet("1", "2", "3")
+	serviceList = NewServiceList("1", "2", "3")
 
-	bt, bc, ok = isServiceInList(&iter, serviceList)
+	bt, bc, ok, err = isServiceInList(&iter, serviceList)
+	assert.NoError(t, err)
 	assert.Equal(t, false, ok)
 	assert.Equal(t, "CPT", bt)
 	assert.Equal(t, "2021", bc)
@@ -151,16 +152,18 @@ func TestIsServiceInListHCPCS(t *testing.T) {
 
 	iter := jp.Iter()
 
-	serviceList := mapset.NewSet("2025", "2021", "53")
+	serviceList := NewServiceList("2025", "2021", "53")
 
-	bt, bc, ok := isServiceInList(&iter, serviceList)
+	bt, bc, ok, err := isServiceInList(&iter, serviceList)
+	assert.NoError(t, err)
 	assert.Equal(t, true, ok)
 	assert.Equal(t, "HCPCS", bt)
 	assert.Equal(t, "2021", bc)
 
-	serviceList = mapset.NewSet("1", "2", "3")
+	serviceList = NewServiceList("1", "2", "3")
 
-	bt, bc, ok = isServiceInList(&iter, serviceList)
+	bt, bc, ok, err = isServiceInList(&iter, serviceList)
+	assert.NoError(t, err)
 	assert.Equal(t, false, ok)
 	assert.Equal(t, "HCPCS", bt)
 	assert.Equal(t, "2021", bc)
@@ -182,7 +185,7 @@ func TestParseInRoot(t *testing.T) {
 
 	iter := jp.Iter()
 
-	serviceList := mapset.NewSet("2025", "999", "53")
+	serviceList := NewServiceList("2025", "999", "53")
 
 	rootUUID := "1234"
 
@@ -213,7 +216,7 @@ func TestParseInRootNotInServiceListError(t *testing.T) {
 
 	iter := jp.Iter()
 
-	serviceList := mapset.NewSet("2025", "999", "53")
+	serviceList := NewServiceList("2025", "999", "53")
 
 	rootUUID := "1234"
 
@@ -425,7 +428,7 @@ func TestParseNegotiatedRates(t *testing.T) {
 
 	iter := jp.Iter()
 
-	mrf, err := parseNegotiatedRates(&iter, "inUUID")
+	mrf, err := parseNegotiatedRates(&iter, "inUUID", NewProviderList())
 	assert.NoError(t, err)
 
 	assert.Equal(t, 6, len(mrf))
@@ -448,3 +451,230 @@ func TestParseNegotiatedRates(t *testing.T) {
 	assert.Equal(t, "negotiated_rate", mrf[1].RecordType)
 	assert.Equal(t, "negotiated_rate", mrf[3].RecordType)
 }
+
+func TestParseCoveredServices(t *testing.T) {
+	var j = []byte(`{"covered_services":[
+		{"billing_code_type":"CPT","billing_code_type_version":"2022","billing_code":"99213","description":"OFFICE O/P EST LOW 20 MIN"},
+		{"billing_code_type":"CPT","billing_code_type_version":"2022","billing_code":"99214","description":"OFFICE O/P EST MOD 30 MIN"},
+		{"billing_code_type":"RC","billing_code_type_version":"2022","billing_code":"99213","description":"NOT A CPT CODE"}
+		]}`)
+
+	jp, err := utils.ParseJSON(&j, nil)
+	assert.NoError(t, err)
+
+	iter := jp.Iter()
+
+	serviceList := NewServiceList("99213")
+
+	mrfList, err := parseCoveredServices(&iter, "inUUID", serviceList)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, len(mrfList))
+	assert.Equal(t, "inUUID", mrfList[0].ParentUUID)
+	assert.Equal(t, "covered_service", mrfList[0].RecordType)
+	assert.Equal(t, "CPT", mrfList[0].CoveredServices.CSBillingCodeType)
+	assert.Equal(t, "99213", mrfList[0].CoveredServices.CSBillingCode)
+	assert.Equal(t, "2022", mrfList[0].CoveredServices.CSBillingCodeTypeVersion)
+	assert.Equal(t, "OFFICE O/P EST LOW 20 MIN", mrfList[0].CoveredServices.CSDescription)
+}
+
+func TestParseCoveredServicesMissing(t *testing.T) {
+	var j = []byte(`{"field":"value"}`)
+
+	jp, err := utils.ParseJSON(&j, nil)
+	assert.NoError(t, err)
+
+	iter := jp.Iter()
+
+	mrfList, err := parseCoveredServices(&iter, "inUUID", NewServiceList("99213"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(mrfList))
+}
+
+func TestParseInObjectCapitation(t *testing.T) {
+	var j = []byte(`{
+		"negotiation_arrangement": "capitation",
+		"name": "PRIMARY CARE CAPITATION",
+		"billing_code_type": "CSTM-ALL",
+		"billing_code_type_version": "2022",
+		"billing_code": "CSTM-00",
+		"description": "Primary care capitation",
+		"covered_services": [
+			{"billing_code_type":"CPT","billing_code_type_version":"2022","billing_code":"99213","description":"OFFICE O/P EST LOW 20 MIN"},
+			{"billing_code_type":"CPT","billing_code_type_version":"2022","billing_code":"99214","description":"OFFICE O/P EST MOD 30 MIN"}
+		],
+		"negotiated_rates": [
+		  {
+			"provider_references": [1234],
+			"negotiated_prices": [
+			  {
+				"negotiated_type": "negotiated",
+				"negotiated_rate": 25.00,
+				"expiration_date": "9999-12-31",
+				"billing_class": "institutional"
+			  }
+			]
+		  }
+		]
+	  }`)
+
+	jp, err := utils.ParseJSON(&j, nil)
+	assert.NoError(t, err)
+
+	iter := jp.Iter()
+
+	mrfList, err := parseInObject(&iter, "rootUUID", NewServiceList("99214"), NewProviderList())
+	assert.NoError(t, err)
+
+	inMrf := mrfList[0]
+	assert.Equal(t, "in_network", inMrf.RecordType)
+	assert.Equal(t, "capitation", inMrf.NegotiationArrangement)
+	assert.Equal(t, "CSTM-00", inMrf.BillingCode)
+
+	csMrf := utils.Filter(mrfList, func(mrf *models.Mrf) bool {
+		return mrf.RecordType == "covered_service"
+	})
+	assert.Equal(t, 1, len(csMrf))
+	assert.Equal(t, "99214", csMrf[0].CSBillingCode)
+	assert.Equal(t, inMrf.UUID, csMrf[0].ParentUUID)
+
+	npMrf := utils.Filter(mrfList, func(mrf *models.Mrf) bool {
+		return mrf.RecordType == "negotiated_prices"
+	})
+	assert.Equal(t, 1, len(npMrf))
+	assert.Equal(t, 25.00, npMrf[0].NegotiatedRateValue)
+
+	// Neither the in_network billing code nor any of the covered_services are in the list
+	iter = jp.Iter()
+
+	_, err = parseInObject(&iter, "rootUUID", NewServiceList("99215"), NewProviderList())
+	_, ok := err.(*NotInListError)
+	assert.Equal(t, true, ok)
+}
+
+func TestIsServiceInListNDC(t *testing.T) {
+	var j = []byte(`{
+		"negotiation_arrangement": "ffs",
+		"name": "HUMALOG 100 UNIT/ML VIAL",
+		"billing_code_type": "NDC",
+		"billing_code_type_version": "2022",
+		"billing_code": "00002-7597-01"}`)
+
+	jp, err := utils.ParseJSON(&j, nil)
+	assert.NoError(t, err)
+
+	iter := jp.Iter()
+
+	// hyphenated codes are matched on their normalized form
+	serviceList := NewServiceList("00002759701")
+
+	bt, bc, ok, err := isServiceInList(&iter, serviceList)
+	assert.NoError(t, err)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "NDC", bt)
+	assert.Equal(t, "00002-7597-01", bc)
+
+	serviceList = NewServiceList("00002759702")
+
+	_, _, ok, err = isServiceInList(&iter, serviceList)
+	assert.NoError(t, err)
+	assert.Equal(t, false, ok)
+}
+
+func TestParseInObjectNDC(t *testing.T) {
+	var j = []byte(`{
+		"negotiation_arrangement": "ffs",
+		"name": "ATORVASTATIN 20 MG TABLET",
+		"billing_code_type": "NDC",
+		"billing_code_type_version": "2022",
+		"billing_code": "50090034701",
+		"description": "ATORVASTATIN 20 MG TABLET",
+		"negotiated_rates": [
+		  {
+			"provider_references": [1234],
+			"prices": [
+			  {
+				"negotiated_type": "negotiated",
+				"negotiated_rate": 4.25,
+				"expiration_date": "9999-12-31",
+				"pharmacy_type": "retail",
+				"dosage": 30,
+				"nadac": 0.0213
+			  },
+			  {
+				"negotiated_type": "negotiated",
+				"negotiated_rate": 3.10,
+				"expiration_date": "9999-12-31",
+				"pharmacy_type": "mail order",
+				"additional_information": "90 day supply"
+			  }
+			]
+		  }
+		]
+	  }`)
+
+	jp, err := utils.ParseJSON(&j, nil)
+	assert.NoError(t, err)
+
+	iter := jp.Iter()
+
+	mrfList, err := parseInObject(&iter, "rootUUID", NewServiceList("50090034701"), NewProviderList())
+	assert.NoError(t, err)
+
+	assert.Equal(t, "NDC", mrfList[0].BillingCodeType)
+
+	nrMrf := utils.Filter(mrfList, func(mrf *models.Mrf) bool {
+		return mrf.RecordType == "negotiated_rate"
+	})
+	assert.Equal(t, 1, len(nrMrf))
+
+	dpMrf := utils.Filter(mrfList, func(mrf *models.Mrf) bool {
+		return mrf.RecordType == "drug_price"
+	})
+
+	assert.Equal(t, 2, len(dpMrf))
+	assert.Equal(t, nrMrf[0].UUID, dpMrf[0].ParentUUID)
+	assert.Equal(t, "negotiated", dpMrf[0].DPNegotiatedType)
+	assert.Equal(t, 4.25, dpMrf[0].DPNegotiatedRateValue)
+	assert.Equal(t, "9999-12-31", dpMrf[0].DPExpirationDate)
+	assert.Equal(t, "retail", dpMrf[0].DPPharmacyType)
+	assert.Equal(t, "30", dpMrf[0].DPDosage)
+	assert.Equal(t, 0.0213, dpMrf[0].DPNadac)
+	assert.Equal(t, "mail order", dpMrf[1].DPPharmacyType)
+	assert.Equal(t, "", dpMrf[1].DPDosage)
+	assert.Equal(t, 0.0, dpMrf[1].DPNadac)
+	assert.Equal(t, "90 day supply", dpMrf[1].DPAdditionalInformation)
+
+	npMrf := utils.Filter(mrfList, func(mrf *models.Mrf) bool {
+		return mrf.RecordType == "negotiated_prices"
+	})
+	assert.Equal(t, 0, len(npMrf))
+}
+
+func TestIsServiceInListTyped(t *testing.T) {
+	var j = []byte(`{
+		"negotiation_arrangement": "ffs",
+		"name": "MAJOR HIP AND KNEE JOINT REPLACEMENT",
+		"billing_code_type": "MS-DRG",
+		"billing_code_type_version": "2022",
+		"billing_code": "470"}`)
+
+	jp, err := utils.ParseJSON(&j, nil)
+	assert.NoError(t, err)
+
+	iter := jp.Iter()
+
+	// untyped codes only match CPT/HCPCS/NDC codes
+	_, _, ok, err := isServiceInList(&iter, NewServiceList("470"))
+	assert.NoError(t, err)
+	assert.Equal(t, false, ok)
+
+	serviceList := NewServiceList()
+	serviceList.Add("MS-DRG", "470")
+
+	bt, bc, ok, err := isServiceInList(&iter, serviceList)
+	assert.NoError(t, err)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "MS-DRG", bt)
+	assert.Equal(t, "470", bc)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// compactLine returns raw as a single line of JSON, so that it may be used as a NDJSON line
+func compactLine(raw []byte) ([]byte, error) {
+	if bytes.IndexByte(raw, '\n') < 0 {
+		return raw, nil
+	}
+
+	var buf bytes.Buffer
+
+	err := json.Compact(&buf, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// lineBatcher collects JSON elements into NDJSON batches of size lines, handing each batch to submit
+type lineBatcher struct {
+	submit     func(lines *string) error
+	strBuilder strings.Builder
+	size       int
+	lineCount  int
+	total      int
+}
+
+func newLineBatcher(size int, submit func(lines *string) error) *lineBatcher {
+	return &lineBatcher{size: size, submit: submit}
+}
+
+// Add appends raw to the current batch, submitting the batch if it's full
+func (b *lineBatcher) Add(raw []byte) error {
+	line, err := compactLine(raw)
+	if err != nil {
+		return err
+	}
+
+	b.strBuilder.Write(line)
+	b.strBuilder.WriteString("\n")
+	b.lineCount++
+	b.total++
+
+	if b.lineCount == b.size {
+		return b.Flush()
+	}
+
+	return nil
+}
+
+// Flush submits the current batch, if not empty, returning any error from submit
+func (b *lineBatcher) Flush() error {
+	if b.lineCount == 0 {
+		return nil
+	}
+
+	lines := b.strBuilder.String()
+
+	b.lineCount = 0
+	b.strBuilder.Reset()
+
+	return b.submit(&lines)
+}
+
+// Total returns the number of elements added to the batcher
+func (b *lineBatcher) Total() int {
+	return b.total
+}
@@ -0,0 +1,239 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/sink"
+
+	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/spf13/viper"
+)
+
+// ManifestFile is the name of the manifest written to the output of a parse once it has completed
+const ManifestFile = "_manifest.json"
+
+// Manifest summarizes a completed parse, so that its output may be validated without reading it. It is
+// written to ManifestFile in the output path, once the output has been committed, by parses using the
+// default writer.
+type Manifest struct {
+	Source     ManifestSource `json:"source"`
+	Output     string         `json:"output"`
+	Format     string         `json:"format"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	// Timings are the durations of the phases of the parse, in seconds
+	Timings map[string]float64 `json:"timings"`
+	Files   []ManifestFileInfo `json:"files"`
+	// Records is the number of records written of each record type
+	Records   map[string]int64  `json:"records"`
+	Services  ManifestServices  `json:"services"`
+	Providers ManifestProviders `json:"providers"`
+	// Skipped is the number of in_network and out_of_network objects not in the service list, and of
+	// provider_references not referenced by the in_network objects parsed
+	Skipped map[string]int64 `json:"skipped"`
+	// Unsupported are the split files, or the top-level MRF keys when streaming, that were not parsed
+	Unsupported []string `json:"unsupported"`
+}
+
+// ManifestSource is the MRF parsed. Checksum is the sha256 of the MRF as downloaded or streamed, and is
+// empty if the MRF was parsed from a split fileset it wasn't computed for.
+type ManifestSource struct {
+	URI      string `json:"uri"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// ManifestFileInfo is a file written by the parse
+type ManifestFileInfo struct {
+	URI   string `json:"uri"`
+	Rows  int64  `json:"rows"`
+	Bytes int64  `json:"bytes"`
+}
+
+// ManifestServices are the number of services in the service list, and the number of distinct billing
+// codes in the service list matched by the MRF
+type ManifestServices struct {
+	Requested int `json:"requested"`
+	Matched   int `json:"matched"`
+}
+
+// ManifestProviders are the number of provider_references found, of provider groups referenced by the
+// in_network objects parsed, and of provider_references matched and written
+type ManifestProviders struct {
+	Found      int `json:"found"`
+	Referenced int `json:"referenced"`
+	Matched    int `json:"matched"`
+}
+
+// runStats counts the records written and services matched by a parse. It is safe for concurrent use.
+type runStats struct {
+	mu       sync.Mutex
+	records  map[string]int64
+	services mapset.Set[string]
+}
+
+func newRunStats() *runStats {
+	return &runStats{records: make(map[string]int64), services: mapset.NewSet[string]()}
+}
+
+// add counts records, recording the services in serviceList that they match
+func (s *runStats) add(records []*models.Mrf, serviceList *ServiceList) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range records {
+		s.records[m.RecordType]++
+
+		var billingCodeType, billingCode string
+
+		switch m.RecordType {
+		case "in_network":
+			billingCodeType, billingCode = m.BillingCodeType, m.BillingCode
+		case "covered_service":
+			billingCodeType, billingCode = m.CSBillingCodeType, m.CSBillingCode
+		case "out_of_network":
+			billingCodeType, billingCode = m.OONBillingCodeType, m.OONBillingCode
+		case "rate_fact":
+			billingCodeType, billingCode = m.RFBillingCodeType, m.RFBillingCode
+		default:
+			continue
+		}
+
+		if serviceList.Contains(billingCodeType, billingCode) {
+			s.services.Add(typedCode(normalizeCodeType(billingCodeType), billingCode))
+		}
+	}
+}
+
+// checkpoint returns the records and services counted, for a checkpoint
+func (s *runStats) checkpoint() checkpointStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make(map[string]int64, len(s.records))
+	for recordType, n := range s.records {
+		records[recordType] = n
+	}
+
+	return checkpointStats{Records: records, Services: s.services.ToSlice()}
+}
+
+// manifest returns the Manifest of a parse that completed at finished, writing the files listed by files
+func (run *parseRun) manifest(files []sink.File, finished time.Time) (*Manifest, error) {
+	run.stats.mu.Lock()
+	defer run.stats.mu.Unlock()
+
+	format := viper.GetString("writer.format")
+	if format == "" {
+		format = sink.ParquetFormat
+	}
+
+	m := &Manifest{
+		Source:     run.source,
+		Output:     run.outputPath,
+		Format:     format,
+		StartedAt:  run.started,
+		FinishedAt: finished,
+		Timings:    run.timings,
+		Files:      make([]ManifestFileInfo, 0, len(files)),
+		Records:    run.stats.records,
+		Services: ManifestServices{
+			Requested: run.serviceList.Cardinality(),
+			Matched:   run.stats.services.Cardinality(),
+		},
+		Providers: ManifestProviders{
+			Found:      int(run.totalProviders.Load()),
+			Referenced: run.providers.Len(),
+			Matched:    int(run.matchedProviders.Load()),
+		},
+		Skipped: map[string]int64{
+			"in_network":          run.skippedIn.Load(),
+			"out_of_network":      run.skippedOON.Load(),
+			"provider_references": int64(run.totalProviders.Load() - run.matchedProviders.Load()),
+		},
+		Unsupported: run.unsupported,
+	}
+
+	m.Timings["total"] = finished.Sub(run.started).Seconds()
+
+	if m.Unsupported == nil {
+		m.Unsupported = []string{}
+	}
+
+	// Files are written with a context that is never cancelled, so their sizes are too
+	ctx := context.Background()
+
+	for _, f := range files {
+		attrs, err := cloud.Attributes(ctx, f.URI)
+		if err != nil {
+			return nil, err
+		}
+
+		m.Files = append(m.Files, ManifestFileInfo{URI: f.URI, Rows: f.Rows, Bytes: attrs.Size})
+	}
+
+	return m, nil
+}
+
+// writeManifest writes the Manifest of the completed parse to the output path
+func (run *parseRun) writeManifest(files []sink.File) error {
+	m, err := run.manifest(files, time.Now())
+	if err != nil {
+		return err
+	}
+
+	doc, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if !cloud.IsCloudURI(run.outputPath) {
+		// The postgres format doesn't write to the output path, so it may not exist
+		err = os.MkdirAll(run.outputPath, os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+
+	uri := cloud.JoinURI(run.outputPath, ManifestFile)
+
+	w, err := cloud.NewWriter(context.Background(), uri)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(doc)
+	if err != nil {
+		_ = w.Close()
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	log.Info("Wrote manifest to ", uri)
+
+	return nil
+}
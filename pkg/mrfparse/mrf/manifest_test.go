@@ -0,0 +1,130 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readManifest reads the Manifest written to dir
+func readManifest(t *testing.T, dir string) *Manifest {
+	doc, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	assert.NoError(t, err)
+
+	var m Manifest
+
+	err = json.Unmarshal(doc, &m)
+	assert.NoError(t, err)
+
+	return &m
+}
+
+func TestParseManifest(t *testing.T) {
+	input := writeFileset(t, map[string]string{
+		"root.json": parseTestRoot,
+		"in_network_0.json": `{"negotiation_arrangement": "ffs", "name": "VISIT", "billing_code_type": "CPT", "billing_code_type_version": "2022", "billing_code": "99213", "negotiated_rates": [{"provider_references": [1], "negotiated_prices": [{"negotiated_type": "negotiated", "negotiated_rate": 80.5, "expiration_date": "9999-12-31", "billing_class": "institutional"}]}]}
+{"negotiation_arrangement": "ffs", "name": "VISIT", "billing_code_type": "CPT", "billing_code_type_version": "2022", "billing_code": "99215", "negotiated_rates": [{"provider_references": [2], "negotiated_prices": [{"negotiated_type": "negotiated", "negotiated_rate": 120, "expiration_date": "9999-12-31", "billing_class": "institutional"}]}]}`,
+		"provider_references_0.json": `{"provider_group_id": 1, "provider_groups": [{"npi": [1821198789], "tin": {"type": "ein", "value": "11-1111111"}}]}
+{"provider_group_id": 2, "provider_groups": [{"npi": [1770512915], "tin": {"type": "ein", "value": "22-2222222"}}]}`,
+		"out_of_network_0.json": `{}`,
+	})
+
+	p := NewParser(WithServiceList(NewServiceList("99213", "99214")), WithSource("https://example.com/in-network.json.gz", "sha256:abc"))
+	defer p.Close()
+
+	output := t.TempDir()
+
+	err := p.Parse(context.Background(), input, output)
+	assert.NoError(t, err)
+
+	m := readManifest(t, output)
+
+	assert.Equal(t, ManifestSource{URI: "https://example.com/in-network.json.gz", Checksum: "sha256:abc"}, m.Source)
+	assert.Equal(t, output, m.Output)
+	assert.Equal(t, "parquet", m.Format)
+	assert.False(t, m.FinishedAt.Before(m.StartedAt))
+
+	for _, phase := range []string{"in_network", "provider_references", "parse", "close", "total"} {
+		assert.Contains(t, m.Timings, phase)
+	}
+
+	assert.Equal(t, map[string]int64{
+		"root": 1, "in_network": 1, "negotiated_rate": 1, "negotiated_prices": 1, "provider_group": 1, "provider": 1, "tin": 1,
+	}, m.Records)
+
+	var rows int64
+
+	for _, f := range m.Files {
+		assert.True(t, strings.HasPrefix(f.URI, output))
+		assert.Positive(t, f.Bytes)
+
+		rows += f.Rows
+	}
+
+	assert.Equal(t, countRows(t, output), rows)
+
+	assert.Equal(t, ManifestServices{Requested: 2, Matched: 1}, m.Services)
+	assert.Equal(t, ManifestProviders{Found: 2, Referenced: 1, Matched: 1}, m.Providers)
+	assert.Equal(t, map[string]int64{"in_network": 1, "out_of_network": 0, "provider_references": 1}, m.Skipped)
+	assert.Equal(t, []string{"out_of_network_0.json"}, m.Unsupported)
+}
+
+// The manifest of a streamed MRF has the checksum of the MRF, and lists the top-level keys not parsed
+func TestParseStreamManifest(t *testing.T) {
+	mrf := `{"reporting_entity_name": "Test Payer", "version": "1.3.1", "in_network": [], "provider_references": [], "other": {"a": 1}}`
+	input := filepath.Join(t.TempDir(), "in-network.json")
+
+	err := os.WriteFile(input, []byte(mrf), 0o600)
+	assert.NoError(t, err)
+
+	p := NewParser(WithServiceList(NewServiceList("99213")))
+	defer p.Close()
+
+	output := t.TempDir()
+
+	err = p.ParseStream(context.Background(), input, output)
+	assert.NoError(t, err)
+
+	m := readManifest(t, output)
+
+	assert.Equal(t, input, m.Source.URI)
+	assert.Equal(t, fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(mrf))), m.Source.Checksum)
+	assert.Equal(t, []string{"other"}, m.Unsupported)
+	assert.Equal(t, map[string]int64{"root": 1}, m.Records)
+}
+
+// A failed parse doesn't write a manifest
+func TestParseManifestFailed(t *testing.T) {
+	input := writeFileset(t, map[string]string{"root.json": parseTestRoot, "in_network_0.json": `{"negotiation_arrangement": "ffs"}`})
+
+	p := NewParser(WithServiceList(NewServiceList("99213")))
+	defer p.Close()
+
+	output := t.TempDir()
+
+	err := p.Parse(context.Background(), input, output)
+	assert.Error(t, err)
+	assert.NoFileExists(t, filepath.Join(output, ManifestFile))
+}
@@ -0,0 +1,54 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import "strings"
+
+// ndcSegmentLengths are the labeler, product, and package segment lengths of an 11 digit (5-4-2) NDC
+var ndcSegmentLengths = [3]int{5, 4, 2}
+
+// normalizeNDC converts a hyphenated 10 or 11 digit NDC code (4-4-2, 5-3-2, 5-4-1 or 5-4-2) to the
+// 11 digit 5-4-2 form without hyphens, by zero padding each segment. Codes that are not hyphenated
+// NDC codes are returned unchanged.
+func normalizeNDC(code string) string {
+	segments := strings.Split(strings.TrimSpace(code), "-")
+	if len(segments) != len(ndcSegmentLengths) {
+		return code
+	}
+
+	var sb strings.Builder
+
+	for i, segment := range segments {
+		if segment == "" || len(segment) > ndcSegmentLengths[i] || !isDigits(segment) {
+			return code
+		}
+
+		sb.WriteString(strings.Repeat("0", ndcSegmentLengths[i]-len(segment)))
+		sb.WriteString(segment)
+	}
+
+	return sb.String()
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
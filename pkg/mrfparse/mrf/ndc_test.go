@@ -0,0 +1,46 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeNDC(t *testing.T) {
+	cases := []struct {
+		name string
+		code string
+		want string
+	}{
+		{"4-4-2", "0002-7597-01", "00002759701"},
+		{"5-3-2", "50090-347-01", "50090034701"},
+		{"5-4-1", "00071-0155-1", "00071015501"},
+		{"5-4-2", "00071-0155-23", "00071015523"},
+		{"11 digit", "00071015523", "00071015523"},
+		{"cpt", "99213", "99213"},
+		{"too long segment", "000071-0155-23", "000071-0155-23"},
+		{"not digits", "0007A-0155-23", "0007A-0155-23"},
+		{"empty segment", "00071--23", "00071--23"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, normalizeNDC(c.code))
+		})
+	}
+}
@@ -16,17 +16,17 @@ limitations under the License.
 package mrf
 
 import (
+	"bufio"
 	"context"
-	"os"
+	"io"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
-	"github.com/danielchalef/mrfparse/pkg/mrfparse/parquet"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
 
-	"github.com/alitto/pond"
 	mapset "github.com/deckarep/golang-set/v2"
 )
 
@@ -40,87 +40,253 @@ type StringSet mapset.Set[string]
 
 var log = utils.GetLogger()
 
-var processPool = pond.New(MaxWorkers, MaxCapacity)
-var inPoolGroup = processPool.Group()
-var prPoolGroup = processPool.Group()
-var writerPoolGroup = processPool.Group()
-
-func Parse(inputPath, outputPath string, planID int64, serviceFile string) {
-	const writerChannelSize int = 4 * 1024
-
-	// used to persist []mrf to parquet
-	wc := make(chan []*models.Mrf, writerChannelSize)
-	// done channel for writers
-	done := make(chan bool)
-
-	// if outputPath is on the local filesystem and does not exist, create it
-	if !cloud.IsCloudURI(outputPath) {
-		// test if path already exists
-		_, err := os.Stat(outputPath)
-		if os.IsNotExist(err) {
-			err = os.MkdirAll(outputPath, os.ModePerm)
-			utils.ExitOnError(err)
-		} else {
-			utils.ExitOnError(err)
-		}
-	}
-
-	// Start the writer in a goroutine
-	writerPoolGroup.Submit(func() { parquet.Writer("mrf", outputPath, wc, done) })
+// The prefixes of the split files parsed from in-network-rates and allowed-amounts filesets. Any other
+// files, bar the root file, are recorded as unsupported in the Manifest.
+var (
+	inNetworkPrefixes      = []string{"in_network_", "provider_references_"}
+	allowedAmountsPrefixes = []string{"out_of_network_"}
+)
 
-	// create the record writer using the new wc channel
-	WriteRecords = NewRecordWriter(wc)
+// filesetParser parses the split files of a MRF fileset, after the root file has been parsed
+type filesetParser func(run *parseRun, filesList []string, rootUUID string) error
 
-	// Load service list that we'll use to filter for services we care about
-	serviceList := loadServiceList(serviceFile)
-	log.Info("Loaded ", serviceList.Cardinality(), " services.")
+// Parse parses a split in-network-rates fileset at inputPath, writing a fileset in the writer.format to outputPath.
+// It is a convenience wrapper around a Parser with the default options, followed by any opts.
+func Parse(ctx context.Context, inputPath, outputPath string, plan *models.Plan, serviceFile string, opts ...ParserOption) error {
+	p := NewParser(append([]ParserOption{WithPlan(plan), WithServiceFile(serviceFile)}, opts...)...)
+	defer p.Close()
 
-	// Get list of files in inputPath. We expect to find a root file and in_network_rate and provider_references files
-	filesList, err := cloud.Glob(context.TODO(), inputPath, "*.json*")
-	utils.ExitOnError(err)
+	return p.Parse(ctx, inputPath, outputPath)
+}
 
-	log.Info("Found ", len(filesList), " files.")
+// ParseAllowedAmounts parses a split allowed-amounts fileset at inputPath, writing a fileset in the writer.format to outputPath.
+// It is a convenience wrapper around a Parser with the default options, followed by any opts.
+func ParseAllowedAmounts(ctx context.Context, inputPath, outputPath string, plan *models.Plan, serviceFile string, opts ...ParserOption) error {
+	p := NewParser(append([]ParserOption{WithPlan(plan), WithServiceFile(serviceFile)}, opts...)...)
+	defer p.Close()
 
-	// Parse root file first as we need root uuid for the other records
-	filename, err := findRootFile(filesList)
-	utils.ExitOnError(err)
+	return p.ParseAllowedAmounts(ctx, inputPath, outputPath)
+}
 
-	rootUUID := writeRoot(filename, planID)
-	log.Info("MrfRoot file parsed: ", filename)
+// parseInNetworkFileset parses the in_network and provider_references files of an in-network-rates fileset.
+func (run *parseRun) parseInNetworkFileset(filesList []string, rootUUID string) error {
+	start := time.Now()
 
 	// Parse in_network files first
 	for i := range filesList {
 		f := filepath.Base(filesList[i])
 		if strings.HasPrefix(f, "in_network_") {
-			log.Info("Found in_network_rate file", filename)
-			parseInNetworkRates(filesList[i], rootUUID, serviceList)
+			log.Info("Found in_network_rate file", f)
+
+			err := run.parseInNetworkRates(filesList[i], rootUUID, run.writeRecords)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
 	// Wait for all in_network threads to finish
 	log.Debug("Waiting for in_network_rate threads to finish.")
-	inPoolGroup.Wait()
 
-	log.Info("Found ", providersFilter.Len(), " providers in in_network_rates.")
+	err := run.inGroup.Wait()
+	if err != nil {
+		return err
+	}
+
+	run.timed("in_network", start)
+	start = time.Now()
+
+	// Checkpoint the providers set, so that a parse failing while parsing the provider_references files
+	// doesn't have to parse the in_network files again
+	run.checkpoint()
+
+	log.Info("Found ", run.providers.Len(), " providers in in_network_rates.")
 
 	// Parse provider_references_ files
 	for i := range filesList {
 		f := filepath.Base(filesList[i])
 		if strings.HasPrefix(f, "provider_references_") {
 			log.Info("Found provider_references file", f)
-			parseProviderReference(filesList[i], rootUUID)
+
+			err = run.parseProviderReference(filesList[i], rootUUID, run.writeRecords)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
 	// Wait for all pr threads to finish
-	prPoolGroup.Wait()
-	// Tell writer to finish
-	done <- true
-	// Wait for Writers to clean up
-	writerPoolGroup.Wait()
-	log.Debugf("Finished waiting for writer pool group to finish.")
-	// Stop the process pool
-	processPool.StopAndWait()
-
-	log.Info("Found ", totalProviderCounter.Load(), " providers. Matched on ", matchedProviderCounter.Load(), " providers.")
+	err = run.prGroup.Wait()
+	if err != nil {
+		return err
+	}
+
+	run.timed("provider_references", start)
+	run.logProviders()
+
+	return nil
+}
+
+// parseFileset opens the writer and parses the root file of the split fileset at inputPath, before
+// handing the remaining files to parseFiles. Files without one of the prefixes parsed are listed as unsupported.
+func (p *Parser) parseFileset(ctx context.Context, inputPath, outputPath string, parseFiles filesetParser, prefixes ...string) error {
+	run, err := p.newRun(ctx, inputPath, outputPath)
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		// Get list of files in inputPath. We expect to find a root file and in_network_rate and provider_references files
+		filesList, err := cloud.Glob(ctx, inputPath, "*.json*")
+		if err != nil {
+			return err
+		}
+
+		log.Info("Found ", len(filesList), " files.")
+
+		// Parse root file first as we need root uuid for the other records
+		filename, err := findRootFile(filesList)
+		if err != nil {
+			return err
+		}
+
+		rootUUID, err := run.initCheckpoints()
+		if err != nil {
+			return err
+		}
+
+		// The root of a resumed parse was written before the checkpoint
+		if rootUUID == "" {
+			rootUUID, err = run.writeRoot(filename, p.plan)
+			if err != nil {
+				return err
+			}
+
+			log.Info("MrfRoot file parsed: ", filename)
+		}
+
+		run.startCheckpoints(rootUUID)
+
+		run.unsupported = unsupportedFiles(filesList, filename, prefixes)
+
+		return parseFiles(run, filesList, rootUUID)
+	}()
+
+	return run.finish(err)
+}
+
+// unsupportedFiles returns the base names of the files in filesList, other than rootFile, without any of prefixes
+func unsupportedFiles(filesList []string, rootFile string, prefixes []string) []string {
+	var unsupported []string
+
+files:
+	for _, f := range filesList {
+		if f == rootFile {
+			continue
+		}
+
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(filepath.Base(f), prefix) {
+				continue files
+			}
+		}
+
+		unsupported = append(unsupported, filepath.Base(f))
+	}
+
+	return unsupported
+}
+
+// scanFile reads the NDJSON file at filename, submitting batches of batchSize lines to group to be
+// parsed by parseLines. It stops reading if a parse task fails or the parse is cancelled. If the parse
+// is checkpointed, the lines written before the checkpoint resumed from are skipped, and each batch is
+// recorded once parsed.
+func (run *parseRun) scanFile(filename string, batchSize int, group *taskGroup, parseLines func(lines *string) error) error {
+	var (
+		name     = filepath.Base(filename)
+		progress = run.checkpoints.progress(name)
+		// line is the number of lines read, and start the first line of the current batch
+		line, start int
+	)
+
+	if progress.complete() {
+		log.Info("Skipping ", filename, ", parsed before the checkpoint")
+		return nil
+	}
+
+	f, err := cloud.NewReader(run.ctx, filename)
+	if err != nil {
+		return err
+	}
+
+	defer func(f io.ReadCloser) {
+		err := f.Close()
+		if err != nil {
+			log.Errorf("Unable to close %s: %s", filename, err.Error())
+		}
+	}(f)
+
+	batcher := newLineBatcher(batchSize, func(lines *string) error {
+		first, end := start, line
+		start = line
+
+		return submitTo(group, func(lines *string) error {
+			return run.checkpoints.parseBatch(name, first, end, func() error {
+				return parseLines(lines)
+			})
+		})(lines)
+	})
+
+	scanner := bufio.NewScanner(f)
+
+	buf := make([]byte, LineBuffer)
+	scanner.Buffer(buf, MaxLineBuffer)
+
+	for scanner.Scan() {
+		if progress.done(line) {
+			// Submit the lines before those already written, so that each batch is a contiguous range of lines
+			err = batcher.Flush()
+			if err != nil {
+				return err
+			}
+
+			line++
+			start = line
+
+			continue
+		}
+
+		line++
+
+		err = batcher.Add(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+
+		if batcher.Total()%100_000 == 0 {
+			log.Debug("Read ", batcher.Total(), " lines")
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	run.checkpoints.setLines(name, line)
+
+	// Ensure we parse the last few lines if we've not yet reached batchSize
+	return batcher.Flush()
+}
+
+// submitTo returns a lineBatcher submit function that submits batches to group to be parsed by
+// parseLines. It returns the error of any failed parse task, or of a cancelled context, so that the
+// reader stops reading.
+func submitTo(group *taskGroup, parseLines func(lines *string) error) func(lines *string) error {
+	return func(lines *string) error {
+		group.Submit(func() error {
+			return parseLines(lines)
+		})
+
+		return group.Err()
+	}
 }
@@ -0,0 +1,100 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/segmentio/parquet-go"
+	"github.com/stretchr/testify/assert"
+)
+
+const parseTestRoot = `{"reporting_entity_name": "Test Payer", "reporting_entity_type": "health insurance issuer",
+"last_updated_on": "2023-01-01", "version": "1.3.1"}`
+
+// writeFileset writes a split fileset to a temporary directory, returning its path
+func writeFileset(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600)
+		assert.NoError(t, err)
+	}
+
+	return dir
+}
+
+// countRows returns the number of rows in the parquet files in dir
+func countRows(t *testing.T, dir string) int64 {
+	var rows int64
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.parquet"))
+	assert.NoError(t, err)
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		assert.NoError(t, err)
+
+		st, err := f.Stat()
+		assert.NoError(t, err)
+
+		pf, err := parquet.OpenFile(f, st.Size())
+		assert.NoError(t, err)
+
+		rows += pf.NumRows()
+
+		assert.NoError(t, f.Close())
+	}
+
+	return rows
+}
+
+func TestParse(t *testing.T) {
+	input := writeFileset(t, map[string]string{
+		"root.json":                  parseTestRoot,
+		"in_network_0.json":          `{"negotiation_arrangement": "ffs", "name": "VISIT", "billing_code_type": "CPT", "billing_code_type_version": "2022", "billing_code": "99213", "negotiated_rates": [{"provider_references": [1], "negotiated_prices": [{"negotiated_type": "negotiated", "negotiated_rate": 80.5, "expiration_date": "9999-12-31", "billing_class": "institutional"}]}]}`,
+		"provider_references_0.json": `{"provider_group_id": 1, "provider_groups": [{"npi": [1821198789], "tin": {"type": "ein", "value": "11-1111111"}}]}`,
+	})
+	output := t.TempDir()
+
+	err := Parse(context.Background(), input, output, nil, "../../../data/test_typed_services.csv")
+	assert.NoError(t, err)
+
+	// root, in_network, negotiated_rate, negotiated_prices, provider_group, provider and tin
+	assert.Equal(t, int64(7), countRows(t, output))
+}
+
+// a malformed in_network file fails the parse, but the writer still closes the output cleanly
+func TestParseError(t *testing.T) {
+	input := writeFileset(t, map[string]string{
+		"root.json":         parseTestRoot,
+		"in_network_0.json": `{"negotiation_arrangement": "ffs", "name": "VISIT", "billing_code_type": "CPT"}`,
+	})
+	output := t.TempDir()
+
+	err := Parse(context.Background(), input, output, nil, "../../../data/test_typed_services.csv")
+	assert.Error(t, err)
+
+	assert.Equal(t, int64(1), countRows(t, output))
+}
+
+func TestParseMissingServices(t *testing.T) {
+	err := Parse(context.Background(), t.TempDir(), t.TempDir(), nil, "../../../data/missing_services.csv")
+	assert.Error(t, err)
+}
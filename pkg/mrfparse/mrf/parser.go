@@ -0,0 +1,374 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/sink"
+
+	"github.com/alitto/pond"
+)
+
+// ErrRateFactsUnsupported is returned when rate facts are requested from a parse that can't produce them
+var ErrRateFactsUnsupported = errors.New("rate facts may only be parsed from a split in-network-rates fileset")
+
+// Default batch sizes, in lines, submitted to the worker pool
+const (
+	DefaultInNetworkBatchSize          int = 100
+	DefaultProviderReferencesBatchSize int = 2_000
+	DefaultOutOfNetworkBatchSize       int = 100
+)
+
+// RecordWriter writes batches of Mrf records to the output of a parse. Write is called concurrently
+// by the parse workers. Close is called once, when the parse is complete or has failed.
+type RecordWriter interface {
+	Write(records []*models.Mrf) error
+	Close() error
+}
+
+// RecordAborter is implemented by RecordWriters whose output is only committed once a parse succeeds.
+// Abort is called in place of Close when a parse fails, closing the output without committing it.
+type RecordAborter interface {
+	Abort() error
+}
+
+// WriterFactory opens a RecordWriter for the output path of a parse. The RecordWriter should stop
+// writing, leaving its output readable, when ctx is cancelled.
+type WriterFactory func(ctx context.Context, outputPath string) (RecordWriter, error)
+
+// Parser parses MRF files, writing the records to a fileset in the writer.format or the RecordWriter returned by
+// its WriterFactory. A Parser owns its worker pool, and each parse has its own provider set, location
+// cache and writer, so that a Parser may be used for any number of parses, including concurrently.
+// Close the Parser once done to stop its worker pool.
+type Parser struct {
+	pool          *pond.WorkerPool
+	workers       int
+	queueCapacity int
+	inBatchSize   int
+	prBatchSize   int
+	oonBatchSize  int
+	newWriter     WriterFactory
+	serviceFile   string
+	serviceList   *ServiceList
+	plan          *models.Plan
+	rateFacts     bool
+	source        ManifestSource
+	// checkpointInterval is the interval between checkpoints of parses of split filesets. If not positive,
+	// parses aren't checkpointed.
+	checkpointInterval time.Duration
+	resume             bool
+}
+
+// ParserOption configures a Parser
+type ParserOption func(p *Parser)
+
+// WithWorkers sets the number of workers parsing batches of lines. Defaults to MaxWorkers.
+func WithWorkers(workers int) ParserOption {
+	return func(p *Parser) {
+		p.workers = workers
+	}
+}
+
+// WithQueueCapacity sets the number of batches that may be queued for the workers before the readers
+// block. Defaults to MaxCapacity.
+func WithQueueCapacity(capacity int) ParserOption {
+	return func(p *Parser) {
+		p.queueCapacity = capacity
+	}
+}
+
+// WithBatchSizes sets the number of in_network, provider_references and out_of_network lines parsed
+// by each worker task. A size of zero leaves the default in place.
+func WithBatchSizes(inNetwork, providerReferences, outOfNetwork int) ParserOption {
+	return func(p *Parser) {
+		if inNetwork > 0 {
+			p.inBatchSize = inNetwork
+		}
+
+		if providerReferences > 0 {
+			p.prBatchSize = providerReferences
+		}
+
+		if outOfNetwork > 0 {
+			p.oonBatchSize = outOfNetwork
+		}
+	}
+}
+
+// WithWriter sets the WriterFactory used to open the output of each parse. Defaults to a writer for
+// the RecordSink of writer.format.
+func WithWriter(newWriter WriterFactory) ParserOption {
+	return func(p *Parser) {
+		p.newWriter = newWriter
+	}
+}
+
+// WithServiceFile sets the CSV file of services to filter on. If empty, the services.file config
+// value is used.
+func WithServiceFile(uri string) ParserOption {
+	return func(p *Parser) {
+		p.serviceFile = uri
+	}
+}
+
+// WithServiceList sets the services to filter on, in place of a services file
+func WithServiceList(services *ServiceList) ParserOption {
+	return func(p *Parser) {
+		p.serviceList = services
+	}
+}
+
+// WithPlan sets the plan whose non-empty fields override those of the root record
+func WithPlan(plan *models.Plan) ParserOption {
+	return func(p *Parser) {
+		p.plan = plan
+	}
+}
+
+// WithRateFacts sets Parse to output rate_fact records, each a negotiated price denormalized with the
+// billing code and one of the provider NPIs and TINs it applies to, in place of the in_network and
+// provider_references records. Only in-network-rates filesets may be parsed into rate facts.
+func WithRateFacts() ParserOption {
+	return func(p *Parser) {
+		p.rateFacts = true
+	}
+}
+
+// WithSource sets the URI and checksum of the MRF recorded in the manifest, where the input of the parse
+// is a fileset split from it. Defaults to the input path, without a checksum.
+func WithSource(uri, checksum string) ParserOption {
+	return func(p *Parser) {
+		p.source = ManifestSource{URI: uri, Checksum: checksum}
+	}
+}
+
+// WithCheckpointInterval sets the interval between checkpoints of parses of split filesets, from which a parse
+// may be resumed should it fail. Checkpoints are also taken once the in_network files have been parsed. An
+// interval of zero disables checkpoints. Defaults to checkpoint.interval minutes, or DefaultCheckpointInterval.
+// Only the parquet format supports checkpoints.
+func WithCheckpointInterval(interval time.Duration) ParserOption {
+	return func(p *Parser) {
+		p.checkpointInterval = interval
+	}
+}
+
+// WithResume sets parses of split filesets to resume from the checkpoint in their output path, if any, skipping
+// the lines of the split files whose records were written before the checkpoint was taken. The checkpoint must be
+// of a parse of the same source, with the same writer config. Rate facts parses can't be resumed.
+func WithResume() ParserOption {
+	return func(p *Parser) {
+		p.resume = true
+	}
+}
+
+// NewParser returns a new Parser configured with opts
+func NewParser(opts ...ParserOption) *Parser {
+	p := &Parser{
+		workers:       MaxWorkers,
+		queueCapacity: MaxCapacity,
+		inBatchSize:   DefaultInNetworkBatchSize,
+		prBatchSize:   DefaultProviderReferencesBatchSize,
+		oonBatchSize:  DefaultOutOfNetworkBatchSize,
+		newWriter:     newSinkWriter,
+
+		checkpointInterval: checkpointInterval(),
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	p.pool = pond.New(p.workers, p.queueCapacity)
+
+	return p
+}
+
+// Close waits for any running tasks and stops the Parser's worker pool
+func (p *Parser) Close() {
+	p.pool.StopAndWait()
+}
+
+// Parse parses a split in-network-rates fileset at inputPath, writing the output to outputPath.
+// Cancelling ctx stops the parse and closes the output.
+func (p *Parser) Parse(ctx context.Context, inputPath, outputPath string) error {
+	if p.rateFacts {
+		return p.parseFileset(ctx, inputPath, outputPath, (*parseRun).parseRateFactsFileset, inNetworkPrefixes...)
+	}
+
+	return p.parseFileset(ctx, inputPath, outputPath, (*parseRun).parseInNetworkFileset, inNetworkPrefixes...)
+}
+
+// ParseAllowedAmounts parses a split allowed-amounts fileset at inputPath, writing the output to outputPath.
+// Allowed-amounts files contain an out_of_network array, which jsplit splits into out_of_network_ files.
+func (p *Parser) ParseAllowedAmounts(ctx context.Context, inputPath, outputPath string) error {
+	if p.rateFacts {
+		return ErrRateFactsUnsupported
+	}
+
+	return p.parseFileset(ctx, inputPath, outputPath, (*parseRun).parseAllowedAmountsFileset, allowedAmountsPrefixes...)
+}
+
+// loadServices returns the Parser's service list, loading it from the services file if not set
+func (p *Parser) loadServices(ctx context.Context) (*ServiceList, error) {
+	if p.serviceList != nil {
+		return p.serviceList, nil
+	}
+
+	return loadServiceList(ctx, p.serviceFile)
+}
+
+// newRun loads the service list and opens the writer for a parse of inputPath writing to outputPath
+func (p *Parser) newRun(ctx context.Context, inputPath, outputPath string) (*parseRun, error) {
+	started := time.Now()
+
+	serviceList, err := p.loadServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Loaded ", serviceList.Cardinality(), " services.")
+
+	source := p.source
+	if source.URI == "" {
+		source.URI = inputPath
+	}
+
+	// Sinks that key their rows by the MRF parsed, such as postgres, read its URI from the context
+	writer, err := p.newWriter(sink.WithSource(ctx, source.URI), outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	fetch := func(uri string) ([]byte, error) {
+		return fetchLocation(ctx, uri)
+	}
+
+	return &parseRun{
+		ctx:         ctx,
+		parser:      p,
+		serviceList: serviceList,
+		providers:   NewProviderList(),
+		locations:   NewLocationCache(fetch),
+		inGroup:     newTaskGroup(ctx, p.pool),
+		prGroup:     newTaskGroup(ctx, p.pool),
+		oonGroup:    newTaskGroup(ctx, p.pool),
+		writer:      writer,
+		source:      source,
+		outputPath:  outputPath,
+		started:     started,
+		timings:     make(map[string]float64),
+		stats:       newRunStats(),
+	}, nil
+}
+
+// recordHandler handles the records parsed from a MRF object
+type recordHandler func(records []*models.Mrf) error
+
+// parseRun holds the state of a single parse
+type parseRun struct {
+	// ctx is the context of the parse. Cancelling it stops the parse.
+	ctx         context.Context
+	parser      *Parser
+	serviceList *ServiceList
+	// providers is the set of provider_group_ids referenced by the in_network records parsed,
+	// used to filter the provider_references records
+	providers        *ProviderList
+	locations        *LocationCache
+	totalProviders   atomic.Int32
+	matchedProviders atomic.Int32
+	inGroup          *taskGroup
+	prGroup          *taskGroup
+	oonGroup         *taskGroup
+	writer           RecordWriter
+	// skippedIn and skippedOON count the in_network and out_of_network objects not in the serviceList
+	skippedIn  atomic.Int64
+	skippedOON atomic.Int64
+	// source, outputPath, started, timings, stats and unsupported are recorded in the run's Manifest
+	source      ManifestSource
+	outputPath  string
+	started     time.Time
+	timings     map[string]float64
+	stats       *runStats
+	unsupported []string
+	// checkpoints is nil unless the run is checkpointed
+	checkpoints *checkpointer
+}
+
+// writeRecords counts records and writes them to the run's writer
+func (run *parseRun) writeRecords(records []*models.Mrf) error {
+	run.stats.add(records, run.serviceList)
+
+	return run.writer.Write(records)
+}
+
+// timed records the time since start as the duration of phase
+func (run *parseRun) timed(phase string, start time.Time) {
+	run.timings[phase] = time.Since(start).Seconds()
+}
+
+// finish waits for any outstanding parse tasks and then closes the writer, so that the output is
+// closed cleanly even if parsing failed. If parsing failed and the writer is a RecordAborter, it is
+// aborted rather than closed, so that the output isn't committed. Once a successful parse's writer has
+// closed, the Manifest is written to its output path if the writer is a sink.FileLister, and any checkpoint is
+// removed. It returns err if not nil, otherwise the first error returned by a parse task, the writer or writing the
+// manifest.
+func (run *parseRun) finish(err error) error {
+	run.stopCheckpoints()
+
+	for _, g := range []*taskGroup{run.inGroup, run.prGroup, run.oonGroup} {
+		if gerr := g.Wait(); err == nil {
+			err = gerr
+		}
+	}
+
+	run.timed("parse", run.started)
+
+	start := time.Now()
+
+	var werr error
+	if a, ok := run.writer.(RecordAborter); ok && err != nil {
+		werr = a.Abort()
+	} else {
+		werr = run.writer.Close()
+	}
+
+	run.timed("close", start)
+
+	if fl, ok := run.writer.(sink.FileLister); ok && err == nil && werr == nil && run.outputPath != "" {
+		werr = run.writeManifest(fl.Files())
+	}
+
+	if err == nil && werr == nil {
+		werr = run.removeCheckpoint()
+	}
+
+	// A task that failed because the writer stopped is better explained by the writer's error
+	if err == nil || (errors.Is(err, ErrWriterStopped) && werr != nil) {
+		return werr
+	}
+
+	return err
+}
+
+// logProviders logs the number of provider references found and matched
+func (run *parseRun) logProviders() {
+	log.Info("Found ", run.totalProviders.Load(), " providers. Matched on ", run.matchedProviders.Load(), " providers.")
+}
@@ -0,0 +1,235 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/sink"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// inNetworkFileset returns a split fileset with a single 99213 in_network record referencing
+// provider group groupID, and provider references for groups 1 and 2
+func inNetworkFileset(t *testing.T, groupID int) string {
+	return writeFileset(t, map[string]string{
+		"root.json":         parseTestRoot,
+		"in_network_0.json": fmt.Sprintf(`{"negotiation_arrangement": "ffs", "name": "VISIT", "billing_code_type": "CPT", "billing_code_type_version": "2022", "billing_code": "99213", "negotiated_rates": [{"provider_references": [%d], "negotiated_prices": [{"negotiated_type": "negotiated", "negotiated_rate": 80.5, "expiration_date": "9999-12-31", "billing_class": "institutional"}]}]}`, groupID),
+		"provider_references_0.json": `{"provider_group_id": 1, "provider_groups": [{"npi": [1821198789], "tin": {"type": "ein", "value": "11-1111111"}}]}
+{"provider_group_id": 2, "provider_groups": [{"npi": [1770512915], "tin": {"type": "ein", "value": "22-2222222"}}]}`,
+	})
+}
+
+// A Parser may be reused once a parse has completed
+func TestParserSequential(t *testing.T) {
+	p := NewParser(WithServiceFile("../../../data/test_typed_services.csv"))
+	defer p.Close()
+
+	for i := 0; i < 2; i++ {
+		output := t.TempDir()
+
+		err := p.Parse(context.Background(), inNetworkFileset(t, 1), output)
+		assert.NoError(t, err)
+
+		// root, in_network, negotiated_rate, negotiated_prices, provider_group, provider and tin
+		assert.Equal(t, int64(7), countRows(t, output))
+	}
+}
+
+// Concurrent parses with a single Parser don't share providers
+func TestParserConcurrent(t *testing.T) {
+	var (
+		wg      sync.WaitGroup
+		writers [4]*sliceWriter
+		errs    [4]error
+	)
+
+	newWriter := func(_ context.Context, outputPath string) (RecordWriter, error) {
+		var i int
+
+		_, err := fmt.Sscanf(outputPath, "out-%d", &i)
+		if err != nil {
+			return nil, err
+		}
+
+		writers[i] = &sliceWriter{}
+
+		return writers[i], nil
+	}
+
+	p := NewParser(
+		WithServiceList(NewServiceList("99213")),
+		WithWriter(newWriter),
+		WithWorkers(2),
+		WithBatchSizes(1, 1, 0),
+	)
+	defer p.Close()
+
+	for i := range writers {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			errs[i] = p.Parse(context.Background(), inNetworkFileset(t, i%2+1), fmt.Sprintf("out-%d", i))
+		}(i)
+	}
+
+	wg.Wait()
+
+	for i, w := range writers {
+		assert.NoError(t, errs[i])
+
+		groups := recordsOfType(w.records, "provider_group")
+		assert.Equal(t, 1, len(groups))
+		assert.Equal(t, fmt.Sprint(i%2+1), groups[0].ProviderGroupID)
+
+		inNetwork := recordsOfType(w.records, "in_network")
+		assert.Equal(t, 1, len(inNetwork))
+	}
+}
+
+func TestNewParserDefaults(t *testing.T) {
+	p := NewParser(WithBatchSizes(0, 10, 0))
+	defer p.Close()
+
+	assert.Equal(t, MaxWorkers, p.workers)
+	assert.Equal(t, DefaultInNetworkBatchSize, p.inBatchSize)
+	assert.Equal(t, 10, p.prBatchSize)
+	assert.Equal(t, DefaultOutOfNetworkBatchSize, p.oonBatchSize)
+}
+
+// cancelWriter is a sliceWriter that cancels the parse once the first records are written
+type cancelWriter struct {
+	sliceWriter
+	cancel context.CancelFunc
+}
+
+func (w *cancelWriter) Write(records []*models.Mrf) error {
+	w.cancel()
+
+	return w.sliceWriter.Write(records)
+}
+
+// Cancelling the context stops the parse and closes the writer
+func TestParserCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &cancelWriter{cancel: cancel}
+
+	p := NewParser(WithServiceList(NewServiceList("99213")), WithWriter(func(context.Context, string) (RecordWriter, error) {
+		return w, nil
+	}))
+	defer p.Close()
+
+	err := p.Parse(ctx, inNetworkFileset(t, 1), "")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// only the root record, written before the parse was cancelled
+	assert.Equal(t, 1, len(w.records))
+	assert.Equal(t, "root", w.records[0].RecordType)
+}
+
+// abortWriter is a sliceWriter recording whether it was closed or aborted
+type abortWriter struct {
+	sliceWriter
+	closed, aborted bool
+}
+
+func (w *abortWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func (w *abortWriter) Abort() error {
+	w.aborted = true
+	return nil
+}
+
+// A RecordAborter is aborted rather than closed when the parse fails
+func TestParserAbort(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		w := &abortWriter{}
+
+		p := NewParser(WithServiceList(NewServiceList("99213")), WithWriter(func(context.Context, string) (RecordWriter, error) {
+			return w, nil
+		}))
+
+		input := inNetworkFileset(t, 1)
+		if fail {
+			input = writeFileset(t, map[string]string{"root.json": parseTestRoot, "in_network_0.json": `{"negotiation_arrangement": "ffs"}`})
+		}
+
+		err := p.Parse(context.Background(), input, "")
+		p.Close()
+
+		assert.Equal(t, fail, err != nil)
+		assert.Equal(t, fail, w.aborted)
+		assert.Equal(t, !fail, w.closed)
+	}
+}
+
+// The default writer writes the RecordSink of writer.format
+func TestParserFormat(t *testing.T) {
+	defer viper.Set("writer.format", "")
+
+	viper.Set("writer.format", "ndjson")
+
+	p := NewParser(WithServiceList(NewServiceList("99213")))
+	defer p.Close()
+
+	dir := t.TempDir()
+
+	err := p.Parse(context.Background(), inNetworkFileset(t, 1), dir)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, "mrf_0000.ndjson.gz"))
+
+	viper.Set("writer.format", "xml")
+
+	err = p.Parse(context.Background(), inNetworkFileset(t, 1), t.TempDir())
+	assert.ErrorContains(t, err, "unknown writer format")
+}
+
+// The writer is opened with the source of the parse, defaulting to the input path
+func TestParserWriterSource(t *testing.T) {
+	var sources []string
+
+	newWriter := func(ctx context.Context, _ string) (RecordWriter, error) {
+		sources = append(sources, sink.Source(ctx))
+		return &sliceWriter{}, nil
+	}
+
+	input := inNetworkFileset(t, 1)
+
+	for _, opts := range [][]ParserOption{nil, {WithSource("https://example.com/in-network.json.gz", "")}} {
+		p := NewParser(append(opts, WithServiceList(NewServiceList("99213")), WithWriter(newWriter))...)
+
+		err := p.Parse(context.Background(), input, "")
+		p.Close()
+
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, []string{input, "https://example.com/in-network.json.gz"}, sources)
+}
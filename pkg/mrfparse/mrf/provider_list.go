@@ -19,8 +19,6 @@ import (
 	mapset "github.com/deckarep/golang-set/v2"
 )
 
-var providersFilter = NewProviderList()
-
 type ProviderList struct {
 	Providers StringSet
 }
@@ -0,0 +1,145 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/http"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
+
+	"github.com/minio/simdjson-go"
+)
+
+// LocationCache caches the provider_references documents referenced by a location URL, so that
+// each location is fetched only once per run, no matter how many provider references point to it.
+type LocationCache struct {
+	mu      sync.Mutex
+	entries map[string]*locationEntry
+	fetch   func(uri string) ([]byte, error)
+}
+
+type locationEntry struct {
+	once sync.Once
+	doc  []byte
+	err  error
+}
+
+// NewLocationCache returns a new LocationCache that uses fetch to retrieve uncached documents
+func NewLocationCache(fetch func(uri string) ([]byte, error)) *LocationCache {
+	return &LocationCache{
+		entries: make(map[string]*locationEntry),
+		fetch:   fetch,
+	}
+}
+
+// Get returns the document at uri, fetching it if it is not yet cached. Concurrent callers
+// requesting the same uri wait for a single fetch to complete.
+func (c *LocationCache) Get(uri string) ([]byte, error) {
+	c.mu.Lock()
+
+	e, ok := c.entries[uri]
+	if !ok {
+		e = &locationEntry{}
+		c.entries[uri] = e
+	}
+
+	c.mu.Unlock()
+
+	e.once.Do(func() {
+		log.Debug("Fetching provider_references location: ", uri)
+		e.doc, e.err = c.fetch(uri)
+	})
+
+	return e.doc, e.err
+}
+
+// Len returns the number of locations in the cache
+func (c *LocationCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries)
+}
+
+// fetchLocation downloads the document at uri. HTTP(S) locations are retrieved using http.DownloadReader,
+// and anything else using cloud.NewReader. Gzip compressed documents are decompressed.
+func fetchLocation(ctx context.Context, uri string) ([]byte, error) {
+	f, err := openURI(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func(f io.ReadCloser) {
+		err := f.Close()
+		if err != nil {
+			log.Errorf("Unable to close location %s: %s", uri, err.Error())
+		}
+	}(f)
+
+	r, err := utils.NewDecompressReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+// openURI opens uri for reading using http.DownloadReader for HTTP(S) URIs and cloud.NewReader otherwise.
+func openURI(ctx context.Context, uri string) (io.ReadCloser, error) {
+	if strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://") {
+		return http.DownloadReader(ctx, uri)
+	}
+
+	return cloud.NewReader(ctx, uri)
+}
+
+// parseProviderLocation fetches the provider_groups document at location and parses it using
+// parseProviderGroups, so that the records are identical to those of an inline provider reference.
+func parseProviderLocation(locations *LocationCache, location, parentUUID, parent string) ([]*models.Mrf, error) {
+	doc, err := locations.Get(location)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := utils.ParseJSON(&doc, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	iter := parsed.Iter()
+
+	return parseProviderGroups(&iter, parentUUID, parent)
+}
+
+// getLocation returns the location element of a provider reference, and false if there is none
+func getLocation(iter *simdjson.Iter) (string, bool, error) {
+	const path = "location"
+
+	location, err := utils.GetElementValue[string](path, iter)
+	if utils.TestElementNotPresent(err, path) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	return location, true, nil
+}
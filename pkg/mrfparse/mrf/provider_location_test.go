@@ -0,0 +1,139 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const locationDoc = `{
+	"version": "1.0.0",
+	"provider_groups": [
+	  { "npi": [1821198789], "tin": { "type": "ein", "value": "1821198789" } },
+	  { "npi": [1770512915, 1234567890], "tin": { "type": "npi", "value": "1770512915" } }
+	]
+}`
+
+func TestLocationCacheFetchesOnce(t *testing.T) {
+	var fetches atomic.Int32
+	var wg sync.WaitGroup
+
+	cache := NewLocationCache(func(uri string) ([]byte, error) {
+		fetches.Add(1)
+		return []byte(uri), nil
+	})
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			doc, err := cache.Get("https://example.com/a.json")
+			assert.NoError(t, err)
+			assert.Equal(t, "https://example.com/a.json", string(doc))
+		}()
+	}
+
+	wg.Wait()
+
+	_, err := cache.Get("https://example.com/b.json")
+	assert.NoError(t, err)
+
+	assert.Equal(t, int32(2), fetches.Load())
+	assert.Equal(t, 2, cache.Len())
+}
+
+func TestLocationCacheError(t *testing.T) {
+	cache := NewLocationCache(func(uri string) ([]byte, error) {
+		return nil, fmt.Errorf("unable to fetch %s", uri)
+	})
+
+	_, err := cache.Get("https://example.com/a.json")
+	assert.ErrorContains(t, err, "unable to fetch")
+}
+
+// newTestLocationCache returns a LocationCache that fetches locations using fetchLocation
+func newTestLocationCache() *LocationCache {
+	return NewLocationCache(func(uri string) ([]byte, error) {
+		return fetchLocation(context.Background(), uri)
+	})
+}
+
+// test parsePRObject with a location provider reference
+func TestParsePRObjectLocation(t *testing.T) {
+	var requests atomic.Int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		fmt.Fprint(w, locationDoc)
+	}))
+	defer ts.Close()
+
+	var j = []byte(fmt.Sprintf(`{"provider_group_id": 62.0003430048, "location": "%s/groups.json"}`, ts.URL))
+
+	var providerList = NewProviderList()
+	providerList.Add("62.0003430048")
+
+	locations := newTestLocationCache()
+
+	jp, err := utils.ParseJSON(&j, nil)
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		iter := jp.Iter()
+
+		mrfList, err := parsePRObject(&iter, providerList, locations, "rootUUID")
+		assert.NoError(t, err)
+
+		// 1 provider_group, 2 provider, 2 tin
+		assert.Equal(t, 5, len(mrfList))
+
+		pgMrf := utils.Filter(mrfList, func(mrf *models.Mrf) bool {
+			return mrf.RecordType == "provider_group"
+		})
+		assert.Equal(t, 1, len(pgMrf))
+		assert.Equal(t, "62.0003430048", pgMrf[0].ProviderGroupID)
+
+		providerMrf := utils.Filter(mrfList, func(mrf *models.Mrf) bool {
+			return mrf.RecordType == "provider"
+		})
+		assert.Equal(t, 2, len(providerMrf))
+		assert.Equal(t, models.NpiList{1770512915, 1234567890}, providerMrf[1].NpiList)
+		assert.Equal(t, "provider_references", providerMrf[1].Parent)
+		assert.Equal(t, pgMrf[0].UUID, providerMrf[1].ParentUUID)
+
+		tinMrf := utils.Filter(mrfList, func(mrf *models.Mrf) bool {
+			return mrf.RecordType == "tin"
+		})
+		assert.Equal(t, 2, len(tinMrf))
+		assert.Equal(t, "ein", tinMrf[0].TinType)
+	}
+
+	// the location is fetched only once
+	assert.Equal(t, int32(1), requests.Load())
+}
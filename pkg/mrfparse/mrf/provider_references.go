@@ -16,101 +16,37 @@ limitations under the License.
 package mrf
 
 import (
-	"bufio"
-	"context"
-	"fmt"
-	"io"
-	"strings"
-	"sync/atomic"
-
-	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
 
 	"github.com/minio/simdjson-go"
 )
 
-var matchedProviderCounter = atomic.Int32{}
-var totalProviderCounter = atomic.Int32{}
-
-// parseProviderReference parses provider_references_*.jsonl files
-func parseProviderReference(filename, rootUUID string) {
-	const LinesAtATime int = 2_000
-
-	var (
-		line           string
-		lineCount      = 0
-		totalLineCount = 0
-		strBuilder     strings.Builder
-	)
-
+// parseProviderReference parses provider_references_*.jsonl files, passing the records parsed to handle.
+// It stops reading if a parse task fails.
+func (run *parseRun) parseProviderReference(filename, rootUUID string, handle recordHandler) error {
 	log.Info("Parsing provider references: ", filename)
 
-	f, err := cloud.NewReader(context.TODO(), filename)
-	utils.ExitOnError(err)
-
-	defer func(f io.ReadCloser) {
-		err := f.Close()
-		if err != nil {
-			utils.ExitOnError(err)
-		}
-	}(f)
-
-	scanner := bufio.NewScanner(f)
-
-	buf := make([]byte, LineBuffer)
-	scanner.Buffer(buf, MaxLineBuffer)
-
-	for scanner.Scan() {
-		// Build a NDJSON string with LinesAtATime lines
-		line = scanner.Text()
-		strBuilder.WriteString(line)
-		strBuilder.WriteString("\n")
-
-		if lineCount == LinesAtATime {
-			lines := strBuilder.String()
-
-			// submit the parse job to the goroutine pool
-			prPoolGroup.Submit(func() {
-				parsePRLines(&lines, rootUUID)
-			})
-
-			lineCount = 0
-
-			strBuilder.Reset()
-		} else {
-			lineCount++
-		}
-
-		if totalLineCount%100_000 == 0 {
-			log.Debug("Read ", totalLineCount, " lines")
-		}
-
-		totalLineCount++
-	}
-
-	if err := scanner.Err(); err != nil {
-		utils.ExitOnError(err)
-	}
-
-	// Ensure we parse the last few lines if we've not yet reached LinesAtATime
-	if lineCount > 0 {
-		lines := strBuilder.String()
-
-		prPoolGroup.Submit(func() {
-			parsePRLines(&lines, rootUUID)
-		})
+	err := run.scanFile(filename, run.parser.prBatchSize, run.prGroup, func(lines *string) error {
+		return run.parsePRLines(lines, rootUUID, handle)
+	})
+	if err != nil {
+		return err
 	}
 
 	log.Info("Completed reading provider references: ", filename)
+
+	return nil
 }
 
 // parsePRLines parses provider_references lines, each of which is a json object.
 // It's designed to run concurrently, with parseProviderReference submitting parsePRLines jobs
-// to the goroutine pool. Parsed Mrf records are written to a channel for processing by a Writer thread.
-func parsePRLines(lines *string, rootUUID string) {
+// to the goroutine pool. Parsed Mrf records are passed to handle.
+func (run *parseRun) parsePRLines(lines *string, rootUUID string, handle recordHandler) error {
 	parsed, err := utils.ParseJSON(lines, nil)
-	utils.ExitOnError(err)
+	if err != nil {
+		return err
+	}
 
 	var (
 		iter    = parsed.Iter()
@@ -122,18 +58,14 @@ func parsePRLines(lines *string, rootUUID string) {
 		typ := iter.Advance()
 
 		if typ == simdjson.TypeRoot {
-			totalProviderCounter.Add(1)
+			run.totalProviders.Add(1)
 
 			_, tmpIter, err = iter.Root(nil)
-			utils.ExitOnError(err)
-
-			_, err := tmpIter.FindElement(nil, "location")
-			if err == nil {
-				// This is a location record. We don't yet support these.
-				utils.ExitOnError(fmt.Errorf("location records are not supported"))
+			if err != nil {
+				return err
 			}
 
-			mrfList, err = parsePRObject(tmpIter, providersFilter, rootUUID)
+			mrfList, err = parsePRObject(tmpIter, run.providers, run.locations, rootUUID)
 			// We only want to parse records where the provider_group_id is present in the in_network_rates dataset.
 			// If we get a NotInListError, skip this record.
 			if e, ok := err.(*NotInListError); ok {
@@ -141,29 +73,38 @@ func parsePRLines(lines *string, rootUUID string) {
 				continue
 			}
 
-			// Exit on any other error
-			utils.ExitOnError(err)
+			// Return any other error
+			if err != nil {
+				return err
+			}
 
 			// Count a matched provider
-			matchedProviderCounter.Add(1)
+			run.matchedProviders.Add(1)
 
-			err = WriteRecords(mrfList)
-			utils.ExitOnError(err)
+			err = handle(mrfList)
+			if err != nil {
+				return err
+			}
 		} else if typ == simdjson.TypeNone {
 			break
 		}
 	}
+
+	return nil
 }
 
 // parsePRObject parses a provider_reference object. It returns a slice of Mrf records, which
-// contains the root object and any provider_groups.
-func parsePRObject(iter *simdjson.Iter, providersFilter *ProviderList, rootUUID string) ([]*models.Mrf, error) {
+// contains the root object and any provider_groups. If the provider reference has a location
+// rather than inline provider_groups, the provider_groups are fetched from the location using locations.
+func parsePRObject(iter *simdjson.Iter, providersFilter *ProviderList, locations *LocationCache, rootUUID string) ([]*models.Mrf, error) {
 	const parent = "provider_references"
 
 	var (
-		mrf     *models.Mrf
-		mrfList []*models.Mrf
-		err     error
+		mrf      *models.Mrf
+		mrfList  []*models.Mrf
+		location string
+		ok       bool
+		err      error
 	)
 
 	mrf, err = parsePRRoot(providersFilter, rootUUID, iter)
@@ -171,7 +112,17 @@ func parsePRObject(iter *simdjson.Iter, providersFilter *ProviderList, rootUUID
 		return nil, err
 	}
 
-	mrfList, err = parseProviderGroups(iter, mrf.UUID, parent)
+	location, ok, err = getLocation(iter)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		mrfList, err = parseProviderLocation(locations, location, mrf.UUID, parent)
+	} else {
+		mrfList, err = parseProviderGroups(iter, mrf.UUID, parent)
+	}
+
 	if err != nil {
 		return nil, err
 	}
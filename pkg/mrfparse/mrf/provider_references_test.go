@@ -42,7 +42,7 @@ func TestParsePRObject(t *testing.T) {
 
 	iter := jp.Iter()
 
-	mrfList, err := parsePRObject(&iter, providerList, "1234-5678-9012-3456")
+	mrfList, err := parsePRObject(&iter, providerList, newTestLocationCache(), "1234-5678-9012-3456")
 	assert.NoError(t, err)
 
 	// 1 provider_group, 2 provider, 2 tin
@@ -0,0 +1,260 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
+)
+
+// groupProvider is a provider of a provider group, identified by its NPIs and TIN
+type groupProvider struct {
+	groupID  string
+	npiList  []int64
+	tinType  string
+	tinValue string
+}
+
+// providerIndex holds the providers of each provider group referenced by the in_network records,
+// keyed by provider_group_id. It's built from the provider_references files, which are filtered on
+// the run's providers set, so only referenced groups are held in memory.
+type providerIndex struct {
+	mu     sync.RWMutex
+	groups map[string][]groupProvider
+}
+
+func newProviderIndex() *providerIndex {
+	return &providerIndex{groups: make(map[string][]groupProvider)}
+}
+
+// add is a recordHandler that indexes the providers of a parsed provider_reference object
+func (x *providerIndex) add(records []*models.Mrf) error {
+	var groupID string
+
+	for _, mrf := range records {
+		if mrf.RecordType == "provider_group" {
+			groupID = mrf.ProviderGroupID
+		}
+	}
+
+	providers := groupProviders(records, groupID)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.groups[groupID] = append(x.groups[groupID], providers...)
+
+	return nil
+}
+
+// get returns the providers of the provider group groupID
+func (x *providerIndex) get(groupID string) []groupProvider {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	return x.groups[groupID]
+}
+
+// groupProviders pairs the provider and tin records of a provider_groups array. parseProviderGroups
+// appends each provider's tin record directly after its provider record.
+func groupProviders(records []*models.Mrf, groupID string) []groupProvider {
+	var providers []groupProvider
+
+	for _, mrf := range records {
+		switch mrf.RecordType {
+		case "provider":
+			providers = append(providers, groupProvider{groupID: groupID, npiList: mrf.NpiList})
+		case "tin":
+			if len(providers) == 0 || providers[len(providers)-1].tinType != "" {
+				providers = append(providers, groupProvider{groupID: groupID})
+			}
+
+			last := &providers[len(providers)-1]
+			last.tinType = mrf.TinType
+			last.tinValue = mrf.Tin.Value
+		}
+	}
+
+	return providers
+}
+
+// rateFacts converts the records parsed from an in_network object into rate_fact records, one per
+// price and provider NPI. Providers are resolved from the negotiated rate's provider_references using
+// index, or taken from its inline provider_groups. A provider with no NPIs gets a single row with a
+// zero NPI. Rate facts are parented to the root record.
+func rateFacts(records []*models.Mrf, index *providerIndex) []*models.Mrf {
+	var (
+		in      *models.Mrf
+		rates   = make(map[string]*models.Mrf)
+		inline  = make(map[string][]*models.Mrf)
+		prices  []*models.Mrf
+		mrfList []*models.Mrf
+	)
+
+	for _, mrf := range records {
+		switch mrf.RecordType {
+		case "in_network":
+			in = mrf
+		case "negotiated_rate":
+			rates[mrf.UUID] = mrf
+		case "provider", "tin":
+			inline[mrf.ParentUUID] = append(inline[mrf.ParentUUID], mrf)
+		case "negotiated_prices", "drug_price":
+			prices = append(prices, mrf)
+		}
+	}
+
+	if in == nil {
+		return nil
+	}
+
+	for _, price := range prices {
+		nr, ok := rates[price.ParentUUID]
+		if !ok {
+			continue
+		}
+
+		providers := groupProviders(inline[nr.UUID], "")
+		for _, id := range nr.PRList {
+			providers = append(providers, index.get(id)...)
+		}
+
+		fact := newRateFact(in, price)
+
+		for i := range providers {
+			npiList := providers[i].npiList
+			if len(npiList) == 0 {
+				npiList = []int64{0}
+			}
+
+			for _, npi := range npiList {
+				rf := fact
+				rf.RFProviderGroupID = providers[i].groupID
+				rf.RFTinType = providers[i].tinType
+				rf.RFTinValue = providers[i].tinValue
+				rf.RFNpi = npi
+
+				mrfList = append(mrfList, &models.Mrf{UUID: utils.GetUniqueID(), ParentUUID: in.ParentUUID,
+					RecordType: "rate_fact", RateFact: rf})
+			}
+		}
+	}
+
+	return mrfList
+}
+
+// newRateFact returns a RateFact for the service in and its negotiated_prices or drug_price record price
+func newRateFact(in, price *models.Mrf) models.RateFact {
+	rf := models.RateFact{
+		RFBillingCodeType:        in.BillingCodeType,
+		RFBillingCode:            in.BillingCode,
+		RFBillingCodeTypeVersion: in.BillingCodeTypeVersion,
+		RFName:                   in.Name,
+		RFNegotiationArrangement: in.NegotiationArrangement,
+	}
+
+	if price.RecordType == "drug_price" {
+		rf.RFNegotiatedType = price.DPNegotiatedType
+		rf.RFNegotiatedRate = price.DPNegotiatedRateValue
+		rf.RFExpirationDate = price.DPExpirationDate
+		rf.RFServiceCodes = price.DPServiceCodes
+		rf.RFAdditionalInformation = price.DPAdditionalInformation
+
+		return rf
+	}
+
+	rf.RFNegotiatedType = price.NegotiatedType
+	rf.RFNegotiatedRate = price.NegotiatedRateValue
+	rf.RFExpirationDate = price.ExpirationDate
+	rf.RFBillingClass = price.BillingClass
+	rf.RFServiceCodes = price.ServiceCodes
+	rf.RFBillingCodeModifiers = price.BillingCodeModifiers
+	rf.RFAdditionalInformation = price.AdditionalInformation
+
+	return rf
+}
+
+// parseRateFactsFileset parses an in-network-rates fileset into rate_fact records. The in_network
+// files are read twice: first to build the providers set used to filter the provider_references
+// files, whose providers are then indexed, and again to convert each in_network object into rate
+// facts using the index.
+func (run *parseRun) parseRateFactsFileset(filesList []string, rootUUID string) error {
+	inFiles := filesWithPrefix(filesList, "in_network_")
+
+	discard := func([]*models.Mrf) error { return nil }
+
+	for _, f := range inFiles {
+		err := run.parseInNetworkRates(f, rootUUID, discard)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := run.inGroup.Wait()
+	if err != nil {
+		return err
+	}
+
+	log.Info("Found ", run.providers.Len(), " providers in in_network_rates.")
+
+	index := newProviderIndex()
+
+	for _, f := range filesWithPrefix(filesList, "provider_references_") {
+		err = run.parseProviderReference(f, rootUUID, index.add)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = run.prGroup.Wait()
+	if err != nil {
+		return err
+	}
+
+	run.logProviders()
+
+	// The in_network objects skipped are counted again as the files are read a second time
+	run.skippedIn.Store(0)
+
+	writeFacts := func(records []*models.Mrf) error {
+		facts := rateFacts(records, index)
+		if len(facts) == 0 {
+			return nil
+		}
+
+		return run.writeRecords(facts)
+	}
+
+	for _, f := range inFiles {
+		err = run.parseInNetworkRates(f, rootUUID, writeFacts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return run.inGroup.Wait()
+}
+
+// filesWithPrefix returns the files in filesList whose base name starts with prefix
+func filesWithPrefix(filesList []string, prefix string) []string {
+	return utils.Filter(filesList, func(f string) bool {
+		return strings.HasPrefix(filepath.Base(f), prefix)
+	})
+}
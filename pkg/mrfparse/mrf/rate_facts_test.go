@@ -0,0 +1,113 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"context"
+	"testing"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const rateFactsInNetwork = `{"negotiation_arrangement": "ffs", "name": "VISIT", "billing_code_type": "CPT", "billing_code_type_version": "2022", "billing_code": "99213", "negotiated_rates": [{"provider_references": [1], "negotiated_prices": [{"negotiated_type": "negotiated", "negotiated_rate": 80.5, "expiration_date": "9999-12-31", "billing_class": "professional", "service_code": ["11"], "billing_code_modifier": ["26"]}]}, {"provider_groups": [{"npi": [1003000126], "tin": {"type": "npi", "value": "1003000126"}}], "negotiated_prices": [{"negotiated_type": "negotiated", "negotiated_rate": 95, "expiration_date": "9999-12-31", "billing_class": "institutional"}]}]}`
+
+func TestParseRateFacts(t *testing.T) {
+	w := &sliceWriter{}
+
+	p := NewParser(WithServiceList(NewServiceList("99213")), WithRateFacts(),
+		WithWriter(func(context.Context, string) (RecordWriter, error) {
+			return w, nil
+		}))
+	defer p.Close()
+
+	input := writeFileset(t, map[string]string{
+		"root.json":         parseTestRoot,
+		"in_network_0.json": rateFactsInNetwork,
+		"provider_references_0.json": `{"provider_group_id": 1, "provider_groups": [{"npi": [1821198789, 1770512915], "tin": {"type": "ein", "value": "11-1111111"}}, {"npi": [], "tin": {"type": "ein", "value": "33-3333333"}}]}
+{"provider_group_id": 2, "provider_groups": [{"npi": [1558444216], "tin": {"type": "ein", "value": "22-2222222"}}]}`,
+	})
+
+	err := p.Parse(context.Background(), input, "")
+	assert.NoError(t, err)
+
+	roots := recordsOfType(w.records, "root")
+	assert.Equal(t, 1, len(roots))
+
+	// Only root and rate_fact records are written
+	facts := recordsOfType(w.records, "rate_fact")
+	assert.Equal(t, len(w.records)-1, len(facts))
+
+	byNpi := make(map[int64]models.RateFact)
+	for _, mrf := range facts {
+		assert.Equal(t, roots[0].UUID, mrf.ParentUUID)
+		byNpi[mrf.RFNpi] = mrf.RateFact
+	}
+
+	// two NPIs of group 1, its provider without NPIs, and the inline provider group
+	assert.Equal(t, 4, len(facts))
+	assert.Equal(t, 4, len(byNpi))
+
+	rf := byNpi[1821198789]
+	assert.Equal(t, "99213", rf.RFBillingCode)
+	assert.Equal(t, "CPT", rf.RFBillingCodeType)
+	assert.Equal(t, 80.5, rf.RFNegotiatedRate)
+	assert.Equal(t, "professional", rf.RFBillingClass)
+	assert.Equal(t, models.ServiceCodes{"11"}, rf.RFServiceCodes)
+	assert.Equal(t, models.BillingCodeModifiers{"26"}, rf.RFBillingCodeModifiers)
+	assert.Equal(t, "1", rf.RFProviderGroupID)
+	assert.Equal(t, "11-1111111", rf.RFTinValue)
+
+	assert.Equal(t, "33-3333333", byNpi[0].RFTinValue)
+
+	rf = byNpi[1003000126]
+	assert.Equal(t, 95.0, rf.RFNegotiatedRate)
+	assert.Equal(t, "npi", rf.RFTinType)
+	assert.Equal(t, "", rf.RFProviderGroupID)
+}
+
+func TestRateFactsUnsupported(t *testing.T) {
+	p := NewParser(WithRateFacts())
+	defer p.Close()
+
+	err := p.ParseStream(context.Background(), "", "")
+	assert.ErrorIs(t, err, ErrRateFactsUnsupported)
+
+	err = p.ParseAllowedAmounts(context.Background(), "", "")
+	assert.ErrorIs(t, err, ErrRateFactsUnsupported)
+}
+
+func TestGroupProviders(t *testing.T) {
+	records := []*models.Mrf{
+		{RecordType: "provider", Provider: models.Provider{NpiList: models.NpiList{1, 2}}},
+		{RecordType: "tin", Tin: models.Tin{TinType: "ein", Value: "11-1111111"}},
+		{RecordType: "provider", Provider: models.Provider{NpiList: models.NpiList{3}}},
+		{RecordType: "tin", Tin: models.Tin{TinType: "npi", Value: "3"}},
+		{RecordType: "provider_group", ProviderGroup: models.ProviderGroup{ProviderGroupID: "7"}},
+	}
+
+	x := newProviderIndex()
+	assert.NoError(t, x.add(records))
+
+	providers := x.get("7")
+	assert.Equal(t, 2, len(providers))
+	assert.Equal(t, []int64{1, 2}, providers[0].npiList)
+	assert.Equal(t, "11-1111111", providers[0].tinValue)
+	assert.Equal(t, "npi", providers[1].tinType)
+	assert.Equal(t, "7", providers[1].groupID)
+	assert.Nil(t, x.get("8"))
+}
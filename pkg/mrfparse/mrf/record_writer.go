@@ -15,16 +15,165 @@ limitations under the License.
 */
 package mrf
 
-import "github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
 
-var WriteRecords func(records []*models.Mrf) error
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/parquet"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/sink"
 
-// NewRecordWriter returns a function that writes Mrf records to the writer channel
-// This allows us to avoid passing the channel to every function that needs to write
-func NewRecordWriter(wc chan []*models.Mrf) func(records []*models.Mrf) error {
-	return func(records []*models.Mrf) error {
-		wc <- records
+	"github.com/spf13/viper"
+)
 
+// ErrWriterStopped is returned when records are written after the writer has stopped, typically
+// following a write error. The writer's error is returned by Close.
+var ErrWriterStopped = errors.New("writer has stopped")
+
+// newRecordSink returns the RecordSink for format, set by writer.format. An empty format is parquet.
+func newRecordSink(format string) (sink.RecordSink, error) {
+	switch format {
+	case "", sink.ParquetFormat:
+		return parquet.NewSink("mrf"), nil
+	case sink.CSVFormat:
+		return sink.NewCSVSink("mrf"), nil
+	case sink.NDJSONFormat:
+		return sink.NewNDJSONSink("mrf"), nil
+	case sink.Neo4jFormat:
+		return sink.NewNeo4jSink("mrf"), nil
+	case sink.SQLiteFormat:
+		return sink.NewSQLiteSink("mrf"), nil
+	case sink.PostgresFormat:
+		return sink.NewPostgresSink(), nil
+	default:
+		return nil, fmt.Errorf("unknown writer format %q", format)
+	}
+}
+
+// sinkWriter is a RecordWriter that sends records to a RecordSink run by sink.Run in its own goroutine
+type sinkWriter struct {
+	s       sink.RecordSink
+	wc      chan []*models.Mrf
+	cp      chan sink.CheckpointRequest
+	done    chan bool
+	stopped chan struct{}
+	err     error
+}
+
+// newSinkWriter starts the RecordSink of writer.format writing a fileset to outputPath. If outputPath is on
+// the local filesystem and does not exist, it is created, other than for the postgres format, which loads
+// the records into a database instead. The writer closes the current file and stops when ctx is cancelled.
+func newSinkWriter(ctx context.Context, outputPath string) (RecordWriter, error) {
+	const writerChannelSize int = 4 * 1024
+
+	format := viper.GetString("writer.format")
+
+	s, err := newRecordSink(format)
+	if err != nil {
+		return nil, err
+	}
+
+	if format != sink.PostgresFormat && !cloud.IsCloudURI(outputPath) {
+		err = os.MkdirAll(outputPath, os.ModePerm)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create output path %s: %w", outputPath, err)
+		}
+	}
+
+	w := &sinkWriter{
+		s:  s,
+		cp: make(chan sink.CheckpointRequest),
+		// used to persist []mrf to the sink
+		wc: make(chan []*models.Mrf, writerChannelSize),
+		// done channel for writers
+		done:    make(chan bool),
+		stopped: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.stopped)
+
+		w.err = sink.RunWithCheckpoints(ctx, s, outputPath, w.wc, w.done, w.cp)
+	}()
+
+	return w, nil
+}
+
+// Write sends records to the writer. If the writer has stopped, ErrWriterStopped is returned rather
+// than blocking.
+func (w *sinkWriter) Write(records []*models.Mrf) error {
+	select {
+	case w.wc <- records:
 		return nil
+	case <-w.stopped:
+		return ErrWriterStopped
 	}
 }
+
+// Close tells the writer to finish, waits for it to close the current file and commit the output,
+// and returns any error encountered while writing.
+func (w *sinkWriter) Close() error {
+	return w.finish(true)
+}
+
+// Abort tells the writer to close the current file without committing the output, waits for it, and
+// returns any error encountered while writing.
+func (w *sinkWriter) Abort() error {
+	return w.finish(false)
+}
+
+func (w *sinkWriter) checkpoints() bool {
+	_, ok := w.s.(sink.Checkpointer)
+	return ok
+}
+
+func (w *sinkWriter) checkpoint() ([]byte, error) {
+	return w.request(nil)
+}
+
+func (w *sinkWriter) resume(state []byte) error {
+	_, err := w.request(state)
+	return err
+}
+
+// request sends a checkpoint request to the sink, returning its result. If the writer has stopped,
+// ErrWriterStopped is returned.
+func (w *sinkWriter) request(resume []byte) ([]byte, error) {
+	reply := make(chan sink.CheckpointResult, 1)
+
+	select {
+	case w.cp <- sink.CheckpointRequest{Resume: resume, Reply: reply}:
+	case <-w.stopped:
+		return nil, ErrWriterStopped
+	}
+
+	result := <-reply
+
+	return result.State, result.Err
+}
+
+// Files lists the files written by the RecordSink once the writer has closed, or none if the sink doesn't
+// write files
+func (w *sinkWriter) Files() []sink.File {
+	if fl, ok := w.s.(sink.FileLister); ok {
+		return fl.Files()
+	}
+
+	return nil
+}
+
+func (w *sinkWriter) finish(commit bool) error {
+	select {
+	case w.done <- commit:
+	case <-w.stopped:
+	}
+
+	// Wait for the writer to clean up
+	<-w.stopped
+	log.Debugf("Finished waiting for writer to finish.")
+
+	return w.err
+}
@@ -16,20 +16,20 @@ limitations under the License.
 package mrf
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
 	"io"
 	"path/filepath"
-	"strconv"
 	"strings"
 )
 
-// parseMrfRoot parses the root json doc and returns a Mrf struct
-func parseMrfRoot(doc []byte, planID int64) (*models.Mrf, error) {
+// parseMrfRoot parses the root json doc and returns a Mrf struct. If plan is not nil, its non-empty
+// fields override those of the root doc.
+func parseMrfRoot(doc []byte, plan *models.Plan) (*models.Mrf, error) {
 	var (
 		root models.MrfRoot
 		mrf  models.Mrf
@@ -41,8 +41,8 @@ func parseMrfRoot(doc []byte, planID int64) (*models.Mrf, error) {
 		return nil, err
 	}
 
-	if planID != -1 {
-		root.PlanID = strconv.FormatInt(planID, 10)
+	if plan != nil {
+		overridePlan(&root.Plan, plan)
 	}
 
 	mrf = models.Mrf{UUID: uuid, RecordType: "root", MrfRoot: root}
@@ -50,10 +50,12 @@ func parseMrfRoot(doc []byte, planID int64) (*models.Mrf, error) {
 	return &mrf, nil
 }
 
-// WriteRoot loads the root.json file and writes it
-func writeRoot(filename string, planID int64) string {
-	f, err := cloud.NewReader(context.TODO(), filename)
-	utils.ExitOnError(err)
+// writeRoot loads the root.json file and writes it, returning the root record's UUID
+func (run *parseRun) writeRoot(filename string, plan *models.Plan) (string, error) {
+	f, err := cloud.NewReader(run.ctx, filename)
+	if err != nil {
+		return "", err
+	}
 
 	defer func(f io.ReadCloser) {
 		err = f.Close()
@@ -63,15 +65,21 @@ func writeRoot(filename string, planID int64) string {
 	}(f)
 
 	doc, err := io.ReadAll(f)
-	utils.ExitOnError(err)
+	if err != nil {
+		return "", err
+	}
 
-	mrf, err := parseMrfRoot(doc, planID)
-	utils.ExitOnError(err)
+	mrf, err := parseMrfRoot(doc, plan)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse %s: %w", filename, err)
+	}
 
-	err = WriteRecords([]*models.Mrf{mrf})
-	utils.ExitOnError(err)
+	err = run.writeRecords([]*models.Mrf{mrf})
+	if err != nil {
+		return "", err
+	}
 
-	return mrf.UUID
+	return mrf.UUID, nil
 }
 
 func findRootFile(filesList []string) (string, error) {
@@ -84,3 +92,22 @@ func findRootFile(filesList []string) (string, error) {
 
 	return "", errors.New("root.json file not found")
 }
+
+// overridePlan sets the fields of dst to the non-empty fields of src
+func overridePlan(dst, src *models.Plan) {
+	if src.PlanMarketType != "" {
+		dst.PlanMarketType = src.PlanMarketType
+	}
+
+	if src.PlanName != "" {
+		dst.PlanName = src.PlanName
+	}
+
+	if src.PlanIDType != "" {
+		dst.PlanIDType = src.PlanIDType
+	}
+
+	if src.PlanID != "" {
+		dst.PlanID = src.PlanID
+	}
+}
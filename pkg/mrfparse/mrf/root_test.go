@@ -41,7 +41,7 @@ func TestParseMrfRoot(t *testing.T) {
 		"plan_id_type":"planidtype",
         "version":"1.3.1"}`)
 
-	mrf, err := parseMrfRoot(doc, -1)
+	mrf, err := parseMrfRoot(doc, nil)
 	assert.NoError(t, err)
 	assert.Equal(t, "Aetna Health Insurance Company", mrf.ReportingEntityName)
 	assert.Equal(t, "Health Insurance Issuer", mrf.ReportingEntityType)
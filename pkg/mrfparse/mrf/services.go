@@ -18,46 +18,170 @@ package mrf
 import (
 	"context"
 	"encoding/csv"
+	"fmt"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
-	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
 	"io"
+	"strings"
 
 	mapset "github.com/deckarep/golang-set/v2"
 	"github.com/spf13/viper"
 )
 
-// loadServiceList loads a list of services from a csv file and returns a stringSet of the services.
-// The csv file is expected to have a header row, with first column being the
-// CPT/HCPCS service code, and subsequent columns being ignored.
-func loadServiceList(uri string) StringSet {
+// AllCodes is used in place of a billing code to select all codes of a billing code type
+const AllCodes = "*"
+
+// ServiceList is the list of services to filter on.
+//
+// Codes added without a billing code type match CPT, HCPCS and NDC codes. Typed codes only match codes
+// of the same billing code type, and the AllCodes code matches all codes of its billing code type.
+type ServiceList struct {
+	Codes        StringSet
+	TypedCodes   StringSet
+	AllCodeTypes StringSet
+}
+
+// NewServiceList returns a new ServiceList containing the given untyped codes
+func NewServiceList(codes ...string) *ServiceList {
+	s := &ServiceList{
+		Codes:        mapset.NewSet[string](),
+		TypedCodes:   mapset.NewSet[string](),
+		AllCodeTypes: mapset.NewSet[string](),
+	}
+
+	for _, code := range codes {
+		s.Add("", code)
+	}
+
+	return s
+}
+
+// Add adds a service to the ServiceList. billingCodeType may be empty, and billingCode may be AllCodes.
+// Hyphenated NDC codes are also added in their normalized 11 digit form.
+func (s *ServiceList) Add(billingCodeType, billingCode string) {
+	bct := normalizeCodeType(billingCodeType)
+	bc := strings.TrimSpace(billingCode)
+
+	codes := []string{bc}
+	if ndc := normalizeNDC(bc); ndc != bc && (bct == "" || bct == "NDC") {
+		codes = append(codes, ndc)
+	}
+
+	switch {
+	case bct == "":
+		for _, code := range codes {
+			s.Codes.Add(code)
+		}
+	case bc == AllCodes:
+		s.AllCodeTypes.Add(bct)
+	default:
+		for _, code := range codes {
+			s.TypedCodes.Add(typedCode(bct, code))
+		}
+	}
+}
+
+// Contains returns true if the service is in the ServiceList
+func (s *ServiceList) Contains(billingCodeType, billingCode string) bool {
+	bct := normalizeCodeType(billingCodeType)
+
+	if s.AllCodeTypes.Contains(bct) || s.TypedCodes.Contains(typedCode(bct, billingCode)) {
+		return true
+	}
+
+	switch bct {
+	case "HCPCS", "CPT":
+		return s.Codes.Contains(billingCode)
+	case "NDC":
+		ndc := normalizeNDC(billingCode)
+		return s.Codes.Contains(billingCode) || s.Codes.Contains(ndc) || s.TypedCodes.Contains(typedCode(bct, ndc))
+	default:
+		return false
+	}
+}
+
+// Cardinality returns the number of codes and code types in the ServiceList
+func (s *ServiceList) Cardinality() int {
+	return s.Codes.Cardinality() + s.TypedCodes.Cardinality() + s.AllCodeTypes.Cardinality()
+}
+
+func normalizeCodeType(billingCodeType string) string {
+	return strings.ToUpper(strings.TrimSpace(billingCodeType))
+}
+
+func typedCode(billingCodeType, billingCode string) string {
+	return billingCodeType + "|" + billingCode
+}
+
+// loadServiceList loads a list of services from a csv file and returns a ServiceList of the services.
+// The csv file is expected to have a header row. If the header has billing_code_type and billing_code
+// columns, services are loaded as (billing_code_type, billing_code) pairs, and a billing_code of "*"
+// selects all codes of the billing_code_type. If it has a billing_code column only, that column is the
+// CPT/HCPCS/NDC service code. Otherwise, the first column is expected to be the service code, and
+// subsequent columns are ignored. A header with a billing_code_type column but no billing_code column is
+// an error.
+func loadServiceList(ctx context.Context, uri string) (*ServiceList, error) {
 	var f io.ReadCloser
 	var err error
-	var services StringSet = mapset.NewSet[string]()
+	var services = NewServiceList()
 
 	// if empty, get from config file
 	if uri == "" {
 		uri = viper.GetString("services.file")
 	}
 
-	f, err = cloud.NewReader(context.TODO(), uri)
-	utils.ExitOnError(err)
+	f, err = cloud.NewReader(ctx, uri)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open services file %s: %w", uri, err)
+	}
 
 	defer func(f io.ReadCloser) {
-		err = f.Close()
+		err := f.Close()
 		if err != nil {
-			utils.ExitOnError(err)
+			log.Errorf("Unable to close %s: %s", uri, err.Error())
 		}
 	}(f)
 
 	csvReader := csv.NewReader(f)
+
 	serviceData, err := csvReader.ReadAll()
-	utils.ExitOnError(err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read services file %s: %w", uri, err)
+	}
 
-	// extract the first column, the CPT/HCPCS code, from csv,
+	if len(serviceData) == 0 {
+		return services, nil
+	}
+
+	typeCol, codeCol := -1, -1
+
+	for i, h := range serviceData[0] {
+		switch strings.ToLower(strings.TrimSpace(h)) {
+		case "billing_code_type":
+			typeCol = i
+		case "billing_code":
+			codeCol = i
+		}
+	}
+
+	switch {
+	case codeCol >= 0:
+	case typeCol >= 0:
+		return nil, fmt.Errorf("services file %s has a billing_code_type column but no billing_code column", uri)
+	default:
+		codeCol = 0
+	}
+
+	// extract the billing code, and billing code type if present, from csv,
 	// skipping the header row
 	for _, s := range serviceData[1:] { // skip header
-		services.Add(s[0])
+		var bct string
+
+		if typeCol >= 0 {
+			bct = s[typeCol]
+		}
+
+		services.Add(bct, s[codeCol])
 	}
 
-	return services
+	return services, nil
 }
@@ -16,6 +16,9 @@ limitations under the License.
 package mrf
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/alecthomas/assert/v2"
@@ -23,9 +26,85 @@ import (
 
 // Test loadServices
 func TestLoadServices(t *testing.T) {
-	services := loadServiceList("../../../data/test_services.csv")
+	services, err := loadServiceList(context.Background(), "../../../data/test_services.csv")
+	assert.NoError(t, err)
+
 	assert.Equal(t, 2, services.Cardinality())
 
-	assert.True(t, services.Contains("J0702"))
-	assert.True(t, services.Contains("J1745"))
+	assert.True(t, services.Codes.Contains("J0702"))
+	assert.True(t, services.Codes.Contains("J1745"))
+}
+
+// Test loadServices with NDC codes
+func TestLoadServicesNDC(t *testing.T) {
+	services, err := loadServiceList(context.Background(), "../../../data/test_ndc_services.csv")
+	assert.NoError(t, err)
+
+	assert.Equal(t, 3, services.Cardinality())
+	assert.True(t, services.Codes.Contains("0002-7597-01"))
+	assert.True(t, services.Codes.Contains("00002759701"))
+	assert.True(t, services.Codes.Contains("50090034701"))
+}
+
+// Test loadServices with billing code types
+func TestLoadServicesTyped(t *testing.T) {
+	services, err := loadServiceList(context.Background(), "../../../data/test_typed_services.csv")
+	assert.NoError(t, err)
+
+	assert.Equal(t, 4, services.Cardinality())
+
+	assert.True(t, services.Contains("MS-DRG", "470"))
+	assert.True(t, services.Contains("RC", "0450"))
+	assert.True(t, services.Contains("CPT", "99213"))
+	assert.True(t, services.Contains("APR-DRG", "139"))
+	assert.True(t, services.Contains("apr-drg", "140"))
+
+	// typed codes only match their own billing code type
+	assert.False(t, services.Contains("HCPCS", "99213"))
+	assert.False(t, services.Contains("MS-DRG", "0450"))
+	assert.False(t, services.Contains("RC", "0451"))
+}
+
+func TestServiceList(t *testing.T) {
+	services := NewServiceList("J0702", "0002-7597-01")
+	services.Add("EAPG", "00431")
+
+	// untyped codes match CPT, HCPCS and NDC codes
+	assert.True(t, services.Contains("HCPCS", "J0702"))
+	assert.True(t, services.Contains("CPT", "J0702"))
+	assert.False(t, services.Contains("RC", "J0702"))
+	assert.True(t, services.Contains("NDC", "00002759701"))
+	assert.True(t, services.Contains("NDC", "00002-7597-01"))
+
+	assert.True(t, services.Contains("EAPG", "00431"))
+	assert.False(t, services.Contains("EAPG", "00432"))
+
+	services.Add("EAPG", AllCodes)
+	assert.True(t, services.Contains("EAPG", "00432"))
+}
+
+func TestLoadServicesMissing(t *testing.T) {
+	_, err := loadServiceList(context.Background(), "../../../data/missing_services.csv")
+	assert.Error(t, err)
+}
+
+// without a billing_code column, the billing code is read from the first column, unless the header has a
+// billing_code_type column
+func TestLoadServicesNoBillingCode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.csv")
+
+	err := os.WriteFile(path, []byte("code,description\nJ0702,BETAMETHASONE ACET&SOD PHOSP\n"), 0o644)
+	assert.NoError(t, err)
+
+	services, err := loadServiceList(context.Background(), path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, services.Cardinality())
+	assert.True(t, services.Codes.Contains("J0702"))
+
+	err = os.WriteFile(path, []byte("billing_code_type,code,description\nMS-DRG,470,MAJOR HIP AND KNEE JOINT REPLACEMENT\n"), 0o644)
+	assert.NoError(t, err)
+
+	_, err = loadServiceList(context.Background(), path)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "billing_code")
 }
@@ -0,0 +1,414 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/parquet"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
+
+	"github.com/spf13/viper"
+)
+
+// ErrRootPartitionUnsupported is returned when streaming an MRF to output partitioned on a root column. The root
+// record is only written once the whole MRF has been read, so its columns aren't known as rows are partitioned.
+var ErrRootPartitionUnsupported = errors.New("writer.partition_by may not include root columns when streaming an MRF")
+
+// ParseStream parses the in-network-rates MRF at inputPath in a single pass, without downloading
+// and splitting it first. inputPath may be a HTTP(S) URL, a cloud URI or a local path, and may be
+// gzip compressed. A fileset in the writer.format is written to outputPath. It is a convenience wrapper around
+// a Parser with the default options, followed by any opts.
+func ParseStream(ctx context.Context, inputPath, outputPath string, plan *models.Plan, serviceFile string, opts ...ParserOption) error {
+	p := NewParser(append([]ParserOption{WithPlan(plan), WithServiceFile(serviceFile)}, opts...)...)
+	defer p.Close()
+
+	return p.ParseStream(ctx, inputPath, outputPath)
+}
+
+// ParseStream parses the in-network-rates MRF at inputPath in a single pass, without downloading
+// and splitting it first, writing the output to outputPath. See ParseStream.
+func (p *Parser) ParseStream(ctx context.Context, inputPath, outputPath string) error {
+	if p.rateFacts {
+		return ErrRateFactsUnsupported
+	}
+
+	if p.resume {
+		return ErrResumeUnsupported
+	}
+
+	for _, c := range viper.GetStringSlice("writer.partition_by") {
+		if parquet.IsRootPartitionColumn(c) {
+			return ErrRootPartitionUnsupported
+		}
+	}
+
+	run, err := p.newRun(ctx, inputPath, outputPath)
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		log.Info("Streaming MRF: ", inputPath)
+
+		f, err := openURI(ctx, inputPath)
+		if err != nil {
+			return err
+		}
+
+		defer func(f io.ReadCloser) {
+			err := f.Close()
+			if err != nil {
+				log.Errorf("Unable to close %s: %s", inputPath, err.Error())
+			}
+		}(f)
+
+		// The checksum is of the MRF as served, before it is decompressed
+		h := sha256.New()
+		raw := io.TeeReader(f, h)
+
+		r, err := utils.NewDecompressReader(raw)
+		if err != nil {
+			return err
+		}
+
+		err = run.parseStream(r, p.plan)
+		if err != nil {
+			return err
+		}
+
+		// Read any trailing bytes so that the checksum is of the whole MRF
+		_, err = io.Copy(io.Discard, raw)
+		if err != nil {
+			return err
+		}
+
+		run.source.Checksum = "sha256:" + hex.EncodeToString(h.Sum(nil))
+
+		return nil
+	}()
+
+	return run.finish(err)
+}
+
+// parseStream tokenizes the top-level MRF object in r. Each in_network element is handed to the
+// in_network parser as it arrives, in batches of NDJSON lines. provider_references can only be
+// filtered once all in_network elements have been parsed, so any that appear before the end of the
+// in_network array are spilled to a temporary NDJSON file and parsed afterwards. provider_references
+// that follow in_network, as is the case for most payers, are parsed directly. The root record is
+// written once the whole object has been read.
+func (run *parseRun) parseStream(r io.Reader, plan *models.Plan) error {
+	var (
+		rootUUID   = utils.GetUniqueID()
+		rootFields = make(map[string]json.RawMessage)
+		inDone     = false
+		spill      *prSpill
+		start      = time.Now()
+		err        error
+	)
+
+	inBatcher := newLineBatcher(run.parser.inBatchSize, submitTo(run.inGroup, func(lines *string) error {
+		return run.parseInLines(lines, rootUUID, run.writeRecords)
+	}))
+
+	prBatcher := newLineBatcher(run.parser.prBatchSize, submitTo(run.prGroup, func(lines *string) error {
+		return run.parsePRLines(lines, rootUUID, run.writeRecords)
+	}))
+
+	dec := json.NewDecoder(bufio.NewReaderSize(r, LineBuffer))
+
+	if err = expectDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	for dec.More() {
+		var t json.Token
+
+		t, err = dec.Token()
+		if err != nil {
+			return err
+		}
+
+		key, ok := t.(string)
+		if !ok {
+			return fmt.Errorf("unexpected token %v in MRF object", t)
+		}
+
+		switch key {
+		case "in_network":
+			log.Info("Streaming in_network")
+
+			err = streamArray(dec, inBatcher.Add)
+			if err != nil {
+				return err
+			}
+
+			err = inBatcher.Flush()
+			if err != nil {
+				return err
+			}
+
+			inDone = true
+
+			log.Info("Completed reading in_network: ", inBatcher.Total(), " records")
+			run.timed("in_network", start)
+		case "provider_references":
+			if inDone {
+				// Wait for all in_network threads to finish so that the providers filter is complete
+				err = run.inGroup.Wait()
+				if err != nil {
+					return err
+				}
+
+				log.Info("Found ", run.providers.Len(), " providers in in_network_rates.")
+
+				start = time.Now()
+
+				err = streamArray(dec, prBatcher.Add)
+				if err != nil {
+					return err
+				}
+
+				err = prBatcher.Flush()
+				if err != nil {
+					return err
+				}
+
+				log.Info("Completed reading provider references: ", prBatcher.Total(), " records")
+				run.timed("provider_references", start)
+
+				continue
+			}
+
+			log.Info("provider_references precede in_network. Spilling to disk until in_network is parsed.")
+
+			spill, err = newPRSpill()
+			if err != nil {
+				return err
+			}
+
+			// Removed however the parse ends, closing it first if it failed before in_network was parsed
+			defer spill.Remove()
+
+			err = streamArray(dec, func(raw []byte) error {
+				if err := run.ctx.Err(); err != nil {
+					return err
+				}
+
+				return spill.Add(raw)
+			})
+			if err != nil {
+				return err
+			}
+		default:
+			var raw json.RawMessage
+
+			err = dec.Decode(&raw)
+			if err != nil {
+				return err
+			}
+
+			// Only root scalars are of interest. Skip any other arrays or objects.
+			if len(raw) > 0 && (raw[0] == '[' || raw[0] == '{') {
+				log.Debug("Skipping ", key)
+
+				run.unsupported = append(run.unsupported, key)
+
+				continue
+			}
+
+			rootFields[key] = raw
+		}
+	}
+
+	if err = expectDelim(dec, '}'); err != nil {
+		return err
+	}
+
+	err = run.inGroup.Wait()
+	if err != nil {
+		return err
+	}
+
+	if spill != nil {
+		log.Info("Found ", run.providers.Len(), " providers in in_network_rates.")
+
+		start = time.Now()
+
+		err = spill.Close()
+		if err != nil {
+			return err
+		}
+
+		err = run.parseProviderReference(spill.Name(), rootUUID, run.writeRecords)
+		if err != nil {
+			return err
+		}
+
+		err = run.prGroup.Wait()
+		if err != nil {
+			return err
+		}
+
+		run.timed("provider_references", start)
+	}
+
+	err = run.prGroup.Wait()
+	if err != nil {
+		return err
+	}
+
+	run.logProviders()
+
+	return run.writeStreamRoot(rootFields, rootUUID, plan)
+}
+
+// writeStreamRoot writes the root record built from the root fields collected by parseStream, using
+// the rootUUID the in_network and provider_references records were parented to.
+func (run *parseRun) writeStreamRoot(rootFields map[string]json.RawMessage, rootUUID string, plan *models.Plan) error {
+	doc, err := json.Marshal(rootFields)
+	if err != nil {
+		return err
+	}
+
+	mrf, err := parseMrfRoot(doc, plan)
+	if err != nil {
+		return err
+	}
+
+	mrf.UUID = rootUUID
+
+	return run.writeRecords([]*models.Mrf{mrf})
+}
+
+// expectDelim reads the next token from dec and returns an error if it's not delim
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expected %s, found %v", delim, t)
+	}
+
+	return nil
+}
+
+// streamArray reads the array that is the next value in dec, calling fn with each element.
+// A null value is treated as an empty array.
+func streamArray(dec *json.Decoder, fn func(raw []byte) error) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if t == nil {
+		return nil
+	}
+
+	if d, ok := t.(json.Delim); !ok || d != '[' {
+		return fmt.Errorf("expected an array, found %v", t)
+	}
+
+	for dec.More() {
+		var raw json.RawMessage
+
+		err = dec.Decode(&raw)
+		if err != nil {
+			return err
+		}
+
+		err = fn(raw)
+		if err != nil {
+			return err
+		}
+	}
+
+	return expectDelim(dec, ']')
+}
+
+// prSpill is a temporary NDJSON file holding provider_references read before in_network was complete
+type prSpill struct {
+	f      *os.File
+	w      *bufio.Writer
+	closed bool
+}
+
+func newPRSpill() (*prSpill, error) {
+	f, err := os.CreateTemp(viper.GetString("tmp.path"), "provider_references_*.json")
+	if err != nil {
+		return nil, err
+	}
+
+	return &prSpill{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// Add writes raw to the spill file as a NDJSON line
+func (s *prSpill) Add(raw []byte) error {
+	line, err := compactLine(raw)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.w.Write(line)
+	if err != nil {
+		return err
+	}
+
+	return s.w.WriteByte('\n')
+}
+
+// Close flushes and closes the spill file
+func (s *prSpill) Close() error {
+	s.closed = true
+
+	err := s.w.Flush()
+	if err != nil {
+		_ = s.f.Close()
+		return err
+	}
+
+	return s.f.Close()
+}
+
+// Name returns the path of the spill file
+func (s *prSpill) Name() string {
+	return s.f.Name()
+}
+
+// Remove closes the spill file, if it's not yet closed, and deletes it
+func (s *prSpill) Remove() {
+	if !s.closed {
+		s.closed = true
+		_ = s.f.Close()
+	}
+
+	err := os.Remove(s.f.Name())
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Unable to remove %s: %s", s.f.Name(), err.Error())
+	}
+}
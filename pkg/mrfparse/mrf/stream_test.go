@@ -0,0 +1,253 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const streamInNetwork = `"in_network": [
+	{
+	  "negotiation_arrangement": "ffs",
+	  "name": "OFFICE VISIT",
+	  "billing_code_type": "CPT",
+	  "billing_code_type_version": "2022",
+	  "billing_code": "99213",
+	  "negotiated_rates": [
+		{
+		  "provider_references": [1],
+		  "negotiated_prices": [
+			{
+			  "negotiated_type": "negotiated",
+			  "negotiated_rate": 80.5,
+			  "expiration_date": "9999-12-31",
+			  "billing_class": "professional",
+			  "service_code": ["11"]
+			}
+		  ]
+		}
+	  ]
+	},
+	{
+	  "negotiation_arrangement": "ffs",
+	  "name": "OFFICE VISIT, NEW",
+	  "billing_code_type": "CPT",
+	  "billing_code_type_version": "2022",
+	  "billing_code": "99203",
+	  "negotiated_rates": [
+		{
+		  "provider_references": [2],
+		  "negotiated_prices": [
+			{
+			  "negotiated_type": "negotiated",
+			  "negotiated_rate": 120,
+			  "expiration_date": "9999-12-31",
+			  "billing_class": "professional",
+			  "service_code": ["11"]
+			}
+		  ]
+		}
+	  ]
+	}
+]`
+
+const streamProviderReferences = `"provider_references": [
+	{
+	  "provider_group_id": 1,
+	  "provider_groups": [{ "npi": [1821198789], "tin": { "type": "ein", "value": "11-1111111" } }]
+	},
+	{
+	  "provider_group_id": 2,
+	  "provider_groups": [{ "npi": [1770512915], "tin": { "type": "ein", "value": "22-2222222" } }]
+	}
+]`
+
+const streamRoot = `"reporting_entity_name": "Test Payer",
+	"reporting_entity_type": "health insurance issuer",
+	"plan_name": "Test Plan",
+	"plan_id_type": "hios",
+	"plan_id": "12345",
+	"plan_market_type": "individual",
+	"last_updated_on": "2023-01-01",
+	"version": "1.3.1"`
+
+// sliceWriter is a RecordWriter that collects records in memory
+type sliceWriter struct {
+	mu      sync.Mutex
+	records []*models.Mrf
+}
+
+func (w *sliceWriter) Write(records []*models.Mrf) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.records = append(w.records, records...)
+
+	return nil
+}
+
+func (w *sliceWriter) Close() error {
+	return nil
+}
+
+// newTestRun returns a parse run filtering on services, writing to the returned sliceWriter
+func newTestRun(t *testing.T, services *ServiceList) (*parseRun, *sliceWriter) {
+	w := &sliceWriter{}
+
+	p := NewParser(WithServiceList(services), WithWriter(func(context.Context, string) (RecordWriter, error) {
+		return w, nil
+	}))
+	t.Cleanup(p.Close)
+
+	run, err := p.newRun(context.Background(), "", "")
+	assert.NoError(t, err)
+
+	return run, w
+}
+
+func recordsOfType(records []*models.Mrf, recordType string) []*models.Mrf {
+	return utils.Filter(records, func(mrf *models.Mrf) bool {
+		return mrf.RecordType == recordType
+	})
+}
+
+func testParseStream(t *testing.T, doc string) {
+	run, w := newTestRun(t, NewServiceList("99213"))
+
+	err := run.finish(run.parseStream(strings.NewReader(doc), nil))
+	assert.NoError(t, err)
+
+	records := &w.records
+
+	roots := recordsOfType(*records, "root")
+	assert.Equal(t, 1, len(roots))
+
+	root := roots[0]
+	assert.Equal(t, "Test Payer", root.ReportingEntityName)
+	assert.Equal(t, "12345", root.PlanID)
+	assert.Equal(t, "2023-01-01", root.LastUpdatedOn)
+
+	inNetwork := recordsOfType(*records, "in_network")
+	assert.Equal(t, 1, len(inNetwork))
+	assert.Equal(t, "99213", inNetwork[0].BillingCode)
+	assert.Equal(t, root.UUID, inNetwork[0].ParentUUID)
+
+	prices := recordsOfType(*records, "negotiated_prices")
+	assert.Equal(t, 1, len(prices))
+	assert.Equal(t, 80.5, prices[0].NegotiatedRateValue)
+
+	// only the provider reference used by 99213 is kept
+	groups := recordsOfType(*records, "provider_group")
+	assert.Equal(t, 1, len(groups))
+	assert.Equal(t, "1", groups[0].ProviderGroupID)
+	assert.Equal(t, root.UUID, groups[0].ParentUUID)
+
+	assert.Equal(t, int32(2), run.totalProviders.Load())
+	assert.Equal(t, int32(1), run.matchedProviders.Load())
+}
+
+func TestParseStream(t *testing.T) {
+	testParseStream(t, "{"+streamRoot+",\n"+streamInNetwork+",\n"+streamProviderReferences+"}")
+}
+
+// provider_references ahead of in_network are spilled to disk and parsed once in_network is complete
+func TestParseStreamProviderReferencesFirst(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	testParseStream(t, "{"+streamRoot+",\n"+streamProviderReferences+",\n"+streamInNetwork+"}")
+}
+
+// the spill file is closed and removed if the parse fails
+func TestParseStreamSpillRemoved(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	run, _ := newTestRun(t, NewServiceList("99213"))
+
+	err := run.finish(run.parseStream(strings.NewReader("{"+streamRoot+",\n"+streamProviderReferences+",\n\"in_network\": [{"), nil))
+	assert.Error(t, err)
+
+	entries, err := os.ReadDir(tmp)
+	assert.NoError(t, err)
+
+	for _, e := range entries {
+		assert.NotContains(t, e.Name(), "provider_references_")
+	}
+}
+
+func TestPRSpillRemove(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	spill, err := newPRSpill()
+	assert.NoError(t, err)
+	assert.NoError(t, spill.Add([]byte(`{"provider_group_id": 1}`)))
+
+	spill.Remove()
+
+	assert.ErrorIs(t, spill.f.Close(), os.ErrClosed)
+	assert.NoFileExists(t, spill.Name())
+}
+
+func TestParseStreamNotAnObject(t *testing.T) {
+	run, _ := newTestRun(t, NewServiceList("99213"))
+
+	err := run.finish(run.parseStream(strings.NewReader(`[]`), nil))
+	assert.Error(t, err)
+}
+
+// Root columns aren't known until the end of the stream, so output can't be partitioned on them
+func TestParseStreamRootPartition(t *testing.T) {
+	defer viper.Set("writer.partition_by", nil)
+
+	viper.Set("writer.partition_by", []string{"record_type", "reporting_entity_name"})
+
+	output := t.TempDir()
+	p := NewParser(WithServiceList(NewServiceList("99213")))
+	defer p.Close()
+
+	err := p.ParseStream(context.Background(), "testdata/does-not-exist.json", output)
+	assert.ErrorIs(t, err, ErrRootPartitionUnsupported)
+
+	// nothing is written
+	entries, err := os.ReadDir(output)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	viper.Set("writer.partition_by", []string{"record_type", "billing_code_type"})
+
+	err = p.ParseStream(context.Background(), "testdata/does-not-exist.json", output)
+	assert.NotErrorIs(t, err, ErrRootPartitionUnsupported)
+}
+
+func TestCompactLine(t *testing.T) {
+	line, err := compactLine([]byte("{\n  \"a\": \"b\\nc\",\n  \"d\": [1, 2]\n}"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":"b\nc","d":[1,2]}`, string(line))
+
+	line, err = compactLine([]byte(`{"a": 1}`))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a": 1}`, string(line))
+}
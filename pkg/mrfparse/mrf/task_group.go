@@ -0,0 +1,78 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"context"
+	"sync"
+
+	"github.com/alitto/pond"
+)
+
+// taskGroup submits tasks to a worker pool, recording the first error returned by a task. Once a task
+// has failed or ctx is cancelled, tasks that have yet to start are skipped, and readers can check Err
+// to stop submitting work.
+type taskGroup struct {
+	ctx   context.Context
+	group *pond.TaskGroup
+	mu    sync.Mutex
+	err   error
+}
+
+func newTaskGroup(ctx context.Context, pool *pond.WorkerPool) *taskGroup {
+	return &taskGroup{ctx: ctx, group: pool.Group()}
+}
+
+// Submit submits task to the worker pool
+func (g *taskGroup) Submit(task func() error) {
+	g.group.Submit(func() {
+		if g.Err() != nil {
+			return
+		}
+
+		if err := task(); err != nil {
+			g.setErr(err)
+		}
+	})
+}
+
+// Wait waits for all submitted tasks to complete, returning the first error returned by a task
+func (g *taskGroup) Wait() error {
+	g.group.Wait()
+
+	return g.Err()
+}
+
+// Err returns the first error returned by a task, if any, or ctx's error if it has been cancelled
+func (g *taskGroup) Err() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.err != nil {
+		return g.err
+	}
+
+	return g.ctx.Err()
+}
+
+func (g *taskGroup) setErr(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.err == nil {
+		g.err = err
+	}
+}
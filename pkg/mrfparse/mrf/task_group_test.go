@@ -0,0 +1,92 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package mrf
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alitto/pond"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskGroup(t *testing.T) {
+	var ran atomic.Int32
+
+	pool := pond.New(2, 0)
+	defer pool.StopAndWait()
+
+	g := newTaskGroup(context.Background(), pool)
+
+	for i := 0; i < 10; i++ {
+		g.Submit(func() error {
+			ran.Add(1)
+			return nil
+		})
+	}
+
+	assert.NoError(t, g.Wait())
+	assert.Equal(t, int32(10), ran.Load())
+}
+
+func TestTaskGroupError(t *testing.T) {
+	var ran atomic.Int32
+
+	// tasks submitted after a failure are skipped
+	pool := pond.New(1, 0)
+	defer pool.StopAndWait()
+
+	g := newTaskGroup(context.Background(), pool)
+
+	g.Submit(func() error { return fmt.Errorf("first") })
+
+	assert.Error(t, g.Wait())
+
+	for i := 0; i < 5; i++ {
+		g.Submit(func() error {
+			ran.Add(1)
+			return fmt.Errorf("later")
+		})
+	}
+
+	assert.EqualError(t, g.Wait(), "first")
+	assert.Equal(t, int32(0), ran.Load())
+}
+
+func TestTaskGroupCancel(t *testing.T) {
+	var ran atomic.Int32
+
+	pool := pond.New(1, 0)
+	defer pool.StopAndWait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	g := newTaskGroup(ctx, pool)
+
+	cancel()
+
+	// tasks submitted after the context is cancelled are skipped
+	for i := 0; i < 5; i++ {
+		g.Submit(func() error {
+			ran.Add(1)
+			return nil
+		})
+	}
+
+	assert.ErrorIs(t, g.Wait(), context.Canceled)
+	assert.Equal(t, int32(0), ran.Load())
+}
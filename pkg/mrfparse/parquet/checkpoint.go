@@ -0,0 +1,302 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parquet
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+)
+
+// errLayoutMismatch is returned when resuming from a checkpoint written with a different layout
+var errLayoutMismatch = errors.New("checkpoint was written with a different writer layout")
+
+// sinkState is the state of a Sink at a checkpoint: the files written to each table, and the index of each
+// partition's next file
+type sinkState struct {
+	Tables []tableState `json:"tables"`
+	// Rejects and Rejected are the state of the rejects table and the number of records rejected, if the
+	// output has the typed schema
+	Rejects  *tableState `json:"rejects,omitempty"`
+	Rejected int         `json:"rejected,omitempty"`
+	// Root and PartitionValues are the partitioner's last root record and the values of each partition path,
+	// if the output is partitioned
+	Root            *models.Mrf                  `json:"root,omitempty"`
+	PartitionValues map[string]map[string]string `json:"partition_values,omitempty"`
+}
+
+// tableState is the state of a table at a checkpoint
+type tableState struct {
+	// Name is the record type of a table of the normalized layout, and empty otherwise
+	Name  string      `json:"name,omitempty"`
+	Files []fileState `json:"files"`
+	// FileIndexes are the FileIndex of each partition's PqWriterFactory
+	FileIndexes map[string]int `json:"file_indexes"`
+}
+
+// fileState is a writtenFile at a checkpoint
+type fileState struct {
+	URI       string `json:"uri"`
+	Partition string `json:"partition,omitempty"`
+	Rows      int    `json:"rows"`
+}
+
+// Checkpoint closes the current file of every table and partition, so that every row written is in a closed
+// file, and returns the state needed to resume the output. Files are created as rows are next written.
+func (s *Sink) Checkpoint() ([]byte, error) {
+	return s.out.checkpoint()
+}
+
+// Resume restores the state returned by Checkpoint, so that the files written before the checkpoint are kept,
+// and committed once the Sink is closed, and new files continue their tables' and partitions' numbering. Unless
+// the output has a table format, whose readers ignore uncommitted files, the files written after the checkpoint
+// in the partitions checkpointed are removed.
+func (s *Sink) Resume(state []byte) error {
+	return s.out.resume(state)
+}
+
+func (o *output) checkpoint() ([]byte, error) {
+	tables, err := o.layout.checkpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	state := sinkState{Tables: tables}
+
+	if o.rejects != nil {
+		rejects, err := o.rejects.rows.checkpointTable("")
+		if err != nil {
+			return nil, err
+		}
+
+		state.Rejects = &rejects
+		state.Rejected = o.rejects.n
+	}
+
+	if o.partitioner != nil {
+		state.Root = o.partitioner.root
+		state.PartitionValues = o.partitioner.values
+	}
+
+	return json.Marshal(state)
+}
+
+func (o *output) resume(data []byte) error {
+	var state sinkState
+
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+
+	err = o.layout.resume(state.Tables)
+	if err != nil {
+		return err
+	}
+
+	if (state.Rejects != nil) != (o.rejects != nil) {
+		return errors.New("checkpoint was written with a different writer schema")
+	}
+
+	if o.rejects != nil {
+		err = o.rejects.rows.resumeTable(*state.Rejects)
+		if err != nil {
+			return err
+		}
+
+		o.rejects.n = state.Rejected
+	}
+
+	if o.partitioner != nil {
+		o.partitioner.root = state.Root
+
+		for path, values := range state.PartitionValues {
+			o.partitioner.values[path] = values
+		}
+	}
+
+	if o.tableFormat != "" {
+		return nil
+	}
+
+	err = o.layout.removeUncheckpointed()
+	if err != nil {
+		return err
+	}
+
+	if o.rejects != nil {
+		return o.rejects.rows.removeUncheckpointed()
+	}
+
+	return nil
+}
+
+// checkpointTable closes the file of every partition, and returns the state of the table, named name
+func (s *partitionSet) checkpointTable(name string) (tableState, error) {
+	err := s.close()
+	if err != nil {
+		return tableState{}, err
+	}
+
+	for _, p := range s.partitions {
+		p.open = false
+	}
+
+	s.open = 0
+
+	t := tableState{Name: name, Files: make([]fileState, 0, len(s.files.files)), FileIndexes: make(map[string]int)}
+
+	for _, f := range s.files.files {
+		t.Files = append(t.Files, fileState{URI: f.uri, Partition: f.partition, Rows: f.rows})
+	}
+
+	for path, p := range s.partitions {
+		t.FileIndexes[path] = p.w.wf.FileIndex
+	}
+
+	return t, nil
+}
+
+// resumeTable restores the files written and the partitions of t
+func (s *partitionSet) resumeTable(t tableState) error {
+	s.files.files = nil
+
+	for _, f := range t.Files {
+		s.files.add(f.Partition, f.URI, f.Rows)
+	}
+
+	paths := make([]string, 0, len(t.FileIndexes))
+	for path := range t.FileIndexes {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		p, err := s.newPartition(path)
+		if err != nil {
+			return err
+		}
+
+		p.w.wf.FileIndex = t.FileIndexes[path]
+	}
+
+	return nil
+}
+
+// removeUncheckpointed removes the files of each partition resumed that were created after the checkpoint. They
+// are numbered from the partition's FileIndex at the checkpoint, so only those files are removed, and the output
+// isn't listed, as it may be shared with other runs. Partitions first written after the checkpoint aren't
+// resumed, and their files are overwritten as the lines after the checkpoint are parsed again.
+func (s *partitionSet) removeUncheckpointed() error {
+	for _, path := range s.order {
+		wf := s.partitions[path].w.wf
+
+		for i := wf.FileIndex; ; i++ {
+			uri := wf.uri(i)
+
+			ok, err := cloud.Exists(s.ctx, uri)
+			if err != nil {
+				return err
+			}
+
+			// Files are created in turn, each once the last is closed, so there are none after a missing file
+			if !ok {
+				break
+			}
+
+			log.Info("Removing ", uri, ", written after the checkpoint")
+
+			err = cloud.Remove(s.ctx, uri)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkpoint closes the table's files and returns its state, as the table of the wide layout
+func (s *partitionSet) checkpoint() ([]tableState, error) {
+	t, err := s.checkpointTable("")
+	if err != nil {
+		return nil, err
+	}
+
+	return []tableState{t}, nil
+}
+
+// resume restores the state of the table of the wide layout
+func (s *partitionSet) resume(tables []tableState) error {
+	if len(tables) != 1 || tables[0].Name != "" {
+		return errLayoutMismatch
+	}
+
+	return s.resumeTable(tables[0])
+}
+
+// checkpoint closes the files of every table, returning their states in the order the tables were created
+func (r *tableRouter) checkpoint() ([]tableState, error) {
+	tables := make([]tableState, 0, len(r.order))
+
+	for _, recordType := range r.order {
+		t, err := r.tables[recordType].checkpointTable(recordType)
+		if err != nil {
+			return nil, err
+		}
+
+		tables = append(tables, t)
+	}
+
+	return tables, nil
+}
+
+// removeUncheckpointed removes the files of each table resumed that were created after the checkpoint
+func (r *tableRouter) removeUncheckpointed() error {
+	for _, recordType := range r.order {
+		err := r.tables[recordType].removeUncheckpointed()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resume creates the tables of the normalized layout in tables, restoring their states
+func (r *tableRouter) resume(tables []tableState) error {
+	for _, state := range tables {
+		if state.Name == "" {
+			return errLayoutMismatch
+		}
+
+		t, err := r.table(state.Name)
+		if err != nil {
+			return err
+		}
+
+		err = t.resumeTable(state)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parquet
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/spf13/viper"
+)
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// fileURIs returns the URIs of files
+func fileURIs(s *Sink) []string {
+	var uris []string
+
+	for _, f := range s.Files() {
+		uris = append(uris, f.URI)
+	}
+
+	return uris
+}
+
+// A resumed Sink keeps the files written before the checkpoint, removes those written after it, and continues
+// each table's file numbering. Files of a table first written after the checkpoint are written again.
+func TestSinkCheckpointResume(t *testing.T) {
+	viper.Set("writer.filename_template", "_%04d.zstd.parquet")
+	viper.Set("writer.layout", NormalizedLayout)
+	setPartitionBy(t, "reporting_entity_name")
+	t.Cleanup(func() { viper.Set("writer.layout", "") })
+
+	var (
+		ctx  = context.Background()
+		dir  = t.TempDir()
+		root = &models.Mrf{UUID: "0", RecordType: "root", MrfRoot: models.MrfRoot{ReportingEntityName: "Payer"}}
+	)
+
+	s := NewSink("mrf")
+	assert.NoError(t, s.Open(ctx, dir))
+	assert.NoError(t, s.WriteBatch([]*models.Mrf{root, {UUID: "1", ParentUUID: "0", RecordType: "in_network"}}))
+
+	state, err := s.Checkpoint()
+	assert.NoError(t, err)
+
+	inNetwork := filepath.Join(dir, "in_network", "reporting_entity_name=Payer")
+
+	// the rows written before the checkpoint are in closed files
+	assert.Equal(t, int64(1), numRows(t, filepath.Join(inNetwork, "mrf_0000.zstd.parquet")))
+
+	// the parse fails after writing more rows
+	assert.NoError(t, s.WriteBatch([]*models.Mrf{{UUID: "2", ParentUUID: "0", RecordType: "in_network"},
+		{UUID: "3", ParentUUID: "0", RecordType: "tin"}}))
+	assert.NoError(t, s.Close(false))
+	assert.True(t, fileExists(filepath.Join(inNetwork, "mrf_0001.zstd.parquet")))
+
+	s = NewSink("mrf")
+	assert.NoError(t, s.Open(ctx, dir))
+	assert.NoError(t, s.Resume(state))
+
+	assert.False(t, fileExists(filepath.Join(inNetwork, "mrf_0001.zstd.parquet")))
+
+	// rows written once resumed are partitioned on the root written before the checkpoint
+	assert.NoError(t, s.WriteBatch([]*models.Mrf{{UUID: "2", ParentUUID: "0", RecordType: "in_network"},
+		{UUID: "3", ParentUUID: "0", RecordType: "tin"}}))
+	assert.NoError(t, s.Close(true))
+
+	tin := filepath.Join(dir, "tin", "reporting_entity_name=Payer", "mrf_0000.zstd.parquet")
+	assert.Equal(t, []string{
+		filepath.Join(dir, "root", "reporting_entity_name=Payer", "mrf_0000.zstd.parquet"),
+		filepath.Join(inNetwork, "mrf_0000.zstd.parquet"),
+		filepath.Join(inNetwork, "mrf_0001.zstd.parquet"),
+		tin,
+	}, fileURIs(s))
+	assert.Equal(t, int64(1), numRows(t, filepath.Join(inNetwork, "mrf_0001.zstd.parquet")))
+	assert.Equal(t, int64(1), numRows(t, tin))
+}
+
+// Resuming removes only the files of the partitions resumed, and not those of other runs in the same output
+func TestSinkResumeKeepsOtherFiles(t *testing.T) {
+	viper.Set("writer.filename_template", "_%04d.zstd.parquet")
+	setPartitionBy(t, "reporting_entity_name")
+
+	var (
+		ctx   = context.Background()
+		dir   = t.TempDir()
+		payer = filepath.Join(dir, "reporting_entity_name=Payer")
+		other = filepath.Join(dir, "reporting_entity_name=Other")
+	)
+
+	s := NewSink("mrf")
+	assert.NoError(t, s.Open(ctx, dir))
+	assert.NoError(t, s.WriteBatch([]*models.Mrf{
+		{UUID: "0", RecordType: "root", MrfRoot: models.MrfRoot{ReportingEntityName: "Payer"}}}))
+
+	state, err := s.Checkpoint()
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.WriteBatch([]*models.Mrf{{UUID: "1", ParentUUID: "0", RecordType: "in_network"}}))
+	assert.NoError(t, s.Close(false))
+
+	// another run's files, in another partition of the output
+	assert.NoError(t, os.MkdirAll(other, 0o755))
+
+	for _, name := range []string{"mrf_0000.zstd.parquet", "mrf_0001.zstd.parquet"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(other, name), nil, 0o600))
+	}
+
+	s = NewSink("mrf")
+	assert.NoError(t, s.Open(ctx, dir))
+	assert.NoError(t, s.Resume(state))
+	assert.NoError(t, s.Close(true))
+
+	assert.True(t, fileExists(filepath.Join(payer, "mrf_0000.zstd.parquet")))
+	assert.False(t, fileExists(filepath.Join(payer, "mrf_0001.zstd.parquet")))
+	assert.True(t, fileExists(filepath.Join(other, "mrf_0000.zstd.parquet")))
+	assert.True(t, fileExists(filepath.Join(other, "mrf_0001.zstd.parquet")))
+}
+
+// A checkpoint can't be resumed with a different layout
+func TestSinkResumeLayoutMismatch(t *testing.T) {
+	viper.Set("writer.filename_template", "_%04d.zstd.parquet")
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s := NewSink("mrf")
+	assert.NoError(t, s.Open(ctx, dir))
+	assert.NoError(t, s.WriteBatch([]*models.Mrf{{UUID: "1", RecordType: "root"}}))
+
+	state, err := s.Checkpoint()
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close(true))
+
+	viper.Set("writer.layout", NormalizedLayout)
+	t.Cleanup(func() { viper.Set("writer.layout", "") })
+
+	s = NewSink("mrf")
+	assert.NoError(t, s.Open(ctx, dir))
+	assert.True(t, errors.Is(s.Resume(state), errLayoutMismatch))
+}
@@ -0,0 +1,233 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parquet
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/segmentio/parquet-go"
+	"github.com/segmentio/parquet-go/compress"
+	pqzstd "github.com/segmentio/parquet-go/compress/zstd"
+	"github.com/segmentio/parquet-go/encoding"
+	"github.com/spf13/viper"
+)
+
+// Encoding profiles, set by writer.encoding
+const (
+	// PlainEncoding writes every column with plain encoding, as set by the models' struct tags, for compatibility
+	// with parquet libraries that don't support other encodings. It is the default.
+	PlainEncoding = "plain"
+	// DictionaryEncoding writes low-cardinality columns, those with the ENUM logical type and any listed by
+	// writer.dictionary_columns, with RLE dictionary encoding. Other columns are written with plain encoding.
+	DictionaryEncoding = "dictionary"
+)
+
+// Compression codecs, set by writer.compression
+const (
+	ZstdCompression   = "zstd"
+	SnappyCompression = "snappy"
+	GzipCompression   = "gzip"
+	NoCompression     = "none"
+)
+
+// bloomFilterBitsPerValue is the size of the bloom filters written, giving a false positive rate of about 1%
+const bloomFilterBitsPerValue = 10
+
+// fileConfig is the encoding, compression, statistics and bloom filters of the parquet files written, set by
+// the writer config
+type fileConfig struct {
+	encoding          string
+	compression       string
+	codec             compress.Codec
+	pageStatistics    bool
+	bloomFilters      []string
+	dictionaryColumns map[string]bool
+}
+
+// loadFileConfig returns the fileConfig set by the writer config
+func loadFileConfig() (*fileConfig, error) {
+	c := &fileConfig{
+		encoding:          viper.GetString("writer.encoding"),
+		compression:       viper.GetString("writer.compression"),
+		pageStatistics:    viper.GetBool("writer.page_statistics"),
+		bloomFilters:      viper.GetStringSlice("writer.bloom_filters"),
+		dictionaryColumns: make(map[string]bool),
+	}
+
+	switch c.encoding {
+	case "":
+		c.encoding = PlainEncoding
+	case PlainEncoding, DictionaryEncoding:
+	default:
+		return nil, fmt.Errorf("unknown writer encoding %q", c.encoding)
+	}
+
+	switch c.compression {
+	case "", ZstdCompression:
+		c.compression = ZstdCompression
+		c.codec = &parquet.Zstd
+
+		if viper.IsSet("writer.compression_level") {
+			c.codec = &pqzstd.Codec{Level: zstd.EncoderLevelFromZstd(viper.GetInt("writer.compression_level"))}
+		}
+	case SnappyCompression:
+		c.codec = &parquet.Snappy
+	case GzipCompression:
+		c.codec = &parquet.Gzip
+	case NoCompression:
+		c.codec = &parquet.Uncompressed
+	default:
+		return nil, fmt.Errorf("unknown writer compression %q", c.compression)
+	}
+
+	for _, column := range viper.GetStringSlice("writer.dictionary_columns") {
+		if _, ok := wideSchema.Lookup(column); !ok && !isGroup(wideSchema, column) {
+			return nil, fmt.Errorf("unknown dictionary column %q", column)
+		}
+
+		c.dictionaryColumns[column] = true
+	}
+
+	for _, column := range c.bloomFilters {
+		if _, ok := wideSchema.Lookup(column); !ok {
+			return nil, fmt.Errorf("unknown bloom filter column %q", column)
+		}
+	}
+
+	return c, nil
+}
+
+// isGroup returns true if column is a top-level group of schema, such as a list
+func isGroup(schema *parquet.Schema, column string) bool {
+	for _, f := range schema.Fields() {
+		if f.Name() == column {
+			return !f.Leaf()
+		}
+	}
+
+	return false
+}
+
+// extension returns the extension of the files written, e.g. ".zstd.parquet"
+func (c *fileConfig) extension() string {
+	if c.compression == NoCompression {
+		return ".parquet"
+	}
+
+	return "." + c.compression + ".parquet"
+}
+
+// writerOptions returns the options of a parquet writer writing rows with schema
+func (c *fileConfig) writerOptions(schema *parquet.Schema, maxRowsPerGroup int64) []parquet.WriterOption {
+	options := []parquet.WriterOption{
+		parquet.Compression(c.codec),
+		parquet.DataPageStatistics(c.pageStatistics),
+	}
+
+	if maxRowsPerGroup > 0 {
+		options = append(options, parquet.MaxRowsPerRowGroup(maxRowsPerGroup))
+	}
+
+	// Bloom filters are only written for the columns in schema, as a normalized table has only some columns
+	var filters []parquet.BloomFilterColumn
+
+	for _, column := range c.bloomFilters {
+		if _, ok := schema.Lookup(column); ok {
+			filters = append(filters, parquet.SplitBlockFilter(bloomFilterBitsPerValue, column))
+		}
+	}
+
+	if len(filters) > 0 {
+		options = append(options, parquet.BloomFilters(filters...))
+	}
+
+	// schema is always set, as it may differ from the schema of the rows' Go type, e.g. with dates
+	if c.encoding == DictionaryEncoding {
+		schema = c.dictionarySchema(schema)
+	}
+
+	return append(options, schema)
+}
+
+// dictionarySchema returns schema with RLE dictionary encoding on its low-cardinality columns
+func (c *fileConfig) dictionarySchema(schema *parquet.Schema) *parquet.Schema {
+	fields := make([]parquet.Field, 0, len(schema.Fields()))
+
+	for _, f := range schema.Fields() {
+		fields = append(fields, encodeField(f, c.dictionaryColumns[f.Name()]))
+	}
+
+	return parquet.NewSchema(schema.Name(), &encodedNode{Node: schema, fields: fields})
+}
+
+// encodeField returns f with RLE dictionary encoding on its ENUM leaves, or all of its leaves if dict is true
+func encodeField(f parquet.Field, dict bool) parquet.Field {
+	if f.Leaf() {
+		if dict || isEnum(f) {
+			return &encodedField{Field: f, encoding: &parquet.RLEDictionary}
+		}
+
+		return f
+	}
+
+	fields := make([]parquet.Field, 0, len(f.Fields()))
+
+	for _, child := range f.Fields() {
+		fields = append(fields, encodeField(child, dict))
+	}
+
+	return &encodedField{Field: f, fields: fields}
+}
+
+func isEnum(n parquet.Node) bool {
+	lt := n.Type().LogicalType()
+	return lt != nil && lt.Enum != nil
+}
+
+// encodedNode is a group node whose fields have been re-encoded. Unlike a parquet.Group, it keeps the order of
+// the fields, so that the columns are written in the same order as with the models' struct tags.
+type encodedNode struct {
+	parquet.Node
+	fields []parquet.Field
+}
+
+func (n *encodedNode) Fields() []parquet.Field {
+	return n.fields
+}
+
+// encodedField is a field whose encoding, if a leaf, or fields, if a group, have been replaced
+type encodedField struct {
+	parquet.Field
+	encoding encoding.Encoding
+	fields   []parquet.Field
+}
+
+func (f *encodedField) Encoding() encoding.Encoding {
+	if f.encoding != nil {
+		return f.encoding
+	}
+
+	return f.Field.Encoding()
+}
+
+func (f *encodedField) Fields() []parquet.Field {
+	if f.fields != nil {
+		return f.fields
+	}
+
+	return f.Field.Fields()
+}
@@ -0,0 +1,168 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parquet
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/segmentio/parquet-go"
+	"github.com/segmentio/parquet-go/format"
+	"github.com/spf13/viper"
+)
+
+// setFileConfig sets the writer config keys in config for the duration of the test
+func setFileConfig(t *testing.T, config map[string]any) {
+	for k, v := range config {
+		viper.Set(k, v)
+	}
+
+	t.Cleanup(func() {
+		for k := range config {
+			viper.Set(k, nil)
+		}
+
+		viper.Set("writer.filename_template", "_%04d.zstd.parquet")
+	})
+}
+
+// columnChunk returns the metadata of column's chunk in the first row group of the parquet file at path. column
+// is the dotted path of a leaf column.
+func columnChunk(t *testing.T, path, column string) (format.ColumnMetaData, parquet.ColumnChunk) {
+	pf, err := parquet.OpenFile(mustOpen(t, path))
+	assert.NoError(t, err)
+
+	leaf, ok := pf.Schema().Lookup(strings.Split(column, ".")...)
+	assert.True(t, ok, column)
+
+	return pf.Metadata().RowGroups[0].Columns[leaf.ColumnIndex].MetaData, pf.RowGroups()[0].ColumnChunks()[leaf.ColumnIndex]
+}
+
+func TestWriterFileConfig(t *testing.T) {
+	setFileConfig(t, map[string]any{
+		"writer.filename_template":  "",
+		"writer.encoding":           DictionaryEncoding,
+		"writer.compression":        SnappyCompression,
+		"writer.page_statistics":    true,
+		"writer.bloom_filters":      []string{"in_billing_code", "provider_group_id"},
+		"writer.dictionary_columns": []string{"in_billing_code", "in_np_service_codes"},
+	})
+
+	dir := t.TempDir()
+
+	err := runWriter(dir, []*models.Mrf{
+		{UUID: "1", RecordType: "in_network", InNetwork: models.InNetwork{BillingCode: "99213"}},
+		{UUID: "2", RecordType: "negotiated_prices", NegotiatedPrices: models.NegotiatedPrices{ServiceCodes: []string{"11", "22"}}},
+	})
+	assert.NoError(t, err)
+
+	path := filepath.Join(dir, "mrf_0000.snappy.parquet")
+
+	rows, err := parquet.ReadFile[models.Mrf](path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(rows))
+	assert.Equal(t, "99213", rows[0].BillingCode)
+	assert.Equal(t, models.ServiceCodes{"11", "22"}, rows[1].ServiceCodes)
+
+	// the columns are in the same order as with plain encoding
+	pf, err := parquet.OpenFile(mustOpen(t, path))
+	assert.NoError(t, err)
+	assert.Equal(t, wideSchema.Columns(), pf.Schema().Columns())
+
+	for column, dict := range map[string]bool{"record_type": true, "in_billing_code": true, "uuid": false,
+		"in_np_service_codes.list.element": true} {
+		meta, _ := columnChunk(t, path, column)
+		assert.Equal(t, format.Snappy, meta.Codec, column)
+		assert.Equal(t, dict, contains(meta.Encoding, format.RLEDictionary), column)
+	}
+
+	_, chunk := columnChunk(t, path, "in_billing_code")
+	assert.NotZero(t, chunk.BloomFilter())
+
+	_, chunk = columnChunk(t, path, "uuid")
+	assert.Zero(t, chunk.BloomFilter())
+}
+
+// mustOpen opens the file at path, returning it and its size
+func mustOpen(t *testing.T, path string) (*os.File, int64) {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+
+	t.Cleanup(func() { f.Close() })
+
+	st, err := f.Stat()
+	assert.NoError(t, err)
+
+	return f, st.Size()
+}
+
+func contains(encodings []format.Encoding, e format.Encoding) bool {
+	for _, enc := range encodings {
+		if enc == e {
+			return true
+		}
+	}
+
+	return false
+}
+
+// the plain encoding profile and uncompressed files, with bloom filters only on the columns of each table
+func TestWriterFileConfigNormalized(t *testing.T) {
+	setFileConfig(t, map[string]any{
+		"writer.filename_template": "",
+		"writer.layout":            NormalizedLayout,
+		"writer.compression":       NoCompression,
+		"writer.bloom_filters":     []string{"in_billing_code", "provider_tin_value"},
+	})
+
+	dir := t.TempDir()
+
+	err := runWriter(dir, []*models.Mrf{
+		{UUID: "1", RecordType: "in_network", InNetwork: models.InNetwork{BillingCode: "99213"}},
+		{UUID: "2", RecordType: "tin", Tin: models.Tin{Value: "11-1111111"}},
+	})
+	assert.NoError(t, err)
+
+	meta, chunk := columnChunk(t, filepath.Join(dir, "tin", "mrf_0000.parquet"), "provider_tin_value")
+	assert.Equal(t, format.Uncompressed, meta.Codec)
+	assert.False(t, contains(meta.Encoding, format.RLEDictionary))
+	assert.NotZero(t, chunk.BloomFilter())
+
+	_, chunk = columnChunk(t, filepath.Join(dir, "in_network", "mrf_0000.parquet"), "in_billing_code")
+	assert.NotZero(t, chunk.BloomFilter())
+}
+
+func TestWriterFileConfigInvalid(t *testing.T) {
+	for k, v := range map[string]any{
+		"writer.encoding":           "rle",
+		"writer.compression":        "lzo",
+		"writer.bloom_filters":      []string{"billing_code"},
+		"writer.dictionary_columns": []string{"billing_code"},
+	} {
+		setFileConfig(t, map[string]any{k: v})
+
+		err := Writer(context.Background(), "mrf", t.TempDir(), make(chan []*models.Mrf), make(chan bool))
+		assert.Error(t, err, k)
+
+		viper.Set(k, nil)
+	}
+}
@@ -0,0 +1,356 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parquet
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+)
+
+// HiveDefaultPartition is the partition value of rows with no value for a partition column, as used by Hive
+const HiveDefaultPartition = "__HIVE_DEFAULT_PARTITION__"
+
+// DefaultMaxOpenPartitions is the default number of partitions of a table that may have an open file
+const DefaultMaxOpenPartitions = 100
+
+// partitionColumn returns a row's value for a column that output may be partitioned on
+type partitionColumn struct {
+	// root columns are only present on the root record, and are taken from the last root row written
+	root  bool
+	value func(m *models.Mrf) string
+}
+
+// partitionColumns are the columns output may be partitioned on, set by writer.partition_by
+var partitionColumns = map[string]partitionColumn{
+	"record_type":           {value: func(m *models.Mrf) string { return m.RecordType }},
+	"billing_code_type":     {value: billingCodeType},
+	"reporting_entity_name": {root: true, value: func(m *models.Mrf) string { return m.ReportingEntityName }},
+	"reporting_entity_type": {root: true, value: func(m *models.Mrf) string { return m.ReportingEntityType }},
+	"last_updated_on":       {root: true, value: func(m *models.Mrf) string { return m.LastUpdatedOn }},
+	"plan_id":               {root: true, value: func(m *models.Mrf) string { return m.PlanID }},
+	"plan_market_type":      {root: true, value: func(m *models.Mrf) string { return m.PlanMarketType }},
+}
+
+// IsRootPartitionColumn reports whether column is a partition column taken from the root record
+func IsRootPartitionColumn(column string) bool {
+	return partitionColumns[column].root
+}
+
+// billingCodeType returns the billing code type of an in_network, out_of_network or rate_fact row
+func billingCodeType(m *models.Mrf) string {
+	switch {
+	case m.BillingCodeType != "":
+		return m.BillingCodeType
+	case m.OONBillingCodeType != "":
+		return m.OONBillingCodeType
+	default:
+		return m.RFBillingCodeType
+	}
+}
+
+// partitioner assigns rows to Hive-style partitions, a key=value directory for each partition column.
+//
+// Columns other than root columns are only present on some record types. Rows without a value inherit the
+// value of the first row of their batch that has one, as a batch holds the records of a single MRF object.
+type partitioner struct {
+	columns []string
+	root    *models.Mrf
+	// values are the partition values of each partition path assigned, with no entry for null values
+	values map[string]map[string]string
+}
+
+// newPartitioner returns a partitioner partitioning on columns
+func newPartitioner(columns []string) (*partitioner, error) {
+	for _, c := range columns {
+		if _, ok := partitionColumns[c]; !ok {
+			return nil, fmt.Errorf("unknown partition column %q", c)
+		}
+	}
+
+	return &partitioner{columns: columns, values: make(map[string]map[string]string)}, nil
+}
+
+// group groups the rows of data by their partition path, returning the paths in the order first seen
+func (p *partitioner) group(data []*models.Mrf) ([]string, map[string][]*models.Mrf) {
+	var (
+		byPath = make(map[string][]*models.Mrf)
+		paths  []string
+	)
+
+	for _, row := range data {
+		if row.RecordType == "root" {
+			p.root = row
+		}
+	}
+
+	inherited := p.batchValues(data)
+
+	for _, row := range data {
+		path := p.path(row, inherited)
+
+		if _, ok := byPath[path]; !ok {
+			paths = append(paths, path)
+		}
+
+		byPath[path] = append(byPath[path], row)
+	}
+
+	return paths, byPath
+}
+
+// batchValues returns the value of each non-root partition column on the first row of data that has one
+func (p *partitioner) batchValues(data []*models.Mrf) map[string]string {
+	values := make(map[string]string)
+
+	for _, c := range p.columns {
+		col := partitionColumns[c]
+		if col.root {
+			continue
+		}
+
+		for _, row := range data {
+			if v := col.value(row); v != "" {
+				values[c] = v
+				break
+			}
+		}
+	}
+
+	return values
+}
+
+// path returns the partition directory of row, relative to the table's root
+func (p *partitioner) path(row *models.Mrf, inherited map[string]string) string {
+	var (
+		dirs   = make([]string, len(p.columns))
+		values = make(map[string]string)
+	)
+
+	for i, c := range p.columns {
+		var (
+			col = partitionColumns[c]
+			v   string
+		)
+
+		switch {
+		case col.root && p.root != nil:
+			v = col.value(p.root)
+		case !col.root:
+			v = col.value(row)
+			if v == "" {
+				v = inherited[c]
+			}
+		}
+
+		if v == "" {
+			dirs[i] = c + "=" + HiveDefaultPartition
+			continue
+		}
+
+		values[c] = v
+		dirs[i] = c + "=" + escapePartitionValue(v)
+	}
+
+	path := strings.Join(dirs, "/")
+
+	if _, ok := p.values[path]; !ok {
+		p.values[path] = values
+	}
+
+	return path
+}
+
+// partition is the rowWriter of a single partition directory
+type partition struct {
+	w        *rowWriter
+	open     bool
+	lastUsed int64
+}
+
+// partitionSet writes a table's rows to a directory per partition, beneath the table's root. Each partition
+// has its own rowWriter, so that max_rows_per_file applies per partition. Once more than maxOpen partitions
+// have open files, the least recently used partition's file is closed. A partition that is written to again
+// continues its file numbering. Unpartitioned tables have a single partition, with an empty path, at the
+// table's root.
+type partitionSet struct {
+	ctx        context.Context
+	uri        string
+	newFactory func(uri string) (*PqWriterFactory, error)
+	maxOpen    int
+	files      *tableFiles
+	partitions map[string]*partition
+	// order is the order in which partitions were created, so that they are closed deterministically
+	order []string
+	open  int
+	tick  int64
+}
+
+// newPartitionSet returns a partitionSet for the table at uri, creating each partition's PqWriterFactory
+// with newFactory. Closed files are recorded in files.
+func newPartitionSet(ctx context.Context, uri string, maxOpen int, files *tableFiles,
+	newFactory func(uri string) (*PqWriterFactory, error)) *partitionSet {
+	if maxOpen <= 0 {
+		maxOpen = DefaultMaxOpenPartitions
+	}
+
+	return &partitionSet{
+		ctx:        ctx,
+		uri:        uri,
+		newFactory: newFactory,
+		maxOpen:    maxOpen,
+		files:      files,
+		partitions: make(map[string]*partition),
+	}
+}
+
+// write writes data to the partition at path
+func (s *partitionSet) write(path string, data []*models.Mrf) error {
+	p, err := s.partition(path)
+	if err != nil {
+		return err
+	}
+
+	return p.w.write(data)
+}
+
+// partition returns the partition for path, creating it if need be, and closes the least recently used
+// partition if too many are open
+func (s *partitionSet) partition(path string) (*partition, error) {
+	p, ok := s.partitions[path]
+	if !ok {
+		var err error
+
+		p, err = s.newPartition(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.tick++
+	p.lastUsed = s.tick
+
+	if !p.open {
+		p.open = true
+		s.open++
+
+		if s.open > s.maxOpen {
+			err := s.closeLeastRecentlyUsed()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// newPartition creates the partition for path, without opening a file
+func (s *partitionSet) newPartition(path string) (*partition, error) {
+	uri := s.uri
+
+	if path != "" {
+		if cloud.IsCloudURI(uri) {
+			// Cloud URIs are unescaped when parsed, so escape the partition values' escapes
+			uri = cloud.JoinURI(uri, escapeURIPath(path))
+		} else {
+			uri = cloud.JoinURI(uri, path)
+		}
+	}
+
+	err := mkdirLocal(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	wf, err := s.newFactory(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &partition{w: &rowWriter{ctx: s.ctx, wf: wf, onClose: func(uri string, rows int) {
+		s.files.add(path, uri, rows)
+	}}}
+	s.partitions[path] = p
+	s.order = append(s.order, path)
+
+	return p, nil
+}
+
+// closeLeastRecentlyUsed closes the file of the open partition that was least recently written to
+func (s *partitionSet) closeLeastRecentlyUsed() error {
+	var lru *partition
+
+	for _, path := range s.order {
+		p := s.partitions[path]
+		if p.open && (lru == nil || p.lastUsed < lru.lastUsed) {
+			lru = p
+		}
+	}
+
+	lru.open = false
+	s.open--
+
+	return lru.w.close()
+}
+
+// close closes the file of every partition, returning the first error
+func (s *partitionSet) close() error {
+	var err error
+
+	for _, path := range s.order {
+		if cerr := s.partitions[path].w.close(); cerr != nil {
+			if err != nil {
+				log.Errorf("Unable to close partition %s of %s: %s", path, s.uri, cerr.Error())
+				continue
+			}
+
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// escapeURIPath URL escapes each segment of path
+func escapeURIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// escapePartitionValue escapes the characters of a partition value that Hive escapes in directory names
+func escapePartitionValue(v string) string {
+	var b strings.Builder
+
+	for _, c := range []byte(v) {
+		if c < 0x20 || c == 0x7f || strings.IndexByte("\"#%'*/:=?\\{[]^", c) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
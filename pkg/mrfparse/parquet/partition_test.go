@@ -0,0 +1,135 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parquet
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/spf13/viper"
+)
+
+func setPartitionBy(t *testing.T, columns ...string) {
+	viper.Set("writer.filename_template", "_%04d.zstd.parquet")
+	viper.Set("writer.partition_by", columns)
+	t.Cleanup(func() { viper.Set("writer.partition_by", nil) })
+}
+
+func TestWriterPartitioned(t *testing.T) {
+	setPartitionBy(t, "reporting_entity_name", "billing_code_type")
+
+	dir := t.TempDir()
+
+	err := runWriter(dir,
+		[]*models.Mrf{{UUID: "1", RecordType: "root", MrfRoot: models.MrfRoot{ReportingEntityName: "Payer/One"}}},
+		[]*models.Mrf{
+			{UUID: "2", ParentUUID: "1", RecordType: "in_network", InNetwork: models.InNetwork{BillingCodeType: "CPT"}},
+			{UUID: "3", ParentUUID: "2", RecordType: "negotiated_rate"},
+		},
+		[]*models.Mrf{
+			{UUID: "4", ParentUUID: "1", RecordType: "in_network", InNetwork: models.InNetwork{BillingCodeType: "MS-DRG"}},
+		},
+		[]*models.Mrf{{UUID: "5", ParentUUID: "1", RecordType: "provider_group"}},
+	)
+	assert.NoError(t, err)
+
+	entity := filepath.Join(dir, "reporting_entity_name=Payer%2FOne")
+
+	// the root and provider_group rows have no billing code type
+	assert.Equal(t, int64(2), numRows(t, filepath.Join(entity, "billing_code_type="+HiveDefaultPartition, "mrf_0000.zstd.parquet")))
+	// negotiated_rate inherits CPT from its in_network row
+	assert.Equal(t, int64(2), numRows(t, filepath.Join(entity, "billing_code_type=CPT", "mrf_0000.zstd.parquet")))
+	assert.Equal(t, int64(1), numRows(t, filepath.Join(entity, "billing_code_type=MS-DRG", "mrf_0000.zstd.parquet")))
+}
+
+// max_rows_per_file applies to each partition, and a partition closed to limit the number of open
+// partitions continues its file numbering
+func TestWriterPartitionedFiles(t *testing.T) {
+	setPartitionBy(t, "record_type")
+	viper.Set("writer.max_rows_per_file", 2)
+	viper.Set("writer.max_open_partitions", 1)
+	t.Cleanup(func() {
+		viper.Set("writer.max_rows_per_file", 100_000_000)
+		viper.Set("writer.max_open_partitions", 0)
+	})
+
+	dir := t.TempDir()
+
+	err := runWriter(dir,
+		[]*models.Mrf{{UUID: "1", RecordType: "provider"}, {UUID: "2", RecordType: "provider"}},
+		[]*models.Mrf{{UUID: "3", RecordType: "tin"}},
+		[]*models.Mrf{{UUID: "4", RecordType: "provider"}},
+		[]*models.Mrf{{UUID: "5", RecordType: "tin"}},
+	)
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(2), numRows(t, filepath.Join(dir, "record_type=provider", "mrf_0000.zstd.parquet")))
+	assert.Equal(t, int64(1), numRows(t, filepath.Join(dir, "record_type=provider", "mrf_0001.zstd.parquet")))
+	assert.Equal(t, int64(1), numRows(t, filepath.Join(dir, "record_type=tin", "mrf_0000.zstd.parquet")))
+	assert.Equal(t, int64(1), numRows(t, filepath.Join(dir, "record_type=tin", "mrf_0001.zstd.parquet")))
+}
+
+// with the normalized layout, each record type's table is partitioned
+func TestWriterPartitionedNormalized(t *testing.T) {
+	setPartitionBy(t, "last_updated_on")
+	viper.Set("writer.layout", NormalizedLayout)
+	t.Cleanup(func() { viper.Set("writer.layout", "") })
+
+	dir := t.TempDir()
+
+	err := runWriter(dir,
+		[]*models.Mrf{{UUID: "1", RecordType: "root", MrfRoot: models.MrfRoot{LastUpdatedOn: "2023-01-01"}}},
+		[]*models.Mrf{{UUID: "2", ParentUUID: "1", RecordType: "in_network"}},
+	)
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(1), numRows(t, filepath.Join(dir, "in_network", "last_updated_on=2023-01-01", "mrf_0000.zstd.parquet")))
+}
+
+func TestWriterUnknownPartitionColumn(t *testing.T) {
+	setPartitionBy(t, "in_np_negotiated_rate")
+
+	err := Writer(context.Background(), "mrf", t.TempDir(), make(chan []*models.Mrf), make(chan bool))
+	assert.Error(t, err)
+}
+
+func TestEscapePartitionValue(t *testing.T) {
+	assert.Equal(t, "Blue Cross %3D 100%25 %2F a%3Ab", escapePartitionValue("Blue Cross = 100% / a:b"))
+	assert.Equal(t, "2023-01-01", escapePartitionValue("2023-01-01"))
+}
+
+func TestEscapeURIPath(t *testing.T) {
+	assert.Equal(t, "a=Payer%252FOne/b=Blue%20Cross", escapeURIPath("a=Payer%2FOne/b=Blue Cross"))
+}
+
+// partition directories are only created for partitions that are written
+func TestWriterPartitionedNoData(t *testing.T) {
+	setPartitionBy(t, "record_type")
+
+	dir := t.TempDir()
+
+	err := runWriter(dir)
+	assert.NoError(t, err)
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(entries))
+}
@@ -20,12 +20,25 @@ import (
 	"fmt"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
 	"io"
+	"strings"
 
 	"github.com/segmentio/parquet-go"
 	"github.com/spf13/viper"
 )
 
+// RowWriteCloser writes Mrf rows to a single parquet file
+type RowWriteCloser interface {
+	Write(rows []*models.Mrf) (int, error)
+	Flush() error
+	Close() error
+	URI() string
+}
+
+// newRowWriterFunc opens a RowWriteCloser writing to uri
+type newRowWriterFunc func(ctx context.Context, uri string, maxRowsPerGroup int64) (RowWriteCloser, error)
+
 // PqWriteCloser is a wrapper around parquet.GenericWriter and io.WriteCloser
 type PqWriteCloser struct {
 	closer io.WriteCloser
@@ -34,19 +47,17 @@ type PqWriteCloser struct {
 	uri    string
 }
 
-// Close closes the underlying parquet.GenericWriter and the underlying io.WriteCloser.
+// Close closes the underlying parquet.GenericWriter and the underlying io.WriteCloser. The io.WriteCloser is
+// closed even if closing the parquet.GenericWriter fails.
 func (pwc *PqWriteCloser) Close() error {
 	err := pwc.writer.Close()
-	if err != nil {
-		return err
-	}
 
-	err = pwc.closer.Close()
+	cerr := pwc.closer.Close()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return cerr
 }
 
 // Write writes the given data to the underlying parquet.GenericWriter.
@@ -64,73 +75,137 @@ func (pwc *PqWriteCloser) URI() string {
 	return pwc.uri
 }
 
-// NewPqWriter creates a new PqWriteCloser. ctx is the context to use for the underlying io.WriteCloser, making it
-// possible to cancel the write operation.
+// NewPqWriter creates a new PqWriteCloser, with the encoding, compression, statistics and bloom filters set by the
+// writer config. ctx is the context to use for the underlying io.WriteCloser, making it possible to cancel the
+// write operation.
 func NewPqWriter(ctx context.Context, uri string, maxRowsPerGroup int64) (*PqWriteCloser, error) {
-	pqConfig := parquet.WriterConfig{Compression: &parquet.Zstd, MaxRowsPerRowGroup: maxRowsPerGroup}
+	config, err := loadFileConfig()
+	if err != nil {
+		return nil, err
+	}
 
 	w, err := cloud.NewWriter(ctx, uri)
 	if err != nil {
 		return nil, err
 	}
 
-	writer := parquet.NewGenericWriter[*models.Mrf](w, &pqConfig)
+	writer := parquet.NewGenericWriter[*models.Mrf](w, config.writerOptions(wideSchema, maxRowsPerGroup)...)
 
 	return &PqWriteCloser{uri: uri, writer: writer, closer: w, ctx: ctx}, nil
 }
 
+// newPqRowWriter creates a PqWriteCloser writing the wide Mrf schema
+func newPqRowWriter(ctx context.Context, uri string, maxRowsPerGroup int64) (RowWriteCloser, error) {
+	return NewPqWriter(ctx, uri, maxRowsPerGroup)
+}
+
 // PqWriterFactory is a factory for creating PqWriteClosers.
 // It is used to create a new PqWriteCloser when the number of rows written to the current PqWriteCloser exceeds
-// MaxRowsPerFile. The URI of the new PqWriteCloser is created by incrementing the fileIndex and formatting it
+// MaxRowsPerFile. The URI of the new PqWriteCloser is created by incrementing the FileIndex and formatting it
 // into the filenameTemplate.
 type PqWriterFactory struct {
+	newWriter        newRowWriterFunc
 	filenameTemplate string
-	fileIndex        int
-	MaxRowsPerFile   int
-	MaxRowsPerGroup  int64
+	// FileIndex is the index of the next file created. It is set from a checkpoint when a parse is resumed, so
+	// that the files already written aren't overwritten.
+	FileIndex       int
+	MaxRowsPerFile  int
+	MaxRowsPerGroup int64
 }
 
 // NewPqWriterFactory creates a new PqWriterFactory. filePrefix is the prefix of the filename (e.g. "mrf"), outputURI
-// is the URI of the output directory (e.g. "gs://bucket/output").
+// is the URI of the output directory (e.g. "gs://bucket/output"). If writer.table_format is delta, files are
+// instead named part-<index>-<unique id>-c000, and writer.filename_template is ignored.
 func NewPqWriterFactory(filePrefix, outputURI string) *PqWriterFactory {
 	var (
 		DefaultMaxRowsPerFile       = 100_000_000
 		MaxRowsPerGroup       int64 = 1_000_000
-		DefaultOutputTemplate       = "_%04d.zstd.parquet"
+		DefaultOutputTemplate       = "_%04d" + compressionExtension()
 	)
 
 	if viper.IsSet("writer.max_rows_per_file") {
 		DefaultMaxRowsPerFile = viper.GetInt("writer.max_rows_per_file")
 	}
 
-	if viper.IsSet("writer.filename_template") {
-		DefaultOutputTemplate = viper.GetString("writer.filename_template")
+	if t := viper.GetString("writer.filename_template"); t != "" {
+		DefaultOutputTemplate = t
 	}
 
 	if viper.IsSet("writer.max_rows_per_group") {
 		MaxRowsPerGroup = viper.GetInt64("writer.max_rows_per_group")
 	}
 
-	filenameTemplate := cloud.JoinURI(outputURI, filePrefix) + DefaultOutputTemplate
+	// Files of a Delta table are named uniquely, following Spark's part-<index>-<id>-c000 convention, so that a
+	// run into an existing table never overwrites the files of a version already committed
+	if viper.GetString("writer.table_format") == DeltaTableFormat {
+		filePrefix = "part"
+		DefaultOutputTemplate = "-%05d-" + utils.GetUniqueID() + "-c000" + compressionExtension()
+	}
+
+	// The URI may contain escaped partition values, so escape any % verbs in it
+	filenameTemplate := strings.ReplaceAll(cloud.JoinURI(outputURI, filePrefix), "%", "%%") + DefaultOutputTemplate
 
 	return &PqWriterFactory{
+		newWriter:        newPqRowWriter,
 		filenameTemplate: filenameTemplate,
-		fileIndex:        0,
+		FileIndex:        0,
 		MaxRowsPerFile:   DefaultMaxRowsPerFile,
 		MaxRowsPerGroup:  MaxRowsPerGroup,
 	}
 }
 
-// CreateWriter creates a new PqWriteCloser. fileIndex is incremented by each call to CreateWriter, and the
-// filenameTemplate is formatted with the new fileIndex to create the URI of the new PqWriteCloser.
-func (pwf *PqWriterFactory) CreateWriter(ctx context.Context) (*PqWriteCloser, error) {
-	uri := fmt.Sprintf(pwf.filenameTemplate, pwf.fileIndex)
-	pwf.fileIndex++
+// compressionExtension returns the extension of the files written with writer.compression, defaulting to that of
+// zstd if it isn't valid, as the error is returned once a file is created
+func compressionExtension() string {
+	config, err := loadFileConfig()
+	if err != nil {
+		return ".zstd.parquet"
+	}
 
-	w, err := NewPqWriter(ctx, uri, pwf.MaxRowsPerGroup)
+	return config.extension()
+}
+
+// CreateWriter creates a new RowWriteCloser. FileIndex is incremented by each call to CreateWriter, and the
+// filenameTemplate is formatted with the new FileIndex to create the URI of the new RowWriteCloser.
+func (pwf *PqWriterFactory) CreateWriter(ctx context.Context) (RowWriteCloser, error) {
+	uri := pwf.uri(pwf.FileIndex)
+	pwf.FileIndex++
+
+	w, err := pwf.newWriter(ctx, uri, pwf.MaxRowsPerGroup)
 	if err != nil {
 		return nil, err
 	}
 
 	return w, nil
 }
+
+// uri returns the URI of the file created with index
+func (pwf *PqWriterFactory) uri(index int) string {
+	return fmt.Sprintf(pwf.filenameTemplate, index)
+}
+
+// WriteFile writes rows to a single parquet file at uri, with the writer config's compression. It is intended for
+// small tables that are written in one go, such as the plans table of an index file.
+func WriteFile[T any](ctx context.Context, uri string, rows []T) error {
+	config, err := loadFileConfig()
+	if err != nil {
+		return err
+	}
+
+	w, err := cloud.NewWriter(ctx, uri)
+	if err != nil {
+		return err
+	}
+
+	writer := parquet.NewGenericWriter[T](w, parquet.Compression(config.codec))
+
+	if _, err = writer.Write(rows); err != nil {
+		return err
+	}
+
+	if err = writer.Close(); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
@@ -22,6 +22,7 @@ import (
 	"testing"
 
 	"github.com/alecthomas/assert/v2"
+	"github.com/segmentio/parquet-go"
 	"github.com/spf13/viper"
 )
 
@@ -84,3 +85,19 @@ func TestNewPqWriterFactoryConfig(t *testing.T) {
 	assert.Equal(t, expectedMaxRowsPerGroup, pwf.MaxRowsPerGroup)
 	assert.Equal(t, "/tmp/output/file"+expectedOutputTemplate, pwf.filenameTemplate)
 }
+
+// test writing a small table to a single parquet file
+func TestWriteFile(t *testing.T) {
+	var rows = []*models.PlanFile{{FileID: "a", FileType: "in_network"}, {FileID: "b", FileType: "allowed_amounts"}}
+
+	uri := t.TempDir() + "/plans.zstd.parquet"
+
+	err := WriteFile(context.TODO(), uri, rows)
+	assert.NoError(t, err)
+
+	readRows, err := parquet.ReadFile[models.PlanFile](uri)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(readRows))
+	assert.Equal(t, "b", readRows[1].FileID)
+	assert.Equal(t, "allowed_amounts", readRows[1].FileType)
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parquet
+
+import (
+	"strings"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/delta"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
+	"github.com/segmentio/parquet-go"
+)
+
+// DeltaTableFormat commits the files written to a Delta Lake table, set by writer.table_format
+const DeltaTableFormat = "delta"
+
+// wideSchema is the schema of the wide layout's table
+var wideSchema = parquet.SchemaOf(new(models.Mrf))
+
+// writtenFile is a parquet file that has been written and closed
+type writtenFile struct {
+	uri string
+	// partition is the path of the file's partition, relative to its table's root
+	partition string
+	rows      int
+}
+
+// tableFiles are the files written to a table
+type tableFiles struct {
+	uri    string
+	schema *parquet.Schema
+	files  []writtenFile
+}
+
+func (t *tableFiles) add(partition, uri string, rows int) {
+	t.files = append(t.files, writtenFile{uri: uri, partition: partition, rows: rows})
+}
+
+// fileSet records the files written to each table of an output, so that they may be committed
+type fileSet struct {
+	tables []*tableFiles
+}
+
+// table returns the tableFiles of a new table at uri
+func (s *fileSet) table(uri string, schema *parquet.Schema) *tableFiles {
+	t := &tableFiles{uri: uri, schema: schema}
+	s.tables = append(s.tables, t)
+
+	return t
+}
+
+// commitDelta commits the files written to each table in a new version of its Delta log. Each table is
+// committed atomically, in the order the tables were created.
+func (o *output) commitDelta() error {
+	var partitionColumns []string
+	if o.partitioner != nil {
+		partitionColumns = o.partitioner.columns
+	}
+
+	for _, t := range o.files.tables {
+		if len(t.files) == 0 {
+			continue
+		}
+
+		files := make([]delta.DataFile, 0, len(t.files))
+
+		for _, f := range t.files {
+			attrs, err := cloud.Attributes(o.ctx, f.uri)
+			if err != nil {
+				return err
+			}
+
+			path := f.uri[strings.LastIndex(f.uri, "/")+1:]
+			if f.partition != "" {
+				path = f.partition + "/" + path
+			}
+
+			var values map[string]string
+			if o.partitioner != nil {
+				values = o.partitioner.values[f.partition]
+			}
+
+			files = append(files, delta.DataFile{
+				Path:             path,
+				PartitionValues:  values,
+				Size:             attrs.Size,
+				ModificationTime: attrs.ModTime,
+				NumRecords:       int64(f.rows),
+			})
+		}
+
+		table := delta.Table{URI: t.uri, Schema: t.schema, PartitionColumns: partitionColumns}
+
+		_, err := delta.Commit(o.ctx, table, files)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
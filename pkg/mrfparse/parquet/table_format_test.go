@@ -0,0 +1,168 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parquet
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/delta"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/spf13/viper"
+)
+
+func setTableFormat(t *testing.T, format string) {
+	viper.Set("writer.filename_template", "_%04d.zstd.parquet")
+	viper.Set("writer.table_format", format)
+	t.Cleanup(func() { viper.Set("writer.table_format", "") })
+}
+
+// deltaAdd is an add action of a Delta commit
+type deltaAdd struct {
+	Path  string `json:"path"`
+	Stats string `json:"stats"`
+}
+
+// readCommit returns the add actions of version of the Delta table at dir
+func readCommit(t *testing.T, dir string, version int) []deltaAdd {
+	f, err := os.Open(filepath.Join(dir, delta.LogDir, fmt.Sprintf("%020d.json", version)))
+	assert.NoError(t, err)
+
+	defer f.Close()
+
+	var adds []deltaAdd
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var action struct {
+			Add *deltaAdd `json:"add"`
+		}
+
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &action))
+
+		if action.Add != nil {
+			adds = append(adds, *action.Add)
+		}
+	}
+
+	assert.NoError(t, scanner.Err())
+
+	return adds
+}
+
+func TestWriterDelta(t *testing.T) {
+	setTableFormat(t, DeltaTableFormat)
+	setPartitionBy(t, "record_type")
+
+	dir := t.TempDir()
+
+	err := runWriter(dir, []*models.Mrf{{UUID: "1", RecordType: "root"}, {UUID: "2", RecordType: "in_network"}})
+	assert.NoError(t, err)
+
+	commit, err := os.ReadFile(filepath.Join(dir, delta.LogDir, "00000000000000000000.json"))
+	assert.NoError(t, err)
+
+	assert.Contains(t, string(commit), `"partitionColumns":["record_type"]`)
+	assert.Contains(t, string(commit), `"partitionValues":{"record_type":"in_network"}`)
+
+	// a second run into the same table commits a new version, with files of its own
+	err = runWriter(dir, []*models.Mrf{{UUID: "3", RecordType: "root"}, {UUID: "4", RecordType: "in_network"},
+		{UUID: "5", RecordType: "in_network"}})
+	assert.NoError(t, err)
+
+	paths := make(map[string]bool)
+
+	for version, want := range []map[string]int64{
+		{"root": 1, "in_network": 1},
+		{"root": 1, "in_network": 2},
+	} {
+		adds := readCommit(t, dir, version)
+		assert.Equal(t, 2, len(adds))
+
+		// each version's files are as committed, and weren't overwritten by a later version
+		for _, a := range adds {
+			assert.False(t, paths[a.Path], a.Path)
+			paths[a.Path] = true
+
+			partition, name := filepath.Split(a.Path)
+			assert.True(t, strings.HasPrefix(name, "part-00000-") && strings.HasSuffix(name, "-c000.zstd.parquet"), name)
+
+			recordType := strings.TrimSuffix(strings.TrimPrefix(partition, "record_type="), "/")
+			assert.Equal(t, fmt.Sprintf(`{"numRecords":%d}`, want[recordType]), a.Stats)
+			assert.Equal(t, want[recordType], numRows(t, filepath.Join(dir, a.Path)))
+		}
+	}
+}
+
+// with the normalized layout, each record type's table has its own log
+func TestWriterDeltaNormalized(t *testing.T) {
+	setTableFormat(t, DeltaTableFormat)
+	viper.Set("writer.layout", NormalizedLayout)
+	t.Cleanup(func() { viper.Set("writer.layout", "") })
+
+	dir := t.TempDir()
+
+	err := runWriter(dir, []*models.Mrf{{UUID: "1", RecordType: "root"}, {UUID: "2", RecordType: "tin"}})
+	assert.NoError(t, err)
+
+	commit, err := os.ReadFile(filepath.Join(dir, "tin", delta.LogDir, "00000000000000000000.json"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(commit), `"path":"part-00000-`)
+	assert.Contains(t, string(commit), `provider_tin_value`)
+
+	_, err = os.Stat(filepath.Join(dir, "root", delta.LogDir, "00000000000000000000.json"))
+	assert.NoError(t, err)
+}
+
+// a writer that is told not to commit closes its files without committing them
+func TestWriterDeltaAbort(t *testing.T) {
+	setTableFormat(t, DeltaTableFormat)
+
+	dir := t.TempDir()
+
+	wc := make(chan []*models.Mrf, 1)
+	done := make(chan bool, 1)
+
+	wc <- []*models.Mrf{{UUID: "1"}}
+	done <- false
+
+	err := Writer(context.Background(), "mrf", dir, wc, done)
+	assert.NoError(t, err)
+
+	files, err := filepath.Glob(filepath.Join(dir, "part-00000-*-c000.zstd.parquet"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, int64(1), numRows(t, files[0]))
+
+	_, err = os.Stat(filepath.Join(dir, delta.LogDir))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWriterUnknownTableFormat(t *testing.T) {
+	setTableFormat(t, "iceberg")
+
+	err := Writer(context.Background(), "mrf", t.TempDir(), make(chan []*models.Mrf), make(chan bool))
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "iceberg"))
+}
@@ -0,0 +1,229 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parquet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
+	"github.com/segmentio/parquet-go"
+	"golang.org/x/exp/slices"
+)
+
+// tables maps each record type to its table in the normalized output
+var tables = map[string]table{
+	"root":              newTable((*models.Mrf).RootRow),
+	"in_network":        newTable((*models.Mrf).InNetworkRow),
+	"bundled_codes":     newTable((*models.Mrf).BundledCodesRow),
+	"covered_service":   newTable((*models.Mrf).CoveredServiceRow),
+	"negotiated_rate":   newTable((*models.Mrf).NegotiatedRateRow),
+	"negotiated_prices": newTable((*models.Mrf).NegotiatedPricesRow),
+	"drug_price":        newTable((*models.Mrf).DrugPriceRow),
+	"provider_group":    newTable((*models.Mrf).ProviderGroupRow),
+	"provider":          newTable((*models.Mrf).ProviderRow),
+	"tin":               newTable((*models.Mrf).TinRow),
+	"out_of_network":    newTable((*models.Mrf).OutOfNetworkRow),
+	"allowed_amount":    newTable((*models.Mrf).AllowedAmountRow),
+	"payment":           newTable((*models.Mrf).PaymentRow),
+	"payment_provider":  newTable((*models.Mrf).PaymentProviderRow),
+	"rate_fact":         newTable((*models.Mrf).RateFactRow),
+}
+
+// typedTables maps the record types with dates or amounts to their table with the typed schema. Other
+// record types' tables are the same with either schema.
+var typedTables = map[string]table{
+	"root":              newTable((*models.Mrf).TypedRootRow),
+	"negotiated_prices": newTable((*models.Mrf).TypedNegotiatedPricesRow),
+	"drug_price":        newTable((*models.Mrf).TypedDrugPriceRow),
+	"payment":           newTable((*models.Mrf).TypedPaymentRow),
+	"payment_provider":  newTable((*models.Mrf).TypedPaymentProviderRow),
+	"rate_fact":         newTable((*models.Mrf).TypedRateFactRow),
+}
+
+// typedWideTable is the wide layout's table with the typed schema
+var typedWideTable = newTable((*models.Mrf).TypedRow)
+
+// lookupTable returns the table of recordType with schema
+func lookupTable(recordType, schema string) (table, error) {
+	if schema == TypedSchema {
+		if t, ok := typedTables[recordType]; ok {
+			return t, nil
+		}
+	}
+
+	t, ok := tables[recordType]
+	if !ok {
+		return table{}, fmt.Errorf("no table for record type %q", recordType)
+	}
+
+	return t, nil
+}
+
+// table is the writer and schema of a record type's table
+type table struct {
+	newWriter newRowWriterFunc
+	schema    *parquet.Schema
+}
+
+// newTable returns a table whose rows, of type T, are converted from Mrf rows by toRow
+func newTable[T any](toRow func(*models.Mrf) T) table {
+	return table{newWriter: newTableWriter(toRow), schema: schemaOf[T]()}
+}
+
+// schemaOf returns the schema of rows of type T, with the DATE logical type on the INT32 leaves of the typed
+// schema's date columns
+func schemaOf[T any]() *parquet.Schema {
+	schema := parquet.SchemaOf(new(T))
+
+	fields := make([]parquet.Field, 0, len(schema.Fields()))
+	dates := false
+
+	for _, f := range schema.Fields() {
+		if f.Leaf() && f.Type().Kind() == parquet.Int32 && slices.Contains(models.DateColumns, f.Name()) {
+			f = &dateField{Field: f}
+			dates = true
+		}
+
+		fields = append(fields, f)
+	}
+
+	if !dates {
+		return schema
+	}
+
+	return parquet.NewSchema(schema.Name(), &encodedNode{Node: schema, fields: fields})
+}
+
+// dateField is an INT32 field with the DATE logical type
+type dateField struct {
+	parquet.Field
+}
+
+func (f *dateField) Type() parquet.Type {
+	return parquet.Date().Type()
+}
+
+// TableWriteCloser writes Mrf rows to a parquet file with the schema of a single record type's table.
+// Rows are converted to the table's row type, T, by toRow.
+type TableWriteCloser[T any] struct {
+	closer io.WriteCloser
+	writer *parquet.GenericWriter[T]
+	toRow  func(*models.Mrf) T
+	rows   []T
+	uri    string
+}
+
+// Close closes the underlying parquet.GenericWriter and the underlying io.WriteCloser. The io.WriteCloser is
+// closed even if closing the parquet.GenericWriter fails.
+func (twc *TableWriteCloser[T]) Close() error {
+	err := twc.writer.Close()
+
+	cerr := twc.closer.Close()
+	if err != nil {
+		return err
+	}
+
+	return cerr
+}
+
+// Write converts rows to the table's row type and writes them to the underlying parquet.GenericWriter.
+func (twc *TableWriteCloser[T]) Write(rows []*models.Mrf) (int, error) {
+	twc.rows = twc.rows[:0]
+
+	for _, row := range rows {
+		twc.rows = append(twc.rows, twc.toRow(row))
+	}
+
+	return twc.writer.Write(twc.rows)
+}
+
+// Flush flushes the underlying parquet.GenericWriter.
+func (twc *TableWriteCloser[T]) Flush() error {
+	return twc.writer.Flush()
+}
+
+// URI returns the composed URI of the underlying io.WriteCloser.
+func (twc *TableWriteCloser[T]) URI() string {
+	return twc.uri
+}
+
+// newTableWriter returns a newRowWriterFunc creating TableWriteClosers that convert rows using toRow, with the
+// encoding, compression, statistics and bloom filters set by the writer config
+func newTableWriter[T any](toRow func(*models.Mrf) T) newRowWriterFunc {
+	schema := schemaOf[T]()
+
+	return func(ctx context.Context, uri string, maxRowsPerGroup int64) (RowWriteCloser, error) {
+		config, err := loadFileConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		w, err := cloud.NewWriter(ctx, uri)
+		if err != nil {
+			return nil, err
+		}
+
+		writer := parquet.NewGenericWriter[T](w, config.writerOptions(schema, maxRowsPerGroup)...)
+
+		return &TableWriteCloser[T]{uri: uri, writer: writer, closer: w, toRow: toRow}, nil
+	}
+}
+
+// NewTableWriterFactory creates a new PqWriterFactory for the table of recordType in the normalized output, with
+// the string schema.
+// The table's files are written to outputURI/recordType/, which is created if it is on the local filesystem.
+func NewTableWriterFactory(recordType, filePrefix, outputURI string) (*PqWriterFactory, error) {
+	tableURI := cloud.JoinURI(outputURI, recordType)
+
+	pwf, err := newTableWriterFactory(recordType, StringSchema, filePrefix, tableURI)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mkdirLocal(tableURI)
+	if err != nil {
+		return nil, err
+	}
+
+	return pwf, nil
+}
+
+// newTableWriterFactory creates a new PqWriterFactory writing the table of recordType with schema to uri
+func newTableWriterFactory(recordType, schema, filePrefix, uri string) (*PqWriterFactory, error) {
+	t, err := lookupTable(recordType, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	pwf := NewPqWriterFactory(filePrefix, uri)
+	pwf.newWriter = t.newWriter
+
+	return pwf, nil
+}
+
+// mkdirLocal creates the directory at uri if it is on the local filesystem
+func mkdirLocal(uri string) error {
+	if cloud.IsCloudURI(uri) {
+		return nil
+	}
+
+	return os.MkdirAll(uri, os.ModePerm)
+}
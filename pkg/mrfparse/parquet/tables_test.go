@@ -0,0 +1,128 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parquet
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/segmentio/parquet-go"
+	"github.com/spf13/viper"
+)
+
+// a table's files contain only the columns of its record type
+func TestNewTableWriterFactory(t *testing.T) {
+	viper.Set("writer.filename_template", "_%04d.zstd.parquet")
+
+	dir := t.TempDir()
+
+	pwf, err := NewTableWriterFactory("tin", "mrf", dir)
+	assert.NoError(t, err)
+
+	w, err := pwf.CreateWriter(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "tin", "mrf_0000.zstd.parquet"), w.URI())
+
+	n, err := w.Write([]*models.Mrf{{UUID: "1", ParentUUID: "2", RecordType: "tin",
+		Tin: models.Tin{Value: "11-1111111", TinType: "ein"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	assert.NoError(t, w.Close())
+
+	f, err := os.Open(w.URI())
+	assert.NoError(t, err)
+
+	defer f.Close()
+
+	st, err := f.Stat()
+	assert.NoError(t, err)
+
+	pf, err := parquet.OpenFile(f, st.Size())
+	assert.NoError(t, err)
+
+	var columns []string
+	for _, field := range pf.Schema().Fields() {
+		columns = append(columns, field.Name())
+	}
+
+	assert.Equal(t, []string{"uuid", "parent_uuid", "provider_tin_value", "provider_tin_type"}, columns)
+}
+
+func TestNewTableWriterFactoryUnknown(t *testing.T) {
+	_, err := NewTableWriterFactory("unknown", "mrf", t.TempDir())
+	assert.Error(t, err)
+}
+
+// models.Mrf.TableRow, used by the CSV and NDJSON sinks, returns the row of the same table as the parquet output
+func TestTableRow(t *testing.T) {
+	for recordType, tbl := range tables {
+		m := &models.Mrf{RecordType: recordType}
+
+		row := m.TableRow()
+		assert.NotZero(t, row, recordType)
+		assert.Equal(t, tbl.schema.String(), parquet.SchemaOf(row).String(), recordType)
+	}
+
+	assert.Zero(t, (&models.Mrf{RecordType: "unknown"}).TableRow())
+
+	assert.Equal(t, len(tables), len(models.RecordTypes))
+
+	for _, recordType := range models.RecordTypes {
+		_, ok := tables[recordType]
+		assert.True(t, ok, recordType)
+	}
+}
+
+// The typed tables have the same columns as the string tables
+func TestTypedTables(t *testing.T) {
+	for recordType, tbl := range typedTables {
+		columns := func(s *parquet.Schema) (names []string) {
+			for _, path := range s.Columns() {
+				names = append(names, path[0])
+			}
+
+			return names
+		}
+
+		assert.Equal(t, columns(tables[recordType].schema), columns(tbl.schema), recordType)
+	}
+
+	assert.Equal(t, len(wideSchema.Columns()), len(typedWideTable.schema.Columns()))
+}
+
+func TestParseDate(t *testing.T) {
+	for _, s := range []string{"2022-12-05", "2022-12-5", "2022/12/05", "20221205", "12/05/2022", "12/5/2022",
+		"12-05-2022", "2022-12-05T10:00:00Z", "2022-12-05T10:00:00", "2022-12-05 10:00:00"} {
+		d, err := models.ParseDate(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, int32(19331), d, s)
+	}
+
+	d, err := models.ParseDate("")
+	assert.NoError(t, err)
+	assert.Zero(t, d)
+
+	_, err = models.ParseDate("2022-13-45")
+	assert.Error(t, err)
+
+	assert.Equal(t, int64(801235), models.Decimal(80.12345))
+}
@@ -17,61 +17,502 @@ package parquet
 
 import (
 	"context"
+	"fmt"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/sink"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
+
+	"github.com/spf13/viper"
 )
 
 var log = utils.GetLogger()
 
+// Output layouts, set by writer.layout
+const (
+	// WideLayout writes all record types to a single table with the Mrf schema
+	WideLayout = sink.WideLayout
+	// NormalizedLayout writes each record type to its own table, in a directory named for the record type
+	NormalizedLayout = sink.NormalizedLayout
+)
+
+// Column schemas, set by writer.schema
+const (
+	// StringSchema writes dates as strings and amounts as doubles, as they are found in the MRF
+	StringSchema = sink.StringSchema
+	// TypedSchema writes dates with the DATE logical type and amounts as DECIMAL(18,4). Records with dates that
+	// can't be parsed are written to the rejects table with the string schema.
+	TypedSchema = sink.TypedSchema
+)
+
+// RejectsDir is the directory, beneath the output, of the rejects table. Being prefixed with an underscore, it is
+// ignored by query engines reading the output.
+const RejectsDir = "_rejects"
+
 // Writer is intended to run as a goroutine, writing data to parquet files. The wc channel
 // receives slices of Mrf structs. Send true to the done channel to signal that no more
-// data will be sent to wc and that the writer should close the current file and exit.
+// data will be sent to wc and that the writer should write any data remaining in wc, close the
+// current file, commit the files written to the table format set by writer.table_format, if any,
+// and exit. The rejects table is never committed. Send false to close the current file without committing, e.g. if the parse failed.
 //
 // Writer will create a new file when the number of rows written to the current file
-// exceeds the WriterFactory's MaxRowsPerFile.
-func Writer(filePrefix, outputURI string, wc <-chan []*models.Mrf, done <-chan bool) {
+// exceeds the WriterFactory's MaxRowsPerFile. With the normalized layout, each record type's
+// table has its own current file. If writer.partition_by lists any columns, rows are written to a
+// key=value directory per partition, each with its own current file.
+//
+// If a write fails or ctx is cancelled, Writer closes the current file, so that the data already
+// written remains readable, and returns the error without waiting on done. Callers should stop
+// sending to wc once Writer has returned.
+//
+// Writer runs a Sink with sink.Run.
+func Writer(ctx context.Context, filePrefix, outputURI string, wc <-chan []*models.Mrf, done <-chan bool) error {
+	return sink.Run(ctx, NewSink(filePrefix), outputURI, wc, done)
+}
+
+// Sink is the sink.RecordSink writing parquet files, with the layout, partitioning and table format
+// set by the writer config
+type Sink struct {
+	filePrefix string
+	out        *output
+}
+
+// NewSink returns a Sink writing files named with filePrefix (e.g. "mrf")
+func NewSink(filePrefix string) *Sink {
+	return &Sink{filePrefix: filePrefix}
+}
+
+// Open reads the writer config. Files are only created as rows are written.
+func (s *Sink) Open(_ context.Context, outputURI string) error {
+	out, err := newOutput(s.filePrefix, outputURI)
+	if err != nil {
+		return err
+	}
+
+	s.out = out
+
+	return nil
+}
+
+// WriteBatch writes records to the current files of their tables and partitions
+func (s *Sink) WriteBatch(records []*models.Mrf) error {
+	return s.out.write(records)
+}
+
+// Close closes any open files and, if commit is true, commits the files written to the table format
+func (s *Sink) Close(commit bool) error {
+	return s.out.close(commit)
+}
+
+// Files lists the files written to each table, followed by those of the rejects table
+func (s *Sink) Files() []sink.File {
+	var files []sink.File
+
+	tables := s.out.files.tables
+	if s.out.rejects != nil {
+		tables = append(tables[:len(tables):len(tables)], s.out.rejects.rows.files)
+	}
+
+	for _, t := range tables {
+		for _, f := range t.files {
+			files = append(files, sink.File{URI: f.uri, Rows: int64(f.rows)})
+		}
+	}
+
+	return files
+}
+
+// output writes rows to the partitions of the tables of an output layout, and commits the files
+// written to the output's table format once closed
+type output struct {
+	// ctx is used for committing, and is never cancelled, as is the case for the files written
+	ctx context.Context
+	uri string
+	// partitioner is nil if the output is not partitioned
+	partitioner *partitioner
+	layout      layoutWriter
+	files       *fileSet
+	tableFormat string
+	// rejects is nil unless the output has the typed schema
+	rejects *rejectWriter
+}
+
+// newOutput returns the output for the writer config
+func newOutput(filePrefix, outputURI string) (*output, error) {
 	var (
-		data   []*models.Mrf
-		i      int
-		rowCnt int
-		err    error
-		wf     = NewPqWriterFactory(filePrefix, outputURI)
-		writer *PqWriteCloser
-		ctx    = context.Background()
+		p   *partitioner
+		err error
+		// Files are written with a context that is never cancelled, as cancelling a cloud writer's
+		// context discards the file rather than closing it.
+		ctx = context.Background()
 	)
 
-W:
-	for {
-		select {
-		case data = <-wc:
-			if i%wf.MaxRowsPerFile == 0 {
-				if writer != nil {
-					err = writer.Close()
-					utils.ExitOnError(err)
+	partitionBy := viper.GetStringSlice("writer.partition_by")
+	if len(partitionBy) > 0 {
+		p, err = newPartitioner(partitionBy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tableFormat := viper.GetString("writer.table_format")
+	if tableFormat != "" && tableFormat != DeltaTableFormat {
+		return nil, fmt.Errorf("unknown table format %q", tableFormat)
+	}
+
+	// The file config is read as each file is created, so check that it's valid before any rows are written
+	if _, err = loadFileConfig(); err != nil {
+		return nil, err
+	}
+
+	schema := viper.GetString("writer.schema")
+	if schema == "" {
+		schema = StringSchema
+	}
+
+	if schema != StringSchema && schema != TypedSchema {
+		return nil, fmt.Errorf("unknown writer schema %q", schema)
+	}
+
+	files := &fileSet{}
+	maxOpenPartitions := viper.GetInt("writer.max_open_partitions")
+
+	layout, err := newLayoutWriter(ctx, viper.GetString("writer.layout"), schema, filePrefix, outputURI,
+		maxOpenPartitions, files)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &output{
+		ctx:         ctx,
+		uri:         outputURI,
+		partitioner: p,
+		layout:      layout,
+		files:       files,
+		tableFormat: tableFormat,
+	}
+
+	if schema == TypedSchema {
+		o.rejects = newRejectWriter(ctx, filePrefix, outputURI)
+	}
+
+	return o, nil
+}
+
+func (o *output) write(data []*models.Mrf) error {
+	if o.rejects != nil {
+		var err error
+
+		data, err = o.rejects.filter(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.partitioner == nil {
+		return o.layout.write("", data)
+	}
+
+	paths, byPath := o.partitioner.group(data)
+
+	for _, path := range paths {
+		err := o.layout.write(path, byPath[path])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// close closes any open files and, if commit is true, commits the files written to the table format
+func (o *output) close(commit bool) error {
+	err := o.layout.close()
+
+	if o.rejects != nil {
+		if rerr := o.rejects.close(); err == nil {
+			err = rerr
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !commit || o.tableFormat == "" {
+		return nil
+	}
+
+	return o.commitDelta()
+}
+
+// layoutWriter writes rows to the files of an output layout
+type layoutWriter interface {
+	// write writes data to the partition at path, which is empty if the output is not partitioned
+	write(path string, data []*models.Mrf) error
+	// close closes any open files
+	close() error
+	// checkpoint closes any open files, returning the state of each table
+	checkpoint() ([]tableState, error)
+	// resume restores the state of each table returned by checkpoint
+	resume(tables []tableState) error
+	// removeUncheckpointed removes the files created after the checkpoint resumed from
+	removeUncheckpointed() error
+}
+
+// newLayoutWriter returns the layoutWriter for layout and schema, recording the files written in files. An empty
+// layout is the wide layout.
+func newLayoutWriter(ctx context.Context, layout, schema, filePrefix, outputURI string, maxOpenPartitions int,
+	files *fileSet) (layoutWriter, error) {
+	switch layout {
+	case "", WideLayout:
+		wide := table{newWriter: newPqRowWriter, schema: wideSchema}
+		if schema == TypedSchema {
+			wide = typedWideTable
+		}
 
-					log.Debugf("Closed writer for %s", writer.URI())
-				}
+		return newPartitionSet(ctx, outputURI, maxOpenPartitions, files.table(outputURI, wide.schema),
+			func(uri string) (*PqWriterFactory, error) {
+				pwf := NewPqWriterFactory(filePrefix, uri)
+				pwf.newWriter = wide.newWriter
 
-				writer, err = wf.CreateWriter(ctx)
-				utils.ExitOnError(err)
+				return pwf, nil
+			}), nil
+	case NormalizedLayout:
+		return &tableRouter{
+			ctx:               ctx,
+			schema:            schema,
+			filePrefix:        filePrefix,
+			outputURI:         outputURI,
+			maxOpenPartitions: maxOpenPartitions,
+			files:             files,
+			tables:            make(map[string]*partitionSet),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown writer layout %q", layout)
+	}
+}
+
+// rowWriter writes rows to the current RowWriteCloser, creating a new one once MaxRowsPerFile rows have been
+// written to it, or if it has been closed
+type rowWriter struct {
+	ctx    context.Context
+	wf     *PqWriterFactory
+	writer RowWriteCloser
+	i      int
+	// fileRows is the number of rows written to the current file
+	fileRows int
+	// onClose, if set, is called with the URI and number of rows of each file closed without error
+	onClose func(uri string, rows int)
+}
+
+func (w *rowWriter) write(data []*models.Mrf) error {
+	if w.writer == nil || w.fileRows >= w.wf.MaxRowsPerFile {
+		err := w.close()
+		if err != nil {
+			return err
+		}
+
+		writer, err := w.wf.CreateWriter(w.ctx)
+		if err != nil {
+			return err
+		}
+
+		w.writer = writer
+		w.fileRows = 0
+	}
+
+	rowCnt, err := w.writer.Write(data)
+	if err != nil {
+		return err
+	}
+
+	if w.i%50_000 == 0 {
+		log.Debug("Wrote ", w.i, " rows.")
+		// We see slightly less memory usage and faster run times when periodically
+		// flushing the writer.
+		err = w.writer.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	w.i += rowCnt
+	w.fileRows += rowCnt
+
+	return nil
+}
+
+// close closes the current file, if any
+func (w *rowWriter) close() error {
+	if w.writer == nil {
+		return nil
+	}
+
+	err := w.writer.Close()
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Closed writer for %s", w.writer.URI())
+
+	if w.onClose != nil {
+		w.onClose(w.writer.URI(), w.fileRows)
+	}
+
+	w.writer = nil
+
+	return nil
+}
+
+// tableRouter writes each record type's rows to its own table using a partitionSet per record type. Tables
+// are created as the first row of each record type is written.
+type tableRouter struct {
+	ctx               context.Context
+	schema            string
+	filePrefix        string
+	outputURI         string
+	maxOpenPartitions int
+	files             *fileSet
+	tables            map[string]*partitionSet
+	// order is the order in which tables were created, so that they are closed deterministically
+	order []string
+}
+
+func (r *tableRouter) write(path string, data []*models.Mrf) error {
+	var (
+		byType = make(map[string][]*models.Mrf)
+		types  []string
+	)
+
+	for _, row := range data {
+		if _, ok := byType[row.RecordType]; !ok {
+			types = append(types, row.RecordType)
+		}
+
+		byType[row.RecordType] = append(byType[row.RecordType], row)
+	}
+
+	for _, recordType := range types {
+		t, err := r.table(recordType)
+		if err != nil {
+			return err
+		}
+
+		err = t.write(path, byType[recordType])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// table returns the partitionSet of recordType's table, creating it if need be
+func (r *tableRouter) table(recordType string) (*partitionSet, error) {
+	if t, ok := r.tables[recordType]; ok {
+		return t, nil
+	}
+
+	tbl, err := lookupTable(recordType, r.schema)
+	if err != nil {
+		return nil, err
+	}
+
+	tableURI := cloud.JoinURI(r.outputURI, recordType)
+
+	t := newPartitionSet(r.ctx, tableURI, r.maxOpenPartitions, r.files.table(tableURI, tbl.schema),
+		func(uri string) (*PqWriterFactory, error) {
+			return newTableWriterFactory(recordType, r.schema, r.filePrefix, uri)
+		})
+	r.tables[recordType] = t
+	r.order = append(r.order, recordType)
+
+	return t, nil
+}
+
+// close closes the current files of every table, returning the first error
+func (r *tableRouter) close() error {
+	var err error
+
+	for _, recordType := range r.order {
+		if cerr := r.tables[recordType].close(); cerr != nil {
+			if err != nil {
+				log.Errorf("Unable to close %s table: %s", recordType, cerr.Error())
+				continue
 			}
 
-			rowCnt, err = writer.Write(data)
-			utils.ExitOnError(err)
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// rejectWriter writes the records that can't be written with the typed schema, as their dates can't be parsed,
+// to the rejects table with the string schema, in place of failing the parse
+type rejectWriter struct {
+	rows *partitionSet
+	uri  string
+	n    int
+}
 
-			if i%50_000 == 0 {
-				log.Debug("Wrote ", i, " rows.")
-				// We see slightly less memory usage and faster run times when periodically
-				// flushing the writer.
-				err = writer.Flush()
-				utils.ExitOnError(err)
+// newRejectWriter returns a rejectWriter writing to the rejects table of the output at outputURI. Its files
+// are only created once a record is rejected.
+func newRejectWriter(ctx context.Context, filePrefix, outputURI string) *rejectWriter {
+	uri := cloud.JoinURI(outputURI, RejectsDir)
+
+	return &rejectWriter{
+		uri: uri,
+		// The rejects table isn't committed, so its files are recorded apart from the output's fileSet
+		rows: newPartitionSet(ctx, uri, 1, &tableFiles{uri: uri, schema: wideSchema},
+			func(uri string) (*PqWriterFactory, error) {
+				return NewPqWriterFactory(filePrefix, uri), nil
+			}),
+	}
+}
+
+// filter writes the records of data with dates that can't be parsed to the rejects table, returning the
+// remaining records
+func (r *rejectWriter) filter(data []*models.Mrf) ([]*models.Mrf, error) {
+	var (
+		rejected []*models.Mrf
+		valid    []*models.Mrf
+	)
+
+	for i, row := range data {
+		err := row.ValidateDates()
+		if err == nil {
+			if rejected != nil {
+				valid = append(valid, row)
 			}
-			i += rowCnt
 
-		case <-done:
-			err = writer.Close()
-			utils.ExitOnError(err)
-			break W
+			continue
+		}
+
+		log.Debugf("Rejected %s record %s: %s", row.RecordType, row.UUID, err.Error())
+
+		if rejected == nil {
+			// data is owned by the caller, so the valid records are copied rather than filtered in place
+			valid = append(make([]*models.Mrf, 0, len(data)), data[:i]...)
 		}
+
+		rejected = append(rejected, row)
+	}
+
+	if rejected == nil {
+		return data, nil
 	}
+
+	r.n += len(rejected)
+
+	return valid, r.rows.write("", rejected)
+}
+
+// close closes the rejects table's file, if any
+func (r *rejectWriter) close() error {
+	if r.n > 0 {
+		log.Warnf("Rejected %d records with dates that couldn't be parsed. Wrote them to %s", r.n, r.uri)
+	}
+
+	return r.rows.close()
 }
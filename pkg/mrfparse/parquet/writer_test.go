@@ -0,0 +1,265 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parquet
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/segmentio/parquet-go"
+	"github.com/spf13/viper"
+)
+
+func runWriter(outputURI string, batches ...[]*models.Mrf) error {
+	wc := make(chan []*models.Mrf)
+	done := make(chan bool)
+	errc := make(chan error)
+
+	go func() { errc <- Writer(context.Background(), "mrf", outputURI, wc, done) }()
+
+	for _, batch := range batches {
+		wc <- batch
+	}
+
+	done <- true
+
+	return <-errc
+}
+
+func TestWriter(t *testing.T) {
+	viper.Set("writer.filename_template", "_%04d.zstd.parquet")
+
+	dir := t.TempDir()
+
+	err := runWriter(dir, []*models.Mrf{{UUID: "1"}, {UUID: "2"}}, []*models.Mrf{{UUID: "3"}})
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(3), numRows(t, filepath.Join(dir, "mrf_0000.zstd.parquet")))
+}
+
+// numRows returns the number of rows in the parquet file at path
+func numRows(t *testing.T, path string) int64 {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+
+	defer f.Close()
+
+	st, err := f.Stat()
+	assert.NoError(t, err)
+
+	pf, err := parquet.OpenFile(f, st.Size())
+	assert.NoError(t, err)
+
+	return pf.NumRows()
+}
+
+// a cancelled writer closes the current file, leaving the rows already written readable
+func TestWriterCancel(t *testing.T) {
+	viper.Set("writer.filename_template", "_%04d.zstd.parquet")
+
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	wc := make(chan []*models.Mrf)
+	errc := make(chan error)
+
+	go func() { errc <- Writer(ctx, "mrf", dir, wc, make(chan bool)) }()
+
+	wc <- []*models.Mrf{{UUID: "1"}, {UUID: "2"}}
+
+	cancel()
+
+	err := <-errc
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	assert.Equal(t, int64(2), numRows(t, filepath.Join(dir, "mrf_0000.zstd.parquet")))
+}
+
+// a writer that receives no data has no file to close
+func TestWriterNoData(t *testing.T) {
+	err := runWriter(t.TempDir())
+	assert.NoError(t, err)
+}
+
+func TestWriterCreateError(t *testing.T) {
+	// the output path is beneath a regular file, so the parquet file cannot be created
+	parent := filepath.Join(t.TempDir(), "file")
+	err := os.WriteFile(parent, []byte{}, 0o600)
+	assert.NoError(t, err)
+
+	wc := make(chan []*models.Mrf, 1)
+	done := make(chan bool)
+
+	wc <- []*models.Mrf{{UUID: "1"}}
+
+	// Writer returns without waiting on done
+	err = Writer(context.Background(), "mrf", filepath.Join(parent, "output"), wc, done)
+	assert.Error(t, err)
+}
+
+// with the normalized layout, each record type is written to its own table
+func TestWriterNormalized(t *testing.T) {
+	viper.Set("writer.filename_template", "_%04d.zstd.parquet")
+	viper.Set("writer.layout", NormalizedLayout)
+	t.Cleanup(func() { viper.Set("writer.layout", "") })
+
+	dir := t.TempDir()
+
+	err := runWriter(dir,
+		[]*models.Mrf{
+			{UUID: "1", RecordType: "root"},
+			{UUID: "2", ParentUUID: "1", RecordType: "in_network"},
+			{UUID: "3", ParentUUID: "2", RecordType: "negotiated_rate"},
+		},
+		[]*models.Mrf{{UUID: "4", ParentUUID: "2", RecordType: "negotiated_rate"}},
+	)
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(1), numRows(t, filepath.Join(dir, "root", "mrf_0000.zstd.parquet")))
+	assert.Equal(t, int64(1), numRows(t, filepath.Join(dir, "in_network", "mrf_0000.zstd.parquet")))
+	assert.Equal(t, int64(2), numRows(t, filepath.Join(dir, "negotiated_rate", "mrf_0000.zstd.parquet")))
+
+	rows, err := parquet.ReadFile[models.NegotiatedRateRow](filepath.Join(dir, "negotiated_rate", "mrf_0000.zstd.parquet"))
+	assert.NoError(t, err)
+	assert.Equal(t, "2", rows[0].ParentUUID)
+
+	// tables are only created for record types that are written
+	_, err = os.Stat(filepath.Join(dir, "provider"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWriterNormalizedUnknownRecordType(t *testing.T) {
+	viper.Set("writer.layout", NormalizedLayout)
+	t.Cleanup(func() { viper.Set("writer.layout", "") })
+
+	wc := make(chan []*models.Mrf, 1)
+	wc <- []*models.Mrf{{UUID: "1", RecordType: "unknown"}}
+
+	// Writer returns without waiting on done
+	err := Writer(context.Background(), "mrf", t.TempDir(), wc, make(chan bool))
+	assert.Error(t, err)
+}
+
+func TestWriterUnknownLayout(t *testing.T) {
+	viper.Set("writer.layout", "sparse")
+	t.Cleanup(func() { viper.Set("writer.layout", "") })
+
+	err := Writer(context.Background(), "mrf", t.TempDir(), make(chan []*models.Mrf), make(chan bool))
+	assert.Error(t, err)
+}
+
+// typedDates reads the dates and a rate of the typed schema. parquet-go can't read the optional dates of
+// the typed rows' embedded structs.
+type typedDates struct {
+	LastUpdatedOn       *int32 `parquet:"last_updated_on"`
+	ExpirationDate      *int32 `parquet:"in_np_expiration_date"`
+	NegotiatedRateValue int64  `parquet:"in_np_negotiated_rate"`
+}
+
+// with the typed schema, dates are written as DATE and rates as DECIMAL(18,4), and records with dates
+// that can't be parsed are written to the rejects table. Empty dates are null, and 1970-01-01 is day 0.
+func TestWriterTyped(t *testing.T) {
+	viper.Set("writer.filename_template", "_%04d.zstd.parquet")
+	viper.Set("writer.schema", TypedSchema)
+	t.Cleanup(func() { viper.Set("writer.schema", "") })
+
+	dir := t.TempDir()
+
+	err := runWriter(dir, []*models.Mrf{
+		{UUID: "1", RecordType: "root", MrfRoot: models.MrfRoot{LastUpdatedOn: "12/05/2022"}},
+		{UUID: "2", RecordType: "negotiated_prices", NegotiatedPrices: models.NegotiatedPrices{
+			ExpirationDate: "9999-12-31", NegotiatedRateValue: 80.125}},
+		{UUID: "3", RecordType: "negotiated_prices", NegotiatedPrices: models.NegotiatedPrices{
+			ExpirationDate: "sometime", NegotiatedRateValue: 10}},
+		{UUID: "4", RecordType: "negotiated_prices", NegotiatedPrices: models.NegotiatedPrices{
+			ExpirationDate: "1970-01-01"}},
+	})
+	assert.NoError(t, err)
+
+	file := filepath.Join(dir, "mrf_0000.zstd.parquet")
+	rows, err := parquet.ReadFile[typedDates](file)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(rows))
+	assert.Equal(t, int32(19331), *rows[0].LastUpdatedOn)
+	assert.Zero(t, rows[0].ExpirationDate)
+	assert.Equal(t, int32(2932896), *rows[1].ExpirationDate)
+	assert.Equal(t, int64(801250), rows[1].NegotiatedRateValue)
+	assert.Zero(t, rows[2].LastUpdatedOn)
+	assert.Equal(t, int32(0), *rows[2].ExpirationDate)
+
+	f, err := os.Open(file)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	stat, err := f.Stat()
+	assert.NoError(t, err)
+
+	pf, err := parquet.OpenFile(f, stat.Size())
+	assert.NoError(t, err)
+
+	date, _ := pf.Schema().Lookup("last_updated_on")
+	assert.True(t, date.Node.Type().LogicalType().Date != nil)
+	assert.True(t, date.Node.Optional())
+	rate, _ := pf.Schema().Lookup("in_np_negotiated_rate")
+	assert.True(t, rate.Node.Type().LogicalType().Decimal != nil)
+
+	rejects, err := parquet.ReadFile[models.Mrf](filepath.Join(dir, RejectsDir, "mrf_0000.zstd.parquet"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(rejects))
+	assert.Equal(t, "sometime", rejects[0].ExpirationDate)
+}
+
+// with the typed schema and normalized layout, the tables with dates or amounts are typed, and no rejects
+// table is written if no records are rejected
+func TestWriterTypedNormalized(t *testing.T) {
+	viper.Set("writer.filename_template", "_%04d.zstd.parquet")
+	viper.Set("writer.schema", TypedSchema)
+	viper.Set("writer.layout", NormalizedLayout)
+	t.Cleanup(func() {
+		viper.Set("writer.schema", "")
+		viper.Set("writer.layout", "")
+	})
+
+	dir := t.TempDir()
+
+	err := runWriter(dir, []*models.Mrf{
+		{UUID: "1", RecordType: "root", MrfRoot: models.MrfRoot{LastUpdatedOn: "2022-12-05"}},
+		{UUID: "2", ParentUUID: "1", RecordType: "in_network"},
+	})
+	assert.NoError(t, err)
+
+	roots, err := parquet.ReadFile[typedDates](filepath.Join(dir, "root", "mrf_0000.zstd.parquet"))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(19331), *roots[0].LastUpdatedOn)
+
+	assert.Equal(t, int64(1), numRows(t, filepath.Join(dir, "in_network", "mrf_0000.zstd.parquet")))
+
+	_, err = os.Stat(filepath.Join(dir, RejectsDir))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWriterUnknownSchema(t *testing.T) {
+	viper.Set("writer.schema", "binary")
+	t.Cleanup(func() { viper.Set("writer.schema", "") })
+
+	err := Writer(context.Background(), "mrf", t.TempDir(), make(chan []*models.Mrf), make(chan bool))
+	assert.Error(t, err)
+}
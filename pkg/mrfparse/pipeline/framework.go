@@ -16,6 +16,9 @@ limitations under the License.
 package pipeline
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
 )
 
@@ -24,14 +27,18 @@ import (
 
 var log = utils.GetLogger()
 
-// Step is an interface that defines a pipeline step. Name() returns the step name.
+// Step is an interface that defines a pipeline step. Name() returns the step name. Run should
+// stop and return ctx's error when ctx is cancelled.
 type Step interface {
 	Name() string
-	Run()
+	Run(ctx context.Context) error
 }
 
 type Pipeline struct {
 	Steps []Step
+	// OnFailure steps are run, in order, when a step fails or the pipeline is cancelled, e.g. to remove
+	// intermediate files that a later run can't reuse
+	OnFailure []Step
 }
 
 func (p *Pipeline) AddStep(step Step) {
@@ -39,17 +46,57 @@ func (p *Pipeline) AddStep(step Step) {
 }
 
 // Run executes each step in the pipeline in the order of the Steps slice. Each step is timed and logged.
-// No effort is made to manage errors or recover from them. Each step is responsible for handling errors.
-func (p *Pipeline) Run() {
-	var fn func()
+// Run stops at the first step that returns an error, returning the error annotated with the step name.
+// No effort is made to recover from errors, and remaining steps, including any clean up, are not run.
+// Cancelling ctx stops the running step, and no further steps are run. In either case the OnFailure
+// steps are then run.
+func (p *Pipeline) Run(ctx context.Context) error {
+	err := p.run(ctx)
+	if err != nil {
+		p.fail()
+	}
+
+	return err
+}
+
+// run executes each step in the pipeline, stopping at the first that fails
+func (p *Pipeline) run(ctx context.Context) error {
+	var (
+		fn  func()
+		err error
+	)
 
 	for _, step := range p.Steps {
+		if ctx.Err() != nil {
+			return fmt.Errorf("pipeline cancelled before step %s: %w", step.Name(), ctx.Err())
+		}
+
 		log.Infof("Running step: %s", step.Name())
 
-		fn = func() { step.Run() }
+		fn = func() { err = step.Run(ctx) }
 		elapsed := utils.Timed(fn)
+
+		if err != nil {
+			return fmt.Errorf("step %s failed: %w", step.Name(), err)
+		}
+
 		log.Infof("Step %s completed in %d seconds", step.Name(), elapsed)
 	}
+
+	return nil
+}
+
+// fail runs the OnFailure steps. They're run even if the pipeline was cancelled, and their errors are
+// logged rather than returned so that the error that failed the pipeline is reported.
+func (p *Pipeline) fail() {
+	for _, step := range p.OnFailure {
+		log.Infof("Running failure step: %s", step.Name())
+
+		err := step.Run(context.Background())
+		if err != nil {
+			log.Errorf("Failure step %s failed: %s", step.Name(), err.Error())
+		}
+	}
 }
 
 // New creates a new pipeline with the provided steps.
@@ -0,0 +1,140 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+type testStep struct {
+	name string
+	err  error
+	ran  bool
+	// cancel, if set, is called when the step runs
+	cancel context.CancelFunc
+}
+
+func (s *testStep) Run(_ context.Context) error {
+	s.ran = true
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	return s.err
+}
+
+func (s *testStep) Name() string {
+	return s.name
+}
+
+func TestPipelineRun(t *testing.T) {
+	first := &testStep{name: "First"}
+	second := &testStep{name: "Second"}
+
+	err := New(first, second).Run(context.Background())
+	assert.NoError(t, err)
+
+	assert.True(t, first.ran)
+	assert.True(t, second.ran)
+}
+
+// a failing step stops the pipeline, and its error is returned
+func TestPipelineRunError(t *testing.T) {
+	stepErr := fmt.Errorf("download failed")
+
+	first := &testStep{name: "First", err: stepErr}
+	second := &testStep{name: "Second"}
+
+	err := New(first, second).Run(context.Background())
+	assert.True(t, errors.Is(err, stepErr))
+	assert.Contains(t, err.Error(), "First")
+
+	assert.False(t, second.ran)
+}
+
+// a cancelled pipeline runs no further steps
+func TestPipelineRunCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := &testStep{name: "First", cancel: cancel}
+	second := &testStep{name: "Second"}
+
+	err := New(first, second).Run(ctx)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Contains(t, err.Error(), "Second")
+
+	assert.True(t, first.ran)
+	assert.False(t, second.ran)
+}
+
+// the OnFailure steps run when a step fails, or the pipeline is cancelled, and not otherwise
+func TestPipelineRunOnFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		err    error
+		cancel bool
+	}{
+		{name: "success"},
+		{name: "error", err: fmt.Errorf("parse failed")},
+		{name: "cancel", cancel: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			tmpPath := t.TempDir()
+			src := filepath.Join(tmpPath, "src", "in-network.json")
+			split := filepath.Join(tmpPath, "split")
+
+			for _, path := range []string{src, src + ".download", filepath.Join(split, "in_network_0.json")} {
+				assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+				assert.NoError(t, os.WriteFile(path, []byte("{}"), 0o644))
+			}
+
+			first := &testStep{name: "First", err: tc.err}
+			if tc.cancel {
+				first.cancel = cancel
+			}
+
+			p := New(first, &testStep{name: "Second"})
+			p.OnFailure = []Step{&CleanStep{TmpPath: split}}
+
+			err := p.Run(ctx)
+
+			failed := tc.err != nil || tc.cancel
+			assert.Equal(t, failed, err != nil)
+
+			// the split files are removed on failure, and the download and its state are kept
+			assert.Equal(t, !failed, fileExists(split))
+			assert.True(t, fileExists(src))
+			assert.True(t, fileExists(src+".download"))
+		})
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -16,15 +16,17 @@ limitations under the License.
 package pipeline
 
 import (
-	"io"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/http"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/mrf"
 	"github.com/danielchalef/mrfparse/pkg/mrfparse/split"
-	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
 
 	"github.com/spf13/viper"
 )
@@ -35,12 +37,56 @@ import (
 // InputPath is the path to the input JSON object file.
 // OutputPath is the path to the output parquet fileset.
 // ServiceFile is the path to the HCPCS/CPT service file in CSV format.
-// PlanID is the plan ID to use for the parquet fileset.
+// Plan, if not nil, overrides the plan fields of the parquet fileset's root record.
+// Opts are passed to the parser, e.g. mrf.WithRateFacts().
 //
 // The pipeline uses a tmp path to store the intermediate split files. The tmp
 // path ican be configured in the config file, an enrivonment variable, or a
-// default system tmp path will be used.
-func NewParsePipeline(inputPath, outputPath, serviceFile string, planID int64) *Pipeline {
+// default system tmp path will be used. It's named for the input path, and if
+// the pipeline fails only the split files are removed, so that a partial download is resumed.
+func NewParsePipeline(inputPath, outputPath, serviceFile string, plan *models.Plan, opts ...mrf.ParserOption) (*Pipeline, error) {
+	return newSplitParsePipeline(inputPath, &ParseStep{
+		OutputPath:  outputPath,
+		ServiceFile: serviceFile,
+		Plan:        plan,
+		Options:     opts,
+	})
+}
+
+// NewParseAllowedPipeline returns a pipeline that splits an allowed-amounts input file, parses the
+// split files, and then cleans up afterwards. Arguments are as for NewParsePipeline.
+func NewParseAllowedPipeline(inputPath, outputPath, serviceFile string, plan *models.Plan) (*Pipeline, error) {
+	return newSplitParsePipeline(inputPath, &ParseAllowedStep{
+		OutputPath:  outputPath,
+		ServiceFile: serviceFile,
+		Plan:        plan,
+	})
+}
+
+// NewStreamParsePipeline returns a pipeline that parses the input file in a single pass, without
+// downloading or splitting it first. Only provider_references that precede the in_network array are
+// written to the tmp path. Arguments are as for NewParsePipeline.
+func NewStreamParsePipeline(inputPath, outputPath, serviceFile string, plan *models.Plan, opts ...mrf.ParserOption) *Pipeline {
+	return New(&StreamParseStep{
+		InputPath:   inputPath,
+		OutputPath:  outputPath,
+		ServiceFile: serviceFile,
+		Plan:        plan,
+		Options:     opts,
+	})
+}
+
+// splitParseStep is a Step that parses the split files found at its input path. The MRF they were split
+// from is that downloaded by the source DownloadStep.
+type splitParseStep interface {
+	Step
+	SetInputPath(inputPath string)
+	SetSource(source *DownloadStep)
+}
+
+// newSplitParsePipeline returns a download, split, parse, and clean pipeline. The parseStep's input
+// path is set to the tmp path of the split files.
+func newSplitParsePipeline(inputPath string, parseStep splitParseStep) (*Pipeline, error) {
 	var (
 		err          error
 		tmpPath      string
@@ -51,13 +97,18 @@ func NewParsePipeline(inputPath, outputPath, serviceFile string, planID int64) *
 		cfgTmpPath   = viper.GetString("tmp.path")
 	)
 
-	if cfgTmpPath != "" {
-		tmpPath, err = os.MkdirTemp(cfgTmpPath, "mrfparse")
-	} else {
-		tmpPath, err = os.MkdirTemp("", "mrfparse")
+	if cfgTmpPath == "" {
+		cfgTmpPath = os.TempDir()
 	}
 
-	utils.ExitOnError(err)
+	// The tmp path is named for the input, so that a run that fails leaves a partial download that the
+	// next run of the input resumes
+	tmpPath = filepath.Join(cfgTmpPath, "mrfparse-"+inputID(inputPath))
+
+	err = os.MkdirAll(tmpPath, 0o755)
+	if err != nil {
+		return nil, err
+	}
 
 	tmpPathSrc = filepath.Join(tmpPath, "src")
 	tmpPathSplit = filepath.Join(tmpPath, "split")
@@ -65,64 +116,67 @@ func NewParsePipeline(inputPath, outputPath, serviceFile string, planID int64) *
 	srcFilePath = filepath.Join(tmpPathSrc, filepath.Base(inputPath))
 	srcFilePath = strings.Split(srcFilePath, "?")[0]
 
+	download := &DownloadStep{
+		URL:        inputPath,
+		OutputPath: srcFilePath,
+	}
+
+	parseStep.SetInputPath(tmpPathSplit)
+	parseStep.SetSource(download)
+
 	steps = []Step{
-		&DownloadStep{
-			URL:        inputPath,
-			OutputPath: srcFilePath,
-		},
+		download,
 		&SplitStep{
 			InputPath:  srcFilePath,
 			OutputPath: tmpPathSplit,
 			Overwrite:  true,
 		},
-		&ParseStep{
-			InputPath:   tmpPathSplit,
-			OutputPath:  outputPath,
-			ServiceFile: serviceFile,
-			PlanID:      planID,
-		},
+		parseStep,
 		&CleanStep{
 			TmpPath: tmpPath,
 		},
 	}
 
-	return New(steps...)
+	p := New(steps...)
+	// A failed run keeps the download, which the next run resumes, but not the split files, which
+	// it splits again
+	p.OnFailure = []Step{&CleanStep{TmpPath: tmpPathSplit}}
+
+	return p, nil
+}
+
+// inputID returns an identifier of the input path that may be used in file names
+func inputID(inputPath string) string {
+	h := sha256.Sum256([]byte(inputPath))
+
+	return hex.EncodeToString(h[:8])
 }
 
-// DownloadStep downloads a file from a URL to a local path using http.DownloadReader
+// DownloadStep downloads a file from a URL to a local path using http.DownloadFile, in pipeline.download_segments
+// concurrent segments if set, resuming any earlier download of the URL to the path that was interrupted. Once
+// run, Checksum is the sha256 of the file downloaded.
 type DownloadStep struct {
 	URL        string
 	OutputPath string
+	Checksum   string
 }
 
-func (s *DownloadStep) Run() {
-	var (
-		o   string
-		rd  io.ReadCloser
-		wr  io.WriteCloser
-		err error
-		n   int64
-	)
-
-	o = filepath.Dir(s.OutputPath)
-
-	err = os.MkdirAll(o, 0o755)
-	utils.ExitOnError(err)
-
-	rd, err = http.DownloadReader(s.URL)
-	utils.ExitOnError(err)
-
-	defer rd.Close()
-
-	wr, err = os.Create(s.OutputPath)
-	utils.ExitOnError(err)
+func (s *DownloadStep) Run(ctx context.Context) error {
+	err := os.MkdirAll(filepath.Dir(s.OutputPath), 0o755)
+	if err != nil {
+		return err
+	}
 
-	defer wr.Close()
+	n, sum, err := http.DownloadFileSum(ctx, s.URL, s.OutputPath)
+	if err != nil {
+		return err
+	}
 
-	n, err = io.Copy(wr, rd)
-	utils.ExitOnError(err)
+	s.Checksum = "sha256:" + hex.EncodeToString(sum)
 
 	log.Infof("Downloaded %d bytes from %s to %s", n, s.URL, s.OutputPath)
+
+	return nil
 }
 
 func (s *DownloadStep) Name() string {
@@ -136,8 +190,8 @@ type SplitStep struct {
 	Overwrite  bool
 }
 
-func (s *SplitStep) Run() {
-	split.File(s.InputPath, s.OutputPath, s.Overwrite)
+func (s *SplitStep) Run(ctx context.Context) error {
+	return split.File(ctx, s.InputPath, s.OutputPath, s.Overwrite)
 }
 
 func (s *SplitStep) Name() string {
@@ -149,25 +203,87 @@ type ParseStep struct {
 	InputPath   string
 	OutputPath  string
 	ServiceFile string
-	PlanID      int64
+	Plan        *models.Plan
+	Options     []mrf.ParserOption
+	// Source, if set, is the DownloadStep of the MRF the split files were split from
+	Source *DownloadStep
 }
 
-func (s *ParseStep) Run() {
-	mrf.Parse(s.InputPath, s.OutputPath, s.PlanID, s.ServiceFile)
+func (s *ParseStep) Run(ctx context.Context) error {
+	return mrf.Parse(ctx, s.InputPath, s.OutputPath, s.Plan, s.ServiceFile, withSource(s.Source, s.Options)...)
 }
 
 func (s *ParseStep) Name() string {
 	return "Parse"
 }
 
+func (s *ParseStep) SetInputPath(inputPath string) {
+	s.InputPath = inputPath
+}
+
+func (s *ParseStep) SetSource(source *DownloadStep) {
+	s.Source = source
+}
+
+// ParseAllowedStep parses split allowed-amounts NDJSON files into a parquet fileset using mrf.ParseAllowedAmounts
+type ParseAllowedStep struct {
+	InputPath   string
+	OutputPath  string
+	ServiceFile string
+	Plan        *models.Plan
+	// Source, if set, is the DownloadStep of the MRF the split files were split from
+	Source *DownloadStep
+}
+
+func (s *ParseAllowedStep) Run(ctx context.Context) error {
+	return mrf.ParseAllowedAmounts(ctx, s.InputPath, s.OutputPath, s.Plan, s.ServiceFile, withSource(s.Source, nil)...)
+}
+
+func (s *ParseAllowedStep) Name() string {
+	return "ParseAllowed"
+}
+
+func (s *ParseAllowedStep) SetInputPath(inputPath string) {
+	s.InputPath = inputPath
+}
+
+func (s *ParseAllowedStep) SetSource(source *DownloadStep) {
+	s.Source = source
+}
+
+// withSource returns opts followed by the mrf.WithSource option for the MRF downloaded by source, if set
+func withSource(source *DownloadStep, opts []mrf.ParserOption) []mrf.ParserOption {
+	if source == nil {
+		return opts
+	}
+
+	return append(opts[:len(opts):len(opts)], mrf.WithSource(source.URL, source.Checksum))
+}
+
+// StreamParseStep parses a JSON MRF file into a parquet fileset in a single pass using mrf.ParseStream
+type StreamParseStep struct {
+	InputPath   string
+	OutputPath  string
+	ServiceFile string
+	Plan        *models.Plan
+	Options     []mrf.ParserOption
+}
+
+func (s *StreamParseStep) Run(ctx context.Context) error {
+	return mrf.ParseStream(ctx, s.InputPath, s.OutputPath, s.Plan, s.ServiceFile, s.Options...)
+}
+
+func (s *StreamParseStep) Name() string {
+	return "StreamParse"
+}
+
 // CleanStep removes the tmp directory used to store the split files
 type CleanStep struct {
 	TmpPath string
 }
 
-func (s *CleanStep) Run() {
-	err := os.RemoveAll(s.TmpPath)
-	utils.ExitOnError(err)
+func (s *CleanStep) Run(_ context.Context) error {
+	return os.RemoveAll(s.TmpPath)
 }
 
 func (s *CleanStep) Name() string {
@@ -16,10 +16,16 @@ limitations under the License.
 package pipeline
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
 	"github.com/alecthomas/assert/v2"
 	"github.com/spf13/viper"
 )
@@ -28,11 +34,13 @@ func TestNewParsePipeline(t *testing.T) {
 	inputPath := "http://server.com/somepath/input.gz?somestuff"
 	outputPath := "output"
 	serviceFile := "service.csv"
-	planID := int64(1)
+	plan := &models.Plan{PlanID: "1"}
 
 	viper.Set("tmp.path", "/tmp")
 
-	p := NewParsePipeline(inputPath, outputPath, serviceFile, planID)
+	p, err := NewParsePipeline(inputPath, outputPath, serviceFile, plan)
+	assert.NoError(t, err)
+
 	assert.Equal(t, len(p.Steps), 4)
 
 	downloadStep, ok := p.Steps[0].(*DownloadStep)
@@ -53,12 +61,78 @@ func TestNewParsePipeline(t *testing.T) {
 	assert.True(t, ok)
 	assert.Equal(t, parseStep.OutputPath, outputPath)
 	assert.Equal(t, parseStep.ServiceFile, serviceFile)
-	assert.Equal(t, parseStep.PlanID, planID)
+	assert.Equal(t, parseStep.Plan, plan)
 
 	cleanupStep, ok := p.Steps[3].(*CleanStep)
 	assert.True(t, ok)
 	assert.True(t, strings.HasPrefix(tmpPath, cleanupStep.TmpPath))
 
-	err := os.RemoveAll(tmpPath)
+	// only the split files are removed on failure
+	failureStep, ok := p.OnFailure[0].(*CleanStep)
+	assert.True(t, ok)
+	assert.Equal(t, splitStep.OutputPath, failureStep.TmpPath)
+
+	// the tmp path of the same input is the same, so that a partial download is resumed
+	p, err = NewParsePipeline(inputPath, outputPath, serviceFile, plan)
+	assert.NoError(t, err)
+	assert.Equal(t, tmpPath, p.Steps[0].(*DownloadStep).OutputPath)
+
+	err = os.RemoveAll(cleanupStep.TmpPath)
+	assert.NoError(t, err)
+}
+
+func TestDownloadStep(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	s := &DownloadStep{URL: ts.URL, OutputPath: filepath.Join(t.TempDir(), "src", "in-network.json")}
+
+	err := s.Run(context.Background())
+	assert.NoError(t, err)
+
+	doc, err := os.ReadFile(s.OutputPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", string(doc))
+	assert.Equal(t, "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", s.Checksum)
+}
+
+func TestNewParseAllowedPipeline(t *testing.T) {
+	viper.Set("tmp.path", "/tmp")
+
+	p, err := NewParseAllowedPipeline("http://server.com/allowed.json.gz", "output", "service.csv", nil)
 	assert.NoError(t, err)
+
+	assert.Equal(t, len(p.Steps), 4)
+
+	splitStep, ok := p.Steps[1].(*SplitStep)
+	assert.True(t, ok)
+
+	parseStep, ok := p.Steps[2].(*ParseAllowedStep)
+	assert.True(t, ok)
+	assert.Equal(t, parseStep.InputPath, splitStep.OutputPath)
+	assert.Equal(t, parseStep.OutputPath, "output")
+	assert.Zero(t, parseStep.Plan)
+
+	cleanupStep, ok := p.Steps[3].(*CleanStep)
+	assert.True(t, ok)
+
+	err = os.RemoveAll(cleanupStep.TmpPath)
+	assert.NoError(t, err)
+}
+
+func TestNewStreamParsePipeline(t *testing.T) {
+	inputPath := "http://server.com/somepath/input.gz?somestuff"
+	plan := &models.Plan{PlanID: "1"}
+
+	p := NewStreamParsePipeline(inputPath, "output", "service.csv", plan)
+	assert.Equal(t, len(p.Steps), 1)
+
+	parseStep, ok := p.Steps[0].(*StreamParseStep)
+	assert.True(t, ok)
+	assert.Equal(t, parseStep.InputPath, inputPath)
+	assert.Equal(t, parseStep.OutputPath, "output")
+	assert.Equal(t, parseStep.ServiceFile, "service.csv")
+	assert.Equal(t, parseStep.Plan, plan)
 }
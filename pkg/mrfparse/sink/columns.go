@@ -0,0 +1,81 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sink
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// column is a column of a table, named for the parquet column of the same field so that every
+// format shares the same column names
+type column struct {
+	name string
+	// index is the index sequence of the column's field, for reflect.Value.FieldByIndex
+	index []int
+	// key is the JSON encoded column name
+	key []byte
+	typ reflect.Type
+}
+
+// columnCache caches the columns of each row type
+var columnCache sync.Map
+
+// columnsOf returns the columns of the struct type t. The fields of embedded structs are flattened,
+// as they are in the parquet schema.
+func columnsOf(t reflect.Type) []column {
+	if cols, ok := columnCache.Load(t); ok {
+		return cols.([]column)
+	}
+
+	cols := appendColumns(nil, t, nil)
+	columnCache.Store(t, cols)
+
+	return cols
+}
+
+func appendColumns(cols []column, t reflect.Type, index []int) []column {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		fieldIndex := append(append([]int{}, index...), i)
+
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			cols = appendColumns(cols, f.Type, fieldIndex)
+			continue
+		}
+
+		name, _, _ := strings.Cut(f.Tag.Get("parquet"), ",")
+		if name == "-" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		key, _ := json.Marshal(name)
+
+		cols = append(cols, column{name: name, index: fieldIndex, key: key, typ: f.Type})
+	}
+
+	return cols
+}
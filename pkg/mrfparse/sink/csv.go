@@ -0,0 +1,98 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sink
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// NewCSVSink returns a RecordSink writing gzip compressed CSV files, named filePrefix_0000.csv.gz, with
+// a header row of column names. Lists are written as JSON arrays, so that the files can be loaded with
+// PostgreSQL's COPY ... WITH (FORMAT csv, HEADER) into json or jsonb list columns.
+func NewCSVSink(filePrefix string) RecordSink {
+	return &fileSink{format: CSVFormat, filePrefix: filePrefix, ext: ".csv.gz", newEncoder: newCSVEncoder}
+}
+
+// csvEncoder writes rows as CSV records
+type csvEncoder struct {
+	w      *csv.Writer
+	cols   []column
+	record []string
+}
+
+func newCSVEncoder(w io.Writer, cols []column) (rowEncoder, error) {
+	e := &csvEncoder{w: csv.NewWriter(w), cols: cols, record: make([]string, len(cols))}
+
+	for i, col := range cols {
+		e.record[i] = col.name
+	}
+
+	err := e.w.Write(e.record)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (e *csvEncoder) encode(row reflect.Value) error {
+	for i, col := range e.cols {
+		v, err := csvValue(row.FieldByIndex(col.index))
+		if err != nil {
+			return err
+		}
+
+		e.record[i] = v
+	}
+
+	return e.w.Write(e.record)
+}
+
+func (e *csvEncoder) flush() error {
+	e.w.Flush()
+
+	return e.w.Error()
+}
+
+// csvValue formats v as a CSV field. Lists are formatted as JSON arrays.
+func csvValue(v reflect.Value) (string, error) {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	default:
+		b, err := jsonValue(v)
+		return string(b), err
+	}
+}
+
+// jsonValue returns the JSON encoding of v. A nil list is encoded as an empty array.
+func jsonValue(v reflect.Value) ([]byte, error) {
+	if v.Kind() == reflect.Slice && v.IsNil() {
+		return []byte("[]"), nil
+	}
+
+	return json.Marshal(v.Interface())
+}
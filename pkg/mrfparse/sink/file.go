@@ -0,0 +1,321 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
+	"github.com/spf13/viper"
+)
+
+// DefaultMaxRowsPerFile is the number of rows written to a file before a new one is created, unless
+// set by writer.max_rows_per_file
+const DefaultMaxRowsPerFile = 100_000_000
+
+// rowEncoder encodes rows to a single file
+type rowEncoder interface {
+	// encode writes row, a struct with the columns the encoder was created with
+	encode(row reflect.Value) error
+	// flush writes any buffered rows to the underlying writer
+	flush() error
+}
+
+// newEncoderFunc returns a rowEncoder writing rows with columns cols to w
+type newEncoderFunc func(w io.Writer, cols []column) (rowEncoder, error)
+
+// fileSink is a RecordSink writing gzip compressed text files, with one row per record. Files are
+// named filePrefix_0000 followed by ext, and a new file is created once writer.max_rows_per_file rows
+// have been written to the current one. With the normalized layout, each record type's table is
+// written to its own directory, with its own current file.
+type fileSink struct {
+	format     string
+	filePrefix string
+	ext        string
+	newEncoder newEncoderFunc
+
+	outputURI      string
+	normalized     bool
+	maxRowsPerFile int
+	tables         map[string]*tableWriter
+	// order is the order in which tables were created, so that they are closed deterministically
+	order []string
+	files []File
+}
+
+// Open checks the writer config. Files are only created as rows are written.
+func (s *fileSink) Open(_ context.Context, outputURI string) error {
+	err := checkParquetOnlyConfig(s.format)
+	if err != nil {
+		return err
+	}
+
+	switch layout := viper.GetString("writer.layout"); layout {
+	case "", WideLayout:
+		s.normalized = false
+	case NormalizedLayout:
+		s.normalized = true
+	default:
+		return fmt.Errorf("unknown writer layout %q", layout)
+	}
+
+	s.maxRowsPerFile = DefaultMaxRowsPerFile
+	if viper.IsSet("writer.max_rows_per_file") {
+		s.maxRowsPerFile = viper.GetInt("writer.max_rows_per_file")
+	}
+
+	s.outputURI = outputURI
+	s.tables = make(map[string]*tableWriter)
+	s.order = nil
+	s.files = nil
+
+	return nil
+}
+
+// WriteBatch writes each record to the current file of its table
+func (s *fileSink) WriteBatch(records []*models.Mrf) error {
+	for _, m := range records {
+		var (
+			row       any = m
+			tableName     = ""
+		)
+
+		if s.normalized {
+			row = m.TableRow()
+			if row == nil {
+				return fmt.Errorf("no table for record type %q", m.RecordType)
+			}
+
+			tableName = m.RecordType
+		}
+
+		t, err := s.table(tableName)
+		if err != nil {
+			return err
+		}
+
+		err = t.write(reflect.Indirect(reflect.ValueOf(row)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// table returns the tableWriter of the named table, creating it if need be. The wide table is named "".
+func (s *fileSink) table(name string) (*tableWriter, error) {
+	if t, ok := s.tables[name]; ok {
+		return t, nil
+	}
+
+	uri := s.outputURI
+	if name != "" {
+		uri = cloud.JoinURI(s.outputURI, name)
+
+		if !cloud.IsCloudURI(uri) {
+			err := os.MkdirAll(uri, os.ModePerm)
+			if err != nil {
+				return nil, fmt.Errorf("unable to create table directory %s: %w", uri, err)
+			}
+		}
+	}
+
+	t := &tableWriter{sink: s, uri: uri}
+	s.tables[name] = t
+	s.order = append(s.order, name)
+
+	return t, nil
+}
+
+// Close closes the current file of every table, returning the first error. There is nothing to commit.
+func (s *fileSink) Close(bool) error {
+	var err error
+
+	for _, name := range s.order {
+		if cerr := s.tables[name].close(); cerr != nil {
+			if err != nil {
+				log.Errorf("Unable to close %s: %s", s.tables[name].uri, cerr.Error())
+				continue
+			}
+
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// Files lists the files written
+func (s *fileSink) Files() []File {
+	return s.files
+}
+
+// checkParquetOnlyConfig returns an error if the writer config sets options only supported by the parquet format
+func checkParquetOnlyConfig(format string) error {
+	if len(viper.GetStringSlice("writer.partition_by")) > 0 {
+		return fmt.Errorf("writer.partition_by is not supported by the %s format", format)
+	}
+
+	if viper.GetString("writer.table_format") != "" {
+		return fmt.Errorf("writer.table_format is not supported by the %s format", format)
+	}
+
+	if schema := viper.GetString("writer.schema"); schema != "" && schema != StringSchema {
+		return fmt.Errorf("writer.schema %q is not supported by the %s format", schema, format)
+	}
+
+	return nil
+}
+
+// tableWriter writes rows to the current file of a table's directory
+type tableWriter struct {
+	sink      *fileSink
+	uri       string
+	fileIndex int
+	file      *encodedFile
+}
+
+func (t *tableWriter) write(row reflect.Value) error {
+	if t.file == nil || t.file.rows >= t.sink.maxRowsPerFile {
+		err := t.close()
+		if err != nil {
+			return err
+		}
+
+		uri := cloud.JoinURI(t.uri, fmt.Sprintf("%s_%04d%s", t.sink.filePrefix, t.fileIndex, t.sink.ext))
+		t.fileIndex++
+
+		f, err := createEncodedFile(uri, columnsOf(row.Type()), t.sink.newEncoder)
+		if err != nil {
+			return err
+		}
+
+		t.file = f
+	}
+
+	return t.file.write(row)
+}
+
+// close closes the current file, if any
+func (t *tableWriter) close() error {
+	if t.file == nil {
+		return nil
+	}
+
+	f := t.file
+	t.file = nil
+
+	err := f.close()
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Closed writer for %s", f.uri)
+
+	t.sink.files = append(t.sink.files, File{URI: f.uri, Rows: int64(f.rows)})
+
+	return nil
+}
+
+// encodedFile is a gzip compressed file written by a rowEncoder
+type encodedFile struct {
+	*gzipFile
+	enc  rowEncoder
+	rows int
+}
+
+func createEncodedFile(uri string, cols []column, newEncoder newEncoderFunc) (*encodedFile, error) {
+	f, err := createGzipFile(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := newEncoder(f.buf, cols)
+	if err != nil {
+		_ = f.w.Close()
+		return nil, err
+	}
+
+	return &encodedFile{gzipFile: f, enc: enc}, nil
+}
+
+func (f *encodedFile) write(row reflect.Value) error {
+	err := f.enc.encode(row)
+	if err != nil {
+		return err
+	}
+
+	f.rows++
+
+	return nil
+}
+
+// close flushes the encoder and closes the file. The underlying writer is closed even if flushing fails.
+func (f *encodedFile) close() error {
+	err := f.enc.flush()
+	if err != nil {
+		_ = f.w.Close()
+		return err
+	}
+
+	return f.gzipFile.close()
+}
+
+// gzipFile is a buffered, gzip compressed file
+type gzipFile struct {
+	uri string
+	w   io.WriteCloser
+	gz  *gzip.Writer
+	buf *bufio.Writer
+}
+
+// createGzipFile creates the file at uri. Files are written with a context that is never cancelled,
+// as cancelling a cloud writer's context discards the file rather than closing it.
+func createGzipFile(uri string) (*gzipFile, error) {
+	w, err := cloud.NewWriter(context.Background(), uri)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+
+	return &gzipFile{uri: uri, w: w, gz: gz, buf: bufio.NewWriterSize(gz, 64*1024)}, nil
+}
+
+// close flushes the buffer and closes the gzip stream and the underlying writer. The underlying writer
+// is closed even if flushing fails.
+func (f *gzipFile) close() error {
+	err := f.buf.Flush()
+	if err == nil {
+		err = f.gz.Close()
+	}
+
+	cerr := f.w.Close()
+	if err != nil {
+		return err
+	}
+
+	return cerr
+}
@@ -0,0 +1,171 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setWriterConfig sets the writer config for the duration of the test
+func setWriterConfig(t *testing.T, layout string, maxRowsPerFile int) {
+	viper.Set("writer.layout", layout)
+	viper.Set("writer.max_rows_per_file", maxRowsPerFile)
+
+	t.Cleanup(func() {
+		viper.Set("writer.layout", "")
+		viper.Set("writer.max_rows_per_file", DefaultMaxRowsPerFile)
+	})
+}
+
+func writeRecords(t *testing.T, s RecordSink, dir string, records []*models.Mrf) {
+	require.NoError(t, s.Open(context.Background(), dir))
+	require.NoError(t, s.WriteBatch(records))
+	require.NoError(t, s.Close(true))
+}
+
+// readGzip returns the lines of the gzip compressed file at path
+func readGzip(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+
+	var lines []string
+
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	require.NoError(t, scanner.Err())
+
+	return lines
+}
+
+var tinRecords = []*models.Mrf{
+	{UUID: "1", ParentUUID: "0", RecordType: "tin", Tin: models.Tin{Value: "11-1111111", TinType: "ein"}},
+	{UUID: "2", ParentUUID: "0", RecordType: "provider", Provider: models.Provider{NpiList: models.NpiList{1821198789}}},
+	{UUID: "3", ParentUUID: "0", RecordType: "tin", Tin: models.Tin{Value: "22-2222222", TinType: "npi"}},
+}
+
+func TestCSVSinkWide(t *testing.T) {
+	setWriterConfig(t, WideLayout, 2)
+
+	dir := t.TempDir()
+
+	s := NewCSVSink("mrf")
+
+	writeRecords(t, s, dir, tinRecords)
+
+	assert.Equal(t, []File{
+		{URI: filepath.Join(dir, "mrf_0000.csv.gz"), Rows: 2},
+		{URI: filepath.Join(dir, "mrf_0001.csv.gz"), Rows: 1},
+	}, s.(FileLister).Files())
+
+	f, err := os.Open(filepath.Join(dir, "mrf_0000.csv.gz"))
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+
+	rows, err := csv.NewReader(gz).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+
+	header := make(map[string]int)
+	for i, name := range rows[0] {
+		header[name] = i
+	}
+
+	assert.Len(t, header, len(columnsOf(reflect.TypeOf(models.Mrf{}))))
+	assert.Equal(t, "1", rows[1][header["uuid"]])
+	assert.Equal(t, "11-1111111", rows[1][header["provider_tin_value"]])
+	assert.Equal(t, "[1821198789]", rows[2][header["provider_npi_list"]])
+	assert.Equal(t, "[]", rows[1][header["provider_npi_list"]])
+	assert.Equal(t, "0", rows[1][header["in_np_negotiated_rate"]])
+
+	// the third row rolls over to a new file
+	lines := readGzip(t, filepath.Join(dir, "mrf_0001.csv.gz"))
+	assert.Len(t, lines, 2)
+}
+
+func TestNDJSONSinkNormalized(t *testing.T) {
+	setWriterConfig(t, NormalizedLayout, 100)
+
+	dir := t.TempDir()
+
+	writeRecords(t, NewNDJSONSink("mrf"), dir, tinRecords)
+
+	lines := readGzip(t, filepath.Join(dir, "tin", "mrf_0000.ndjson.gz"))
+	require.Len(t, lines, 2)
+	assert.Equal(t, `{"uuid":"1","parent_uuid":"0","provider_tin_value":"11-1111111","provider_tin_type":"ein"}`, lines[0])
+
+	lines = readGzip(t, filepath.Join(dir, "provider", "mrf_0000.ndjson.gz"))
+	require.Len(t, lines, 1)
+
+	var row map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &row))
+	assert.Equal(t, []any{float64(1821198789)}, row["provider_npi_list"])
+}
+
+func TestFileSinkUnsupportedConfig(t *testing.T) {
+	viper.Set("writer.partition_by", []string{"record_type"})
+	err := NewCSVSink("mrf").Open(context.Background(), t.TempDir())
+	viper.Set("writer.partition_by", []string{})
+	assert.Error(t, err)
+
+	viper.Set("writer.table_format", "delta")
+	err = NewNDJSONSink("mrf").Open(context.Background(), t.TempDir())
+	viper.Set("writer.table_format", "")
+	assert.Error(t, err)
+
+	viper.Set("writer.schema", TypedSchema)
+	err = NewCSVSink("mrf").Open(context.Background(), t.TempDir())
+	viper.Set("writer.schema", "")
+	assert.Error(t, err)
+
+	setWriterConfig(t, "unknown", 100)
+	assert.Error(t, NewCSVSink("mrf").Open(context.Background(), t.TempDir()))
+}
+
+func TestFileSinkUnknownRecordType(t *testing.T) {
+	setWriterConfig(t, NormalizedLayout, 100)
+
+	s := NewCSVSink("mrf")
+	require.NoError(t, s.Open(context.Background(), t.TempDir()))
+
+	assert.Error(t, s.WriteBatch([]*models.Mrf{{RecordType: "unknown"}}))
+	assert.NoError(t, s.Close(false))
+}
@@ -0,0 +1,69 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sink
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+)
+
+// NewNDJSONSink returns a RecordSink writing gzip compressed newline delimited JSON files, named
+// filePrefix_0000.ndjson.gz, with one object per row keyed by column name.
+func NewNDJSONSink(filePrefix string) RecordSink {
+	return &fileSink{format: NDJSONFormat, filePrefix: filePrefix, ext: ".ndjson.gz", newEncoder: newNDJSONEncoder}
+}
+
+// ndjsonEncoder writes rows as JSON objects, one per line, with keys in column order
+type ndjsonEncoder struct {
+	w    io.Writer
+	cols []column
+	line bytes.Buffer
+}
+
+func newNDJSONEncoder(w io.Writer, cols []column) (rowEncoder, error) {
+	return &ndjsonEncoder{w: w, cols: cols}, nil
+}
+
+func (e *ndjsonEncoder) encode(row reflect.Value) error {
+	e.line.Reset()
+	e.line.WriteByte('{')
+
+	for i, col := range e.cols {
+		if i > 0 {
+			e.line.WriteByte(',')
+		}
+
+		v, err := jsonValue(row.FieldByIndex(col.index))
+		if err != nil {
+			return err
+		}
+
+		e.line.Write(col.key)
+		e.line.WriteByte(':')
+		e.line.Write(v)
+	}
+
+	e.line.WriteString("}\n")
+
+	_, err := e.w.Write(e.line.Bytes())
+
+	return err
+}
+
+func (e *ndjsonEncoder) flush() error {
+	return nil
+}
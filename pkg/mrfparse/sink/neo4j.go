@@ -0,0 +1,377 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sink
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+)
+
+// neo4jNode is a node label of the neo4j output, written from the records of a single record type
+type neo4jNode struct {
+	label string
+	// name names the label's file
+	name string
+	// relationship is the type of the relationship from the parent of each of the label's nodes, if any
+	relationship string
+	// props returns the struct holding a record's node properties
+	props func(m *models.Mrf) any
+}
+
+// neo4jNodes maps record types to the node labels they are written as. Records of other types are skipped.
+var neo4jNodes = map[string]neo4jNode{
+	"root": {label: "Plan", name: "plan",
+		props: func(m *models.Mrf) any { return m.MrfRoot }},
+	"in_network": {label: "Service", name: "service", relationship: "HAS_SERVICE",
+		props: func(m *models.Mrf) any { return m.InNetwork }},
+	"negotiated_rate": {label: "NegotiatedRate", name: "negotiated_rate", relationship: "HAS_NEGOTIATED_RATE",
+		props: func(m *models.Mrf) any { return m.NegotiatedRate }},
+	"negotiated_prices": {label: "Price", name: "price", relationship: "HAS_PRICE",
+		props: func(m *models.Mrf) any { return m.NegotiatedPrices }},
+	"provider_group": {label: "ProviderGroup", name: "provider_group", relationship: "HAS_PROVIDER_GROUP",
+		props: func(m *models.Mrf) any { return m.ProviderGroup }},
+	"provider": {label: "Provider", name: "provider", relationship: "HAS_PROVIDER",
+		props: func(m *models.Mrf) any { return m.Provider }},
+	"tin": {label: "TIN", name: "tin", relationship: "HAS_TIN",
+		props: func(m *models.Mrf) any { return m.Tin }},
+}
+
+// neo4jNodeOrder is the order in which node files are created
+var neo4jNodeOrder = []string{"root", "in_network", "negotiated_rate", "negotiated_prices", "provider_group", "provider", "tin"}
+
+// ReferencesRelationship is the type of the relationship from a NegotiatedRate to each ProviderGroup in
+// its provider_references
+const ReferencesRelationship = "REFERENCES"
+
+// neo4jArrayDelimiter is the array delimiter expected by neo4j-admin database import by default
+const neo4jArrayDelimiter = ";"
+
+// NewNeo4jSink returns a RecordSink writing gzip compressed CSV files for neo4j-admin database import.
+// A node file, named filePrefix_nodes_<label>.csv.gz, is written for each of the Plan, Service,
+// NegotiatedRate, Price, ProviderGroup, Provider and TIN labels, with a header in the import tool's
+// syntax. Nodes are identified by the UUID of their record, other than ProviderGroups, which are
+// identified by their provider_group_id so that the provider_references of NegotiatedRates can refer
+// to them. filePrefix_relationships.csv.gz relates each node to its parent, and each NegotiatedRate to
+// the ProviderGroups it references. A TIN is related to the Provider it was listed with.
+func NewNeo4jSink(filePrefix string) RecordSink {
+	return &neo4jSink{filePrefix: filePrefix}
+}
+
+type neo4jSink struct {
+	filePrefix string
+	nodes      map[string]*neo4jFile
+	rels       *neo4jFile
+	// groups maps the UUID of each provider_group record written to its node ID
+	groups map[string]string
+	// groupIDs is the set of ProviderGroup node IDs written, so that each is only written once
+	groupIDs map[string]struct{}
+	skipped  map[string]struct{}
+}
+
+// Open creates the node and relationship files, so that every file exists even if it has no rows
+func (s *neo4jSink) Open(_ context.Context, outputURI string) error {
+	err := checkParquetOnlyConfig(Neo4jFormat)
+	if err != nil {
+		return err
+	}
+
+	s.nodes = make(map[string]*neo4jFile)
+	s.groups = make(map[string]string)
+	s.groupIDs = make(map[string]struct{})
+	s.skipped = make(map[string]struct{})
+
+	for _, recordType := range neo4jNodeOrder {
+		node := neo4jNodes[recordType]
+		uri := cloud.JoinURI(outputURI, fmt.Sprintf("%s_nodes_%s.csv.gz", s.filePrefix, node.name))
+
+		f, err := createNeo4jFile(uri, neo4jNodeHeader(node))
+		if err != nil {
+			return s.closeOnError(err)
+		}
+
+		s.nodes[recordType] = f
+	}
+
+	s.rels, err = createNeo4jFile(cloud.JoinURI(outputURI, s.filePrefix+"_relationships.csv.gz"),
+		[]string{":START_ID", ":END_ID", ":TYPE"})
+	if err != nil {
+		return s.closeOnError(err)
+	}
+
+	return nil
+}
+
+// WriteBatch writes a node and its parent relationship for each record of a type with a node label
+func (s *neo4jSink) WriteBatch(records []*models.Mrf) error {
+	// provider is the node ID of the last provider written, as each tin record follows the provider it was
+	// listed with
+	var provider string
+
+	for _, m := range records {
+		node, ok := neo4jNodes[m.RecordType]
+		if !ok {
+			if _, ok = s.skipped[m.RecordType]; !ok {
+				log.Debugf("Skipping %s records, which have no neo4j node label", m.RecordType)
+				s.skipped[m.RecordType] = struct{}{}
+			}
+
+			continue
+		}
+
+		id, parent := m.UUID, m.ParentUUID
+
+		switch m.RecordType {
+		case "provider_group":
+			id = providerGroupNodeID(m.ProviderGroupID)
+			s.groups[m.UUID] = id
+
+			if _, ok = s.groupIDs[id]; ok {
+				continue
+			}
+
+			s.groupIDs[id] = struct{}{}
+		case "tin":
+			if provider != "" {
+				parent = provider
+			}
+		}
+
+		if groupID, ok := s.groups[parent]; ok {
+			parent = groupID
+		}
+
+		err := s.nodes[m.RecordType].write(neo4jNodeRecord(id, node, m))
+		if err != nil {
+			return err
+		}
+
+		if node.relationship != "" && parent != "" {
+			err = s.rels.write([]string{parent, id, node.relationship})
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, pr := range m.PRList {
+			err = s.rels.write([]string{id, providerGroupNodeID(pr), ReferencesRelationship})
+			if err != nil {
+				return err
+			}
+		}
+
+		provider = ""
+		if m.RecordType == "provider" {
+			provider = id
+		}
+	}
+
+	return nil
+}
+
+// Close closes every file, returning the first error. There is nothing to commit.
+func (s *neo4jSink) Close(bool) error {
+	var err error
+
+	for _, f := range s.files() {
+		if cerr := f.close(); cerr != nil {
+			if err != nil {
+				log.Errorf("Unable to close %s: %s", f.uri, cerr.Error())
+				continue
+			}
+
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// Files lists the node files, followed by the relationships file
+func (s *neo4jSink) Files() []File {
+	var files []File
+
+	for _, f := range s.files() {
+		files = append(files, File{URI: f.uri, Rows: int64(f.rows)})
+	}
+
+	return files
+}
+
+// closeOnError closes any files created after Open fails, and returns err
+func (s *neo4jSink) closeOnError(err error) error {
+	for _, f := range s.files() {
+		_ = f.close()
+	}
+
+	return err
+}
+
+// files returns the files created, in the order they were created
+func (s *neo4jSink) files() []*neo4jFile {
+	var files []*neo4jFile
+
+	for _, recordType := range neo4jNodeOrder {
+		if f, ok := s.nodes[recordType]; ok {
+			files = append(files, f)
+		}
+	}
+
+	if s.rels != nil {
+		files = append(files, s.rels)
+	}
+
+	return files
+}
+
+// providerGroupNodeID returns the node ID of the ProviderGroup with providerGroupID
+func providerGroupNodeID(providerGroupID string) string {
+	return "provider_group:" + providerGroupID
+}
+
+// neo4jNodeHeader returns the header of node's file: an ID column, a column for each property, typed
+// for neo4j-admin database import, and a label column
+func neo4jNodeHeader(node neo4jNode) []string {
+	cols := columnsOf(reflect.TypeOf(node.props(&models.Mrf{})))
+	header := make([]string, 0, len(cols)+2)
+
+	header = append(header, "id:ID")
+
+	for _, col := range cols {
+		header = append(header, col.name+neo4jType(col.typ))
+	}
+
+	return append(header, ":LABEL")
+}
+
+// neo4jType returns the import tool's type suffix of a column of type t. Strings are the default type.
+func neo4jType(t reflect.Type) string {
+	if t.Kind() == reflect.Slice {
+		return ":" + neo4jScalarType(t.Elem()) + "[]"
+	}
+
+	if typ := neo4jScalarType(t); typ != "string" {
+		return ":" + typ
+	}
+
+	return ""
+}
+
+// neo4jScalarType returns the import tool's name of the scalar type t
+func neo4jScalarType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "long"
+	case reflect.Float32, reflect.Float64:
+		return "double"
+	case reflect.Bool:
+		return "boolean"
+	default:
+		return "string"
+	}
+}
+
+// neo4jNodeRecord returns the CSV record of the node with id written from m
+func neo4jNodeRecord(id string, node neo4jNode, m *models.Mrf) []string {
+	props := reflect.ValueOf(node.props(m))
+	cols := columnsOf(props.Type())
+	record := make([]string, 0, len(cols)+2)
+
+	record = append(record, id)
+
+	for _, col := range cols {
+		record = append(record, neo4jValue(props.FieldByIndex(col.index)))
+	}
+
+	return append(record, node.label)
+}
+
+// neo4jValue formats v as an import tool field. Arrays are joined with the default array delimiter.
+func neo4jValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Slice:
+		values := make([]string, v.Len())
+		for i := range values {
+			values[i] = neo4jValue(v.Index(i))
+		}
+
+		return strings.Join(values, neo4jArrayDelimiter)
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+// neo4jFile is a gzip compressed CSV file with a header row
+type neo4jFile struct {
+	*gzipFile
+	w    *csv.Writer
+	rows int
+}
+
+func createNeo4jFile(uri string, header []string) (*neo4jFile, error) {
+	f, err := createGzipFile(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	nf := &neo4jFile{gzipFile: f, w: csv.NewWriter(f.buf)}
+
+	err = nf.w.Write(header)
+	if err != nil {
+		_ = f.w.Close()
+		return nil, err
+	}
+
+	return nf, nil
+}
+
+func (f *neo4jFile) write(record []string) error {
+	err := f.w.Write(record)
+	if err != nil {
+		return err
+	}
+
+	f.rows++
+
+	return nil
+}
+
+// close flushes the CSV writer and closes the file
+func (f *neo4jFile) close() error {
+	f.w.Flush()
+
+	err := f.w.Error()
+	if err != nil {
+		_ = f.gzipFile.w.Close()
+		return err
+	}
+
+	return f.gzipFile.close()
+}
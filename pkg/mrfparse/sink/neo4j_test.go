@@ -0,0 +1,102 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sink
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readCSV returns the records of the gzip compressed CSV file at path
+func readCSV(t *testing.T, path string) [][]string {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+
+	records, err := csv.NewReader(gz).ReadAll()
+	require.NoError(t, err)
+
+	return records
+}
+
+func TestNeo4jSink(t *testing.T) {
+	dir := t.TempDir()
+
+	records := []*models.Mrf{
+		{UUID: "r", RecordType: "root", MrfRoot: models.MrfRoot{ReportingEntityName: "Test Payer"}},
+		{UUID: "in", ParentUUID: "r", RecordType: "in_network", InNetwork: models.InNetwork{BillingCode: "99213"}},
+		{UUID: "bc", ParentUUID: "in", RecordType: "bundled_codes"},
+		{UUID: "nr", ParentUUID: "in", RecordType: "negotiated_rate",
+			NegotiatedRate: models.NegotiatedRate{PRList: models.ProviderReferences{"1", "2"}}},
+		{UUID: "np", ParentUUID: "nr", RecordType: "negotiated_prices",
+			NegotiatedPrices: models.NegotiatedPrices{NegotiatedRateValue: 80.5, ServiceCodes: models.ServiceCodes{"11", "22"}}},
+		{UUID: "pg", ParentUUID: "r", RecordType: "provider_group", ProviderGroup: models.ProviderGroup{ProviderGroupID: "1"}},
+		{UUID: "p", ParentUUID: "pg", RecordType: "provider", Provider: models.Provider{NpiList: models.NpiList{1821198789, 1770512915}}},
+		{UUID: "t", ParentUUID: "pg", RecordType: "tin", Tin: models.Tin{Value: "11-1111111", TinType: "ein"}},
+	}
+
+	s := NewNeo4jSink("mrf")
+	require.NoError(t, s.Open(context.Background(), dir))
+	require.NoError(t, s.WriteBatch(records))
+	require.NoError(t, s.Close(true))
+
+	for _, name := range []string{"plan", "service", "negotiated_rate", "price", "provider_group", "provider", "tin"} {
+		assert.FileExists(t, filepath.Join(dir, "mrf_nodes_"+name+".csv.gz"))
+	}
+
+	prices := readCSV(t, filepath.Join(dir, "mrf_nodes_price.csv.gz"))
+	require.Len(t, prices, 2)
+	assert.Equal(t, "id:ID", prices[0][0])
+	assert.Contains(t, prices[0], "in_np_service_codes:string[]")
+	assert.Contains(t, prices[0], "in_np_negotiated_rate:double")
+	assert.Equal(t, ":LABEL", prices[0][len(prices[0])-1])
+	assert.Contains(t, prices[1], "11;22")
+	assert.Contains(t, prices[1], "80.5")
+	assert.Equal(t, "Price", prices[1][len(prices[1])-1])
+
+	providers := readCSV(t, filepath.Join(dir, "mrf_nodes_provider.csv.gz"))
+	assert.Equal(t, []string{"id:ID", "provider_parent", "provider_npi_list:long[]", ":LABEL"}, providers[0])
+	assert.Equal(t, []string{"p", "", "1821198789;1770512915", "Provider"}, providers[1])
+
+	groups := readCSV(t, filepath.Join(dir, "mrf_nodes_provider_group.csv.gz"))
+	assert.Equal(t, []string{"provider_group:1", "1", "ProviderGroup"}, groups[1])
+
+	rels := readCSV(t, filepath.Join(dir, "mrf_relationships.csv.gz"))
+	assert.Equal(t, [][]string{
+		{":START_ID", ":END_ID", ":TYPE"},
+		{"r", "in", "HAS_SERVICE"},
+		{"in", "nr", "HAS_NEGOTIATED_RATE"},
+		{"nr", "provider_group:1", "REFERENCES"},
+		{"nr", "provider_group:2", "REFERENCES"},
+		{"nr", "np", "HAS_PRICE"},
+		{"r", "provider_group:1", "HAS_PROVIDER_GROUP"},
+		{"provider_group:1", "p", "HAS_PROVIDER"},
+		{"p", "t", "HAS_TIN"},
+	}, rels)
+}
@@ -0,0 +1,424 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+// DefaultPostgresSchema is the schema the postgres format's tables are created in, unless set by
+// writer.postgres.schema
+const DefaultPostgresSchema = "public"
+
+// postgresKeyColumns are the columns that key a run's rows in the target tables: the root columns
+// identifying the payer, date and plan, and the URI of the MRF parsed, as a payer publishes many files with
+// the same root columns. Re-running a file replaces the rows of the previous run with the same key.
+var postgresKeyColumns = []string{"reporting_entity_name", "last_updated_on", "plan_id", "source_uri"}
+
+// ErrNoRootRecord is returned when a postgres sink is closed without a root record having been written,
+// as the run's rows can't be keyed
+var ErrNoRootRecord = errors.New("no root record was written, unable to key the run's rows")
+
+// NewPostgresSink returns a RecordSink loading records into the PostgreSQL database at writer.postgres.url.
+// Each record type is loaded into its own target table, named for the record type, in writer.postgres.schema,
+// with the columns of its table in the normalized layout and lists as arrays. Each table also has those of
+// the reporting_entity_name, last_updated_on and plan_id columns it doesn't have of its own, set from the run's
+// root record, and a source_uri column, set from the source of the context the sink is opened with.
+//
+// Record batches are streamed with COPY FROM STDIN into temporary staging tables. Once the sink is closed,
+// the staging tables are merged into the target tables in a single transaction, replacing the rows of any
+// earlier run with the same key columns, so that re-running a file replaces rather than duplicates its rows,
+// while the rows of other files of the same payer are kept. Nothing is merged if the parse failed.
+func NewPostgresSink() RecordSink {
+	return &postgresSink{}
+}
+
+type postgresSink struct {
+	// ctx is used once the sink is open, and is never cancelled, so that the staging tables may be
+	// dropped after the parse has been cancelled
+	ctx    context.Context
+	conn   *pgx.Conn
+	schema string
+	tables map[string]*postgresTable
+	// staged is the record types with a staging table, in the order they were created
+	staged []string
+	// source is the URI of the MRF parsed, set from the context the sink is opened with
+	source string
+	// key is the value of each of postgresKeyColumns, set from the root record
+	key []any
+}
+
+// postgresTable is the target table of a record type
+type postgresTable struct {
+	name string
+	cols []column
+	// extra are the key columns the record type doesn't have of its own, set from the run's key
+	extra  []string
+	staged bool
+}
+
+// Open connects to the database and creates the target tables that don't yet exist
+func (s *postgresSink) Open(ctx context.Context, _ string) error {
+	err := checkParquetOnlyConfig(PostgresFormat)
+	if err != nil {
+		return err
+	}
+
+	url := viper.GetString("writer.postgres.url")
+	if url == "" {
+		return fmt.Errorf("writer.postgres.url must be set for the %s format", PostgresFormat)
+	}
+
+	s.schema = DefaultPostgresSchema
+	if viper.IsSet("writer.postgres.schema") {
+		s.schema = viper.GetString("writer.postgres.schema")
+	}
+
+	s.ctx = context.Background()
+	s.tables = make(map[string]*postgresTable)
+	s.staged = nil
+	s.key = nil
+	s.source = Source(ctx)
+
+	s.conn, err = pgx.Connect(ctx, url)
+	if err != nil {
+		return fmt.Errorf("unable to connect to postgres: %w", err)
+	}
+
+	for _, recordType := range models.RecordTypes {
+		t := newPostgresTable(recordType)
+
+		for _, stmt := range t.createSQL(s.schema) {
+			if _, err = s.conn.Exec(ctx, stmt); err != nil {
+				_ = s.conn.Close(s.ctx)
+				return fmt.Errorf("unable to create table %s: %w", t.name, err)
+			}
+		}
+
+		s.tables[recordType] = t
+	}
+
+	return nil
+}
+
+// newPostgresTable returns the target table of recordType
+func newPostgresTable(recordType string) *postgresTable {
+	row := (&models.Mrf{RecordType: recordType}).TableRow()
+	t := &postgresTable{name: recordType, cols: columnsOf(reflect.TypeOf(row))}
+
+	for _, key := range postgresKeyColumns {
+		if !t.hasColumn(key) {
+			t.extra = append(t.extra, key)
+		}
+	}
+
+	return t
+}
+
+func (t *postgresTable) hasColumn(name string) bool {
+	for _, col := range t.cols {
+		if col.name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// columnNames returns the names of the record type's columns
+func (t *postgresTable) columnNames() []string {
+	names := make([]string, len(t.cols))
+	for i, col := range t.cols {
+		names[i] = col.name
+	}
+
+	return names
+}
+
+// createSQL returns the statements creating the target table, if it doesn't exist, adding any key columns
+// a table created by an earlier version lacks, and creating its key index
+func (t *postgresTable) createSQL(schema string) []string {
+	defs := make([]string, 0, len(t.cols)+len(t.extra))
+	for _, col := range t.cols {
+		defs = append(defs, pgx.Identifier{col.name}.Sanitize()+" "+postgresType(col.typ))
+	}
+
+	for _, key := range t.extra {
+		defs = append(defs, pgx.Identifier{key}.Sanitize()+" text")
+	}
+
+	stmts := []string{fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", t.target(schema), strings.Join(defs, ", "))}
+
+	for _, key := range t.extra {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s text", t.target(schema),
+			pgx.Identifier{key}.Sanitize()))
+	}
+
+	return append(stmts, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)",
+		pgx.Identifier{t.name + "_source_idx"}.Sanitize(), t.target(schema), sanitizeIdentifiers(postgresKeyColumns)))
+}
+
+// stageSQL returns the statement creating the temporary staging table, with the target table's columns.
+// Any key columns the record type doesn't have of its own are left empty.
+func (t *postgresTable) stageSQL(schema string) string {
+	return fmt.Sprintf("CREATE TEMPORARY TABLE %s (LIKE %s)", t.stage().Sanitize(), t.target(schema))
+}
+
+// deleteSQL returns the statement deleting the target table's rows with the key $1, $2, ...
+func (t *postgresTable) deleteSQL(schema string) string {
+	conds := make([]string, len(postgresKeyColumns))
+	for i, key := range postgresKeyColumns {
+		conds[i] = fmt.Sprintf("%s = $%d", pgx.Identifier{key}.Sanitize(), i+1)
+	}
+
+	return fmt.Sprintf("DELETE FROM %s WHERE %s", t.target(schema), strings.Join(conds, " AND "))
+}
+
+// insertSQL returns the statement inserting the staging table's rows into the target table. The key columns
+// the table doesn't have of its own are set to $1, $2, ...
+func (t *postgresTable) insertSQL(schema string) string {
+	cols := t.columnNames()
+	sel := sanitizeIdentifiers(cols)
+
+	cols = append(cols, t.extra...)
+
+	for i := range t.extra {
+		sel += fmt.Sprintf(", $%d::text", i+1)
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", t.target(schema), sanitizeIdentifiers(cols), sel,
+		t.stage().Sanitize())
+}
+
+// target returns the sanitized name of the target table in schema
+func (t *postgresTable) target(schema string) string {
+	return pgx.Identifier{schema, t.name}.Sanitize()
+}
+
+func (t *postgresTable) stage() pgx.Identifier {
+	return pgx.Identifier{"mrf_stage_" + t.name}
+}
+
+// WriteBatch copies records into the staging tables of their record types, creating any that don't yet exist
+func (s *postgresSink) WriteBatch(records []*models.Mrf) error {
+	var (
+		byType = make(map[string][][]any)
+		types  []string
+	)
+
+	for _, m := range records {
+		t, ok := s.tables[m.RecordType]
+		if !ok {
+			return fmt.Errorf("no table for record type %q", m.RecordType)
+		}
+
+		if m.RecordType == "root" {
+			s.key = []any{m.ReportingEntityName, m.LastUpdatedOn, m.PlanID, s.source}
+		}
+
+		if _, ok = byType[m.RecordType]; !ok {
+			types = append(types, m.RecordType)
+		}
+
+		values := postgresValues(t.cols, reflect.ValueOf(m.TableRow()))
+		byType[m.RecordType] = append(byType[m.RecordType], values)
+	}
+
+	for _, recordType := range types {
+		t := s.tables[recordType]
+
+		if !t.staged {
+			_, err := s.conn.Exec(s.ctx, t.stageSQL(s.schema))
+			if err != nil {
+				return fmt.Errorf("unable to create staging table for %s: %w", t.name, err)
+			}
+
+			t.staged = true
+			s.staged = append(s.staged, recordType)
+		}
+
+		_, err := s.conn.CopyFrom(s.ctx, t.stage(), t.columnNames(), pgx.CopyFromRows(byType[recordType]))
+		if err != nil {
+			return fmt.Errorf("unable to copy %s rows: %w", t.name, err)
+		}
+	}
+
+	return nil
+}
+
+// Close merges the staging tables into the target tables in a single transaction if commit is true, and
+// closes the connection, dropping the staging tables
+func (s *postgresSink) Close(commit bool) error {
+	var err error
+
+	if commit {
+		err = s.merge()
+	}
+
+	cerr := s.conn.Close(s.ctx)
+	if err != nil {
+		return err
+	}
+
+	return cerr
+}
+
+// merge replaces the target tables' rows with the run's key with the rows of the staging tables. Each
+// target table's rows are deleted, including those of record types the run didn't write. Merges of the
+// same key are serialized with an advisory lock.
+func (s *postgresSink) merge() error {
+	if s.key == nil {
+		return ErrNoRootRecord
+	}
+
+	log.Infof("Merging %s into schema %s", strings.Join(s.staged, ", "), s.schema)
+
+	return pgx.BeginFunc(s.ctx, s.conn, func(tx pgx.Tx) error {
+		_, err := tx.Exec(s.ctx, lockSQL(), s.key...)
+		if err != nil {
+			return err
+		}
+
+		for _, recordType := range models.RecordTypes {
+			t := s.tables[recordType]
+
+			tag, err := tx.Exec(s.ctx, t.deleteSQL(s.schema), s.key...)
+			if err != nil {
+				return fmt.Errorf("unable to delete from %s: %w", t.name, err)
+			}
+
+			log.Debugf("%s: %s", t.name, tag.String())
+
+			if !t.staged {
+				continue
+			}
+
+			tag, err = tx.Exec(s.ctx, t.insertSQL(s.schema), s.extraKey(t)...)
+			if err != nil {
+				return fmt.Errorf("unable to insert into %s: %w", t.name, err)
+			}
+
+			log.Debugf("%s: %s", t.name, tag.String())
+		}
+
+		return nil
+	})
+}
+
+// lockSQL returns the statement taking the advisory lock of the key $1, $2, ... for the transaction
+func lockSQL() string {
+	args := make([]string, len(postgresKeyColumns))
+	for i := range postgresKeyColumns {
+		args[i] = fmt.Sprintf("$%d::text", i+1)
+	}
+
+	return fmt.Sprintf("SELECT pg_advisory_xact_lock(hashtext(concat_ws('/', %s)))", strings.Join(args, ", "))
+}
+
+// extraKey returns the run's values of the key columns t doesn't have of its own
+func (s *postgresSink) extraKey(t *postgresTable) []any {
+	var values []any
+
+	for i, key := range postgresKeyColumns {
+		for _, extra := range t.extra {
+			if key == extra {
+				values = append(values, s.key[i])
+			}
+		}
+	}
+
+	return values
+}
+
+// postgresValues returns the values of row's columns
+func postgresValues(cols []column, row reflect.Value) []any {
+	values := make([]any, len(cols))
+
+	for i, col := range cols {
+		values[i] = postgresValue(row.FieldByIndex(col.index))
+	}
+
+	return values
+}
+
+// postgresValue returns v as a value pgx can encode. Lists are converted to slices of their element
+// kind, and a nil list is an empty array.
+func postgresValue(v reflect.Value) any {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Slice:
+		switch v.Type().Elem().Kind() {
+		case reflect.String:
+			values := make([]string, v.Len())
+			for i := range values {
+				values[i] = v.Index(i).String()
+			}
+
+			return values
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			values := make([]int64, v.Len())
+			for i := range values {
+				values[i] = v.Index(i).Int()
+			}
+
+			return values
+		}
+	}
+
+	return v.Interface()
+}
+
+// postgresType returns the column type of a column of type t
+func postgresType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "bigint"
+	case reflect.Float32, reflect.Float64:
+		return "double precision"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice:
+		return postgresType(t.Elem()) + "[]"
+	default:
+		return "text"
+	}
+}
+
+// sanitizeIdentifiers returns the sanitized, comma separated list of names
+func sanitizeIdentifiers(names []string) string {
+	sanitized := make([]string, len(names))
+	for i, name := range names {
+		sanitized[i] = pgx.Identifier{name}.Sanitize()
+	}
+
+	return strings.Join(sanitized, ", ")
+}
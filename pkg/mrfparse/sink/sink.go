@@ -0,0 +1,240 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sink
+
+import (
+	"context"
+	"errors"
+	"net/url"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
+)
+
+var log = utils.GetLogger()
+
+// Output formats, set by writer.format
+const (
+	// ParquetFormat writes zstd compressed parquet files. It is the default.
+	ParquetFormat = "parquet"
+	// CSVFormat writes gzip compressed CSV files with a header row
+	CSVFormat = "csv"
+	// NDJSONFormat writes gzip compressed newline delimited JSON files
+	NDJSONFormat = "ndjson"
+	// Neo4jFormat writes gzip compressed node and relationship CSV files for neo4j-admin database import
+	Neo4jFormat = "neo4j"
+	// SQLiteFormat writes each record type to its own table of a SQLite database
+	SQLiteFormat = "sqlite"
+	// PostgresFormat loads each record type into its own table of a PostgreSQL database
+	PostgresFormat = "postgres"
+)
+
+// Output layouts, set by writer.layout
+const (
+	// WideLayout writes all record types to a single table with the Mrf schema
+	WideLayout = "wide"
+	// NormalizedLayout writes each record type to its own table, in a directory named for the record type
+	NormalizedLayout = "normalized"
+)
+
+// Column schemas, set by writer.schema
+const (
+	// StringSchema writes dates as strings and amounts as doubles, as they are found in the MRF. It is the default.
+	StringSchema = "string"
+	// TypedSchema writes dates with the DATE logical type and amounts as DECIMAL(18,4). It is only supported
+	// by the parquet format.
+	TypedSchema = "typed"
+)
+
+// RecordSink writes the records of a parse to an output in a single format
+type RecordSink interface {
+	// Open opens the output at outputURI
+	Open(ctx context.Context, outputURI string) error
+	// WriteBatch writes a batch of records
+	WriteBatch(records []*models.Mrf) error
+	// Close closes the output. If commit is false, as is the case when a parse fails, output that only
+	// becomes visible once committed, such as a table format's log, is not committed.
+	Close(commit bool) error
+}
+
+type sourceKey struct{}
+
+// WithSource returns a copy of ctx carrying the URI of the MRF parsed, for RecordSinks opened with it that
+// record the source of their rows
+func WithSource(ctx context.Context, uri string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, uri)
+}
+
+// Source returns the URI of the MRF parsed carried by ctx, or "" if it carries none. The query string and
+// fragment of a URL are removed, as payers' links to MRFs are often signed URLs that change with each
+// download, so that the source identifies the same file across runs.
+func Source(ctx context.Context) string {
+	uri, _ := ctx.Value(sourceKey{}).(string)
+
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return uri
+	}
+
+	u.User = nil
+	u.RawQuery, u.ForceQuery = "", false
+	u.Fragment, u.RawFragment = "", ""
+
+	return u.String()
+}
+
+// File is a file written by a RecordSink
+type File struct {
+	URI  string `json:"uri"`
+	Rows int64  `json:"rows"`
+}
+
+// FileLister is implemented by RecordSinks that write files. Once the sink has been closed, Files lists
+// the files it wrote.
+type FileLister interface {
+	Files() []File
+}
+
+// ErrCheckpointUnsupported is returned when a RecordSink that isn't a Checkpointer is asked to checkpoint
+var ErrCheckpointUnsupported = errors.New("writer format does not support checkpoints")
+
+// Checkpointer is implemented by RecordSinks whose output can be checkpointed, so that a failed parse may be
+// resumed without rewriting the records already written
+type Checkpointer interface {
+	// Checkpoint closes any open files, so that every record written so far is in a closed file, and returns the
+	// state needed to resume the output
+	Checkpoint() ([]byte, error)
+	// Resume restores the state returned by Checkpoint once the sink has been opened, removing any files written
+	// after the checkpoint
+	Resume(state []byte) error
+}
+
+// CheckpointRequest asks RunWithCheckpoints to checkpoint its sink once the records already sent have been
+// written, or, if Resume is not nil, to resume the sink from the state Resume. The result is sent on Reply,
+// which should be buffered.
+type CheckpointRequest struct {
+	Resume []byte
+	Reply  chan<- CheckpointResult
+}
+
+// CheckpointResult is the sink's state at a checkpoint, or the error checkpointing or resuming it
+type CheckpointResult struct {
+	State []byte
+	Err   error
+}
+
+// Run is intended to run as a goroutine, opening s at outputURI and writing the batches of records
+// received on wc to it. Send true to the done channel to signal that no more data will be sent to wc
+// and that Run should write any data remaining in wc, close s and exit. Send false to close s without
+// committing, e.g. if the parse failed.
+//
+// If a write fails or ctx is cancelled, Run closes s without committing, so that the data already
+// written remains readable, and returns the error without waiting on done. Callers should stop
+// sending to wc once Run has returned.
+func Run(ctx context.Context, s RecordSink, outputURI string, wc <-chan []*models.Mrf, done <-chan bool) error {
+	return RunWithCheckpoints(ctx, s, outputURI, wc, done, nil)
+}
+
+// RunWithCheckpoints is Run, also handling the CheckpointRequests received on cp. The records already sent to
+// wc are written before s is checkpointed, so callers should not send to wc until the result is received. If
+// s fails to checkpoint, it is closed without committing, as for a failed write.
+func RunWithCheckpoints(ctx context.Context, s RecordSink, outputURI string, wc <-chan []*models.Mrf, done <-chan bool,
+	cp <-chan CheckpointRequest) error {
+	var (
+		data   []*models.Mrf
+		commit bool
+	)
+
+	err := s.Open(ctx, outputURI)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info("Writer cancelled. Closing current file.")
+			return closeOnError(s, ctx.Err())
+
+		case data = <-wc:
+			err = s.WriteBatch(data)
+			if err != nil {
+				return closeOnError(s, err)
+			}
+
+		case req := <-cp:
+			err = checkpoint(s, wc, req)
+			if err != nil {
+				return closeOnError(s, err)
+			}
+
+		case commit = <-done:
+			// Write anything left in the channel before closing
+			for {
+				select {
+				case data = <-wc:
+					err = s.WriteBatch(data)
+					if err != nil {
+						return closeOnError(s, err)
+					}
+				default:
+					return s.Close(commit)
+				}
+			}
+		}
+	}
+}
+
+// checkpoint writes anything left in wc and then checkpoints or resumes s, replying to req. It returns an error
+// if s should be closed, which is not the case if s isn't a Checkpointer.
+func checkpoint(s RecordSink, wc <-chan []*models.Mrf, req CheckpointRequest) error {
+	var result CheckpointResult
+
+	defer func() {
+		req.Reply <- result
+	}()
+
+	c, ok := s.(Checkpointer)
+	if !ok {
+		result.Err = ErrCheckpointUnsupported
+		return nil
+	}
+
+	// The caller doesn't send to wc until it has the result, so wc may be drained by its length
+	for len(wc) > 0 {
+		result.Err = s.WriteBatch(<-wc)
+		if result.Err != nil {
+			return result.Err
+		}
+	}
+
+	if req.Resume != nil {
+		result.Err = c.Resume(req.Resume)
+	} else {
+		result.State, result.Err = c.Checkpoint()
+	}
+
+	return result.Err
+}
+
+// closeOnError closes s without committing after a failed write, and returns err
+func closeOnError(s RecordSink, err error) error {
+	if cerr := s.Close(false); cerr != nil {
+		log.Errorf("Unable to close output: %s", cerr.Error())
+	}
+
+	return err
+}
@@ -0,0 +1,571 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
+	"github.com/spf13/viper"
+	"gocloud.dev/gcerrors"
+
+	// registers the pure Go "sqlite" database/sql driver
+	_ "modernc.org/sqlite"
+)
+
+// sqliteIndexedSuffixes are the suffixes of the names of the columns that are indexed, so that services
+// and providers can be looked up, and tables joined, without scanning them
+var sqliteIndexedSuffixes = []string{"billing_code", "provider_group_id", "parent_uuid"}
+
+// sqliteSourceColumn is the column of every table holding the URI of the MRF each row was parsed from
+const sqliteSourceColumn = "source_uri"
+
+// NewSQLiteSink returns a RecordSink writing each record type to its own table of the SQLite database
+// filePrefix.db, with the columns of the record type's table in the normalized layout. Lists are stored
+// as JSON arrays. The billing code, provider group ID and parent_uuid columns are indexed once the sink is
+// closed.
+//
+// Every table also has a source_uri column, set from the source of the context the sink is opened with. An
+// existing database is appended to, but the rows of any earlier run of the same source are deleted, so that
+// re-running a file replaces rather than duplicates its rows. The rows are deleted and the new rows inserted
+// in a single transaction, committed once the sink is closed after a successful parse, so that a run that
+// fails leaves the database as it was.
+//
+// If the output is in cloud storage, any existing database is downloaded to tmp.path, written to, and
+// uploaded once the sink is closed. It is not uploaded if the parse failed.
+func NewSQLiteSink(filePrefix string) RecordSink {
+	return &sqliteSink{filePrefix: filePrefix}
+}
+
+type sqliteSink struct {
+	filePrefix string
+	// uri is the URI of the database and path the local path it's written to, which differ if uri is
+	// a cloud URI
+	uri, path string
+	// source is the URI of the MRF parsed, written to the source_uri column of each row
+	source string
+	db     *sql.DB
+	// tx is the transaction of the run, committed when the sink is closed
+	tx     *sql.Tx
+	tables map[string]*sqliteTable
+	// order is the order in which tables were created, so that they are indexed deterministically
+	order []string
+	// rows is the number of rows inserted
+	rows int64
+}
+
+// sqliteTable is the table of a record type
+type sqliteTable struct {
+	name   string
+	cols   []column
+	insert string
+}
+
+// Open opens the database, creating it if need be, and begins the transaction of the run, deleting the rows
+// of any earlier run of the source
+func (s *sqliteSink) Open(ctx context.Context, outputURI string) error {
+	err := checkParquetOnlyConfig(SQLiteFormat)
+	if err != nil {
+		return err
+	}
+
+	s.uri = cloud.JoinURI(outputURI, s.filePrefix+".db")
+	s.path = s.uri
+	s.source = Source(ctx)
+	s.tables = make(map[string]*sqliteTable)
+	s.order = nil
+	s.rows = 0
+
+	if cloud.IsCloudURI(s.uri) {
+		s.path, err = download(ctx, s.uri, s.filePrefix+"_*.db")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.open(ctx)
+	if err != nil {
+		s.removeTmp()
+		return err
+	}
+
+	return nil
+}
+
+// open opens the database at path, and begins the transaction of the run
+func (s *sqliteSink) open(ctx context.Context) error {
+	var err error
+
+	s.db, err = sql.Open("sqlite", s.path)
+	if err != nil {
+		return err
+	}
+
+	// A single connection, which the transaction of the run holds
+	s.db.SetMaxOpenConns(1)
+
+	for _, pragma := range []string{"PRAGMA journal_mode = WAL", "PRAGMA synchronous = NORMAL"} {
+		if _, err = s.db.ExecContext(ctx, pragma); err != nil {
+			_ = s.db.Close()
+			return fmt.Errorf("unable to open %s: %w", s.path, err)
+		}
+	}
+
+	// The transaction outlives ctx, so that it is only rolled back by Close
+	s.tx, err = s.db.Begin()
+	if err != nil {
+		_ = s.db.Close()
+		return err
+	}
+
+	err = s.deleteSource(ctx)
+	if err != nil {
+		_ = s.tx.Rollback()
+		_ = s.db.Close()
+
+		return err
+	}
+
+	return nil
+}
+
+// download copies the database at uri, if any, to a temporary file in tmp.path named with pattern, returning
+// its path
+func download(ctx context.Context, uri, pattern string) (string, error) {
+	f, err := os.CreateTemp(viper.GetString("tmp.path"), pattern)
+	if err != nil {
+		return "", err
+	}
+
+	path := f.Name()
+
+	err = func() error {
+		defer f.Close()
+
+		r, err := cloud.NewReader(ctx, uri)
+		if gcerrors.Code(err) == gcerrors.NotFound || os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		defer r.Close()
+
+		log.Infof("Downloading %s to append to it", uri)
+
+		_, err = io.Copy(f, r)
+
+		return err
+	}()
+	if err != nil {
+		_ = os.Remove(path)
+		return "", fmt.Errorf("unable to download %s: %w", uri, err)
+	}
+
+	return path, nil
+}
+
+// deleteSource deletes the rows of an earlier run of the source from every table of an existing database, in
+// the transaction of the run
+func (s *sqliteSink) deleteSource(ctx context.Context) error {
+	tables, err := s.sourceTables(ctx)
+	if err != nil {
+		return err
+	}
+
+	var n int64
+
+	for _, name := range tables {
+		res, err := s.tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s = ?", sqliteIdent(name),
+			sqliteIdent(sqliteSourceColumn)), s.source)
+		if err != nil {
+			return fmt.Errorf("unable to delete earlier rows of %s from %s: %w", s.source, name, err)
+		}
+
+		deleted, err := res.RowsAffected()
+		if err == nil {
+			n += deleted
+		}
+	}
+
+	if n > 0 {
+		log.Infof("Replacing %d rows of an earlier run of %s in %s", n, s.source, s.uri)
+	}
+
+	return nil
+}
+
+// sourceTables returns the names of the tables of the database that have a source_uri column
+func (s *sqliteSink) sourceTables(ctx context.Context) ([]string, error) {
+	rows, err := s.tx.QueryContext(ctx, `SELECT name FROM sqlite_master WHERE type = 'table'`)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for rows.Next() {
+		var name string
+
+		err = rows.Scan(&name)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var tables []string
+
+	for _, name := range names {
+		ok, err := s.hasColumn(ctx, name, sqliteSourceColumn)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			tables = append(tables, name)
+		}
+	}
+
+	return tables, nil
+}
+
+// hasColumn reports whether the table has the column
+func (s *sqliteSink) hasColumn(ctx context.Context, table, column string) (bool, error) {
+	var n int
+
+	err := s.tx.QueryRowContext(ctx, `SELECT count(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("unable to read the columns of %s: %w", table, err)
+	}
+
+	return n > 0, nil
+}
+
+// WriteBatch inserts records into the tables of their record types, creating any tables that don't yet exist
+// first. The batch is inserted in a savepoint of the transaction of the run, so that it's inserted in full or
+// not at all.
+func (s *sqliteSink) WriteBatch(records []*models.Mrf) error {
+	rows := make([]reflect.Value, len(records))
+	tables := make([]*sqliteTable, len(records))
+
+	for i, m := range records {
+		row := m.TableRow()
+		if row == nil {
+			return fmt.Errorf("no table for record type %q", m.RecordType)
+		}
+
+		rows[i] = reflect.Indirect(reflect.ValueOf(row))
+
+		t, err := s.table(m.RecordType, rows[i].Type())
+		if err != nil {
+			return err
+		}
+
+		tables[i] = t
+	}
+
+	_, err := s.tx.Exec("SAVEPOINT batch")
+	if err != nil {
+		return err
+	}
+
+	err = insertRows(s.tx, tables, rows, s.source)
+	if err != nil {
+		_, _ = s.tx.Exec("ROLLBACK TO batch")
+		_, _ = s.tx.Exec("RELEASE batch")
+
+		return err
+	}
+
+	_, err = s.tx.Exec("RELEASE batch")
+	if err != nil {
+		return err
+	}
+
+	s.rows += int64(len(rows))
+
+	return nil
+}
+
+// insertRows inserts each row of source into its table, preparing each table's insert statement once
+func insertRows(tx *sql.Tx, tables []*sqliteTable, rows []reflect.Value, source string) error {
+	stmts := make(map[string]*sql.Stmt)
+
+	defer func() {
+		for _, stmt := range stmts {
+			_ = stmt.Close()
+		}
+	}()
+
+	for i, t := range tables {
+		stmt, ok := stmts[t.name]
+		if !ok {
+			var err error
+
+			stmt, err = tx.Prepare(t.insert)
+			if err != nil {
+				return err
+			}
+
+			stmts[t.name] = stmt
+		}
+
+		args, err := t.values(rows[i])
+		if err != nil {
+			return err
+		}
+
+		_, err = stmt.Exec(append(args, source)...)
+		if err != nil {
+			return fmt.Errorf("unable to insert into %s: %w", t.name, err)
+		}
+	}
+
+	return nil
+}
+
+// table returns the table named for recordType, with the columns of rowType and source_uri, creating it if
+// need be. A source_uri column is added to tables of databases written before it was.
+func (s *sqliteSink) table(recordType string, rowType reflect.Type) (*sqliteTable, error) {
+	if t, ok := s.tables[recordType]; ok {
+		return t, nil
+	}
+
+	t := &sqliteTable{name: recordType, cols: columnsOf(rowType)}
+
+	defs := make([]string, len(t.cols))
+	names := make([]string, len(t.cols))
+	params := make([]string, len(t.cols))
+
+	for i, col := range t.cols {
+		defs[i] = sqliteIdent(col.name) + " " + sqliteType(col.typ)
+		names[i] = sqliteIdent(col.name)
+		params[i] = "?"
+	}
+
+	defs = append(defs, sqliteIdent(sqliteSourceColumn)+" TEXT")
+	names = append(names, sqliteIdent(sqliteSourceColumn))
+	params = append(params, "?")
+
+	_, err := s.tx.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", sqliteIdent(t.name), strings.Join(defs, ", ")))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create table %s: %w", t.name, err)
+	}
+
+	ok, err := s.hasColumn(context.Background(), t.name, sqliteSourceColumn)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		_, err = s.tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s TEXT", sqliteIdent(t.name), sqliteIdent(sqliteSourceColumn)))
+		if err != nil {
+			return nil, fmt.Errorf("unable to add %s to table %s: %w", sqliteSourceColumn, t.name, err)
+		}
+	}
+
+	t.insert = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", sqliteIdent(t.name), strings.Join(names, ", "),
+		strings.Join(params, ", "))
+
+	s.tables[recordType] = t
+	s.order = append(s.order, recordType)
+
+	return t, nil
+}
+
+// values returns the values of row's columns. Lists are JSON encoded.
+func (t *sqliteTable) values(row reflect.Value) ([]any, error) {
+	args := make([]any, len(t.cols))
+
+	for i, col := range t.cols {
+		v := row.FieldByIndex(col.index)
+
+		switch v.Kind() {
+		case reflect.String:
+			args[i] = v.String()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			args[i] = v.Int()
+		case reflect.Float32, reflect.Float64:
+			args[i] = v.Float()
+		case reflect.Bool:
+			args[i] = v.Bool()
+		default:
+			b, err := jsonValue(v)
+			if err != nil {
+				return nil, err
+			}
+
+			args[i] = string(b)
+		}
+	}
+
+	return args, nil
+}
+
+// Close indexes the tables written and commits the transaction of the run, uploading the database if the output
+// is in cloud storage. If commit is false, the transaction is rolled back, leaving the database as it was.
+func (s *sqliteSink) Close(commit bool) error {
+	defer s.removeTmp()
+
+	if !commit {
+		log.Infof("Rolling back the rows written to %s as the parse failed", s.uri)
+
+		err := s.tx.Rollback()
+		if err != nil {
+			_ = s.db.Close()
+			return err
+		}
+
+		return s.db.Close()
+	}
+
+	err := s.createIndices()
+	if err == nil {
+		err = s.tx.Commit()
+	}
+
+	if err != nil {
+		_ = s.tx.Rollback()
+		_ = s.db.Close()
+
+		return err
+	}
+
+	err = s.db.Close()
+	if err != nil {
+		return err
+	}
+
+	if s.path == s.uri {
+		return nil
+	}
+
+	return upload(s.path, s.uri)
+}
+
+// removeTmp removes the local copy of a database in cloud storage
+func (s *sqliteSink) removeTmp() {
+	if s.path == s.uri {
+		return
+	}
+
+	for _, path := range []string{s.path, s.path + "-wal", s.path + "-shm"} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Unable to remove %s: %s", path, err.Error())
+		}
+	}
+}
+
+// Files lists the database, with the number of rows inserted into it by the sink
+func (s *sqliteSink) Files() []File {
+	return []File{{URI: s.uri, Rows: s.rows}}
+}
+
+// createIndices indexes the columns with names ending in any of sqliteIndexedSuffixes, and source_uri so that
+// the rows of a source can be deleted when it's run again
+func (s *sqliteSink) createIndices() error {
+	for _, name := range s.order {
+		t := s.tables[name]
+
+		cols := []string{sqliteSourceColumn}
+
+		for _, col := range t.cols {
+			if hasAnySuffix(col.name, sqliteIndexedSuffixes) {
+				cols = append(cols, col.name)
+			}
+		}
+
+		for _, col := range cols {
+			log.Debugf("Indexing %s.%s", t.name, col)
+
+			_, err := s.tx.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)",
+				sqliteIdent("idx_"+t.name+"_"+col), sqliteIdent(t.name), sqliteIdent(col)))
+			if err != nil {
+				return fmt.Errorf("unable to index %s.%s: %w", t.name, col, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// upload copies the local file at path to uri
+func upload(path, uri string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	w, err := cloud.NewWriter(context.Background(), uri)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, f)
+	if err != nil {
+		_ = w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+func hasAnySuffix(s string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sqliteIdent quotes name as a SQLite identifier
+func sqliteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// sqliteType returns the SQLite column type of a column of type t. Lists are stored as JSON text.
+func sqliteType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Bool:
+		return "INTEGER"
+	case reflect.Float32, reflect.Float64:
+		return "REAL"
+	default:
+		return "TEXT"
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/models"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteSink(t *testing.T) {
+	dir := t.TempDir()
+
+	// a rerun of a source replaces its rows, and a run of another source appends to the same database
+	for _, source := range []string{"in-network-1.json", "in-network-1.json", "in-network-2.json"} {
+		s := NewSQLiteSink("mrf")
+		require.NoError(t, s.Open(WithSource(context.Background(), source), dir))
+		require.NoError(t, s.WriteBatch([]*models.Mrf{
+			{UUID: "in", ParentUUID: "r", RecordType: "in_network", InNetwork: models.InNetwork{BillingCode: "99213"}},
+			{UUID: "np", ParentUUID: "in", RecordType: "negotiated_prices",
+				NegotiatedPrices: models.NegotiatedPrices{NegotiatedRateValue: 80.5, ServiceCodes: models.ServiceCodes{"11"}}},
+		}))
+		require.NoError(t, s.WriteBatch([]*models.Mrf{
+			{UUID: "pg", ParentUUID: "r", RecordType: "provider_group", ProviderGroup: models.ProviderGroup{ProviderGroupID: "1"}},
+		}))
+		require.NoError(t, s.Close(true))
+	}
+
+	db, err := sql.Open("sqlite", filepath.Join(dir, "mrf.db"))
+	require.NoError(t, err)
+
+	defer db.Close()
+
+	var (
+		n            int
+		rate         float64
+		serviceCodes string
+	)
+
+	require.NoError(t, db.QueryRow(`SELECT count(*) FROM in_network WHERE in_billing_code = '99213'`).Scan(&n))
+	assert.Equal(t, 2, n)
+
+	for _, table := range []string{"in_network", "negotiated_prices", "provider_group"} {
+		require.NoError(t, db.QueryRow(`SELECT count(*) FROM `+table+` WHERE source_uri = 'in-network-1.json'`).Scan(&n))
+		assert.Equal(t, 1, n, table)
+	}
+
+	require.NoError(t, db.QueryRow(`SELECT in_np_negotiated_rate, in_np_service_codes FROM negotiated_prices LIMIT 1`).Scan(&rate, &serviceCodes))
+	assert.Equal(t, 80.5, rate)
+	assert.Equal(t, `["11"]`, serviceCodes)
+
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'index' ORDER BY name`)
+	require.NoError(t, err)
+
+	defer rows.Close()
+
+	var indices []string
+
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		indices = append(indices, name)
+	}
+
+	assert.Equal(t, []string{
+		"idx_in_network_in_billing_code",
+		"idx_in_network_parent_uuid",
+		"idx_in_network_source_uri",
+		"idx_negotiated_prices_parent_uuid",
+		"idx_negotiated_prices_source_uri",
+		"idx_provider_group_parent_uuid",
+		"idx_provider_group_provider_group_id",
+		"idx_provider_group_source_uri",
+	}, indices)
+}
+
+// a batch is rolled back if any insert fails
+func TestSQLiteSinkRollback(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := sql.Open("sqlite", filepath.Join(dir, "mrf.db"))
+	require.NoError(t, err)
+
+	defer db.Close()
+
+	// an existing in_network table that rows can't be inserted into
+	_, err = db.Exec(`CREATE TABLE in_network (uuid TEXT)`)
+	require.NoError(t, err)
+
+	s := NewSQLiteSink("mrf")
+	require.NoError(t, s.Open(context.Background(), dir))
+
+	err = s.WriteBatch([]*models.Mrf{{UUID: "np", RecordType: "negotiated_prices"}, {UUID: "in", RecordType: "in_network"}})
+	assert.Error(t, err)
+	require.NoError(t, s.Close(false))
+
+	// the negotiated_prices table created by the batch is rolled back with it
+	var n int
+
+	require.NoError(t, db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'negotiated_prices'`).Scan(&n))
+	assert.Equal(t, 0, n)
+}
+
+// a rerun that fails leaves the rows of the earlier run, and none of its own
+func TestSQLiteSinkRerunFailed(t *testing.T) {
+	dir := t.TempDir()
+	ctx := WithSource(context.Background(), "in-network-1.json")
+
+	for _, code := range []string{"99213", "99214"} {
+		s := NewSQLiteSink("mrf")
+		require.NoError(t, s.Open(ctx, dir))
+		require.NoError(t, s.WriteBatch([]*models.Mrf{
+			{UUID: "in", ParentUUID: "r", RecordType: "in_network", InNetwork: models.InNetwork{BillingCode: code}},
+		}))
+		require.NoError(t, s.Close(code == "99213"))
+	}
+
+	db, err := sql.Open("sqlite", filepath.Join(dir, "mrf.db"))
+	require.NoError(t, err)
+
+	defer db.Close()
+
+	var code string
+
+	require.NoError(t, db.QueryRow(`SELECT group_concat(in_billing_code) FROM in_network`).Scan(&code))
+	assert.Equal(t, "99213", code)
+}
+
+// the database in cloud storage is downloaded to be appended to, if it exists
+func TestSQLiteDownload(t *testing.T) {
+	viper.Set("tmp.path", t.TempDir())
+	defer viper.Set("tmp.path", "")
+
+	uri := filepath.Join(t.TempDir(), "mrf.db")
+
+	path, err := download(context.Background(), uri, "mrf_*.db")
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Empty(t, data)
+
+	require.NoError(t, os.WriteFile(uri, []byte("SQLite format 3"), 0o644))
+
+	path, err = download(context.Background(), uri, "mrf_*.db")
+	require.NoError(t, err)
+
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "SQLite format 3", string(data))
+}
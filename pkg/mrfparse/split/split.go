@@ -16,15 +16,71 @@ limitations under the License.
 package split
 
 import (
-	"github.com/danielchalef/mrfparse/pkg/mrfparse/utils"
+	"context"
+	"fmt"
+	"os"
 
 	"github.com/danielchalef/jsplit/pkg/jsplit"
+	"github.com/danielchalef/mrfparse/pkg/mrfparse/cloud"
 )
 
+const readBufferSize = 1024 * 1024
+
 // File splits a JSON document into multiple files.
 // It produces a root.json file for field elements in the root of the document, and
 // a file for each array element in the document root. Files are limited to 4GB each.
-func File(inputURI, outputURI string, overwrite bool) {
-	err := jsplit.Split(inputURI, outputURI, overwrite)
-	utils.ExitOnError(err)
+// Cancelling ctx stops the split, returning ctx's error.
+func File(ctx context.Context, inputURI, outputURI string, overwrite bool) (err error) {
+	err = prepareOutput(outputURI, overwrite)
+	if err != nil {
+		return err
+	}
+
+	rd, err := jsplit.AsyncReaderFromFile(inputURI, readBufferSize)
+	if err != nil {
+		return err
+	}
+
+	// readCtx is cancelled with the read error if reading inputURI fails
+	readCtx := rd.Start(ctx)
+
+	// jsplit panics when reading fails, including when the read context is cancelled
+	defer func() {
+		if r := recover(); r != nil {
+			switch {
+			case ctx.Err() != nil:
+				err = ctx.Err()
+			case readCtx.Err() != nil:
+				err = fmt.Errorf("unable to read %s: %w", inputURI, readCtx.Err())
+			default:
+				err = fmt.Errorf("unable to split %s: %v", inputURI, r)
+			}
+		}
+	}()
+
+	return jsplit.SplitStream(readCtx, rd, outputURI)
+}
+
+// prepareOutput creates a local outputURI if it doesn't exist. If it does exist, it is removed
+// first if overwrite is true, otherwise an error is returned.
+func prepareOutput(outputURI string, overwrite bool) error {
+	if cloud.IsCloudURI(outputURI) {
+		return nil
+	}
+
+	fi, err := os.Stat(outputURI)
+
+	switch {
+	case err != nil && !os.IsNotExist(err):
+		return err
+	case err == nil && fi.IsDir() && !overwrite:
+		return fmt.Errorf("error: %s already exists", outputURI)
+	case err == nil && fi.IsDir() && overwrite:
+		err = os.RemoveAll(outputURI)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.MkdirAll(outputURI, 0o755)
 }
@@ -0,0 +1,66 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package split
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFile(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "mrf.json")
+	err := os.WriteFile(input, []byte(`{"version": "1.0.0", "in_network": [{"a": 1}, {"a": 2}]}`), 0o600)
+	assert.NoError(t, err)
+
+	output := filepath.Join(t.TempDir(), "split")
+
+	err = File(context.Background(), input, output, false)
+	assert.NoError(t, err)
+
+	assert.FileExists(t, filepath.Join(output, "root.json"))
+
+	inNetwork, err := filepath.Glob(filepath.Join(output, "in_network_*"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(inNetwork))
+}
+
+// a split that is waiting on its input stops when the context is cancelled
+func TestFileCancel(t *testing.T) {
+	release := make(chan struct{})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"in_network": [`)
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := File(ctx, ts.URL+"/mrf.json", filepath.Join(t.TempDir(), "split"), false)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
@@ -0,0 +1,60 @@
+/*
+Copyright © 2023 Daniel Chalef
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDecompressReaderGzip(t *testing.T) {
+	var buf bytes.Buffer
+
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write([]byte(`{"version":"1.0.0"}`))
+	assert.NoError(t, err)
+	assert.NoError(t, gw.Close())
+
+	r, err := NewDecompressReader(&buf)
+	assert.NoError(t, err)
+
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"version":"1.0.0"}`, string(b))
+}
+
+func TestNewDecompressReaderPlain(t *testing.T) {
+	r, err := NewDecompressReader(strings.NewReader(`{"version":"1.0.0"}`))
+	assert.NoError(t, err)
+
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"version":"1.0.0"}`, string(b))
+}
+
+func TestNewDecompressReaderEmpty(t *testing.T) {
+	r, err := NewDecompressReader(strings.NewReader(""))
+	assert.NoError(t, err)
+
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(b))
+}
@@ -86,16 +86,12 @@ func GetArrayForElement(path string, iter *simdjson.Iter) (*simdjson.Array, erro
 	return a, nil
 }
 
-// TestElementNotPresent evaluates simdjson error for ErrPathNotFound and exits if the error is something else.
-// Otherwise, returns true if the element is missing.
+// TestElementNotPresent evaluates simdjson error for ErrPathNotFound, returning true if the element is missing.
+// Any other error is left to the caller to handle.
 func TestElementNotPresent(err error, path string) bool {
-	if err != nil {
-		if errors.Is(err, simdjson.ErrPathNotFound) {
-			log.Tracef("Element not found: %s", path)
-			return true
-		}
-
-		ExitOnError(err)
+	if errors.Is(err, simdjson.ErrPathNotFound) {
+		log.Tracef("Element not found: %s", path)
+		return true
 	}
 
 	return false
@@ -16,6 +16,7 @@ limitations under the License.
 package utils
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -102,6 +103,10 @@ func TestTestElementNotPresent(t *testing.T) {
 	_, err = iter.FindElement(nil, path)
 	r = TestElementNotPresent(err, path)
 	assert.True(t, r)
+
+	// other errors are not a missing element
+	r = TestElementNotPresent(fmt.Errorf("unexpected error"), path)
+	assert.False(t, r)
 }
 
 // test GetArrayIterForElement